@@ -0,0 +1,107 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	AccessLogCLF  = "clf"
+	AccessLogJSON = "json"
+)
+
+// 访问日志配置
+type AccessLogConfig struct {
+	Path   string `json:"path"`   // 日志文件, 为空时输出到标准输出, 为 "off" 时关闭
+	Format string `json:"format"` // clf 或 json, 默认 clf
+}
+
+// 一条代理记录: 隧道按连接记录, 普通 HTTP 按请求记录
+type connEntry struct {
+	ID       uint64    `json:"id"`
+	Client   string    `json:"client"`
+	User     string    `json:"user,omitempty"`
+	Target   string    `json:"target"`
+	Method   string    `json:"method"`
+	Route    string    `json:"route,omitempty"`
+	Status   int       `json:"status"`
+	BytesIn  int64     `json:"bytes_in"`  // 目标 -> 客户端
+	BytesOut int64     `json:"bytes_out"` // 客户端 -> 目标
+	Start    time.Time `json:"start"`
+	Duration float64   `json:"duration,omitempty"` // 秒
+	Reason   string    `json:"reason,omitempty"`   // 关闭原因
+}
+
+// 计数写入, touch 用于记录活动时间
+type countWriter struct {
+	w     io.Writer
+	n     *int64
+	touch func()
+}
+
+func (c *countWriter) Write(p []byte) (int, error) {
+	n, err := c.w.Write(p)
+	atomic.AddInt64(c.n, int64(n))
+	if c.touch != nil {
+		c.touch()
+	}
+	return n, err
+}
+
+type accessLogger struct {
+	mu     sync.Mutex
+	w      io.Writer
+	format string
+}
+
+var accessLog = &accessLogger{w: os.Stdout, format: AccessLogCLF}
+
+func openAccessLog(c AccessLogConfig) error {
+	switch c.Format {
+	case "", AccessLogCLF:
+		accessLog.format = AccessLogCLF
+	case AccessLogJSON:
+		accessLog.format = AccessLogJSON
+	default:
+		return fmt.Errorf("unknown access log format %q", c.Format)
+	}
+	switch c.Path {
+	case "":
+	case "off":
+		accessLog.w = io.Discard
+	default:
+		f, err := os.OpenFile(c.Path, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0644)
+		if err != nil {
+			return err
+		}
+		accessLog.w = f
+	}
+	return nil
+}
+
+func (l *accessLogger) write(e *connEntry) {
+	var line []byte
+	if l.format == AccessLogJSON {
+		line, _ = json.Marshal(e)
+		line = append(line, '\n')
+	} else {
+		// Common Log Format, 后面追加上行字节数, 耗时, 路由和关闭原因
+		user := e.User
+		if user == "" {
+			user = "-"
+		}
+		host, _, _ := net.SplitHostPort(e.Client)
+		line = fmt.Appendf(nil, "%s - %s [%s] \"%s %s\" %d %d %d %.3f %q %q\n",
+			host, user, e.Start.Format("02/Jan/2006:15:04:05 -0700"),
+			e.Method, e.Target, e.Status, e.BytesIn, e.BytesOut, e.Duration, e.Route, e.Reason)
+	}
+	l.mu.Lock()
+	l.w.Write(line)
+	l.mu.Unlock()
+}
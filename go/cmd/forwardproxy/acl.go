@@ -0,0 +1,208 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"regexp"
+	"strings"
+)
+
+const (
+	ACLAllow = "allow"
+	ACLDeny  = "deny"
+)
+
+// 访问控制规则, 同一规则内各字段为"与", 字段内多个值为"或", 空字段视为匹配
+type ACLRule struct {
+	Action  string   `json:"action"`  // allow 或 deny
+	Hosts   []string `json:"hosts"`   // 目标域名: 精确 a.com, 通配 *.a.com, 以 ~ 开头为正则
+	Ports   []int    `json:"ports"`   // 目标端口
+	CIDRs   []string `json:"cidrs"`   // 目标域名解析后的地址段
+	Clients []string `json:"clients"` // 客户端地址段
+
+	hostRegexps []*regexp.Regexp
+	cidrs       []*net.IPNet
+	clients     []*net.IPNet
+}
+
+// 预编译规则中的正则和地址段
+func compileACL(rules []ACLRule) error {
+	for i := range rules {
+		r := &rules[i]
+		r.Action = strings.ToLower(r.Action)
+		if r.Action != ACLAllow && r.Action != ACLDeny {
+			return fmt.Errorf("acl[%d]: unknown action %q", i, r.Action)
+		}
+		r.hostRegexps = nil
+		for _, h := range r.Hosts {
+			if !strings.HasPrefix(h, "~") {
+				continue
+			}
+			re, err := regexp.Compile(h[1:])
+			if err != nil {
+				return fmt.Errorf("acl[%d]: %v", i, err)
+			}
+			r.hostRegexps = append(r.hostRegexps, re)
+		}
+		var err error
+		if r.cidrs, err = parseCIDRs(r.CIDRs); err != nil {
+			return fmt.Errorf("acl[%d]: %v", i, err)
+		}
+		if r.clients, err = parseCIDRs(r.Clients); err != nil {
+			return fmt.Errorf("acl[%d]: %v", i, err)
+		}
+	}
+	return nil
+}
+
+// 解析地址段, 单个 IP 按 /32 或 /128 处理
+func parseCIDRs(list []string) ([]*net.IPNet, error) {
+	var nets []*net.IPNet
+	for _, s := range list {
+		if !strings.Contains(s, "/") {
+			ip := net.ParseIP(s)
+			if ip == nil {
+				return nil, fmt.Errorf("invalid ip %q", s)
+			}
+			bits := 128
+			if ip.To4() != nil {
+				ip, bits = ip.To4(), 32
+			}
+			nets = append(nets, &net.IPNet{IP: ip, Mask: net.CIDRMask(bits, bits)})
+			continue
+		}
+		_, n, err := net.ParseCIDR(s)
+		if err != nil {
+			return nil, err
+		}
+		nets = append(nets, n)
+	}
+	return nets, nil
+}
+
+func containsIP(nets []*net.IPNet, ip net.IP) bool {
+	for _, n := range nets {
+		if n.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+func (r *ACLRule) matchHost(host string) bool {
+	if len(r.Hosts) == 0 {
+		return true
+	}
+	host = strings.ToLower(strings.TrimSuffix(host, "."))
+	for _, h := range r.Hosts {
+		switch {
+		case strings.HasPrefix(h, "~"):
+		case strings.HasPrefix(h, "*."):
+			// *.a.com 匹配 b.a.com 以及 a.com 本身
+			suffix := strings.ToLower(h[1:])
+			if strings.HasSuffix(host, suffix) || host == suffix[1:] {
+				return true
+			}
+		case strings.EqualFold(h, host):
+			return true
+		}
+	}
+	for _, re := range r.hostRegexps {
+		if re.MatchString(host) {
+			return true
+		}
+	}
+	return false
+}
+
+func (r *ACLRule) matchPort(port int) bool {
+	if len(r.Ports) == 0 {
+		return true
+	}
+	for _, p := range r.Ports {
+		if p == port {
+			return true
+		}
+	}
+	return false
+}
+
+func (r *ACLRule) String() string {
+	var b strings.Builder
+	b.WriteString(r.Action)
+	if len(r.Hosts) > 0 {
+		fmt.Fprintf(&b, " hosts=%s", strings.Join(r.Hosts, ","))
+	}
+	if len(r.Ports) > 0 {
+		fmt.Fprintf(&b, " ports=%v", r.Ports)
+	}
+	if len(r.CIDRs) > 0 {
+		fmt.Fprintf(&b, " cidrs=%s", strings.Join(r.CIDRs, ","))
+	}
+	if len(r.Clients) > 0 {
+		fmt.Fprintf(&b, " clients=%s", strings.Join(r.Clients, ","))
+	}
+	return b.String()
+}
+
+// 按顺序匹配规则, 返回是否放行、命中的规则描述以及检查过的目标地址
+// 只有规则用到目标地址段时才做域名解析, 解析失败时只要有地址段规则适用就拒绝;
+// 返回的地址不为空时直连必须用它, 不能再解析一次, 否则 DNS rebinding 可以绕过地址段规则
+// upstream 表示路由中只有上游代理, 本地解析不到的域名(例如只在内网可解析)交给上游,
+// 这时地址段规则不适用
+func checkACL(clientIP net.IP, host string, port int, dst net.IP, upstream bool) (bool, string, net.IP) {
+	var resolved []net.IP
+	var lookupErr error
+	var lookedUp bool
+	for i := range config.ACL {
+		r := &config.ACL[i]
+		if len(r.clients) > 0 && (clientIP == nil || !containsIP(r.clients, clientIP)) {
+			continue
+		}
+		if !r.matchHost(host) || !r.matchPort(port) {
+			continue
+		}
+		if len(r.cidrs) == 0 {
+			return r.Action == ACLAllow, fmt.Sprintf("acl[%d] %s", i, r), firstOf(resolved)
+		}
+		if !lookedUp {
+			// 透明代理已知真实目标地址, 不按嗅探到的域名解析
+			if dst != nil {
+				resolved = []net.IP{dst}
+			} else {
+				resolved, lookupErr = lookupHost(host)
+			}
+			lookedUp = true
+		}
+		if lookupErr != nil {
+			if upstream {
+				continue
+			}
+			return false, fmt.Sprintf("acl[%d] %s: %v", i, r, lookupErr), nil
+		}
+		for _, ip := range resolved {
+			if containsIP(r.cidrs, ip) {
+				return r.Action == ACLAllow, fmt.Sprintf("acl[%d] %s", i, r), ip
+			}
+		}
+	}
+	return config.ACLDefault != ACLDeny, "acl default " + config.ACLDefault, firstOf(resolved)
+}
+
+func firstOf(ips []net.IP) net.IP {
+	if len(ips) == 0 {
+		return nil
+	}
+	return ips[0]
+}
+
+func lookupHost(host string) ([]net.IP, error) {
+	if ip := net.ParseIP(host); ip != nil {
+		return []net.IP{ip}, nil
+	}
+	ips, err := net.LookupIP(host)
+	if err == nil && len(ips) == 0 {
+		err = fmt.Errorf("lookup %s: no addresses", host)
+	}
+	return ips, err
+}
@@ -0,0 +1,73 @@
+package main
+
+import (
+	"crypto/subtle"
+	"encoding/base64"
+	"errors"
+	"io"
+	"net"
+	"strings"
+)
+
+const socks5AuthPassword = 0x02
+
+var errProxyAuthRequired = errors.New("proxy authentication required")
+
+// 配置了用户时要求客户端认证
+func authRequired() bool {
+	return len(config.Users) > 0
+}
+
+func checkPassword(user, password string) bool {
+	want, ok := config.Users[user]
+	return ok && subtle.ConstantTimeCompare([]byte(want), []byte(password)) == 1
+}
+
+// 解析 Proxy-Authorization: Basic xxx, 认证失败时返回空用户
+func parseProxyAuthorization(value string) string {
+	scheme, credentials, ok := strings.Cut(strings.TrimSpace(value), " ")
+	if !ok || !strings.EqualFold(scheme, "Basic") {
+		return ""
+	}
+	decoded, err := base64.StdEncoding.DecodeString(strings.TrimSpace(credentials))
+	if err != nil {
+		return ""
+	}
+	user, password, ok := strings.Cut(string(decoded), ":")
+	if !ok || !checkPassword(user, password) {
+		return ""
+	}
+	return user
+}
+
+// 要求 HTTP 客户端提供代理认证
+func writeProxyAuthRequired(client net.Conn) {
+	io.WriteString(client, "HTTP/1.1 407 Proxy Authentication Required\r\n"+
+		"Proxy-Authenticate: Basic realm=\"forwardproxy\"\r\nContent-Length: 0\r\nConnection: close\r\n\r\n")
+}
+
+// SOCKS5 用户名密码子协商, 见 RFC 1929
+func socks5PasswordAuth(client net.Conn, r io.Reader) (string, bool) {
+	var ver [2]byte
+	if _, err := io.ReadFull(r, ver[:]); err != nil {
+		return "", false
+	}
+	user := make([]byte, ver[1])
+	if _, err := io.ReadFull(r, user); err != nil {
+		return "", false
+	}
+	var plen [1]byte
+	if _, err := io.ReadFull(r, plen[:]); err != nil {
+		return "", false
+	}
+	password := make([]byte, plen[0])
+	if _, err := io.ReadFull(r, password); err != nil {
+		return "", false
+	}
+	if !checkPassword(string(user), string(password)) {
+		client.Write([]byte{0x01, 0x01})
+		return "", false
+	}
+	_, err := client.Write([]byte{0x01, 0x00})
+	return string(user), err == nil
+}
@@ -0,0 +1,318 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// 缓存模式下普通 HTTP 请求逐个解析, 经由缓存或上游转发, 实现 RFC 9111 的常用部分:
+// Cache-Control, Expires, ETag/Last-Modified 重新验证和 Vary
+
+// 逐跳头部, 不转发也不缓存
+var hopHeaders = []string{
+	"Connection", "Proxy-Connection", "Keep-Alive", "Proxy-Authenticate",
+	"Proxy-Authorization", "Te", "Trailer", "Transfer-Encoding", "Upgrade",
+}
+
+// 没有显式过期时间也可以按启发式规则缓存的状态码, 见 RFC 9110 15.1
+var heuristicStatus = map[int]bool{
+	200: true, 203: true, 204: true, 300: true, 301: true, 308: true,
+	404: true, 405: true, 410: true, 414: true, 501: true,
+}
+
+var cacheTransport = &http.Transport{
+	DialContext: func(ctx context.Context, network, addr string) (net.Conn, error) {
+		host, port, err := net.SplitHostPort(addr)
+		if err != nil {
+			return nil, err
+		}
+		// 走与隧道相同的路由, 上游代理统一用 CONNECT
+		req := &request{method: "CONNECT", host: host, address: addr}
+		req.port, _ = strconv.Atoi(port)
+		req.ip, _ = ctx.Value(aclIPKey{}).(net.IP)
+		conn, _, err := dialTarget(req)
+		return conn, err
+	},
+	DisableCompression:  true,
+	MaxIdleConnsPerHost: 8,
+	IdleConnTimeout:     90 * time.Second,
+}
+
+// 请求 context 中访问控制检查过的目标地址, 拨号时使用
+type aclIPKey struct{}
+
+type cacheControl map[string]string
+
+func parseCacheControl(h http.Header) cacheControl {
+	cc := cacheControl{}
+	for _, v := range h.Values("Cache-Control") {
+		for _, d := range strings.Split(v, ",") {
+			name, value, _ := strings.Cut(strings.TrimSpace(d), "=")
+			if name != "" {
+				cc[strings.ToLower(name)] = strings.Trim(value, `"`)
+			}
+		}
+	}
+	return cc
+}
+
+func (cc cacheControl) has(name string) bool {
+	_, ok := cc[name]
+	return ok
+}
+
+func (cc cacheControl) seconds(name string) (time.Duration, bool) {
+	v, ok := cc[name]
+	if !ok {
+		return 0, false
+	}
+	n, err := strconv.ParseInt(v, 10, 64)
+	if err != nil || n < 0 {
+		return 0, false
+	}
+	return time.Duration(n) * time.Second, true
+}
+
+// 响应是否可以存储, 见 RFC 9111 3
+func storable(req *http.Request, resp *http.Response) bool {
+	if req.Method != http.MethodGet || resp.StatusCode == http.StatusPartialContent || resp.StatusCode < 200 || resp.StatusCode == http.StatusNotModified {
+		return false
+	}
+	reqCC, respCC := parseCacheControl(req.Header), parseCacheControl(resp.Header)
+	if reqCC.has("no-store") || respCC.has("no-store") || respCC.has("private") {
+		return false
+	}
+	if req.Header.Get("Authorization") != "" && !respCC.has("public") && !respCC.has("s-maxage") && !respCC.has("must-revalidate") {
+		return false
+	}
+	for _, name := range varyNames(resp.Header) {
+		if name == "*" {
+			return false
+		}
+	}
+	explicit := respCC.has("max-age") || respCC.has("s-maxage") || respCC.has("public") || resp.Header.Get("Expires") != ""
+	return explicit || heuristicStatus[resp.StatusCode]
+}
+
+// 新鲜期, 见 RFC 9111 4.2.1 和 4.2.2
+func freshnessLifetime(meta *cacheMeta) time.Duration {
+	cc := parseCacheControl(meta.Header)
+	if d, ok := cc.seconds("s-maxage"); ok {
+		return d
+	}
+	if d, ok := cc.seconds("max-age"); ok {
+		return d
+	}
+	date := responseDate(meta)
+	if v := meta.Header.Get("Expires"); v != "" {
+		expires, err := http.ParseTime(v)
+		if err != nil || expires.Before(date) {
+			return 0
+		}
+		return expires.Sub(date)
+	}
+	if lm, err := http.ParseTime(meta.Header.Get("Last-Modified")); err == nil && heuristicStatus[meta.Status] && lm.Before(date) {
+		return min(date.Sub(lm)/10, 24*time.Hour)
+	}
+	return 0
+}
+
+func responseDate(meta *cacheMeta) time.Time {
+	if date, err := http.ParseTime(meta.Header.Get("Date")); err == nil {
+		return date
+	}
+	return meta.ResponseTime
+}
+
+// 当前年龄, 见 RFC 9111 4.2.3
+func currentAge(meta *cacheMeta, now time.Time) time.Duration {
+	apparent := max(0, meta.ResponseTime.Sub(responseDate(meta)))
+	ageValue, _ := strconv.ParseInt(meta.Header.Get("Age"), 10, 64)
+	corrected := time.Duration(ageValue)*time.Second + meta.ResponseTime.Sub(meta.RequestTime)
+	return max(apparent, corrected) + now.Sub(meta.ResponseTime)
+}
+
+// 是否可以不经验证直接使用缓存, 见 RFC 9111 4.2 和 5.2.1
+func usableWithoutValidation(meta *cacheMeta, req *http.Request) bool {
+	reqCC, respCC := parseCacheControl(req.Header), parseCacheControl(meta.Header)
+	if respCC.has("no-cache") || reqCC.has("no-cache") || (len(reqCC) == 0 && req.Header.Get("Pragma") == "no-cache") {
+		return false
+	}
+	age, lifetime := currentAge(meta, time.Now()), freshnessLifetime(meta)
+	if d, ok := reqCC.seconds("max-age"); ok && age > d {
+		return false
+	}
+	if d, ok := reqCC.seconds("min-fresh"); ok && age+d > lifetime {
+		return false
+	}
+	if age <= lifetime {
+		return true
+	}
+	// 过期的响应只有在客户端允许且源站没有要求重新验证时才能使用
+	if respCC.has("must-revalidate") || respCC.has("proxy-revalidate") || !reqCC.has("max-stale") {
+		return false
+	}
+	if d, ok := reqCC.seconds("max-stale"); ok {
+		return age-lifetime <= d
+	}
+	return true
+}
+
+func removeHopHeaders(h http.Header) {
+	for _, f := range h.Values("Connection") {
+		for _, name := range strings.Split(f, ",") {
+			h.Del(strings.TrimSpace(name))
+		}
+	}
+	for _, name := range hopHeaders {
+		h.Del(name)
+	}
+}
+
+// 从缓存条目构造响应, 客户端条件请求命中时返回 304
+func cachedResponse(meta *cacheMeta, body io.ReadCloser, req *http.Request) *http.Response {
+	resp := &http.Response{
+		StatusCode:    meta.Status,
+		Proto:         "HTTP/1.1",
+		ProtoMajor:    1,
+		ProtoMinor:    1,
+		Header:        meta.Header,
+		Body:          body,
+		ContentLength: meta.Size,
+		Request:       req,
+	}
+	resp.Header.Set("Age", strconv.FormatInt(int64(currentAge(meta, time.Now())/time.Second), 10))
+	if etag := meta.Header.Get("ETag"); etag != "" && meta.Status == http.StatusOK && req.Header.Get("If-None-Match") == etag {
+		body.Close()
+		resp.StatusCode, resp.Body, resp.ContentLength = http.StatusNotModified, http.NoBody, 0
+		resp.Header.Del("Content-Length")
+	}
+	resp.Status = fmt.Sprintf("%d %s", resp.StatusCode, http.StatusText(resp.StatusCode))
+	if req.Method == http.MethodHead {
+		resp.Body.Close()
+		resp.Body = http.NoBody
+	}
+	return resp
+}
+
+// 经过缓存完成一次请求, 返回响应和 X-Cache 的取值
+func cachedRoundTrip(req *http.Request) (*http.Response, string, error) {
+	url := req.URL.String()
+	out := req.Clone(req.Context())
+	out.RequestURI = ""
+	removeHopHeaders(out.Header)
+
+	if req.Method != http.MethodGet && req.Method != http.MethodHead {
+		resp, err := cacheTransport.RoundTrip(out)
+		// 非安全方法成功后使对应 URL 的缓存失效, 见 RFC 9111 4.4
+		if err == nil && req.Method != http.MethodOptions && req.Method != http.MethodTrace && resp.StatusCode < 400 {
+			cache.invalidate(url)
+		}
+		return resp, "MISS", err
+	}
+
+	if !parseCacheControl(req.Header).has("no-store") {
+		if meta, body := cache.lookup(url, req.Header); meta != nil {
+			if usableWithoutValidation(meta, req) {
+				cache.count(&cache.Hits)
+				return cachedResponse(meta, body, req), "HIT", nil
+			}
+			etag, lastModified := meta.Header.Get("ETag"), meta.Header.Get("Last-Modified")
+			if req.Method == http.MethodGet && (etag != "" || lastModified != "") {
+				cond := out.Clone(out.Context())
+				cond.Header.Del("If-None-Match")
+				cond.Header.Del("If-Modified-Since")
+				if etag != "" {
+					cond.Header.Set("If-None-Match", etag)
+				}
+				if lastModified != "" {
+					cond.Header.Set("If-Modified-Since", lastModified)
+				}
+				requestTime := time.Now()
+				resp, err := cacheTransport.RoundTrip(cond)
+				if err != nil {
+					body.Close()
+					return nil, "", err
+				}
+				if resp.StatusCode == http.StatusNotModified {
+					resp.Body.Close()
+					removeHopHeaders(resp.Header)
+					cache.refresh(meta, resp.Header, requestTime, time.Now())
+					cache.count(&cache.Hits)
+					cache.count(&cache.Revalidated)
+					return cachedResponse(meta, body, req), "HIT", nil
+				}
+				body.Close()
+				cache.count(&cache.Misses)
+				return storeResponse(req, resp, requestTime), "MISS", nil
+			}
+			body.Close()
+		}
+	}
+
+	requestTime := time.Now()
+	resp, err := cacheTransport.RoundTrip(out)
+	if err != nil {
+		return nil, "", err
+	}
+	cache.count(&cache.Misses)
+	return storeResponse(req, resp, requestTime), "MISS", nil
+}
+
+// 可存储的响应在转发的同时写入缓存, 读完整个响应体后提交
+func storeResponse(req *http.Request, resp *http.Response, requestTime time.Time) *http.Response {
+	removeHopHeaders(resp.Header)
+	if !storable(req, resp) {
+		return resp
+	}
+	// 声明的长度已经超过缓存上限, 不用边写边发现
+	if resp.ContentLength > cache.maxSize {
+		return resp
+	}
+	w, err := cache.create(req.URL.String(), req.Header, resp, requestTime, time.Now())
+	if err != nil {
+		log.Printf("cache: %v", err)
+		return resp
+	}
+	resp.Body = &teeBody{ReadCloser: resp.Body, w: w}
+	return resp
+}
+
+type teeBody struct {
+	io.ReadCloser
+	w    *cacheWriter
+	done bool
+}
+
+func (t *teeBody) Read(p []byte) (int, error) {
+	n, err := t.ReadCloser.Read(p)
+	if n > 0 && !t.done {
+		if _, werr := t.w.Write(p[:n]); werr != nil {
+			t.w.abort()
+			t.done = true
+		}
+	}
+	if err == io.EOF && !t.done {
+		if cerr := t.w.commit(); cerr != nil {
+			log.Printf("cache: %v", cerr)
+		}
+		t.done = true
+	}
+	return n, err
+}
+
+func (t *teeBody) Close() error {
+	if !t.done {
+		// 客户端没读完就断开, 响应不完整, 丢弃
+		t.w.abort()
+		t.done = true
+	}
+	return t.ReadCloser.Close()
+}
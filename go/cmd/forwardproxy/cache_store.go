@@ -0,0 +1,371 @@
+package main
+
+import (
+	"container/list"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"io"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// 缓存配置
+type CacheConfig struct {
+	Dir     string `json:"dir"`      // 缓存目录, 为空时不开启缓存
+	MaxSize int64  `json:"max_size"` // 缓存总大小上限(字节), 超过后按 LRU 淘汰, 默认 1GB
+}
+
+// 缓存条目的元数据, 与响应体分开存放
+type cacheMeta struct {
+	Key          string              `json:"key"`
+	URL          string              `json:"url"`
+	Status       int                 `json:"status"`
+	Header       http.Header         `json:"header"`
+	Vary         map[string][]string `json:"vary,omitempty"` // Vary 中各请求头在存入时的取值
+	RequestTime  time.Time           `json:"request_time"`
+	ResponseTime time.Time           `json:"response_time"`
+	Size         int64               `json:"size"`
+}
+
+// 磁盘缓存, 内存中只保存索引和 LRU 链表
+type cacheStore struct {
+	dir     string
+	maxSize int64
+
+	mu      sync.Mutex
+	size    int64                    // 已提交条目的大小
+	pending int64                    // 正在写入的条目已写的大小, 与 size 一起受 maxSize 限制
+	lru     *list.List               // 队首为最近使用
+	entries map[string]*list.Element // key -> *cacheMeta
+	vary    map[string][]string      // URL -> 最近一次响应的 Vary 头
+
+	Hits        uint64 `json:"hits"`
+	Misses      uint64 `json:"misses"`
+	Revalidated uint64 `json:"revalidated"`
+	Stored      uint64 `json:"stored"`
+	Evicted     uint64 `json:"evicted"`
+}
+
+var cache *cacheStore
+
+func openCache(c CacheConfig) error {
+	if c.Dir == "" {
+		return nil
+	}
+	if c.MaxSize <= 0 {
+		c.MaxSize = 1 << 30
+	}
+	if err := os.MkdirAll(c.Dir, 0755); err != nil {
+		return err
+	}
+	s := &cacheStore{
+		dir:     c.Dir,
+		maxSize: c.MaxSize,
+		lru:     list.New(),
+		entries: make(map[string]*list.Element),
+		vary:    make(map[string][]string),
+	}
+	if err := s.load(); err != nil {
+		return err
+	}
+	cache = s
+	return nil
+}
+
+// 启动时从磁盘重建索引, 按修改时间恢复 LRU 顺序
+func (s *cacheStore) load() error {
+	files, err := filepath.Glob(filepath.Join(s.dir, "*.meta"))
+	if err != nil {
+		return err
+	}
+	type loaded struct {
+		meta  *cacheMeta
+		mtime time.Time
+	}
+	var metas []loaded
+	for _, f := range files {
+		fi, err := os.Stat(f)
+		if err != nil {
+			continue
+		}
+		meta, err := s.readMeta(strings.TrimSuffix(filepath.Base(f), ".meta"))
+		if err != nil {
+			log.Printf("cache: drop broken entry %s: %v", f, err)
+			s.removeFiles(strings.TrimSuffix(filepath.Base(f), ".meta"))
+			continue
+		}
+		metas = append(metas, loaded{meta, fi.ModTime()})
+	}
+	sort.Slice(metas, func(i, j int) bool { return metas[i].mtime.After(metas[j].mtime) })
+	for _, m := range metas {
+		s.entries[m.meta.Key] = s.lru.PushBack(m.meta)
+		s.size += m.meta.Size
+		if _, ok := s.vary[m.meta.URL]; !ok {
+			s.vary[m.meta.URL] = varyNames(m.meta.Header)
+		}
+	}
+	s.evict()
+	return nil
+}
+
+func (s *cacheStore) path(key, ext string) string {
+	return filepath.Join(s.dir, key+ext)
+}
+
+func (s *cacheStore) readMeta(key string) (*cacheMeta, error) {
+	data, err := os.ReadFile(s.path(key, ".meta"))
+	if err != nil {
+		return nil, err
+	}
+	meta := &cacheMeta{}
+	if err := json.Unmarshal(data, meta); err != nil {
+		return nil, err
+	}
+	return meta, nil
+}
+
+func (s *cacheStore) removeFiles(key string) {
+	os.Remove(s.path(key, ".meta"))
+	os.Remove(s.path(key, ".body"))
+}
+
+// 主键为 URL, 响应带 Vary 时再加上对应请求头的取值
+func cacheKey(url string, names []string, header http.Header) string {
+	h := sha256.New()
+	io.WriteString(h, url)
+	for _, name := range names {
+		io.WriteString(h, "\x00"+name+"="+strings.Join(header.Values(name), ","))
+	}
+	return hex.EncodeToString(h.Sum(nil))
+}
+
+func varyNames(header http.Header) []string {
+	var names []string
+	for _, v := range header.Values("Vary") {
+		for _, name := range strings.Split(v, ",") {
+			if name = strings.TrimSpace(name); name != "" {
+				names = append(names, http.CanonicalHeaderKey(name))
+			}
+		}
+	}
+	sort.Strings(names)
+	return names
+}
+
+// 查找请求对应的条目并标记为最近使用, 返回元数据的副本
+func (s *cacheStore) lookup(url string, header http.Header) (*cacheMeta, *os.File) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	el, ok := s.entries[cacheKey(url, s.vary[url], header)]
+	if !ok {
+		return nil, nil
+	}
+	meta := el.Value.(*cacheMeta)
+	f, err := os.Open(s.path(meta.Key, ".body"))
+	if err != nil {
+		s.removeLocked(el)
+		return nil, nil
+	}
+	s.lru.MoveToFront(el)
+	now := time.Now()
+	os.Chtimes(s.path(meta.Key, ".meta"), now, now)
+	item := *meta
+	item.Header = meta.Header.Clone()
+	return &item, f
+}
+
+// 新建条目, 响应体写入临时文件, commit 后才可见
+func (s *cacheStore) create(url string, reqHeader http.Header, resp *http.Response, requestTime, responseTime time.Time) (*cacheWriter, error) {
+	names := varyNames(resp.Header)
+	meta := &cacheMeta{
+		Key:          cacheKey(url, names, reqHeader),
+		URL:          url,
+		Status:       resp.StatusCode,
+		Header:       resp.Header.Clone(),
+		RequestTime:  requestTime,
+		ResponseTime: responseTime,
+	}
+	if len(names) > 0 {
+		meta.Vary = make(map[string][]string)
+		for _, name := range names {
+			meta.Vary[name] = reqHeader.Values(name)
+		}
+	}
+	f, err := os.CreateTemp(s.dir, "tmp-*")
+	if err != nil {
+		return nil, err
+	}
+	return &cacheWriter{store: s, meta: meta, f: f}, nil
+}
+
+// 304 重新验证后合并头部并刷新时间, 见 RFC 9111 4.3.4
+// meta 是 lookup 返回的副本, 索引中的条目还在时一并更新并落盘
+func (s *cacheStore) refresh(meta *cacheMeta, header http.Header, requestTime, responseTime time.Time) error {
+	meta.merge(header, requestTime, responseTime)
+	s.mu.Lock()
+	el, ok := s.entries[meta.Key]
+	if !ok {
+		s.mu.Unlock()
+		return nil
+	}
+	live := el.Value.(*cacheMeta)
+	live.merge(header, requestTime, responseTime)
+	data, err := json.Marshal(live)
+	s.mu.Unlock()
+	if err != nil {
+		return err
+	}
+	return os.WriteFile(s.path(meta.Key, ".meta"), data, 0644)
+}
+
+func (m *cacheMeta) merge(header http.Header, requestTime, responseTime time.Time) {
+	for name, values := range header {
+		if name != "Content-Length" {
+			m.Header[name] = values
+		}
+	}
+	m.RequestTime, m.ResponseTime = requestTime, responseTime
+}
+
+// 删除 URL 下的所有条目, 用于非安全方法使缓存失效
+func (s *cacheStore) invalidate(url string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for _, el := range s.entries {
+		if el.Value.(*cacheMeta).URL == url {
+			s.removeLocked(el)
+		}
+	}
+	delete(s.vary, url)
+}
+
+func (s *cacheStore) removeLocked(el *list.Element) {
+	meta := el.Value.(*cacheMeta)
+	s.lru.Remove(el)
+	delete(s.entries, meta.Key)
+	s.size -= meta.Size
+	s.removeFiles(meta.Key)
+}
+
+var errCacheFull = errors.New("cache: response exceeds max_size")
+
+// 写入前占用空间, 不够时淘汰旧条目; 正在写入的条目加起来超过上限时放弃
+func (s *cacheStore) reserve(n int64) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.pending+n > s.maxSize {
+		return errCacheFull
+	}
+	s.pending += n
+	s.evict()
+	return nil
+}
+
+// 超过大小上限时从队尾淘汰
+func (s *cacheStore) evict() {
+	for s.size+s.pending > s.maxSize && s.lru.Len() > 0 {
+		s.removeLocked(s.lru.Back())
+		s.Evicted++
+	}
+}
+
+func (s *cacheStore) stats() map[string]any {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	ratio := 0.0
+	if total := s.Hits + s.Misses; total > 0 {
+		ratio = float64(s.Hits) / float64(total)
+	}
+	return map[string]any{
+		"entries":     s.lru.Len(),
+		"size":        s.size,
+		"max_size":    s.maxSize,
+		"hits":        s.Hits,
+		"misses":      s.Misses,
+		"revalidated": s.Revalidated,
+		"stored":      s.Stored,
+		"evicted":     s.Evicted,
+		"hit_ratio":   ratio,
+	}
+}
+
+func (s *cacheStore) count(counter *uint64) {
+	s.mu.Lock()
+	*counter++
+	s.mu.Unlock()
+}
+
+// 边转发边写入缓存
+type cacheWriter struct {
+	store *cacheStore
+	meta  *cacheMeta
+	f     *os.File
+}
+
+func (w *cacheWriter) Write(p []byte) (int, error) {
+	if err := w.store.reserve(int64(len(p))); err != nil {
+		return 0, err
+	}
+	n, err := w.f.Write(p)
+	w.meta.Size += int64(n)
+	if n < len(p) {
+		w.store.unreserve(int64(len(p) - n))
+	}
+	return n, err
+}
+
+func (s *cacheStore) unreserve(n int64) {
+	s.mu.Lock()
+	s.pending -= n
+	s.mu.Unlock()
+}
+
+// 响应体完整写入后落盘并加入索引
+func (w *cacheWriter) commit() error {
+	s := w.store
+	if err := w.f.Close(); err != nil {
+		w.abort()
+		return err
+	}
+	data, err := json.Marshal(w.meta)
+	if err != nil {
+		w.abort()
+		return err
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.pending -= w.meta.Size
+	if el, ok := s.entries[w.meta.Key]; ok {
+		s.removeLocked(el)
+	}
+	if err := os.Rename(w.f.Name(), s.path(w.meta.Key, ".body")); err != nil {
+		os.Remove(w.f.Name())
+		return err
+	}
+	if err := os.WriteFile(s.path(w.meta.Key, ".meta"), data, 0644); err != nil {
+		os.Remove(s.path(w.meta.Key, ".body"))
+		return err
+	}
+	s.entries[w.meta.Key] = s.lru.PushFront(w.meta)
+	s.size += w.meta.Size
+	s.vary[w.meta.URL] = varyNames(w.meta.Header)
+	s.Stored++
+	s.evict()
+	return nil
+}
+
+// 丢弃临时文件并归还占用的空间, 可以重复调用
+func (w *cacheWriter) abort() {
+	w.f.Close()
+	os.Remove(w.f.Name())
+	w.store.unreserve(w.meta.Size)
+	w.meta.Size = 0
+}
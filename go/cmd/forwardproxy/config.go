@@ -0,0 +1,58 @@
+package main
+
+import (
+	"encoding/json"
+	"os"
+	"time"
+)
+
+// 代理配置, 通过 -config 指定 JSON 文件加载
+type Config struct {
+	Listen      string          `json:"listen"`      // 监听地址
+	ACL         []ACLRule       `json:"acl"`         // 按顺序匹配的访问控制规则
+	ACLDefault  string          `json:"acl_default"` // 没有规则命中时的动作, 默认 allow
+	Routes      []RouteRule     `json:"routes"`      // 上游代理路由, 没有命中时直连
+	AccessLog   AccessLogConfig `json:"access_log"`  // 访问日志
+	Admin       string          `json:"admin"`       // 管理接口监听地址, 为空时不开启, 省略主机时只监听本机
+	Transparent string          `json:"transparent"` // 透明代理监听地址, 配合 iptables REDIRECT 使用, 仅支持 Linux
+
+	DialTimeout       Duration `json:"dial_timeout"`         // 连接目标或上游代理的超时
+	IdleTimeout       Duration `json:"idle_timeout"`         // 两个方向都没有数据时关闭隧道, 0 表示不限制
+	MaxLifetime       Duration `json:"max_lifetime"`         // 隧道最长存活时间, 0 表示不限制
+	ShutdownTimeout   Duration `json:"shutdown_timeout"`     // 收到 SIGTERM 后等待活动连接结束的时间
+	MaxConns          int      `json:"max_conns"`            // 全局并发连接上限, 0 表示不限制
+	MaxConnsPerClient int      `json:"max_conns_per_client"` // 单个客户端 IP 的并发连接上限
+
+	Users          map[string]string `json:"users"`           // 代理认证用户名和密码, 为空时不要求认证
+	Throttle       []ThrottleRule    `json:"throttle"`        // 按客户端或用户限速, 第一条命中的规则生效
+	GlobalThrottle ThrottleRule      `json:"global_throttle"` // 所有连接共享的限速
+
+	Cache CacheConfig `json:"cache"` // 普通 HTTP 请求的响应缓存
+	MITM  MITMConfig  `json:"mitm"`  // CONNECT 隧道的 TLS 解密调试
+}
+
+var config = Config{
+	Listen:     ":8081",
+	ACLDefault: ACLAllow,
+
+	DialTimeout:     Duration(10 * time.Second),
+	ShutdownTimeout: Duration(30 * time.Second),
+}
+
+// 加载配置文件, 未出现的字段保留默认值
+func loadConfig(path string) error {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return err
+	}
+	if err := json.Unmarshal(data, &config); err != nil {
+		return err
+	}
+	if err := compileACL(config.ACL); err != nil {
+		return err
+	}
+	if err := compileRoutes(config.Routes); err != nil {
+		return err
+	}
+	return compileThrottle(config.Throttle)
+}
@@ -1,77 +1,323 @@
 package main
 
 import (
-	"bytes"
+	"bufio"
 	"code/utils"
+	"errors"
+	"flag"
 	"fmt"
 	"io"
 	"log"
 	"net"
+	"net/http"
 	"net/url"
+	"os"
+	"os/signal"
+	"strconv"
 	"strings"
+	"syscall"
+	"time"
 )
 
 func main() {
+	configPath := flag.String("config", "", "config file (json)")
+	flag.Parse()
 	utils.DefaultGatewayRouteInterface()
 	log.SetFlags(log.LstdFlags | log.Lshortfile)
-	l, err := net.Listen("tcp", ":8081")
+	if *configPath != "" {
+		if err := loadConfig(*configPath); err != nil {
+			log.Panic(err)
+		}
+	}
+	if err := openAccessLog(config.AccessLog); err != nil {
+		log.Panic(err)
+	}
+	if err := openCache(config.Cache); err != nil {
+		log.Panic(err)
+	}
+	if err := openMITM(config.MITM); err != nil {
+		log.Panic(err)
+	}
+	if config.Admin != "" {
+		go serveAdmin(config.Admin)
+	}
+	l, err := net.Listen("tcp", config.Listen)
 	if err != nil {
 		log.Panic(err)
 	}
+	listeners := []net.Listener{l}
+	handlers := []func(net.Conn){handleClientRequest}
+	if config.Transparent != "" {
+		tl, err := net.Listen("tcp", config.Transparent)
+		if err != nil {
+			log.Panic(err)
+		}
+		listeners = append(listeners, tl)
+		handlers = append(handlers, handleTransparent)
+	}
+	stop := make(chan struct{})
+	go func() {
+		sig := make(chan os.Signal, 1)
+		signal.Notify(sig, syscall.SIGTERM, syscall.SIGINT)
+		log.Printf("received %s, shutting down", <-sig)
+		close(stop)
+	}()
+	serveUntil(stop, listeners, handlers)
+}
+
+// 在每个监听上接受连接, stop 关闭后停止监听, 等待活动连接结束后返回
+func serveUntil(stop <-chan struct{}, listeners []net.Listener, handlers []func(net.Conn)) {
+	// 接受循环本身也计入 WaitGroup, 并且在循环开始前 Add,
+	// 这样每个连接的 Add 都发生在计数不为 0 时, 不会与 drain 中的 Wait 竞争
+	limiter.wg.Add(len(listeners))
+	for i, l := range listeners {
+		go func(l net.Listener, handle func(net.Conn)) {
+			defer limiter.wg.Done()
+			serve(l, handle)
+		}(l, handlers[i])
+	}
+	<-stop
+	for _, l := range listeners {
+		l.Close()
+	}
+	limiter.drain(time.Duration(config.ShutdownTimeout))
+}
+
+// 接受连接直到监听关闭, 每个连接受连接数限制; 调用方需先 limiter.wg.Add(1)
+func serve(l net.Listener, handle func(net.Conn)) {
+	var delay time.Duration
 	for {
 		client, err := l.Accept()
 		if err != nil {
-			log.Panic(err)
+			if errors.Is(err, net.ErrClosed) {
+				return
+			}
+			// 文件描述符耗尽之类的临时错误, 退避后重试
+			if delay == 0 {
+				delay = 5 * time.Millisecond
+			} else if delay *= 2; delay > time.Second {
+				delay = time.Second
+			}
+			log.Printf("accept error: %v; retrying in %v", err, delay)
+			time.Sleep(delay)
+			continue
+		}
+		delay = 0
+		if !limiter.acquire(client) {
+			log.Printf("connection limit reached, reject %s", client.RemoteAddr())
+			client.Close()
+			continue
+		}
+		go func() {
+			defer limiter.release(client)
+			handle(client)
+		}()
+	}
+}
+
+// 一次代理请求, HTTP、SOCKS5 和透明代理共用
+type request struct {
+	client      net.Conn
+	socks       bool   // 是否为 SOCKS5 请求
+	transparent bool   // 透明代理, 客户端不知道代理存在, 不需要任何回复
+	tls         bool   // 透明代理时客户端发的是 TLS
+	dst         net.IP // 透明代理时 REDIRECT 之前的目标地址
+	sniffed     string // 透明代理时嗅探到但没有解析到 dst 的域名, 只用于日志
+	ip          net.IP // 访问控制检查过的目标地址, 拨号时使用
+	user        string // 认证通过的用户
+	method      string // HTTP 方法, SOCKS5 固定为 CONNECT
+	host        string
+	port        int
+	target      string // 请求行中的目标
+	address     string // host:port
+	head        []byte // 普通 HTTP 请求需要转发给目标的请求行和头部
+}
+
+// PAC 中 url 变量的取值
+func (req *request) url() string {
+	if !req.socks && req.method != "CONNECT" {
+		return req.target
+	}
+	if req.port == 443 {
+		return "https://" + req.host + "/"
+	}
+	return "http://" + req.address + "/"
+}
+
+func (req *request) clientIP() net.IP {
+	if addr, ok := req.client.RemoteAddr().(*net.TCPAddr); ok {
+		return addr.IP
+	}
+	return nil
+}
+
+// 拒绝请求: HTTP 回复 403, SOCKS5 回复规则不允许
+func (req *request) deny(reason string) {
+	log.Printf("deny %s -> %s: %s", req.client.RemoteAddr(), req.address, reason)
+	if req.transparent {
+		return
+	}
+	if req.socks {
+		writeSocks5Reply(req.client, socks5RepNotAllowed)
+		return
+	}
+	body := "Forbidden by proxy: " + reason + "\n"
+	fmt.Fprintf(req.client, "HTTP/1.1 403 Forbidden\r\nContent-Type: text/plain\r\nContent-Length: %d\r\nConnection: close\r\n\r\n%s", len(body), body)
+}
+
+// 拨号失败
+func (req *request) fail(err error) {
+	log.Println(err)
+	if req.transparent {
+		return
+	}
+	if req.socks {
+		writeSocks5Reply(req.client, socks5RepHostUnreachable)
+		return
+	}
+	io.WriteString(req.client, "HTTP/1.1 502 Bad Gateway\r\nContent-Length: 0\r\nConnection: close\r\n\r\n")
+}
+
+// 目标连接建立后通知客户端
+func (req *request) established(server net.Conn) error {
+	if req.transparent {
+		return nil
+	}
+	if req.socks {
+		return writeSocks5Reply(req.client, socks5RepSucceeded)
+	}
+	if req.method == "CONNECT" {
+		_, err := io.WriteString(req.client, "HTTP/1.1 200 Connection established\r\nProxy-agent: localhost"+config.Listen+"\r\n\r\n")
+		return err
+	}
+	_, err := server.Write(req.head)
+	return err
+}
+
+// 读取 HTTP 请求行和头部, 代理认证头不转发给目标
+func readHTTPRequest(client net.Conn, br *bufio.Reader) (*request, error) {
+	line, err := br.ReadString('\n')
+	if err != nil {
+		return nil, err
+	}
+	req := &request{client: client, head: []byte(line)}
+	fmt.Sscanf(line, "%s%s", &req.method, &req.target)
+	for {
+		l, err := br.ReadString('\n')
+		if err != nil {
+			return nil, err
+		}
+		if name, value, ok := strings.Cut(l, ":"); ok && strings.EqualFold(name, "Proxy-Authorization") {
+			req.user = parseProxyAuthorization(value)
+			continue
 		}
-		go handleClientRequest(client)
+		if req.method != "CONNECT" {
+			req.head = append(req.head, l...)
+		}
+		if l == "\r\n" || l == "\n" {
+			break
+		}
+	}
+	if authRequired() && req.user == "" {
+		writeProxyAuthRequired(client)
+		return nil, errProxyAuthRequired
+	}
+	if req.method == "CONNECT" { //https访问, 目标为 host:port
+		req.address = req.target
+	} else { //http访问
+		hostPortURL, err := url.Parse(req.target)
+		if err != nil {
+			return nil, err
+		}
+		if hostPortURL.Port() == "" { //host不带端口， 默认80
+			req.address = net.JoinHostPort(hostPortURL.Hostname(), "80")
+		} else {
+			req.address = hostPortURL.Host
+		}
+	}
+	host, port, err := net.SplitHostPort(req.address)
+	if err != nil {
+		return nil, err
 	}
+	req.host = host
+	req.port, _ = strconv.Atoi(port)
+	return req, nil
 }
+
 func handleClientRequest(client net.Conn) {
 	if client == nil {
 		return
 	}
 	defer client.Close()
-	var b [1024]byte
-	n, err := client.Read(b[:])
+	// 读取请求阶段同样受拨号超时限制, 避免连上不发数据的客户端一直占着连接
+	client.SetReadDeadline(time.Now().Add(time.Duration(config.DialTimeout)))
+	br := bufio.NewReader(client)
+	first, err := br.Peek(1)
 	if err != nil {
 		log.Println(err)
 		return
 	}
-	var method, host, address string
-	fmt.Sscanf(string(b[:bytes.IndexByte(b[:], '\n')]), "%s%s", &method, &host)
-	hostPortURL, err := url.Parse(host)
+	var req *request
+	if first[0] == socks5Version {
+		req, err = readSocks5Request(client, br)
+	} else {
+		req, err = readHTTPRequest(client, br)
+	}
 	if err != nil {
 		log.Println(err)
 		return
 	}
-	if hostPortURL.Opaque == "443" { //https访问
-		address = hostPortURL.Scheme + ":443"
-	} else { //http访问
-		if strings.Index(hostPortURL.Host, ":") == -1 { //host不带端口， 默认80
-			address = hostPortURL.Host + ":80"
-		} else {
-			address = hostPortURL.Host
-		}
-	} //获得了请求的host和port，就开始拨号吧
-	server, err := net.Dial("tcp", address)
-	if err != nil {
-		log.Println(err)
+	client.SetReadDeadline(time.Time{})
+	proxyRequest(req, br)
+}
+
+// 请求解析完成后的处理: 访问控制, 缓存, 解密或者拨号转发
+func proxyRequest(req *request, br *bufio.Reader) {
+	// 普通 HTTP 请求逐个解析, 每个请求单独做访问控制和记录访问日志
+	if !req.socks && !req.transparent && req.method != "CONNECT" {
+		serveHTTP(req, br)
 		return
 	}
-	if method == "CONNECT" {
-		_, err = client.Write([]byte("HTTP/1.1 200 Connection established\r\n"))
-		if err != nil {
-			log.Println(err)
+	client := req.client
+	e := tracker.open(req)
+	defer tracker.close(e)
+	allowed, rule, ip := checkACL(req.clientIP(), strings.TrimSuffix(req.host, "."), req.port, req.dst, upstreamOnly(findRoute(req)))
+	if !allowed {
+		tracker.update(e, func(e *connEntry) { e.Status, e.Reason = http.StatusForbidden, "denied by "+rule })
+		req.deny(rule)
+		return
+	}
+	req.ip = ip
+	if mitm != nil && req.method == "CONNECT" && mitm.intercept(req) {
+		// 解密模式下按请求连接目标, 这里先告诉客户端隧道已建立
+		tracker.update(e, func(e *connEntry) { e.Status = http.StatusOK })
+		if err := req.established(nil); err != nil {
 			return
 		}
-		_, err = client.Write([]byte("Proxy-agent: localhost:8081\r\n\r\n"))
-		if err != nil {
-			log.Println(err)
-			return
+		reason := mitm.serve(e, req, br)
+		tracker.update(e, func(e *connEntry) { e.Reason = reason })
+		return
+	}
+	//获得了请求的host和port，就开始拨号吧
+	server, hop, err := dialTarget(req)
+	if err != nil {
+		tracker.update(e, func(e *connEntry) { e.Status, e.Reason = http.StatusBadGateway, "dial: "+err.Error() })
+		req.fail(err)
+		return
+	}
+	defer server.Close()
+	limiter.track(server)
+	defer limiter.untrack(server)
+	tracker.update(e, func(e *connEntry) {
+		e.Route = hop.String()
+		if req.socks || req.method == "CONNECT" {
+			e.Status = http.StatusOK
 		}
-	} else {
-		server.Write(b[:n])
+	})
+	if err := req.established(server); err != nil {
+		tracker.update(e, func(e *connEntry) { e.Reason = err.Error() })
+		return
 	} //进行转发
-	go io.Copy(server, client)
-	io.Copy(client, server)
+	reason := tunnel(e, br, client, server)
+	tracker.update(e, func(e *connEntry) { e.Reason = reason })
 }
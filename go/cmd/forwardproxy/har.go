@@ -0,0 +1,198 @@
+package main
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/json"
+	"io"
+	"net/http"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+	"unicode/utf8"
+)
+
+// HAR 1.2 中用到的部分, 见 http://www.softwareishard.com/blog/har-12-spec/
+type harLog struct {
+	Version string     `json:"version"`
+	Creator harCreator `json:"creator"`
+	Entries []harEntry `json:"entries"`
+}
+
+type harCreator struct {
+	Name    string `json:"name"`
+	Version string `json:"version"`
+}
+
+type harEntry struct {
+	StartedDateTime time.Time   `json:"startedDateTime"`
+	Time            float64     `json:"time"` // 毫秒
+	Request         harRequest  `json:"request"`
+	Response        harResponse `json:"response"`
+	Cache           struct{}    `json:"cache"`
+	Timings         harTimings  `json:"timings"`
+	ServerIPAddress string      `json:"serverIPAddress,omitempty"`
+}
+
+type harRequest struct {
+	Method      string         `json:"method"`
+	URL         string         `json:"url"`
+	HTTPVersion string         `json:"httpVersion"`
+	Headers     []harNameValue `json:"headers"`
+	QueryString []harNameValue `json:"queryString"`
+	Cookies     []harNameValue `json:"cookies"`
+	PostData    *harPostData   `json:"postData,omitempty"`
+	HeadersSize int            `json:"headersSize"`
+	BodySize    int64          `json:"bodySize"`
+}
+
+type harResponse struct {
+	Status      int            `json:"status"`
+	StatusText  string         `json:"statusText"`
+	HTTPVersion string         `json:"httpVersion"`
+	Headers     []harNameValue `json:"headers"`
+	Cookies     []harNameValue `json:"cookies"`
+	Content     harContent     `json:"content"`
+	RedirectURL string         `json:"redirectURL"`
+	HeadersSize int            `json:"headersSize"`
+	BodySize    int64          `json:"bodySize"`
+}
+
+type harNameValue struct {
+	Name  string `json:"name"`
+	Value string `json:"value"`
+}
+
+type harPostData struct {
+	MimeType string `json:"mimeType"`
+	Text     string `json:"text"`
+}
+
+type harContent struct {
+	Size     int64  `json:"size"`
+	MimeType string `json:"mimeType"`
+	Text     string `json:"text,omitempty"`
+	Encoding string `json:"encoding,omitempty"`
+}
+
+type harTimings struct {
+	Send    float64 `json:"send"`
+	Wait    float64 `json:"wait"`
+	Receive float64 `json:"receive"`
+}
+
+func harHeaders(h http.Header) []harNameValue {
+	list := []harNameValue{}
+	for name, values := range h {
+		for _, v := range values {
+			list = append(list, harNameValue{Name: name, Value: v})
+		}
+	}
+	sort.Slice(list, func(i, j int) bool { return list[i].Name < list[j].Name })
+	return list
+}
+
+// 文本内容原样保存, 二进制内容用 base64
+func harText(body []byte) (string, string) {
+	if utf8.Valid(body) {
+		return string(body), ""
+	}
+	return base64.StdEncoding.EncodeToString(body), "base64"
+}
+
+// HAR 文件写入器, 记录逐条追加到文件末尾, 每次写完都补上结尾, 保证文件随时是完整的 JSON
+// 文件超过 maxSize 后改名为 .1 (覆盖上一个), 重新开始一个文件
+type harWriter struct {
+	mu      sync.Mutex
+	path    string
+	maxSize int64
+	f       *os.File
+	end     int64 // 最后一条记录之后的位置, 结尾从这里开始写
+	entries int   // 当前文件中的记录数
+}
+
+const (
+	harTrailer        = "\n]}}\n"
+	defaultHARMaxSize = 100 << 20
+)
+
+func newHARWriter(path string, maxSize int64) (*harWriter, error) {
+	if maxSize <= 0 {
+		maxSize = defaultHARMaxSize
+	}
+	w := &harWriter{path: path, maxSize: maxSize}
+	if err := w.open(); err != nil {
+		return nil, err
+	}
+	return w, nil
+}
+
+// 新建文件并写入头部
+func (w *harWriter) open() error {
+	f, err := os.Create(w.path)
+	if err != nil {
+		return err
+	}
+	// 去掉空列表的结尾 "]}}" 就是文件头
+	empty, err := json.Marshal(map[string]harLog{"log": {
+		Version: "1.2",
+		Creator: harCreator{Name: "forwardproxy", Version: "1.0"},
+		Entries: []harEntry{},
+	}})
+	if err != nil {
+		f.Close()
+		return err
+	}
+	head := strings.TrimSuffix(string(empty), "]}}")
+	if _, err := io.WriteString(f, head+harTrailer); err != nil {
+		f.Close()
+		return err
+	}
+	w.f, w.end, w.entries = f, int64(len(head)), 0
+	return nil
+}
+
+func (w *harWriter) add(e harEntry) error {
+	data, err := json.Marshal(e)
+	if err != nil {
+		return err
+	}
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if w.entries > 0 && w.end+int64(len(data)) > w.maxSize {
+		if err := w.rotate(); err != nil {
+			return err
+		}
+	}
+	var buf bytes.Buffer
+	if w.entries > 0 {
+		buf.WriteString(",")
+	}
+	buf.WriteString("\n")
+	buf.Write(data)
+	end := w.end + int64(buf.Len())
+	buf.WriteString(harTrailer)
+	// 覆盖上一次的结尾
+	if _, err := w.f.WriteAt(buf.Bytes(), w.end); err != nil {
+		return err
+	}
+	w.end = end
+	w.entries++
+	return nil
+}
+
+func (w *harWriter) rotate() error {
+	w.f.Close()
+	if err := os.Rename(w.path, w.path+".1"); err != nil {
+		return err
+	}
+	return w.open()
+}
+
+func (w *harWriter) Close() error {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	return w.f.Close()
+}
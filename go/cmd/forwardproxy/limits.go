@@ -0,0 +1,212 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"io"
+	"log"
+	"net"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// 配置中的时长, 写作 "10s", "5m" 这样的字符串
+type Duration time.Duration
+
+func (d *Duration) UnmarshalJSON(b []byte) error {
+	var s string
+	if err := json.Unmarshal(b, &s); err != nil {
+		return err
+	}
+	v, err := time.ParseDuration(s)
+	if err != nil {
+		return err
+	}
+	*d = Duration(v)
+	return nil
+}
+
+func (d Duration) MarshalJSON() ([]byte, error) {
+	return json.Marshal(time.Duration(d).String())
+}
+
+// 并发连接数限制, 以及用于优雅退出的连接集合
+type connLimiter struct {
+	mu        sync.Mutex
+	total     int
+	perClient map[string]int
+	conns     map[net.Conn]struct{}
+	wg        sync.WaitGroup
+}
+
+var limiter = &connLimiter{
+	perClient: make(map[string]int),
+	conns:     make(map[net.Conn]struct{}),
+}
+
+// 占用一个连接名额, 超过全局或单个客户端上限时返回 false
+func (l *connLimiter) acquire(client net.Conn) bool {
+	ip := remoteIP(client)
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if config.MaxConns > 0 && l.total >= config.MaxConns {
+		return false
+	}
+	if config.MaxConnsPerClient > 0 && l.perClient[ip] >= config.MaxConnsPerClient {
+		return false
+	}
+	l.total++
+	l.perClient[ip]++
+	l.conns[client] = struct{}{}
+	l.wg.Add(1)
+	return true
+}
+
+func (l *connLimiter) release(client net.Conn) {
+	ip := remoteIP(client)
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.total--
+	if l.perClient[ip]--; l.perClient[ip] <= 0 {
+		delete(l.perClient, ip)
+	}
+	delete(l.conns, client)
+	l.wg.Done()
+}
+
+// 记录连向目标的连接, 强制退出时一并关闭
+func (l *connLimiter) track(conn net.Conn) {
+	l.mu.Lock()
+	l.conns[conn] = struct{}{}
+	l.mu.Unlock()
+}
+
+func (l *connLimiter) untrack(conn net.Conn) {
+	l.mu.Lock()
+	delete(l.conns, conn)
+	l.mu.Unlock()
+}
+
+// 等待活动连接结束, 超时后强制关闭剩余连接
+func (l *connLimiter) drain(timeout time.Duration) {
+	done := make(chan struct{})
+	go func() {
+		l.wg.Wait()
+		close(done)
+	}()
+	select {
+	case <-done:
+		return
+	case <-time.After(timeout):
+	}
+	l.mu.Lock()
+	log.Printf("shutdown timeout, closing %d connections", len(l.conns))
+	for c := range l.conns {
+		c.Close()
+	}
+	l.mu.Unlock()
+	<-done
+}
+
+func remoteIP(c net.Conn) string {
+	host, _, err := net.SplitHostPort(c.RemoteAddr().String())
+	if err != nil {
+		return c.RemoteAddr().String()
+	}
+	return host
+}
+
+var (
+	errIdleTimeout = errors.New("idle timeout")
+	errMaxLifetime = errors.New("max lifetime exceeded")
+)
+
+// 双向转发, 一个方向读到 EOF 时对另一端 CloseWrite, 两个方向都结束后返回关闭原因
+// 配置了空闲超时或最长存活时间时, 由后台检查协程关闭两端连接
+func tunnel(e *connEntry, br io.Reader, client, server net.Conn) string {
+	var lastActive atomic.Int64
+	lastActive.Store(time.Now().UnixNano())
+	touch := func() { lastActive.Store(time.Now().UnixNano()) }
+
+	// 任一方向出错或超时关闭连接时取消, 另一方向不再等限速令牌
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	up, down, release := shapeFor(net.ParseIP(remoteIP(client)), e.User)
+	defer release()
+	done := make(chan string, 2)
+	go func() {
+		w, flush := shape(ctx, server, up)
+		_, err := io.Copy(&countWriter{w: w, n: &e.BytesOut, touch: touch}, br)
+		if ferr := flush(); err == nil {
+			err = ferr
+		}
+		if err != nil {
+			cancel()
+		}
+		done <- finishCopy("client", server, err)
+	}()
+	go func() {
+		w, flush := shape(ctx, client, down)
+		_, err := io.Copy(&countWriter{w: w, n: &e.BytesIn, touch: touch}, server)
+		if ferr := flush(); err == nil {
+			err = ferr
+		}
+		if err != nil {
+			cancel()
+		}
+		done <- finishCopy("server", client, err)
+	}()
+
+	timeout := make(chan error, 1)
+	stop := make(chan struct{})
+	defer close(stop)
+	if config.IdleTimeout > 0 || config.MaxLifetime > 0 {
+		go func() {
+			ticker := time.NewTicker(time.Second)
+			defer ticker.Stop()
+			for {
+				select {
+				case <-stop:
+					return
+				case now := <-ticker.C:
+					if config.MaxLifetime > 0 && now.Sub(e.Start) > time.Duration(config.MaxLifetime) {
+						timeout <- errMaxLifetime
+					} else if config.IdleTimeout > 0 && now.Sub(time.Unix(0, lastActive.Load())) > time.Duration(config.IdleTimeout) {
+						timeout <- errIdleTimeout
+					} else {
+						continue
+					}
+					cancel()
+					client.Close()
+					server.Close()
+					return
+				}
+			}
+		}()
+	}
+
+	first := <-done
+	<-done
+	select {
+	case err := <-timeout:
+		return err.Error()
+	default:
+		return first
+	}
+}
+
+// 单向转发结束: 正常 EOF 时半关闭写端, 出错时直接关闭
+func finishCopy(side string, dst net.Conn, err error) string {
+	if err != nil {
+		dst.Close()
+		return side + " error: " + err.Error()
+	}
+	if cw, ok := dst.(interface{ CloseWrite() error }); ok {
+		cw.CloseWrite()
+	} else {
+		dst.Close()
+	}
+	return side + " closed"
+}
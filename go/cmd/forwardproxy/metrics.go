@@ -0,0 +1,169 @@
+package main
+
+import (
+	"encoding/json"
+	"log"
+	"net"
+	"net/http"
+	"sort"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// 活动连接和累计计数
+type connTracker struct {
+	mu     sync.Mutex
+	nextID uint64
+	active map[uint64]*connEntry
+
+	Total    uint64 `json:"total"`
+	Denied   uint64 `json:"denied"`
+	Failed   uint64 `json:"failed"`
+	BytesIn  int64  `json:"bytes_in"`
+	BytesOut int64  `json:"bytes_out"`
+}
+
+var tracker = &connTracker{active: make(map[uint64]*connEntry)}
+
+func (t *connTracker) open(req *request) *connEntry {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.nextID++
+	t.Total++
+	e := &connEntry{
+		ID:     t.nextID,
+		Client: req.client.RemoteAddr().String(),
+		User:   req.user,
+		Target: req.address,
+		Method: req.method,
+		Start:  time.Now(),
+	}
+	if req.socks {
+		e.Method = "SOCKS5"
+	} else if req.transparent {
+		e.Method = "TRANSPARENT"
+		if req.sniffed != "" {
+			e.Target += " (" + req.sniffed + ")"
+		}
+	} else if req.method != "CONNECT" {
+		e.Target = req.target
+	}
+	t.active[e.ID] = e
+	return e
+}
+
+// 修改活动连接的字段, 与 snapshot 互斥
+func (t *connTracker) update(e *connEntry, fn func(e *connEntry)) {
+	t.mu.Lock()
+	fn(e)
+	t.mu.Unlock()
+}
+
+// 连接结束, 写访问日志并累加计数
+func (t *connTracker) close(e *connEntry) {
+	t.mu.Lock()
+	e.Duration = time.Since(e.Start).Seconds()
+	delete(t.active, e.ID)
+	switch e.Status {
+	case http.StatusForbidden:
+		t.Denied++
+	case http.StatusBadGateway:
+		t.Failed++
+	}
+	t.mu.Unlock()
+	atomic.AddInt64(&t.BytesIn, atomic.LoadInt64(&e.BytesIn))
+	atomic.AddInt64(&t.BytesOut, atomic.LoadInt64(&e.BytesOut))
+	accessLog.write(e)
+}
+
+// 活动连接快照, 按 ID 排序
+func (t *connTracker) snapshot() []connEntry {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	list := make([]connEntry, 0, len(t.active))
+	for _, e := range t.active {
+		item := *e
+		item.BytesIn = atomic.LoadInt64(&e.BytesIn)
+		item.BytesOut = atomic.LoadInt64(&e.BytesOut)
+		item.Duration = time.Since(e.Start).Seconds()
+		list = append(list, item)
+	}
+	sort.Slice(list, func(i, j int) bool { return list[i].ID < list[j].ID })
+	return list
+}
+
+func (t *connTracker) counters() map[string]any {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return map[string]any{
+		"active":    len(t.active),
+		"total":     t.Total,
+		"denied":    t.Denied,
+		"failed":    t.Failed,
+		"bytes_in":  atomic.LoadInt64(&t.BytesIn),
+		"bytes_out": atomic.LoadInt64(&t.BytesOut),
+	}
+}
+
+// 管理接口: /connections 列出活动连接, /stats 输出累计计数和缓存命中率
+// 活动连接中有客户端地址和用户名, 地址省略主机时只监听本机; 配置了代理用户时要求 Basic 认证
+func serveAdmin(addr string) {
+	addr = adminAddr(addr)
+	if host, _, _ := net.SplitHostPort(addr); !authRequired() && !isLoopbackHost(host) {
+		log.Printf("admin on %s is reachable from the network without authentication", addr)
+	}
+	log.Printf("admin listening on %s", addr)
+	if err := http.ListenAndServe(addr, adminHandler()); err != nil {
+		log.Println(err)
+	}
+}
+
+// ":9090" 这样省略主机的地址绑定到 127.0.0.1
+func adminAddr(addr string) string {
+	host, port, err := net.SplitHostPort(addr)
+	if err != nil || host != "" {
+		return addr
+	}
+	return net.JoinHostPort("127.0.0.1", port)
+}
+
+func isLoopbackHost(host string) bool {
+	if host == "localhost" {
+		return true
+	}
+	ip := net.ParseIP(host)
+	return ip != nil && ip.IsLoopback()
+}
+
+func adminHandler() http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/connections", func(w http.ResponseWriter, r *http.Request) {
+		writeJSON(w, tracker.snapshot())
+	})
+	mux.HandleFunc("/stats", func(w http.ResponseWriter, r *http.Request) {
+		stats := tracker.counters()
+		if cache != nil {
+			stats["cache"] = cache.stats()
+		}
+		writeJSON(w, stats)
+	})
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if authRequired() {
+			user, password, ok := r.BasicAuth()
+			if !ok || !checkPassword(user, password) {
+				w.Header().Set("WWW-Authenticate", `Basic realm="forwardproxy admin"`)
+				http.Error(w, "unauthorized", http.StatusUnauthorized)
+				return
+			}
+		}
+		mux.ServeHTTP(w, r)
+	})
+}
+
+func writeJSON(w http.ResponseWriter, v any) {
+	w.Header().Set("Content-Type", "application/json")
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "  ")
+	enc.Encode(v)
+}
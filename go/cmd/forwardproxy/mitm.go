@@ -0,0 +1,350 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"container/list"
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"math/big"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// TLS 解密调试模式, 只对 hosts 中列出的目标生效, 其余 CONNECT 隧道原样转发
+type MITMConfig struct {
+	CACert           string   `json:"ca_cert"`           // 本地 CA 证书 (PEM)
+	CAKey            string   `json:"ca_key"`            // 本地 CA 私钥 (PEM)
+	Hosts            []string `json:"hosts"`             // 需要解密的域名, 语法同 acl 的 hosts
+	HAR              string   `json:"har"`               // 解密后的请求写入 HAR 文件, 为空时只打日志
+	HARMaxSize       int64    `json:"har_max_size"`      // HAR 文件超过这个大小后轮转为 .1, 默认 100MB
+	MaxBody          int64    `json:"max_body"`          // HAR 中每个请求/响应体最多记录的字节数, 默认 1MB
+	InsecureUpstream bool     `json:"insecure_upstream"` // 不校验上游证书
+}
+
+type mitmState struct {
+	ca        *x509.Certificate
+	caKey     any
+	leafKey   *ecdsa.PrivateKey
+	hosts     ACLRule
+	har       *harWriter
+	maxBody   int64
+	transport *http.Transport
+
+	mu    sync.Mutex
+	certs map[string]*list.Element // 按域名缓存签发的证书, 最多 maxMITMCerts 个
+	lru   *list.List               // 队首为最近使用, 元素为 *mitmCert
+}
+
+// 缓存的叶子证书数量上限, 超过后淘汰最久未用的
+const maxMITMCerts = 1024
+
+type mitmCert struct {
+	name string
+	cert *tls.Certificate
+}
+
+var mitm *mitmState
+
+func openMITM(c MITMConfig) error {
+	if c.CACert == "" {
+		return nil
+	}
+	pair, err := tls.LoadX509KeyPair(c.CACert, c.CAKey)
+	if err != nil {
+		return err
+	}
+	ca, err := x509.ParseCertificate(pair.Certificate[0])
+	if err != nil {
+		return err
+	}
+	if !ca.IsCA {
+		return errors.New("mitm: ca_cert is not a CA certificate")
+	}
+	// 所有叶子证书共用一把密钥, 省去每个域名生成密钥的开销
+	leafKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return err
+	}
+	rules := []ACLRule{{Action: ACLAllow, Hosts: c.Hosts}}
+	if err := compileACL(rules); err != nil {
+		return err
+	}
+	s := &mitmState{
+		ca:      ca,
+		caKey:   pair.PrivateKey,
+		leafKey: leafKey,
+		hosts:   rules[0],
+		maxBody: c.MaxBody,
+		certs:   make(map[string]*list.Element),
+		lru:     list.New(),
+	}
+	if s.maxBody <= 0 {
+		s.maxBody = 1 << 20
+	}
+	if c.HAR != "" {
+		if s.har, err = newHARWriter(c.HAR, c.HARMaxSize); err != nil {
+			return err
+		}
+	}
+	s.transport = &http.Transport{
+		DialContext:        cacheTransport.DialContext,
+		TLSClientConfig:    &tls.Config{InsecureSkipVerify: c.InsecureUpstream},
+		DisableCompression: true,
+		IdleConnTimeout:    90 * time.Second,
+	}
+	mitm = s
+	return nil
+}
+
+// 是否需要解密到该目标的隧道, hosts 为空时不解密任何目标
+func (s *mitmState) intercept(req *request) bool {
+	if req.transparent && !req.tls {
+		return false
+	}
+	return len(s.hosts.Hosts) > 0 && s.hosts.matchHost(req.host)
+}
+
+// 按名字签发叶子证书, 有效期不超过 CA
+func (s *mitmState) certificate(name string) (*tls.Certificate, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if el, ok := s.certs[name]; ok {
+		if c := el.Value.(*mitmCert); time.Now().Before(c.cert.Leaf.NotAfter) {
+			s.lru.MoveToFront(el)
+			return c.cert, nil
+		}
+		s.lru.Remove(el)
+		delete(s.certs, name)
+	}
+	serial, err := rand.Int(rand.Reader, new(big.Int).Lsh(big.NewInt(1), 128))
+	if err != nil {
+		return nil, err
+	}
+	notAfter := time.Now().AddDate(0, 0, 30)
+	if notAfter.After(s.ca.NotAfter) {
+		notAfter = s.ca.NotAfter
+	}
+	tmpl := &x509.Certificate{
+		SerialNumber: serial,
+		Subject:      pkix.Name{CommonName: name, Organization: []string{"forwardproxy mitm"}},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     notAfter,
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+	}
+	if ip := net.ParseIP(name); ip != nil {
+		tmpl.IPAddresses = []net.IP{ip}
+	} else {
+		tmpl.DNSNames = []string{name}
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, s.ca, &s.leafKey.PublicKey, s.caKey)
+	if err != nil {
+		return nil, err
+	}
+	leaf, err := x509.ParseCertificate(der)
+	if err != nil {
+		return nil, err
+	}
+	cert := &tls.Certificate{
+		Certificate: [][]byte{der, s.ca.Raw},
+		PrivateKey:  s.leafKey,
+		Leaf:        leaf,
+	}
+	s.certs[name] = s.lru.PushFront(&mitmCert{name: name, cert: cert})
+	for s.lru.Len() > maxMITMCerts {
+		oldest := s.lru.Back()
+		s.lru.Remove(oldest)
+		delete(s.certs, oldest.Value.(*mitmCert).name)
+	}
+	return cert, nil
+}
+
+// 在已建立的 CONNECT 隧道上终结 TLS, 逐个解析请求并重新以 TLS 发往目标
+// 上游始终是访问控制检查过的 req.host, SNI 与它不同时拒绝握手, 否则客户端可以借 SNI 访问别的主机
+func (s *mitmState) serve(e *connEntry, req *request, br *bufio.Reader) string {
+	host := strings.ToLower(strings.TrimSuffix(req.host, "."))
+	conn := tls.Server(&bufferedConn{Conn: req.client, r: br}, &tls.Config{
+		GetCertificate: func(hello *tls.ClientHelloInfo) (*tls.Certificate, error) {
+			if sni := strings.ToLower(strings.TrimSuffix(hello.ServerName, ".")); sni != "" && sni != host {
+				return nil, fmt.Errorf("sni %q does not match target %q", hello.ServerName, req.host)
+			}
+			return s.certificate(host)
+		},
+		NextProtos: []string{"http/1.1"},
+	})
+	defer conn.Close()
+	if err := conn.Handshake(); err != nil {
+		return "mitm handshake: " + err.Error()
+	}
+	tracker.update(e, func(e *connEntry) { e.Route += " mitm" })
+	// 解密后的响应不经过 tunnel, 在这里按同样的规则限速和加延迟
+	_, down, release := shapeFor(req.clientIP(), req.user)
+	defer release()
+	w, flush := shape(context.Background(), conn, down)
+	defer flush()
+
+	rd := bufio.NewReader(conn)
+	for {
+		if config.IdleTimeout > 0 {
+			conn.SetReadDeadline(time.Now().Add(time.Duration(config.IdleTimeout)))
+		}
+		hreq, err := http.ReadRequest(rd)
+		if err != nil {
+			if errors.Is(err, io.EOF) {
+				return "client closed"
+			}
+			return "client error: " + err.Error()
+		}
+		conn.SetReadDeadline(time.Time{})
+		hreq.URL.Scheme = "https"
+		hreq.URL.Host = host
+		if req.port != 443 {
+			hreq.URL.Host = net.JoinHostPort(host, strconv.Itoa(req.port))
+		}
+		if req.ip != nil {
+			hreq = hreq.WithContext(context.WithValue(hreq.Context(), aclIPKey{}, req.ip))
+		}
+		resp, err := s.roundTrip(hreq)
+		if err != nil {
+			flush()
+			io.WriteString(conn, "HTTP/1.1 502 Bad Gateway\r\nContent-Length: 0\r\nConnection: close\r\n\r\n")
+			return "upstream error: " + err.Error()
+		}
+		resp.Close = resp.Close || hreq.Close
+		tracker.update(e, func(e *connEntry) { e.Status = resp.StatusCode })
+		err = resp.Write(&countWriter{w: w, n: &e.BytesIn})
+		resp.Body.Close()
+		if err != nil {
+			return "client error: " + err.Error()
+		}
+		if resp.Close {
+			return "client closed"
+		}
+	}
+}
+
+// 转发一次解密后的请求, 记录日志和 HAR
+func (s *mitmState) roundTrip(hreq *http.Request) (*http.Response, error) {
+	start := time.Now()
+	out := hreq.Clone(hreq.Context())
+	out.RequestURI = ""
+	removeHopHeaders(out.Header)
+	var reqBody *cappedBuffer
+	if hreq.Body != nil && hreq.Body != http.NoBody {
+		reqBody = &cappedBuffer{max: s.maxBody}
+		out.Body = struct {
+			io.Reader
+			io.Closer
+		}{io.TeeReader(hreq.Body, reqBody), hreq.Body}
+	}
+	resp, err := s.transport.RoundTrip(out)
+	if err != nil {
+		log.Printf("mitm %s %s: %v", hreq.Method, hreq.URL, err)
+		return nil, err
+	}
+	wait := time.Since(start)
+	removeHopHeaders(resp.Header)
+	log.Printf("mitm %s %s %d", hreq.Method, hreq.URL, resp.StatusCode)
+	if s.har == nil {
+		return resp, nil
+	}
+	entry := harEntry{
+		StartedDateTime: start,
+		Request: harRequest{
+			Method:      hreq.Method,
+			URL:         hreq.URL.String(),
+			HTTPVersion: hreq.Proto,
+			Headers:     harHeaders(hreq.Header),
+			QueryString: []harNameValue{},
+			Cookies:     []harNameValue{},
+			HeadersSize: -1,
+			BodySize:    hreq.ContentLength,
+		},
+		Response: harResponse{
+			Status:      resp.StatusCode,
+			StatusText:  http.StatusText(resp.StatusCode),
+			HTTPVersion: resp.Proto,
+			Headers:     harHeaders(resp.Header),
+			Cookies:     []harNameValue{},
+			RedirectURL: resp.Header.Get("Location"),
+			HeadersSize: -1,
+		},
+		Timings: harTimings{Wait: float64(wait) / float64(time.Millisecond)},
+	}
+	for name, values := range hreq.URL.Query() {
+		for _, v := range values {
+			entry.Request.QueryString = append(entry.Request.QueryString, harNameValue{Name: name, Value: v})
+		}
+	}
+	if reqBody != nil {
+		text, _ := harText(reqBody.Bytes())
+		entry.Request.PostData = &harPostData{MimeType: hreq.Header.Get("Content-Type"), Text: text}
+	}
+	// 响应体读完或连接关闭时写入 HAR
+	respBody := &cappedBuffer{max: s.maxBody}
+	resp.Body = &harBody{
+		ReadCloser: resp.Body,
+		buf:        respBody,
+		done: func() {
+			entry.Response.BodySize = respBody.total
+			entry.Response.Content = harContent{Size: respBody.total, MimeType: resp.Header.Get("Content-Type")}
+			entry.Response.Content.Text, entry.Response.Content.Encoding = harText(respBody.Bytes())
+			entry.Timings.Receive = float64(time.Since(start)-wait) / float64(time.Millisecond)
+			entry.Time = entry.Timings.Wait + entry.Timings.Receive
+			if err := s.har.add(entry); err != nil {
+				log.Printf("mitm har: %v", err)
+			}
+		},
+	}
+	return resp, nil
+}
+
+// 只保存前 max 字节, total 记录总长度
+type cappedBuffer struct {
+	bytes.Buffer
+	max   int64
+	total int64
+}
+
+func (b *cappedBuffer) Write(p []byte) (int, error) {
+	b.total += int64(len(p))
+	if room := b.max - int64(b.Len()); room > 0 {
+		b.Buffer.Write(p[:min(int64(len(p)), room)])
+	}
+	return len(p), nil
+}
+
+type harBody struct {
+	io.ReadCloser
+	buf  *cappedBuffer
+	once sync.Once
+	done func()
+}
+
+func (h *harBody) Read(p []byte) (int, error) {
+	n, err := h.ReadCloser.Read(p)
+	h.buf.Write(p[:n])
+	if err == io.EOF {
+		h.once.Do(h.done)
+	}
+	return n, err
+}
+
+func (h *harBody) Close() error {
+	h.once.Do(h.done)
+	return h.ReadCloser.Close()
+}
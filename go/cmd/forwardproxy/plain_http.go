@@ -0,0 +1,223 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"io"
+	"net"
+	"net/http"
+	"slices"
+	"strconv"
+	"sync/atomic"
+	"time"
+)
+
+// 计数读取
+type countReader struct {
+	r io.Reader
+	n *int64
+}
+
+func (c *countReader) Read(p []byte) (int, error) {
+	n, err := c.r.Read(p)
+	atomic.AddInt64(c.n, int64(n))
+	return n, err
+}
+
+// 在客户端连接上循环处理普通 HTTP 请求, 每个请求一条访问日志
+// keep-alive 连接上后续请求的目标可以与第一个不同, 每个请求都单独做访问控制和路由,
+// 不能在第一个请求之后直接转发原始字节, 否则后续请求可以访问任意主机
+func serveHTTP(first *request, br *bufio.Reader) {
+	client := first.client
+	rd := bufio.NewReader(io.MultiReader(bytes.NewReader(first.head), br))
+	// 响应不经过 tunnel, 在这里按同样的规则限速和加延迟
+	_, down, release := shapeFor(first.clientIP(), first.user)
+	defer release()
+	w, flush := shape(context.Background(), client, down)
+	defer flush()
+	upstream := &httpUpstream{}
+	defer upstream.close()
+	for {
+		if config.IdleTimeout > 0 {
+			client.SetReadDeadline(time.Now().Add(time.Duration(config.IdleTimeout)))
+		}
+		hreq, err := http.ReadRequest(rd)
+		if err != nil {
+			return
+		}
+		client.SetReadDeadline(time.Time{})
+		if hreq.URL.Host == "" {
+			hreq.URL.Host = hreq.Host
+		}
+		if hreq.URL.Scheme == "" {
+			hreq.URL.Scheme = "http"
+		}
+		port, _ := strconv.Atoi(hreq.URL.Port())
+		if port == 0 {
+			port = 80
+		}
+		req := *first
+		req.method, req.target, req.host, req.port = hreq.Method, hreq.URL.String(), hreq.URL.Hostname(), port
+		req.address = net.JoinHostPort(req.host, strconv.Itoa(port))
+		if !forwardHTTP(&req, hreq, upstream, w, flush) {
+			return
+		}
+	}
+}
+
+// 转发一个请求并写回响应, 返回连接能否继续处理下一个请求
+func forwardHTTP(req *request, hreq *http.Request, upstream *httpUpstream, w io.Writer, flush func() error) bool {
+	e := tracker.open(req)
+	defer tracker.close(e)
+	if hreq.Body != http.NoBody {
+		hreq.Body = struct {
+			io.Reader
+			io.Closer
+		}{&countReader{r: hreq.Body, n: &e.BytesOut}, hreq.Body}
+	}
+	allowed, rule, ip := checkACL(req.clientIP(), req.host, req.port, nil, upstreamOnly(findRoute(req)))
+	if !allowed {
+		tracker.update(e, func(e *connEntry) { e.Status, e.Reason = http.StatusForbidden, "denied by "+rule })
+		flush()
+		req.deny(rule)
+		return false
+	}
+	req.ip = ip
+
+	var resp *http.Response
+	var err error
+	xcache := ""
+	if cache != nil {
+		if ip != nil {
+			hreq = hreq.WithContext(context.WithValue(hreq.Context(), aclIPKey{}, ip))
+		}
+		resp, xcache, err = cachedRoundTrip(hreq)
+	} else {
+		resp, err = upstream.roundTrip(req, hreq)
+	}
+	if err != nil {
+		tracker.update(e, func(e *connEntry) { e.Status, e.Reason = http.StatusBadGateway, "upstream error: "+err.Error() })
+		flush()
+		req.fail(err)
+		return false
+	}
+	if xcache != "" {
+		resp.Header.Set("X-Cache", xcache)
+	}
+	resp.Proto, resp.ProtoMajor, resp.ProtoMinor = "HTTP/1.1", 1, 1
+	// 长度未知又不是 chunked 的响应只能以关闭连接表示结束, resp.Write 会加上 Connection: close
+	resp.Close = hreq.Close || (resp.ContentLength < 0 && !slices.Contains(resp.TransferEncoding, "chunked"))
+	tracker.update(e, func(e *connEntry) {
+		e.Status = resp.StatusCode
+		if upstream.conn != nil {
+			e.Route = upstream.hop.String()
+		} else if xcache != "" {
+			e.Route = "CACHE " + xcache
+		}
+	})
+	err = resp.Write(&countWriter{w: w, n: &e.BytesIn})
+	resp.Body.Close()
+	if err != nil {
+		tracker.update(e, func(e *connEntry) { e.Reason = "client error: " + err.Error() })
+		return false
+	}
+	return !resp.Close
+}
+
+// 不经过缓存时到目标或上游代理的连接, 同一客户端连接上连续访问同一目标时复用
+type httpUpstream struct {
+	conn    net.Conn
+	br      *bufio.Reader
+	address string
+	hop     routeHop
+	keep    bool // 上一个响应之后连接还能继续使用
+}
+
+func (u *httpUpstream) close() {
+	if u.conn != nil {
+		limiter.untrack(u.conn)
+		u.conn.Close()
+		u.conn = nil
+	}
+}
+
+// 发送请求并读取响应头, 经过上游 HTTP 代理时请求行用绝对 URL
+func (u *httpUpstream) roundTrip(req *request, hreq *http.Request) (*http.Response, error) {
+	removeHopHeaders(hreq.Header)
+	reused := u.conn != nil && u.keep && u.address == req.address && slices.Contains(findRoute(req), u.hop)
+	if !reused {
+		u.close()
+		if err := u.dial(req); err != nil {
+			return nil, err
+		}
+	}
+	resp, err := u.send(hreq)
+	// 复用的连接可能已被对端关闭, 没有请求体时换新连接重试一次
+	if err != nil && reused && hreq.Body == http.NoBody {
+		u.close()
+		if err := u.dial(req); err != nil {
+			return nil, err
+		}
+		resp, err = u.send(hreq)
+	}
+	if err != nil {
+		u.close()
+		return nil, err
+	}
+	u.keep = !resp.Close
+	if resp.Body != http.NoBody {
+		resp.Body = &upstreamBody{ReadCloser: resp.Body, u: u}
+	}
+	removeHopHeaders(resp.Header)
+	return resp, nil
+}
+
+func (u *httpUpstream) dial(req *request) error {
+	conn, hop, err := dialTarget(req)
+	if err != nil {
+		return err
+	}
+	limiter.track(conn)
+	u.conn, u.br, u.address, u.hop = conn, bufio.NewReader(conn), req.address, hop
+	return nil
+}
+
+func (u *httpUpstream) send(hreq *http.Request) (*http.Response, error) {
+	var err error
+	if u.hop.kind == routeProxy {
+		err = hreq.WriteProxy(u.conn)
+	} else {
+		err = hreq.Write(u.conn)
+	}
+	if err != nil {
+		return nil, err
+	}
+	return http.ReadResponse(u.br, hreq)
+}
+
+// 响应体没有读完就关闭时上游连接上还留有数据, 不能再复用
+type upstreamBody struct {
+	io.ReadCloser
+	u   *httpUpstream
+	eof bool
+}
+
+func (b *upstreamBody) Read(p []byte) (int, error) {
+	n, err := b.ReadCloser.Read(p)
+	if err == io.EOF {
+		b.eof = true
+	}
+	return n, err
+}
+
+func (b *upstreamBody) Close() error {
+	err := b.ReadCloser.Close()
+	if !b.eof {
+		b.u.keep = false
+	}
+	if !b.u.keep {
+		b.u.close()
+	}
+	return err
+}
@@ -0,0 +1,316 @@
+package main
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"net/http"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+
+	"golang.org/x/net/proxy"
+)
+
+// 路由规则, 语法取自 PAC 文件 FindProxyForURL 的一个子集
+//
+//	{"match": "dnsDomainIs(host, \".corp.example\")", "route": "PROXY parent:3128; SOCKS5 parent:1080; DIRECT"}
+//
+// match 支持 isPlainHostName, dnsDomainIs, localHostOrDomainIs, shExpMatch,
+// isInNet, isResolvable 以及 !, &&, ||, 为空或 true 表示总是命中
+type RouteRule struct {
+	Match string `json:"match"`
+	Route string `json:"route"`
+
+	cond pacCond
+	hops []routeHop
+}
+
+// 路由中的一跳: DIRECT, PROXY(HTTP CONNECT) 或 SOCKS5
+type routeHop struct {
+	kind string
+	addr string
+}
+
+func (h routeHop) String() string {
+	if h.kind == routeDirect {
+		return routeDirect
+	}
+	return h.kind + " " + h.addr
+}
+
+const (
+	routeDirect = "DIRECT"
+	routeProxy  = "PROXY"
+	routeSocks5 = "SOCKS5"
+)
+
+var directRoute = []routeHop{{kind: routeDirect}}
+
+func compileRoutes(rules []RouteRule) error {
+	for i := range rules {
+		r := &rules[i]
+		cond, err := parsePACCond(r.Match)
+		if err != nil {
+			return fmt.Errorf("routes[%d]: %v", i, err)
+		}
+		r.cond = cond
+		if r.hops, err = parseRoute(r.Route); err != nil {
+			return fmt.Errorf("routes[%d]: %v", i, err)
+		}
+	}
+	return nil
+}
+
+// 解析 "PROXY a:1; SOCKS5 b:2; DIRECT"
+func parseRoute(s string) ([]routeHop, error) {
+	var hops []routeHop
+	for _, part := range strings.Split(s, ";") {
+		fields := strings.Fields(part)
+		if len(fields) == 0 {
+			continue
+		}
+		kind := strings.ToUpper(fields[0])
+		switch {
+		case kind == routeDirect && len(fields) == 1:
+			hops = append(hops, routeHop{kind: routeDirect})
+		case (kind == routeProxy || kind == "HTTP") && len(fields) == 2:
+			hops = append(hops, routeHop{kind: routeProxy, addr: fields[1]})
+		case (kind == routeSocks5 || kind == "SOCKS") && len(fields) == 2:
+			hops = append(hops, routeHop{kind: routeSocks5, addr: fields[1]})
+		default:
+			return nil, fmt.Errorf("bad route %q", part)
+		}
+	}
+	if len(hops) == 0 {
+		return nil, errors.New("empty route")
+	}
+	return hops, nil
+}
+
+// 查找请求对应的路由, 没有规则命中时直连
+func findRoute(req *request) []routeHop {
+	for i := range config.Routes {
+		r := &config.Routes[i]
+		if r.cond(req.host, req.url()) {
+			return r.hops
+		}
+	}
+	return directRoute
+}
+
+// 依次尝试路由中的每一跳, 上游不可达时换下一跳
+func dialTarget(req *request) (net.Conn, routeHop, error) {
+	var errs []error
+	for _, hop := range findRoute(req) {
+		conn, err := dialHop(hop, req)
+		if err == nil {
+			return conn, hop, nil
+		}
+		log.Printf("route %s -> %s failed: %v", hop, req.address, err)
+		errs = append(errs, err)
+	}
+	return nil, routeHop{}, errors.Join(errs...)
+}
+
+func dialHop(hop routeHop, req *request) (net.Conn, error) {
+	switch hop.kind {
+	case routeProxy:
+		conn, err := net.DialTimeout("tcp", hop.addr, time.Duration(config.DialTimeout))
+		if err != nil {
+			return nil, err
+		}
+		// 普通 HTTP 请求的请求行本来就是绝对 URL, 直接交给上游代理即可
+		if !req.socks && req.method != "CONNECT" {
+			return conn, nil
+		}
+		return httpConnect(conn, req.address)
+	case routeSocks5:
+		dialer, err := proxy.SOCKS5("tcp", hop.addr, nil, &net.Dialer{Timeout: time.Duration(config.DialTimeout)})
+		if err != nil {
+			return nil, err
+		}
+		return dialer.Dial("tcp", req.address)
+	default:
+		return net.DialTimeout("tcp", req.dialAddress(), time.Duration(config.DialTimeout))
+	}
+}
+
+// 路由中没有 DIRECT, 目标只由上游代理解析和连接
+func upstreamOnly(hops []routeHop) bool {
+	for _, hop := range hops {
+		if hop.kind == routeDirect {
+			return false
+		}
+	}
+	return true
+}
+
+// 直连时的目标地址: 访问控制解析过目标时连检查过的地址, 否则连原始的 host:port
+// 上游代理始终收到原始的 host:port, 由它按域名过滤和解析内网域名
+func (req *request) dialAddress() string {
+	if req.ip == nil {
+		return req.address
+	}
+	return net.JoinHostPort(req.ip.String(), strconv.Itoa(req.port))
+}
+
+// 通过上游 HTTP 代理建立 CONNECT 隧道
+func httpConnect(conn net.Conn, address string) (net.Conn, error) {
+	conn.SetDeadline(time.Now().Add(time.Duration(config.DialTimeout)))
+	_, err := fmt.Fprintf(conn, "CONNECT %s HTTP/1.1\r\nHost: %s\r\n\r\n", address, address)
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+	br := bufio.NewReader(conn)
+	resp, err := http.ReadResponse(br, &http.Request{Method: "CONNECT"})
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		conn.Close()
+		return nil, fmt.Errorf("upstream CONNECT %s: %s", address, resp.Status)
+	}
+	conn.SetDeadline(time.Time{})
+	if br.Buffered() > 0 {
+		return &bufferedConn{Conn: conn, r: br}, nil
+	}
+	return conn, nil
+}
+
+// 读取时先消费已经缓冲的数据
+type bufferedConn struct {
+	net.Conn
+	r *bufio.Reader
+}
+
+func (c *bufferedConn) Read(p []byte) (int, error) {
+	return c.r.Read(p)
+}
+
+func (c *bufferedConn) CloseWrite() error {
+	if cw, ok := c.Conn.(interface{ CloseWrite() error }); ok {
+		return cw.CloseWrite()
+	}
+	return c.Conn.Close()
+}
+
+// PAC 条件, 参数为目标主机和 URL
+type pacCond func(host, url string) bool
+
+var pacCallRe = regexp.MustCompile(`^(\w+)\s*\((.*)\)$`)
+
+func parsePACCond(expr string) (pacCond, error) {
+	expr = strings.TrimSpace(expr)
+	if expr == "" || expr == "true" {
+		return func(string, string) bool { return true }, nil
+	}
+	if parts := strings.Split(expr, "||"); len(parts) > 1 {
+		conds, err := parsePACConds(parts)
+		if err != nil {
+			return nil, err
+		}
+		return func(host, url string) bool {
+			for _, c := range conds {
+				if c(host, url) {
+					return true
+				}
+			}
+			return false
+		}, nil
+	}
+	if parts := strings.Split(expr, "&&"); len(parts) > 1 {
+		conds, err := parsePACConds(parts)
+		if err != nil {
+			return nil, err
+		}
+		return func(host, url string) bool {
+			for _, c := range conds {
+				if !c(host, url) {
+					return false
+				}
+			}
+			return true
+		}, nil
+	}
+	if strings.HasPrefix(expr, "!") {
+		if strings.TrimSpace(expr[1:]) == "" {
+			return nil, fmt.Errorf("bad pac expression %q", expr)
+		}
+		c, err := parsePACCond(expr[1:])
+		if err != nil {
+			return nil, err
+		}
+		return func(host, url string) bool { return !c(host, url) }, nil
+	}
+
+	m := pacCallRe.FindStringSubmatch(expr)
+	if m == nil {
+		return nil, fmt.Errorf("bad pac expression %q", expr)
+	}
+	var args []string
+	for _, a := range strings.Split(m[2], ",") {
+		args = append(args, strings.Trim(strings.TrimSpace(a), `"'`))
+	}
+	// 第一个参数是 host 或 url 变量
+	subject := func(host, url string) string {
+		if args[0] == "url" {
+			return url
+		}
+		return host
+	}
+	switch {
+	case m[1] == "isPlainHostName" && len(args) == 1:
+		return func(host, url string) bool { return !strings.Contains(host, ".") }, nil
+	case m[1] == "dnsDomainIs" && len(args) == 2:
+		return func(host, url string) bool { return strings.HasSuffix(host, args[1]) }, nil
+	case m[1] == "localHostOrDomainIs" && len(args) == 2:
+		return func(host, url string) bool {
+			return host == args[1] || (!strings.Contains(host, ".") && strings.HasPrefix(args[1], host+"."))
+		}, nil
+	case m[1] == "shExpMatch" && len(args) == 2:
+		re, err := regexp.Compile("^" + strings.NewReplacer(`\*`, ".*", `\?`, ".").Replace(regexp.QuoteMeta(args[1])) + "$")
+		if err != nil {
+			return nil, err
+		}
+		return func(host, url string) bool { return re.MatchString(subject(host, url)) }, nil
+	case m[1] == "isInNet" && len(args) == 3:
+		ip, mask := net.ParseIP(args[1]), net.ParseIP(args[2])
+		if ip == nil || mask == nil {
+			return nil, fmt.Errorf("bad isInNet arguments %q", expr)
+		}
+		n := &net.IPNet{IP: ip.To4(), Mask: net.IPMask(mask.To4())}
+		return func(host, url string) bool { return containsIP([]*net.IPNet{n}, firstIP(host)) }, nil
+	case m[1] == "isResolvable" && len(args) == 1:
+		return func(host, url string) bool { return firstIP(host) != nil }, nil
+	}
+	return nil, fmt.Errorf("unsupported pac function %q", expr)
+}
+
+func parsePACConds(parts []string) ([]pacCond, error) {
+	var conds []pacCond
+	for _, p := range parts {
+		c, err := parsePACCond(p)
+		if err != nil {
+			return nil, err
+		}
+		conds = append(conds, c)
+	}
+	return conds, nil
+}
+
+func firstIP(host string) net.IP {
+	ips, _ := lookupHost(host)
+	for _, ip := range ips {
+		if ip4 := ip.To4(); ip4 != nil {
+			return ip4
+		}
+	}
+	return nil
+}
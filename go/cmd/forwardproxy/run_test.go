@@ -0,0 +1,1458 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"io"
+	"math/big"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"golang.org/x/time/rate"
+)
+
+// 修改全局配置, 测试结束后恢复
+// Config 里的限速规则带锁不能整体复制, 只保存测试会改动的字段
+func setConfig(t *testing.T, f func(c *Config)) {
+	t.Helper()
+	acl, aclDefault, routes, users := config.ACL, config.ACLDefault, config.Routes, config.Users
+	dialTimeout, idleTimeout, shutdownTimeout := config.DialTimeout, config.IdleTimeout, config.ShutdownTimeout
+	maxLifetime, maxConns, maxConnsPerClient := config.MaxLifetime, config.MaxConns, config.MaxConnsPerClient
+	t.Cleanup(func() {
+		config.ACL, config.ACLDefault, config.Routes, config.Users = acl, aclDefault, routes, users
+		config.DialTimeout, config.IdleTimeout, config.ShutdownTimeout = dialTimeout, idleTimeout, shutdownTimeout
+		config.MaxLifetime, config.MaxConns, config.MaxConnsPerClient = maxLifetime, maxConns, maxConnsPerClient
+	})
+	f(&config)
+	if err := compileACL(config.ACL); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestACL(t *testing.T) {
+	rules := []ACLRule{
+		{Action: "deny", Clients: []string{"192.0.2.66"}},
+		{Action: "allow", Hosts: []string{"admin.example.com"}, Clients: []string{"192.0.2.0/28"}},
+		{Action: "deny", Hosts: []string{"admin.example.com"}},
+		{Action: "DENY", Hosts: []string{"*.ads.example"}},
+		{Action: "allow", Hosts: []string{"~^api[0-9]+\\.example\\.net$"}, Ports: []int{443, 8443}},
+		{Action: "deny", Hosts: []string{"~\\.example\\.net$"}},
+		{Action: "deny", Ports: []int{25}},
+		{Action: "deny", CIDRs: []string{"10.0.0.0/8", "fd00::/8", "127.0.0.1"}},
+	}
+	tests := []struct {
+		name   string
+		client string
+		host   string
+		port   int
+		dst    string
+		allow  bool
+		rule   string // 命中的规则前缀
+	}{
+		{"client denied first", "192.0.2.66", "www.example.org", 443, "", false, "acl[0]"},
+		{"client allowed before host deny", "192.0.2.5", "admin.example.com", 443, "", true, "acl[1]"},
+		{"host deny for other clients", "192.0.2.20", "ADMIN.example.com.", 443, "", false, "acl[2]"},
+		{"wildcard subdomain", "198.51.100.1", "x.y.ads.example", 80, "", false, "acl[3]"},
+		{"wildcard apex", "198.51.100.1", "ads.example", 80, "", false, "acl[3]"},
+		{"wildcard does not match suffix", "198.51.100.1", "badads.example", 25, "", false, "acl[6]"},
+		{"regexp with port", "198.51.100.1", "api12.example.net", 8443, "", true, "acl[4]"},
+		{"regexp port mismatch falls through", "198.51.100.1", "api12.example.net", 80, "", false, "acl[5]"},
+		{"cidr literal ipv4", "198.51.100.1", "10.1.2.3", 443, "", false, "acl[7]"},
+		{"cidr literal ipv6", "198.51.100.1", "fd00::1", 443, "", false, "acl[7]"},
+		{"cidr single ip", "198.51.100.1", "127.0.0.1", 443, "", false, "acl[7]"},
+		{"cidr outside", "198.51.100.1", "203.0.113.9", 443, "", true, "acl default"},
+		{"transparent uses dst", "198.51.100.1", "www.example.org", 443, "10.9.9.9", false, "acl[7]"},
+		{"port rule", "198.51.100.1", "203.0.113.9", 25, "", false, "acl[6]"},
+	}
+	setConfig(t, func(c *Config) { c.ACL = rules })
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			allow, rule, _ := checkACL(net.ParseIP(tt.client), strings.TrimSuffix(tt.host, "."), tt.port, net.ParseIP(tt.dst), false)
+			if allow != tt.allow || !strings.HasPrefix(rule, tt.rule) {
+				t.Errorf("checkACL = %v %q, want %v %s", allow, rule, tt.allow, tt.rule)
+			}
+		})
+	}
+
+	setConfig(t, func(c *Config) {
+		c.ACL, c.ACLDefault = []ACLRule{{Action: "allow", Ports: []int{443}}}, ACLDeny
+	})
+	if allow, rule, _ := checkACL(nil, "example.org", 80, nil, false); allow || rule != "acl default deny" {
+		t.Errorf("default deny: %v %q", allow, rule)
+	}
+	if err := compileACL([]ACLRule{{Action: "permit"}}); err == nil {
+		t.Error("unknown action accepted")
+	}
+	if err := compileACL([]ACLRule{{Action: "deny", CIDRs: []string{"10.0.0.0/33"}}}); err == nil {
+		t.Error("bad cidr accepted")
+	}
+}
+
+// 解析失败时地址段规则不能被跳过, 无论规则是 allow 还是 deny
+func TestACLLookupFailure(t *testing.T) {
+	setConfig(t, func(c *Config) { c.ACL = []ACLRule{{Action: "deny", CIDRs: []string{"10.0.0.0/8"}}} })
+	if allow, rule, _ := checkACL(nil, "nonexistent.invalid", 443, nil, false); allow || !strings.Contains(rule, "acl[0]") {
+		t.Errorf("deny rule with failed lookup: %v %q", allow, rule)
+	}
+	setConfig(t, func(c *Config) { c.ACL = []ACLRule{{Action: "allow", CIDRs: []string{"192.0.2.0/24"}}} })
+	if allow, _, _ := checkACL(nil, "nonexistent.invalid", 443, nil, false); allow {
+		t.Error("allow rule with failed lookup")
+	}
+	// 只走上游代理时解析不到的域名交给上游, 地址段规则不适用
+	setConfig(t, func(c *Config) { c.ACL = []ACLRule{{Action: "deny", CIDRs: []string{"10.0.0.0/8"}}} })
+	if allow, rule, ip := checkACL(nil, "intranet.invalid", 443, nil, true); !allow || ip != nil {
+		t.Errorf("upstream-only route with failed lookup: %v %q %v", allow, rule, ip)
+	}
+	// 没有地址段规则时不解析
+	setConfig(t, func(c *Config) { c.ACL = []ACLRule{{Action: "deny", Ports: []int{25}}} })
+	if allow, _, ip := checkACL(nil, "nonexistent.invalid", 443, nil, false); !allow || ip != nil {
+		t.Errorf("no cidr rules: %v %v", allow, ip)
+	}
+}
+
+// 检查过的地址用于拨号, 不再解析域名
+func TestACLPinsCheckedIP(t *testing.T) {
+	setConfig(t, func(c *Config) {
+		c.ACL, c.ACLDefault = []ACLRule{{Action: "allow", CIDRs: []string{"127.0.0.0/8"}}}, ACLDeny
+	})
+	allow, _, ip := checkACL(nil, "localhost", 80, nil, false)
+	if !allow || !ip.Equal(net.IPv4(127, 0, 0, 1)) {
+		t.Fatalf("localhost: %v %v", allow, ip)
+	}
+
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	port := l.Addr().(*net.TCPAddr).Port
+	req := &request{method: "CONNECT", host: "rebind.invalid", port: port, address: net.JoinHostPort("rebind.invalid", strconv.Itoa(port)), ip: ip}
+	conn, _, err := dialTarget(req)
+	if err != nil {
+		t.Fatalf("dial pinned ip: %v", err)
+	}
+	conn.Close()
+}
+
+// 两个监听都计入 WaitGroup, 停止后等活动连接结束, 超时强制关闭
+func TestServeUntilDrains(t *testing.T) {
+	setConfig(t, func(c *Config) { c.ShutdownTimeout = Duration(200 * time.Millisecond) })
+	var listeners []net.Listener
+	var handlers []func(net.Conn)
+	for i := 0; i < 2; i++ {
+		l, err := net.Listen("tcp", "127.0.0.1:0")
+		if err != nil {
+			t.Fatal(err)
+		}
+		listeners = append(listeners, l)
+		handlers = append(handlers, func(c net.Conn) {
+			defer c.Close()
+			io.Copy(c, c)
+		})
+	}
+	stop := make(chan struct{})
+	done := make(chan struct{})
+	go func() {
+		serveUntil(stop, listeners, handlers)
+		close(done)
+	}()
+
+	var conns []net.Conn
+	for _, l := range listeners {
+		c, err := net.Dial("tcp", l.Addr().String())
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer c.Close()
+		c.Write([]byte("x"))
+		io.ReadFull(c, make([]byte, 1))
+		conns = append(conns, c)
+	}
+	close(stop)
+	// 第一个连接自己结束, 第二个等到超时后被关闭
+	conns[0].Close()
+	select {
+	case <-done:
+		t.Fatal("returned before shutdown timeout")
+	case <-time.After(100 * time.Millisecond):
+	}
+	select {
+	case <-done:
+	case <-time.After(2 * time.Second):
+		t.Fatal("serveUntil did not return")
+	}
+	if _, err := conns[1].Read(make([]byte, 1)); err == nil {
+		t.Error("remaining connection not closed")
+	}
+	for _, l := range listeners {
+		if c, err := net.Dial("tcp", l.Addr().String()); err == nil {
+			c.Close()
+			t.Error("listener still open")
+		}
+	}
+}
+
+// 空闲并且令牌回满的桶被回收, 还有连接在用或者令牌没回满的保留
+func TestThrottleBucketEviction(t *testing.T) {
+	r := &ThrottleRule{Up: 1024, Down: 4096}
+	idle := r.bucket("idle")
+	r.release(idle)
+	busy := r.bucket("busy")
+	drained := r.bucket("drained")
+	drained.down.AllowN(time.Now(), drained.down.Burst())
+	r.release(drained)
+	if len(r.buckets) != 3 {
+		t.Fatalf("buckets = %d", len(r.buckets))
+	}
+
+	// 模拟过了 bucketIdleTTL, drained 的令牌刚用完还没回满
+	past := time.Now().Add(-2 * bucketIdleTTL)
+	r.lastSweep, idle.lastUsed, busy.lastUsed, drained.lastUsed = past, past, past, past
+	if again := r.bucket("new"); again == nil {
+		t.Fatal("nil bucket")
+	}
+	if _, ok := r.buckets["idle"]; ok {
+		t.Error("idle bucket not evicted")
+	}
+	if _, ok := r.buckets["busy"]; !ok {
+		t.Error("bucket in use evicted")
+	}
+	if _, ok := r.buckets["drained"]; !ok {
+		t.Error("bucket without full tokens evicted")
+	}
+	// 同一个 key 在使用期间拿到的是同一个桶
+	if r.bucket("busy") != busy {
+		t.Error("busy bucket replaced")
+	}
+}
+
+// 64 KiB 按 32 KiB/s 限速约需 2s, 减去初始的一桶令牌; 取消 ctx 后等待中的写立即返回
+func TestShapedWriterRate(t *testing.T) {
+	const bytesPerSecond = 32 * 1024
+	spec := &shapeSpec{limiters: []*rate.Limiter{newLimiter(bytesPerSecond)}}
+	w, flush := shape(context.Background(), io.Discard, spec)
+	start := time.Now()
+	n, err := w.Write(make([]byte, 64*1024))
+	elapsed := time.Since(start)
+	if err != nil || n != 64*1024 {
+		t.Fatalf("write = %d, %v", n, err)
+	}
+	if want := time.Duration(float64(64*1024-limiterBurst(bytesPerSecond)) / bytesPerSecond * float64(time.Second)); elapsed < want-100*time.Millisecond || elapsed > want+500*time.Millisecond {
+		t.Errorf("64 KiB took %v, want about %v", elapsed, want)
+	}
+	flush()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	w, flush = shape(ctx, io.Discard, spec)
+	defer flush()
+	time.AfterFunc(200*time.Millisecond, cancel)
+	start = time.Now()
+	n, err = w.Write(make([]byte, 64*1024))
+	if err == nil || time.Since(start) > time.Second {
+		t.Errorf("cancelled write = %d, %v after %v", n, err, time.Since(start))
+	}
+	if n >= 64*1024 {
+		t.Errorf("cancelled write wrote %d bytes", n)
+	}
+}
+
+// 在临时目录打开缓存, 测试结束后恢复
+func newTestCache(t *testing.T, maxSize int64) *cacheStore {
+	t.Helper()
+	old := cache
+	t.Cleanup(func() { cache = old })
+	if err := openCache(CacheConfig{Dir: t.TempDir(), MaxSize: maxSize}); err != nil {
+		t.Fatal(err)
+	}
+	return cache
+}
+
+func header(kv ...string) http.Header {
+	h := http.Header{}
+	for i := 0; i < len(kv); i += 2 {
+		h.Add(kv[i], kv[i+1])
+	}
+	return h
+}
+
+func TestCacheFreshness(t *testing.T) {
+	now := time.Now()
+	date := func(d time.Duration) string { return now.Add(d).UTC().Format(http.TimeFormat) }
+	tests := []struct {
+		name     string
+		resp     http.Header
+		status   int
+		received time.Duration // 响应在多久之前收到
+		req      http.Header
+		lifetime time.Duration
+		usable   bool
+	}{
+		{"max-age fresh", header("Cache-Control", "max-age=60", "Date", date(-30*time.Second)), 200, -30 * time.Second, nil, time.Minute, true},
+		{"max-age stale", header("Cache-Control", "max-age=60", "Date", date(-90*time.Second)), 200, -90 * time.Second, nil, time.Minute, false},
+		{"s-maxage wins", header("Cache-Control", "max-age=10, s-maxage=120"), 200, -time.Minute, nil, 2 * time.Minute, true},
+		{"age header counts", header("Cache-Control", "max-age=60", "Age", "50"), 200, -20 * time.Second, nil, time.Minute, false},
+		{"expires", header("Expires", date(time.Hour), "Date", date(0)), 200, 0, nil, time.Hour, true},
+		{"expires before date", header("Expires", date(-time.Hour), "Date", date(0)), 200, 0, nil, 0, false},
+		{"invalid expires", header("Expires", "0", "Date", date(0)), 200, 0, nil, 0, false},
+		{"heuristic", header("Last-Modified", date(-100*time.Hour), "Date", date(0)), 200, 0, nil, 10 * time.Hour, true},
+		{"heuristic capped", header("Last-Modified", date(-1000*time.Hour), "Date", date(0)), 200, 0, nil, 24 * time.Hour, true},
+		{"no heuristic for 302", header("Last-Modified", date(-100*time.Hour), "Date", date(0)), 302, 0, nil, 0, false},
+		{"response no-cache", header("Cache-Control", "max-age=60, no-cache"), 200, 0, nil, time.Minute, false},
+		{"request no-cache", header("Cache-Control", "max-age=60"), 200, 0, header("Cache-Control", "no-cache"), time.Minute, false},
+		{"pragma no-cache", header("Cache-Control", "max-age=60"), 200, 0, header("Pragma", "no-cache"), time.Minute, false},
+		{"request max-age", header("Cache-Control", "max-age=60"), 200, -30 * time.Second, header("Cache-Control", "max-age=10"), time.Minute, false},
+		{"request min-fresh", header("Cache-Control", "max-age=60"), 200, -30 * time.Second, header("Cache-Control", "min-fresh=40"), time.Minute, false},
+		{"max-stale any", header("Cache-Control", "max-age=60"), 200, -90 * time.Second, header("Cache-Control", "max-stale"), time.Minute, true},
+		{"max-stale bounded", header("Cache-Control", "max-age=60"), 200, -90 * time.Second, header("Cache-Control", "max-stale=10"), time.Minute, false},
+		{"must-revalidate beats max-stale", header("Cache-Control", "max-age=60, must-revalidate"), 200, -90 * time.Second, header("Cache-Control", "max-stale"), time.Minute, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			meta := &cacheMeta{Status: tt.status, Header: tt.resp, RequestTime: now.Add(tt.received), ResponseTime: now.Add(tt.received)}
+			if got := freshnessLifetime(meta); got != tt.lifetime {
+				t.Errorf("lifetime = %v, want %v", got, tt.lifetime)
+			}
+			req := &http.Request{Method: http.MethodGet, Header: tt.req}
+			if req.Header == nil {
+				req.Header = http.Header{}
+			}
+			if got := usableWithoutValidation(meta, req); got != tt.usable {
+				t.Errorf("usable = %v, want %v", got, tt.usable)
+			}
+		})
+	}
+}
+
+func TestCacheStorable(t *testing.T) {
+	tests := []struct {
+		name   string
+		method string
+		req    http.Header
+		status int
+		resp   http.Header
+		want   bool
+	}{
+		{"max-age", "GET", nil, 200, header("Cache-Control", "max-age=60"), true},
+		{"heuristic status", "GET", nil, 404, nil, true},
+		{"no explicit freshness", "GET", nil, 302, nil, false},
+		{"post", "POST", nil, 200, header("Cache-Control", "max-age=60"), false},
+		{"partial content", "GET", nil, 206, header("Cache-Control", "max-age=60"), false},
+		{"response no-store", "GET", nil, 200, header("Cache-Control", "no-store, max-age=60"), false},
+		{"request no-store", "GET", header("Cache-Control", "no-store"), 200, header("Cache-Control", "max-age=60"), false},
+		{"private", "GET", nil, 200, header("Cache-Control", "private, max-age=60"), false},
+		{"authorization", "GET", header("Authorization", "Basic eDp5"), 200, header("Cache-Control", "max-age=60"), false},
+		{"authorization public", "GET", header("Authorization", "Basic eDp5"), 200, header("Cache-Control", "public, max-age=60"), true},
+		{"vary star", "GET", nil, 200, header("Cache-Control", "max-age=60", "Vary", "*"), false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req := &http.Request{Method: tt.method, Header: tt.req}
+			if req.Header == nil {
+				req.Header = http.Header{}
+			}
+			resp := &http.Response{StatusCode: tt.status, Header: tt.resp}
+			if resp.Header == nil {
+				resp.Header = http.Header{}
+			}
+			if got := storable(req, resp); got != tt.want {
+				t.Errorf("storable = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+// 写入一个完整的条目
+func storeEntry(t *testing.T, s *cacheStore, url string, reqHeader http.Header, resp *http.Response, body string) {
+	t.Helper()
+	w, err := s.create(url, reqHeader, resp, time.Now(), time.Now())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := io.WriteString(w, body); err != nil {
+		t.Fatal(err)
+	}
+	if err := w.commit(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestCacheVary(t *testing.T) {
+	s := newTestCache(t, 1<<20)
+	const url = "http://example.com/a"
+	resp := func() *http.Response {
+		return &http.Response{StatusCode: 200, Header: header("Vary", "accept-encoding, Accept-Language")}
+	}
+	storeEntry(t, s, url, header("Accept-Encoding", "gzip", "Accept-Language", "en"), resp(), "gzip-en")
+	storeEntry(t, s, url, header("Accept-Encoding", "br", "Accept-Language", "en"), resp(), "br-en")
+
+	for _, tt := range []struct {
+		req  http.Header
+		want string
+	}{
+		{header("Accept-Encoding", "gzip", "Accept-Language", "en"), "gzip-en"},
+		{header("Accept-Encoding", "br", "Accept-Language", "en", "User-Agent", "x"), "br-en"},
+		{header("Accept-Encoding", "gzip"), ""},
+		{header("Accept-Encoding", "gzip", "Accept-Language", "de"), ""},
+	} {
+		meta, body := s.lookup(url, tt.req)
+		got := ""
+		if meta != nil {
+			data, _ := io.ReadAll(body)
+			body.Close()
+			got = string(data)
+		}
+		if got != tt.want {
+			t.Errorf("lookup %v = %q, want %q", tt.req, got, tt.want)
+		}
+	}
+
+	// 非安全方法使 URL 下所有变体失效
+	s.invalidate(url)
+	if meta, _ := s.lookup(url, header("Accept-Encoding", "gzip", "Accept-Language", "en")); meta != nil {
+		t.Error("entry survived invalidate")
+	}
+}
+
+// 写入过程中就受大小上限约束, 不会等到提交时才发现
+func TestCacheSizeLimit(t *testing.T) {
+	s := newTestCache(t, 100)
+	resp := func() *http.Response { return &http.Response{StatusCode: 200, Header: http.Header{}} }
+	storeEntry(t, s, "http://example.com/old", nil, resp(), strings.Repeat("a", 60))
+
+	w, err := s.create("http://example.com/new", nil, resp(), time.Now(), time.Now())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := w.Write(bytes.Repeat([]byte("b"), 60)); err != nil {
+		t.Fatal(err)
+	}
+	if s.size+s.pending > s.maxSize || s.lru.Len() != 0 {
+		t.Errorf("old entry not evicted while streaming: size %d pending %d", s.size, s.pending)
+	}
+	if _, err := w.Write(bytes.Repeat([]byte("b"), 60)); !errors.Is(err, errCacheFull) {
+		t.Errorf("oversized write: %v", err)
+	}
+	w.abort()
+	w.abort()
+	if s.pending != 0 {
+		t.Errorf("pending = %d after abort", s.pending)
+	}
+
+	// Content-Length 超过上限的响应直接透传, 不建临时文件
+	req, _ := http.NewRequest("GET", "http://example.com/big", nil)
+	big := &http.Response{StatusCode: 200, Header: header("Cache-Control", "max-age=60"), ContentLength: 1000, Body: io.NopCloser(strings.NewReader(""))}
+	if got := storeResponse(req, big, time.Now()); got.Body != big.Body {
+		t.Error("response larger than max_size was teed into the cache")
+	}
+}
+
+// 过期后用 ETag 重新验证, 304 时用缓存的响应体
+func TestCachedRoundTripRevalidate(t *testing.T) {
+	newTestCache(t, 1<<20)
+	var hits, notModified atomic.Int32
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		hits.Add(1)
+		w.Header().Set("ETag", `"v1"`)
+		w.Header().Set("Cache-Control", "max-age=0")
+		if r.Header.Get("If-None-Match") == `"v1"` {
+			notModified.Add(1)
+			w.WriteHeader(http.StatusNotModified)
+			return
+		}
+		io.WriteString(w, "hello")
+	}))
+	defer srv.Close()
+
+	get := func() (string, string) {
+		req, _ := http.NewRequest("GET", srv.URL+"/x", nil)
+		resp, xcache, err := cachedRoundTrip(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer resp.Body.Close()
+		body, _ := io.ReadAll(resp.Body)
+		return string(body), xcache
+	}
+	if body, xcache := get(); body != "hello" || xcache != "MISS" {
+		t.Fatalf("first: %q %s", body, xcache)
+	}
+	if body, xcache := get(); body != "hello" || xcache != "HIT" {
+		t.Fatalf("second: %q %s", body, xcache)
+	}
+	if hits.Load() != 2 || notModified.Load() != 1 || cache.Revalidated != 1 {
+		t.Errorf("origin hits %d, 304s %d, revalidated %d", hits.Load(), notModified.Load(), cache.Revalidated)
+	}
+}
+
+func TestHARWriter(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "dump.har")
+	w, err := newHARWriter(path, 4096)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer w.Close()
+	read := func(path string) harLog {
+		t.Helper()
+		data, err := os.ReadFile(path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		var v struct{ Log harLog }
+		if err := json.Unmarshal(data, &v); err != nil {
+			t.Fatalf("%s is not valid json: %v\n%s", path, err, data)
+		}
+		return v.Log
+	}
+	if l := read(path); l.Version != "1.2" || len(l.Entries) != 0 {
+		t.Fatalf("empty har: %+v", l)
+	}
+	for i := 0; i < 3; i++ {
+		if err := w.add(harEntry{Request: harRequest{URL: fmt.Sprintf("https://example.com/%d", i)}}); err != nil {
+			t.Fatal(err)
+		}
+		// 每条记录后文件都是完整的 JSON
+		if l := read(path); len(l.Entries) != i+1 || l.Entries[i].Request.URL != fmt.Sprintf("https://example.com/%d", i) {
+			t.Fatalf("after %d entries: %+v", i+1, l.Entries)
+		}
+	}
+	// 超过上限后轮转, 旧文件同样完整
+	big := harEntry{Response: harResponse{Content: harContent{Text: strings.Repeat("x", 3000)}}}
+	for i := 0; i < 3; i++ {
+		if err := w.add(big); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if fi, _ := os.Stat(path); fi.Size() > 4096 {
+		t.Errorf("har size %d exceeds limit", fi.Size())
+	}
+	if l := read(path); len(l.Entries) != 1 {
+		t.Errorf("current file has %d entries", len(l.Entries))
+	}
+	if l := read(path + ".1"); len(l.Entries) != 1 {
+		t.Errorf("rotated file has %d entries", len(l.Entries))
+	}
+}
+
+// 生成测试用 CA 并开启解密, 测试结束后恢复
+func newTestMITM(t *testing.T, hosts ...string) *mitmState {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tmpl := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "test ca"},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(24 * time.Hour),
+		IsCA:                  true,
+		BasicConstraintsValid: true,
+		KeyUsage:              x509.KeyUsageCertSign,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	keyDER, _ := x509.MarshalECPrivateKey(key)
+	dir := t.TempDir()
+	certFile, keyFile := filepath.Join(dir, "ca.pem"), filepath.Join(dir, "ca.key")
+	os.WriteFile(certFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), 0600)
+	os.WriteFile(keyFile, pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER}), 0600)
+	old := mitm
+	t.Cleanup(func() { mitm = old })
+	if err := openMITM(MITMConfig{CACert: certFile, CAKey: keyFile, Hosts: hosts, InsecureUpstream: true}); err != nil {
+		t.Fatal(err)
+	}
+	return mitm
+}
+
+func TestMITMCertCache(t *testing.T) {
+	s := newTestMITM(t, "*")
+	first, err := s.certificate("a.example")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if again, _ := s.certificate("a.example"); again != first {
+		t.Error("certificate not cached")
+	}
+	for i := 0; i < maxMITMCerts+10; i++ {
+		if _, err := s.certificate(fmt.Sprintf("h%d.example", i)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if len(s.certs) != maxMITMCerts || s.lru.Len() != maxMITMCerts {
+		t.Errorf("cache holds %d/%d certificates", len(s.certs), s.lru.Len())
+	}
+	if _, ok := s.certs["a.example"]; ok {
+		t.Error("least recently used certificate not evicted")
+	}
+}
+
+// SNI 与 CONNECT 的目标不同时拒绝握手, 上游只连检查过的目标
+func TestMITMRejectsSNIMismatch(t *testing.T) {
+	var hits atomic.Int32
+	origin := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		hits.Add(1)
+		io.WriteString(w, "origin "+r.Host)
+	}))
+	defer origin.Close()
+	port := origin.Listener.Addr().(*net.TCPAddr).Port
+	s := newTestMITM(t, "localhost")
+
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	serve := func(sni string) (string, error) {
+		c, err := net.Dial("tcp", l.Addr().String())
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer c.Close()
+		server, err := l.Accept()
+		if err != nil {
+			t.Fatal(err)
+		}
+		req := &request{client: server, method: "CONNECT", host: "localhost", port: port, address: net.JoinHostPort("localhost", strconv.Itoa(port)), ip: net.IPv4(127, 0, 0, 1)}
+		done := make(chan string, 1)
+		go func() {
+			defer server.Close()
+			done <- s.serve(tracker.open(req), req, bufio.NewReader(server))
+		}()
+		defer func() { <-done }()
+		tc := tls.Client(c, &tls.Config{ServerName: sni, InsecureSkipVerify: true})
+		if err := tc.Handshake(); err != nil {
+			return "", err
+		}
+		fmt.Fprintf(tc, "GET / HTTP/1.1\r\nHost: localhost\r\nConnection: close\r\n\r\n")
+		resp, err := http.ReadResponse(bufio.NewReader(tc), nil)
+		if err != nil {
+			return "", err
+		}
+		defer resp.Body.Close()
+		body, _ := io.ReadAll(resp.Body)
+		return string(body), nil
+	}
+
+	if body, err := serve("localhost"); err != nil || body != "origin localhost" {
+		t.Fatalf("matching sni: %q %v", body, err)
+	}
+	if _, err := serve("other.example"); err == nil {
+		t.Error("handshake with mismatched sni succeeded")
+	}
+	if hits.Load() != 1 {
+		t.Errorf("origin hits = %d", hits.Load())
+	}
+}
+
+// 替换原始目标查询, 验证嗅探出的域名和原始 IP 的使用
+func TestTransparent(t *testing.T) {
+	origin := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		io.WriteString(w, "origin "+r.Host)
+	}))
+	defer origin.Close()
+	dst := origin.Listener.Addr().(*net.TCPAddr)
+	old := lookupOriginalDst
+	t.Cleanup(func() { lookupOriginalDst = old })
+	lookupOriginalDst = func(net.Conn) (*net.TCPAddr, error) { return dst, nil }
+
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	get := func(host string) (string, error) {
+		c, err := net.Dial("tcp", l.Addr().String())
+		if err != nil {
+			t.Fatal(err)
+		}
+		server, err := l.Accept()
+		if err != nil {
+			t.Fatal(err)
+		}
+		done := make(chan struct{})
+		go func() {
+			defer close(done)
+			handleTransparent(server)
+		}()
+		defer func() {
+			c.Close()
+			<-done
+		}()
+		fmt.Fprintf(c, "GET / HTTP/1.1\r\nHost: %s\r\nConnection: close\r\n\r\n", host)
+		resp, err := http.ReadResponse(bufio.NewReader(c), nil)
+		if err != nil {
+			return "", err
+		}
+		defer resp.Body.Close()
+		body, err := io.ReadAll(resp.Body)
+		return string(body), err
+	}
+
+	tests := []struct {
+		name  string
+		acl   []ACLRule
+		def   string
+		host  string
+		reach bool
+	}{
+		// localhost 解析到原始目标, 域名规则生效
+		{"verified host denied", []ACLRule{{Action: "deny", Hosts: []string{"localhost"}}}, ACLAllow, "localhost", false},
+		{"verified host allowed", []ACLRule{{Action: "allow", Hosts: []string{"localhost"}}}, ACLDeny, "localhost", true},
+		// 伪造的域名不能借允许规则访问任意 IP, 也不会被它的拒绝规则拦住, 只按原始 IP 检查
+		{"spoofed host not trusted", []ACLRule{{Action: "allow", Hosts: []string{"*.corp.example"}}}, ACLDeny, "git.corp.example", false},
+		{"spoofed host ignored by deny", []ACLRule{{Action: "deny", Hosts: []string{"blocked.example"}}}, ACLAllow, "blocked.example", true},
+		{"cidr uses original dst", []ACLRule{{Action: "allow", CIDRs: []string{"127.0.0.0/8"}}}, ACLDeny, "git.corp.example", true},
+		{"cidr deny uses original dst", []ACLRule{{Action: "deny", CIDRs: []string{"127.0.0.0/8"}}}, ACLAllow, "localhost", false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			setConfig(t, func(c *Config) { c.ACL, c.ACLDefault = tt.acl, tt.def })
+			body, err := get(tt.host)
+			// 域名只用于访问控制, 连接始终发往原始 IP
+			if tt.reach && (err != nil || body != "origin "+tt.host) {
+				t.Errorf("not forwarded: %q %v", body, err)
+			}
+			if !tt.reach && err == nil {
+				t.Errorf("reached origin: %q", body)
+			}
+		})
+	}
+
+	req := &request{transparent: true, host: "git.corp.example", dst: dst.IP}
+	verifySniffedHost(req)
+	if req.host != dst.IP.String() || req.sniffed != "git.corp.example" {
+		t.Errorf("unverified host: %q %q", req.host, req.sniffed)
+	}
+	// 解密也只认验证过的域名
+	req.tls = true
+	if newTestMITM(t, "*.corp.example").intercept(req) {
+		t.Error("mitm intercepted a spoofed sni")
+	}
+}
+
+// 需要 root 并且在独立的网络命名空间中运行, 以免改动本机的 iptables:
+//
+//	sudo unshare -n sh -c 'ip link set lo up && FORWARDPROXY_NETNS=1 go test -run TestOriginalDst .'
+func TestOriginalDst(t *testing.T) {
+	if os.Geteuid() != 0 || os.Getenv("FORWARDPROXY_NETNS") == "" {
+		t.Skip("requires root in a network namespace with FORWARDPROXY_NETNS=1")
+	}
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	port := strconv.Itoa(l.Addr().(*net.TCPAddr).Port)
+	iptables := func(op string) error {
+		out, err := exec.Command("iptables", "-t", "nat", op, "OUTPUT", "-p", "tcp", "-d", "127.0.0.2", "--dport", "9",
+			"-j", "REDIRECT", "--to-ports", port).CombinedOutput()
+		if err != nil {
+			return fmt.Errorf("iptables %s: %v: %s", op, err, out)
+		}
+		return nil
+	}
+	if err := iptables("-A"); err != nil {
+		t.Skip(err)
+	}
+	defer iptables("-D")
+
+	c, err := net.Dial("tcp", "127.0.0.2:9")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	server, err := l.Accept()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer server.Close()
+	dst, err := originalDst(server)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !dst.IP.Equal(net.IPv4(127, 0, 0, 2)) || dst.Port != 9 {
+		t.Errorf("original dst = %v", dst)
+	}
+	if isSelfDst(server, dst) {
+		t.Error("redirected connection treated as self")
+	}
+
+	// 没有经过 REDIRECT 的连接查不到原始目标
+	direct, err := net.Dial("tcp", l.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer direct.Close()
+	server2, err := l.Accept()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer server2.Close()
+	if dst, err := originalDst(server2); err == nil && !isSelfDst(server2, dst) {
+		t.Errorf("direct connection original dst = %v", dst)
+	}
+}
+
+// 在本地端口上运行代理, 测试结束时停止并等待连接结束
+func startProxy(t *testing.T) string {
+	t.Helper()
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	stop := make(chan struct{})
+	done := make(chan struct{})
+	go func() {
+		serveUntil(stop, []net.Listener{l}, []func(net.Conn){handleClientRequest})
+		close(done)
+	}()
+	t.Cleanup(func() {
+		close(stop)
+		<-done
+	})
+	return l.Addr().String()
+}
+
+// keep-alive 连接上的每个请求都要检查访问控制, 直连和经过上游代理都一样
+func TestPipelinedRequestsACL(t *testing.T) {
+	var hits []string
+	var mu sync.Mutex
+	record := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		hits = append(hits, r.Host+r.URL.Path)
+		mu.Unlock()
+		io.WriteString(w, "ok "+r.URL.Path)
+	})
+	origin := httptest.NewServer(record)
+	defer origin.Close()
+	// 上游代理直接处理绝对 URL 的请求, 记录收到的目标
+	parent := httptest.NewServer(record)
+	defer parent.Close()
+	port := origin.Listener.Addr().(*net.TCPAddr).Port
+
+	for _, route := range []string{"DIRECT", "PROXY " + parent.Listener.Addr().String()} {
+		t.Run(route, func(t *testing.T) {
+			setConfig(t, func(c *Config) {
+				c.ACL = []ACLRule{{Action: "deny", Hosts: []string{"localhost"}}}
+				c.Routes = []RouteRule{{Route: route}}
+				if err := compileRoutes(c.Routes); err != nil {
+					t.Fatal(err)
+				}
+			})
+			mu.Lock()
+			hits = nil
+			mu.Unlock()
+			c, err := net.Dial("tcp", startProxy(t))
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer c.Close()
+			// 两个请求一次写出, 第二个的目标被拒绝
+			fmt.Fprintf(c, "GET http://127.0.0.1:%d/a HTTP/1.1\r\nHost: 127.0.0.1:%d\r\n\r\n"+
+				"GET http://localhost:%d/b HTTP/1.1\r\nHost: localhost:%d\r\n\r\n", port, port, port, port)
+			c.SetReadDeadline(time.Now().Add(5 * time.Second))
+			br := bufio.NewReader(c)
+			for _, want := range []int{http.StatusOK, http.StatusForbidden} {
+				resp, err := http.ReadResponse(br, nil)
+				if err != nil {
+					t.Fatal(err)
+				}
+				io.Copy(io.Discard, resp.Body)
+				resp.Body.Close()
+				if resp.StatusCode != want {
+					t.Errorf("status = %d, want %d", resp.StatusCode, want)
+				}
+			}
+			mu.Lock()
+			defer mu.Unlock()
+			if want := fmt.Sprintf("127.0.0.1:%d/a", port); len(hits) != 1 || hits[0] != want {
+				t.Errorf("upstream saw %v, want [%s]", hits, want)
+			}
+		})
+	}
+}
+
+// 同一连接上的多个允许的请求依次转发, 访问同一目标时复用上游连接
+func TestKeepAliveForward(t *testing.T) {
+	setConfig(t, func(c *Config) {})
+	var conns atomic.Int32
+	origin := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		io.WriteString(w, r.URL.Path)
+	}))
+	origin.Config.ConnState = func(c net.Conn, s http.ConnState) {
+		if s == http.StateNew {
+			conns.Add(1)
+		}
+	}
+	origin.Start()
+	defer origin.Close()
+
+	proxyURL, _ := url.Parse("http://" + startProxy(t))
+	client := &http.Client{Transport: &http.Transport{Proxy: http.ProxyURL(proxyURL)}, Timeout: 5 * time.Second}
+	defer client.CloseIdleConnections()
+	for _, path := range []string{"/1", "/2", "/3"} {
+		resp, err := client.Get(origin.URL + path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		body, _ := io.ReadAll(resp.Body)
+		resp.Body.Close()
+		if string(body) != path {
+			t.Errorf("%s: body %q", path, body)
+		}
+	}
+	if n := conns.Load(); n != 1 {
+		t.Errorf("origin connections = %d", n)
+	}
+}
+
+func TestParseRoute(t *testing.T) {
+	tests := []struct {
+		route string
+		want  string // 各跳用 | 连接, 为空表示解析失败
+	}{
+		{"DIRECT", "DIRECT"},
+		{"PROXY parent:3128; SOCKS5 parent:1080; DIRECT", "PROXY parent:3128|SOCKS5 parent:1080|DIRECT"},
+		{"http a:1;socks b:2", "PROXY a:1|SOCKS5 b:2"},
+		{" proxy a:1 ; ; direct ", "PROXY a:1|DIRECT"},
+		{"", ""},
+		{"PROXY", ""},
+		{"DIRECT x", ""},
+		{"HTTPS a:443", ""},
+	}
+	for _, tt := range tests {
+		hops, err := parseRoute(tt.route)
+		var got []string
+		for _, h := range hops {
+			got = append(got, h.String())
+		}
+		if strings.Join(got, "|") != tt.want || (err != nil) != (tt.want == "") {
+			t.Errorf("parseRoute(%q) = %v %v, want %q", tt.route, got, err, tt.want)
+		}
+	}
+}
+
+func TestParsePACCond(t *testing.T) {
+	tests := []struct {
+		expr string
+		host string
+		url  string
+		want bool
+	}{
+		{"", "a.com", "", true},
+		{"true", "a.com", "", true},
+		{"isPlainHostName(host)", "intranet", "", true},
+		{"isPlainHostName(host)", "a.com", "", false},
+		{`dnsDomainIs(host, ".corp.example")`, "git.corp.example", "", true},
+		{`dnsDomainIs(host, ".corp.example")`, "corp.example.com", "", false},
+		{`localHostOrDomainIs(host, "www.corp.example")`, "www", "", true},
+		{`localHostOrDomainIs(host, "www.corp.example")`, "www.corp.example", "", true},
+		{`localHostOrDomainIs(host, "www.corp.example")`, "web", "", false},
+		{`shExpMatch(host, "*.example.?om")`, "a.example.com", "", true},
+		{`shExpMatch(url, "https://*")`, "a.com", "https://a.com/", true},
+		{`shExpMatch(url, "https://*")`, "a.com", "http://a.com/", false},
+		{`isInNet(host, "10.0.0.0", "255.0.0.0")`, "10.1.2.3", "", true},
+		{`isInNet(host, "10.0.0.0", "255.0.0.0")`, "11.1.2.3", "", false},
+		{"isResolvable(host)", "127.0.0.1", "", true},
+		{"isResolvable(host)", "nonexistent.invalid", "", false},
+		{"!isPlainHostName(host)", "a.com", "", true},
+		{`isPlainHostName(host) || dnsDomainIs(host, ".corp")`, "x.corp", "", true},
+		{`dnsDomainIs(host, ".corp") && !shExpMatch(host, "pub.*")`, "pub.corp", "", false},
+		{`dnsDomainIs(host, ".corp") && !shExpMatch(host, "pub.*")`, "git.corp", "", true},
+	}
+	for _, tt := range tests {
+		cond, err := parsePACCond(tt.expr)
+		if err != nil {
+			t.Errorf("parsePACCond(%q): %v", tt.expr, err)
+			continue
+		}
+		if got := cond(tt.host, tt.url); got != tt.want {
+			t.Errorf("%s with host=%q url=%q = %v, want %v", tt.expr, tt.host, tt.url, got, tt.want)
+		}
+	}
+	for _, expr := range []string{"myIpAddress()", "dnsDomainIs(host)", `isInNet(host, "x", "255.0.0.0")`, "host ==", "!"} {
+		if _, err := parsePACCond(expr); err == nil {
+			t.Errorf("parsePACCond(%q) accepted", expr)
+		}
+	}
+}
+
+// 第一跳不可达时换下一跳, 上游代理收到的是域名而不是本地解析的地址
+func TestRouteFallback(t *testing.T) {
+	refused, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	refused.Close()
+	parent, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer parent.Close()
+	connectLine := make(chan string, 1)
+	go func() {
+		c, err := parent.Accept()
+		if err != nil {
+			return
+		}
+		defer c.Close()
+		req, err := http.ReadRequest(bufio.NewReader(c))
+		if err != nil {
+			return
+		}
+		connectLine <- req.Method + " " + req.RequestURI
+		io.WriteString(c, "HTTP/1.1 200 Connection established\r\n\r\nhello")
+	}()
+
+	setConfig(t, func(c *Config) {
+		c.Routes = []RouteRule{{Match: `dnsDomainIs(host, ".corp.example")`, Route: "PROXY " + refused.Addr().String() + "; PROXY " + parent.Addr().String()}}
+		if err := compileRoutes(c.Routes); err != nil {
+			t.Fatal(err)
+		}
+	})
+	req := &request{method: "CONNECT", host: "git.corp.example", port: 443, address: "git.corp.example:443", ip: net.IPv4(10, 0, 0, 1)}
+	conn, hop, err := dialTarget(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	if hop.addr != parent.Addr().String() {
+		t.Errorf("connected through %s", hop)
+	}
+	if line := <-connectLine; line != "CONNECT git.corp.example:443" {
+		t.Errorf("upstream got %q", line)
+	}
+	// 上游回复之后紧跟的数据不能丢
+	buf := make([]byte, 5)
+	conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	if _, err := io.ReadFull(conn, buf); err != nil || string(buf) != "hello" {
+		t.Errorf("tunnel data %q %v", buf, err)
+	}
+
+	// 没有规则命中时直连, 所有跳都失败时返回错误
+	if hops := findRoute(&request{host: "www.example.org", address: "www.example.org:443"}); len(hops) != 1 || hops[0].kind != routeDirect {
+		t.Errorf("default route = %v", hops)
+	}
+	parent.Close()
+	if _, _, err := dialTarget(req); err == nil {
+		t.Error("dial succeeded with all hops down")
+	}
+}
+
+// 并发安全的 buffer, 访问日志在处理连接的协程中写入
+type syncBuffer struct {
+	mu  sync.Mutex
+	buf bytes.Buffer
+}
+
+func (b *syncBuffer) Write(p []byte) (int, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.buf.Write(p)
+}
+
+// 等到写满 n 行后返回
+func (b *syncBuffer) lines(t *testing.T, n int) []string {
+	t.Helper()
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		b.mu.Lock()
+		lines := strings.Split(strings.TrimSuffix(b.buf.String(), "\n"), "\n")
+		empty := b.buf.Len() == 0
+		b.mu.Unlock()
+		if !empty && len(lines) >= n {
+			return lines
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("access log has %d lines, want %d", len(lines), n)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+// 替换访问日志和计数, 测试结束后恢复
+func captureAccessLog(t *testing.T, format string) *syncBuffer {
+	t.Helper()
+	oldLog, oldTracker := accessLog, tracker
+	t.Cleanup(func() { accessLog, tracker = oldLog, oldTracker })
+	buf := &syncBuffer{}
+	accessLog = &accessLogger{w: buf, format: format}
+	tracker = &connTracker{active: make(map[uint64]*connEntry)}
+	return buf
+}
+
+func TestAccessLogFormat(t *testing.T) {
+	e := &connEntry{
+		ID: 7, Client: "192.0.2.1:5555", User: "alice", Target: "http://a.example/x", Method: "GET",
+		Route: "DIRECT", Status: 200, BytesIn: 1234, BytesOut: 56,
+		Start:    time.Date(2024, 3, 1, 10, 20, 30, 0, time.FixedZone("", 8*3600)),
+		Duration: 0.25,
+	}
+	buf := captureAccessLog(t, AccessLogCLF)
+	accessLog.write(e)
+	anonymous := *e
+	anonymous.User, anonymous.Reason = "", "client closed"
+	accessLog.write(&anonymous)
+	want := []string{
+		`192.0.2.1 - alice [01/Mar/2024:10:20:30 +0800] "GET http://a.example/x" 200 1234 56 0.250 "DIRECT" ""`,
+		`192.0.2.1 - - [01/Mar/2024:10:20:30 +0800] "GET http://a.example/x" 200 1234 56 0.250 "DIRECT" "client closed"`,
+	}
+	if got := buf.lines(t, 2); strings.Join(got, "\n") != strings.Join(want, "\n") {
+		t.Errorf("clf:\n%s\nwant:\n%s", strings.Join(got, "\n"), strings.Join(want, "\n"))
+	}
+
+	buf = captureAccessLog(t, AccessLogJSON)
+	accessLog.write(e)
+	var got connEntry
+	if err := json.Unmarshal([]byte(buf.lines(t, 1)[0]), &got); err != nil {
+		t.Fatal(err)
+	}
+	if !got.Start.Equal(e.Start) {
+		t.Errorf("json start = %v", got.Start)
+	}
+	got.Start = e.Start
+	if got != *e {
+		t.Errorf("json = %+v, want %+v", got, *e)
+	}
+
+	if err := openAccessLog(AccessLogConfig{Format: "xml"}); err == nil {
+		t.Error("unknown format accepted")
+	}
+}
+
+// 普通 HTTP 每个请求一条日志, 状态码和字节数对应各自的响应
+func TestAccessLogPerRequest(t *testing.T) {
+	setConfig(t, func(c *Config) {
+		c.ACL = []ACLRule{{Action: "deny", Hosts: []string{"localhost"}}}
+	})
+	buf := captureAccessLog(t, AccessLogJSON)
+	origin := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/missing" {
+			http.NotFound(w, r)
+			return
+		}
+		io.Copy(io.Discard, r.Body)
+		io.WriteString(w, "hello")
+	}))
+	defer origin.Close()
+	port := origin.Listener.Addr().(*net.TCPAddr).Port
+	refused, _ := net.Listen("tcp", "127.0.0.1:0")
+	refused.Close()
+
+	addr := startProxy(t)
+	c, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	fmt.Fprintf(c, "POST http://127.0.0.1:%d/upload HTTP/1.1\r\nHost: 127.0.0.1\r\nContent-Length: 3\r\n\r\nabc"+
+		"GET http://127.0.0.1:%d/missing HTTP/1.1\r\nHost: 127.0.0.1\r\n\r\n"+
+		"GET http://localhost:%d/ HTTP/1.1\r\nHost: localhost\r\n\r\n", port, port, port)
+	io.Copy(io.Discard, c)
+	c2, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c2.Close()
+	fmt.Fprintf(c2, "GET http://%s/ HTTP/1.1\r\nHost: x\r\n\r\n", refused.Addr())
+	io.Copy(io.Discard, c2)
+
+	var entries []connEntry
+	for _, line := range buf.lines(t, 4) {
+		var e connEntry
+		if err := json.Unmarshal([]byte(line), &e); err != nil {
+			t.Fatal(err)
+		}
+		entries = append(entries, e)
+	}
+	want := []struct {
+		method, target string
+		status         int
+		bytesOut       int64
+	}{
+		{"POST", fmt.Sprintf("http://127.0.0.1:%d/upload", port), 200, 3},
+		{"GET", fmt.Sprintf("http://127.0.0.1:%d/missing", port), 404, 0},
+		{"GET", fmt.Sprintf("http://localhost:%d/", port), 403, 0},
+		{"GET", fmt.Sprintf("http://%s/", refused.Addr()), 502, 0},
+	}
+	for i, w := range want {
+		e := entries[i]
+		if e.Method != w.method || e.Target != w.target || e.Status != w.status || e.BytesOut != w.bytesOut {
+			t.Errorf("entry %d = %+v, want %+v", i, e, w)
+		}
+	}
+	if entries[0].BytesIn == 0 || entries[0].Route != "DIRECT" {
+		t.Errorf("first entry = %+v", entries[0])
+	}
+	counters := tracker.counters()
+	if counters["total"] != uint64(4) || counters["denied"] != uint64(1) || counters["failed"] != uint64(1) || counters["active"] != 0 {
+		t.Errorf("counters = %v", counters)
+	}
+	if in := counters["bytes_in"].(int64); in != entries[0].BytesIn+entries[1].BytesIn {
+		t.Errorf("bytes_in = %d", in)
+	}
+}
+
+func TestAdmin(t *testing.T) {
+	if got := adminAddr(":9090"); got != "127.0.0.1:9090" {
+		t.Errorf("adminAddr(:9090) = %s", got)
+	}
+	if got := adminAddr("0.0.0.0:9090"); got != "0.0.0.0:9090" {
+		t.Errorf("explicit host rewritten: %s", got)
+	}
+
+	captureAccessLog(t, AccessLogCLF)
+	c1, c2 := net.Pipe()
+	defer c1.Close()
+	defer c2.Close()
+	e := tracker.open(&request{client: c1, method: "CONNECT", address: "a.example:443", user: "bob"})
+	atomic.AddInt64(&e.BytesIn, 10)
+	srv := httptest.NewServer(adminHandler())
+	defer srv.Close()
+	get := func(path, user, password string) (int, []byte) {
+		req, _ := http.NewRequest("GET", srv.URL+path, nil)
+		if user != "" {
+			req.SetBasicAuth(user, password)
+		}
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer resp.Body.Close()
+		body, _ := io.ReadAll(resp.Body)
+		return resp.StatusCode, body
+	}
+
+	status, body := get("/connections", "", "")
+	var conns []connEntry
+	if err := json.Unmarshal(body, &conns); status != 200 || err != nil || len(conns) != 1 || conns[0].Target != "a.example:443" || conns[0].BytesIn != 10 {
+		t.Errorf("connections: %d %s", status, body)
+	}
+	tracker.close(e)
+	status, body = get("/stats", "", "")
+	var stats map[string]any
+	if err := json.Unmarshal(body, &stats); status != 200 || err != nil || stats["active"] != 0.0 || stats["total"] != 1.0 || stats["bytes_in"] != 10.0 {
+		t.Errorf("stats: %d %s", status, body)
+	}
+
+	// 配置了代理用户时管理接口要求认证
+	setConfig(t, func(c *Config) { c.Users = map[string]string{"admin": "secret"} })
+	for _, path := range []string{"/stats", "/connections"} {
+		if status, _ := get(path, "", ""); status != http.StatusUnauthorized {
+			t.Errorf("%s without auth: %d", path, status)
+		}
+		if status, _ := get(path, "admin", "wrong"); status != http.StatusUnauthorized {
+			t.Errorf("%s with wrong password: %d", path, status)
+		}
+		if status, _ := get(path, "admin", "secret"); status != http.StatusOK {
+			t.Errorf("%s with auth: %d", path, status)
+		}
+	}
+}
+
+// 回显服务, 用作隧道的目标
+func startEcho(t *testing.T) string {
+	t.Helper()
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { l.Close() })
+	go func() {
+		for {
+			c, err := l.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer c.Close()
+				io.Copy(c, c)
+			}()
+		}
+	}()
+	return l.Addr().String()
+}
+
+// 通过代理建立 CONNECT 隧道
+func connectTunnel(t *testing.T, proxyAddr, target string) net.Conn {
+	t.Helper()
+	c, err := net.Dial("tcp", proxyAddr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { c.Close() })
+	fmt.Fprintf(c, "CONNECT %s HTTP/1.1\r\nHost: %s\r\n\r\n", target, target)
+	c.SetReadDeadline(time.Now().Add(5 * time.Second))
+	resp, err := http.ReadResponse(bufio.NewReader(c), &http.Request{Method: "CONNECT"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("CONNECT %s: %s", target, resp.Status)
+	}
+	c.SetReadDeadline(time.Time{})
+	return c
+}
+
+// 等连接被对端关闭, 返回等待的时间
+func waitClosed(t *testing.T, c net.Conn, limit time.Duration) time.Duration {
+	t.Helper()
+	start := time.Now()
+	c.SetReadDeadline(start.Add(limit))
+	// 对端没读完数据就关闭时读到的是 RST, 同样算关闭
+	if _, err := io.Copy(io.Discard, c); errors.Is(err, os.ErrDeadlineExceeded) {
+		t.Fatalf("connection not closed within %v", limit)
+	}
+	return time.Since(start)
+}
+
+func TestTunnelTimeouts(t *testing.T) {
+	echo := startEcho(t)
+	lastReason := func(t *testing.T, buf *syncBuffer) string {
+		var e connEntry
+		lines := buf.lines(t, 1)
+		json.Unmarshal([]byte(lines[len(lines)-1]), &e)
+		return e.Reason
+	}
+
+	// 空闲超时: 没有数据后一段时间关闭, 有数据时不关闭
+	t.Run("idle", func(t *testing.T) {
+		buf := captureAccessLog(t, AccessLogJSON)
+		setConfig(t, func(c *Config) { c.IdleTimeout = Duration(300 * time.Millisecond) })
+		c := connectTunnel(t, startProxy(t), echo)
+		for i := 0; i < 4; i++ {
+			time.Sleep(200 * time.Millisecond)
+			io.WriteString(c, "x")
+			c.SetReadDeadline(time.Now().Add(time.Second))
+			if _, err := io.ReadFull(c, make([]byte, 1)); err != nil {
+				t.Fatalf("active tunnel closed: %v", err)
+			}
+		}
+		if d := waitClosed(t, c, 3*time.Second); d < 300*time.Millisecond {
+			t.Errorf("idle tunnel closed after %v", d)
+		}
+		if reason := lastReason(t, buf); reason != errIdleTimeout.Error() {
+			t.Errorf("reason = %q", reason)
+		}
+	})
+
+	// 最长存活时间: 一直有数据也会关闭
+	t.Run("lifetime", func(t *testing.T) {
+		buf := captureAccessLog(t, AccessLogJSON)
+		setConfig(t, func(c *Config) { c.MaxLifetime = Duration(500 * time.Millisecond) })
+		c := connectTunnel(t, startProxy(t), echo)
+		start := time.Now()
+		go func() {
+			for time.Since(start) < 5*time.Second {
+				if _, err := io.WriteString(c, "x"); err != nil {
+					return
+				}
+				time.Sleep(50 * time.Millisecond)
+			}
+		}()
+		if d := waitClosed(t, c, 3*time.Second); d < 500*time.Millisecond {
+			t.Errorf("tunnel closed after %v", d)
+		}
+		if reason := lastReason(t, buf); reason != errMaxLifetime.Error() {
+			t.Errorf("reason = %q", reason)
+		}
+	})
+}
+
+// 普通 HTTP 连接在两个请求之间空闲超时后关闭
+func TestHTTPIdleTimeout(t *testing.T) {
+	setConfig(t, func(c *Config) { c.IdleTimeout = Duration(200 * time.Millisecond) })
+	origin := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	defer origin.Close()
+	c, err := net.Dial("tcp", startProxy(t))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	fmt.Fprintf(c, "GET %s/ HTTP/1.1\r\nHost: x\r\n\r\n", origin.URL)
+	c.SetReadDeadline(time.Now().Add(5 * time.Second))
+	br := bufio.NewReader(c)
+	resp, err := http.ReadResponse(br, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	start := time.Now()
+	if _, err := br.ReadByte(); err != io.EOF {
+		t.Fatalf("read after idle: %v", err)
+	}
+	if d := time.Since(start); d < 150*time.Millisecond || d > 2*time.Second {
+		t.Errorf("closed after %v", d)
+	}
+}
+
+// 单个客户端超过连接数上限时拒绝新连接, 旧连接结束后恢复
+func TestConnLimits(t *testing.T) {
+	echo := startEcho(t)
+	// 第 N+1 个连接被直接关闭
+	refused := func(t *testing.T, addr string) {
+		t.Helper()
+		c, err := net.Dial("tcp", addr)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer c.Close()
+		fmt.Fprintf(c, "CONNECT %s HTTP/1.1\r\nHost: %s\r\n\r\n", echo, echo)
+		waitClosed(t, c, 2*time.Second)
+	}
+
+	t.Run("per client", func(t *testing.T) {
+		setConfig(t, func(c *Config) { c.MaxConnsPerClient = 2 })
+		addr := startProxy(t)
+		first := connectTunnel(t, addr, echo)
+		connectTunnel(t, addr, echo)
+		refused(t, addr)
+
+		first.Close()
+		deadline := time.Now().Add(5 * time.Second)
+		for {
+			limiter.mu.Lock()
+			n := limiter.perClient["127.0.0.1"]
+			limiter.mu.Unlock()
+			if n < 2 {
+				break
+			}
+			if time.Now().After(deadline) {
+				t.Fatal("closed connection still counted")
+			}
+			time.Sleep(10 * time.Millisecond)
+		}
+		connectTunnel(t, addr, echo)
+	})
+
+	t.Run("global", func(t *testing.T) {
+		setConfig(t, func(c *Config) { c.MaxConns = 1 })
+		addr := startProxy(t)
+		connectTunnel(t, addr, echo)
+		refused(t, addr)
+	})
+}
@@ -0,0 +1,125 @@
+package main
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+)
+
+// SOCKS5 协议常量, 见 RFC 1928
+const (
+	socks5Version = 0x05
+
+	socks5AuthNone         = 0x00
+	socks5AuthNoAcceptable = 0xFF
+
+	socks5CmdConnect = 0x01
+
+	socks5AtypIPv4   = 0x01
+	socks5AtypDomain = 0x03
+	socks5AtypIPv6   = 0x04
+
+	socks5RepSucceeded           = 0x00
+	socks5RepGeneralFailure      = 0x01
+	socks5RepNotAllowed          = 0x02
+	socks5RepHostUnreachable     = 0x04
+	socks5RepCommandNotSupported = 0x07
+)
+
+// 完成握手并读取 CONNECT 请求
+func readSocks5Request(client net.Conn, br *bufio.Reader) (*request, error) {
+	var head [2]byte
+	if _, err := io.ReadFull(br, head[:]); err != nil {
+		return nil, err
+	}
+	methods := make([]byte, head[1])
+	if _, err := io.ReadFull(br, methods); err != nil {
+		return nil, err
+	}
+	// 配置了用户时只接受用户名密码认证
+	want := byte(socks5AuthNone)
+	if authRequired() {
+		want = socks5AuthPassword
+	}
+	method := byte(socks5AuthNoAcceptable)
+	for _, m := range methods {
+		if m == want {
+			method = want
+		}
+	}
+	if _, err := client.Write([]byte{socks5Version, method}); err != nil {
+		return nil, err
+	}
+	if method == socks5AuthNoAcceptable {
+		return nil, errors.New("socks5: no acceptable auth method")
+	}
+	var user string
+	if method == socks5AuthPassword {
+		var ok bool
+		if user, ok = socks5PasswordAuth(client, br); !ok {
+			return nil, errProxyAuthRequired
+		}
+	}
+
+	// VER CMD RSV ATYP
+	var hdr [4]byte
+	if _, err := io.ReadFull(br, hdr[:]); err != nil {
+		return nil, err
+	}
+	if hdr[0] != socks5Version {
+		return nil, fmt.Errorf("socks5: bad version %d", hdr[0])
+	}
+	var host string
+	switch hdr[3] {
+	case socks5AtypIPv4, socks5AtypIPv6:
+		size := net.IPv4len
+		if hdr[3] == socks5AtypIPv6 {
+			size = net.IPv6len
+		}
+		ip := make(net.IP, size)
+		if _, err := io.ReadFull(br, ip); err != nil {
+			return nil, err
+		}
+		host = ip.String()
+	case socks5AtypDomain:
+		n, err := br.ReadByte()
+		if err != nil {
+			return nil, err
+		}
+		name := make([]byte, n)
+		if _, err := io.ReadFull(br, name); err != nil {
+			return nil, err
+		}
+		host = string(name)
+	default:
+		return nil, fmt.Errorf("socks5: bad address type %d", hdr[3])
+	}
+	var port [2]byte
+	if _, err := io.ReadFull(br, port[:]); err != nil {
+		return nil, err
+	}
+	req := &request{
+		client: client,
+		socks:  true,
+		user:   user,
+		method: "CONNECT",
+		host:   host,
+		port:   int(binary.BigEndian.Uint16(port[:])),
+	}
+	req.address = net.JoinHostPort(host, strconv.Itoa(req.port))
+	if hdr[1] != socks5CmdConnect {
+		writeSocks5Reply(client, socks5RepCommandNotSupported)
+		return nil, fmt.Errorf("socks5: unsupported command %d", hdr[1])
+	}
+	return req, nil
+}
+
+// 回复请求结果, 绑定地址统一填 0.0.0.0:0
+func writeSocks5Reply(client net.Conn, rep byte) error {
+	_, err := client.Write([]byte{socks5Version, rep, 0x00, socks5AtypIPv4, 0, 0, 0, 0, 0, 0})
+	return err
+}
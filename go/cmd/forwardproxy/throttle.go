@@ -0,0 +1,299 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"math/rand"
+	"net"
+	"sync"
+	"time"
+
+	"golang.org/x/time/rate"
+)
+
+// 限速规则, clients 和 users 都为空时对所有连接生效
+// 命中 users 的规则按用户共享令牌桶, 否则按客户端 IP 共享
+// latency 和 jitter 给每个方向的数据增加固定延迟和随机抖动, 用于模拟网络环境
+type ThrottleRule struct {
+	Clients []string `json:"clients"`
+	Users   []string `json:"users"`
+	Up      int      `json:"up"`   // 客户端 -> 目标, 字节/秒, 0 表示不限制
+	Down    int      `json:"down"` // 目标 -> 客户端, 字节/秒, 0 表示不限制
+	Latency Duration `json:"latency"`
+	Jitter  Duration `json:"jitter"`
+
+	clients   []*net.IPNet
+	mu        sync.Mutex
+	buckets   map[string]*bucketPair
+	lastSweep time.Time
+}
+
+// 令牌桶没有连接使用并空闲超过这个时间后回收
+const bucketIdleTTL = 5 * time.Minute
+
+type bucketPair struct {
+	up, down *rate.Limiter
+	refs     int       // 正在使用的连接数
+	lastUsed time.Time // 最后一个连接结束的时间
+}
+
+// 令牌已经回满, 删掉后重新创建的桶与它等价
+func (b *bucketPair) full(now time.Time) bool {
+	for _, l := range []*rate.Limiter{b.up, b.down} {
+		if l != nil && l.TokensAt(now) < float64(l.Burst()) {
+			return false
+		}
+	}
+	return true
+}
+
+func compileThrottle(rules []ThrottleRule) error {
+	for i := range rules {
+		var err error
+		if rules[i].clients, err = parseCIDRs(rules[i].Clients); err != nil {
+			return fmt.Errorf("throttle[%d]: %v", i, err)
+		}
+	}
+	return nil
+}
+
+func (r *ThrottleRule) match(ip net.IP, user string) bool {
+	if len(r.clients) > 0 && (ip == nil || !containsIP(r.clients, ip)) {
+		return false
+	}
+	if len(r.Users) == 0 {
+		return true
+	}
+	for _, u := range r.Users {
+		if u == user {
+			return true
+		}
+	}
+	return false
+}
+
+// 取出共享的令牌桶并增加引用, 不存在时创建, 连接结束时调用 release
+// 客户端 IP 和用户不断变化时桶会越来越多, 每隔 bucketIdleTTL 回收一次空闲的桶
+func (r *ThrottleRule) bucket(key string) *bucketPair {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	now := time.Now()
+	if r.buckets == nil {
+		r.buckets = make(map[string]*bucketPair)
+		r.lastSweep = now
+	}
+	if now.Sub(r.lastSweep) >= bucketIdleTTL {
+		r.sweep(now)
+	}
+	b, ok := r.buckets[key]
+	if !ok {
+		b = &bucketPair{up: newLimiter(r.Up), down: newLimiter(r.Down)}
+		r.buckets[key] = b
+	}
+	b.refs++
+	return b
+}
+
+func (r *ThrottleRule) release(b *bucketPair) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	b.refs--
+	b.lastUsed = time.Now()
+}
+
+// 删除没有连接使用、空闲超过 bucketIdleTTL 并且令牌已回满的桶; 调用方持有 r.mu
+func (r *ThrottleRule) sweep(now time.Time) {
+	r.lastSweep = now
+	for key, b := range r.buckets {
+		if b.refs == 0 && now.Sub(b.lastUsed) >= bucketIdleTTL && b.full(now) {
+			delete(r.buckets, key)
+		}
+	}
+}
+
+func newLimiter(bytesPerSecond int) *rate.Limiter {
+	if bytesPerSecond <= 0 {
+		return nil
+	}
+	return rate.NewLimiter(rate.Limit(bytesPerSecond), limiterBurst(bytesPerSecond))
+}
+
+// 桶容量取 100ms 的流量, 至少 1KB, 每次写入按桶容量切片
+func limiterBurst(bytesPerSecond int) int {
+	return max(bytesPerSecond/10, 1024)
+}
+
+// 单个方向的整形参数
+type shapeSpec struct {
+	limiters []*rate.Limiter
+	latency  time.Duration
+	jitter   time.Duration
+}
+
+func (s *shapeSpec) add(l *rate.Limiter) {
+	if l != nil {
+		s.limiters = append(s.limiters, l)
+	}
+}
+
+// 计算连接的上下行整形参数, 不需要整形的方向返回 nil; 连接结束时调用 release 归还令牌桶
+func shapeFor(ip net.IP, user string) (up, down *shapeSpec, release func()) {
+	up, down = &shapeSpec{}, &shapeSpec{}
+	var releases []func()
+	release = func() {
+		for _, f := range releases {
+			f()
+		}
+	}
+	global := &config.GlobalThrottle
+	if global.Up > 0 || global.Down > 0 {
+		b := global.bucket("")
+		releases = append(releases, func() { global.release(b) })
+		up.add(b.up)
+		down.add(b.down)
+	}
+	latency, jitter := global.Latency, global.Jitter
+	for i := range config.Throttle {
+		r := &config.Throttle[i]
+		if !r.match(ip, user) {
+			continue
+		}
+		key := ip.String()
+		if len(r.Users) > 0 {
+			key = "user:" + user
+		}
+		b := r.bucket(key)
+		releases = append(releases, func() { r.release(b) })
+		up.add(b.up)
+		down.add(b.down)
+		if r.Latency > 0 || r.Jitter > 0 {
+			latency, jitter = r.Latency, r.Jitter
+		}
+		break
+	}
+	up.latency, up.jitter = time.Duration(latency), time.Duration(jitter)
+	down.latency, down.jitter = up.latency, up.jitter
+	if len(up.limiters) == 0 && up.latency == 0 && up.jitter == 0 {
+		up = nil
+	}
+	if len(down.limiters) == 0 && down.latency == 0 && down.jitter == 0 {
+		down = nil
+	}
+	return up, down, release
+}
+
+// 包装写端, 返回的 flush 在转发结束时调用, 等待延迟队列写完
+// 限速等待在 ctx 取消后立即返回错误, 连接被关闭的转发不会一直卡在令牌桶上
+func shape(ctx context.Context, w io.Writer, spec *shapeSpec) (io.Writer, func() error) {
+	if spec == nil {
+		return w, func() error { return nil }
+	}
+	sw := &shapedWriter{w: w, spec: spec, chunk: 32 * 1024}
+	// WaitN 的 n 超过桶容量时直接返回错误, 每次最多等一个桶的令牌
+	for _, l := range spec.limiters {
+		sw.chunk = min(sw.chunk, l.Burst())
+	}
+	sw.ctx, sw.cancel = context.WithCancel(ctx)
+	if spec.latency > 0 || spec.jitter > 0 {
+		sw.queue = make(chan delayedChunk, 64)
+		sw.done = make(chan struct{})
+		go sw.deliver()
+	}
+	return sw, sw.flush
+}
+
+type delayedChunk struct {
+	data []byte
+	due  time.Time
+}
+
+type shapedWriter struct {
+	w      io.Writer
+	spec   *shapeSpec
+	chunk  int
+	ctx    context.Context
+	cancel context.CancelFunc
+
+	queue   chan delayedChunk
+	done    chan struct{}
+	lastDue time.Time
+	mu      sync.Mutex
+	err     error
+	flushed sync.Once
+}
+
+func (s *shapedWriter) Write(p []byte) (int, error) {
+	written := 0
+	for len(p) > 0 {
+		n := min(len(p), s.chunk)
+		for _, l := range s.spec.limiters {
+			if err := l.WaitN(s.ctx, n); err != nil {
+				return written, err
+			}
+		}
+		if s.queue == nil {
+			m, err := s.w.Write(p[:n])
+			written += m
+			if err != nil {
+				return written, err
+			}
+		} else {
+			if err := s.loadErr(); err != nil {
+				return written, err
+			}
+			// 保持字节流顺序, 抖动不能让后面的数据先到
+			due := time.Now().Add(s.spec.latency)
+			if s.spec.jitter > 0 {
+				due = due.Add(time.Duration(rand.Int63n(int64(s.spec.jitter))))
+			}
+			if due.Before(s.lastDue) {
+				due = s.lastDue
+			}
+			s.lastDue = due
+			select {
+			case s.queue <- delayedChunk{data: append([]byte(nil), p[:n]...), due: due}:
+			case <-s.ctx.Done():
+				return written, s.ctx.Err()
+			}
+			written += n
+		}
+		p = p[n:]
+	}
+	return written, nil
+}
+
+func (s *shapedWriter) deliver() {
+	defer close(s.done)
+	for c := range s.queue {
+		if s.loadErr() != nil {
+			continue
+		}
+		time.Sleep(time.Until(c.due))
+		if _, err := s.w.Write(c.data); err != nil {
+			s.mu.Lock()
+			s.err = err
+			s.mu.Unlock()
+			// 写端已经出错, 让还在等令牌的 Write 尽快返回
+			s.cancel()
+		}
+	}
+}
+
+func (s *shapedWriter) loadErr() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.err
+}
+
+// 等延迟队列写完, 可以重复调用, 之后不能再写
+func (s *shapedWriter) flush() error {
+	s.flushed.Do(func() {
+		if s.queue != nil {
+			close(s.queue)
+			<-s.done
+		}
+		s.cancel()
+	})
+	return s.loadErr()
+}
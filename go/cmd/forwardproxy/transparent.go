@@ -0,0 +1,125 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"io"
+	"log"
+	"net"
+	"os"
+	"strconv"
+	"time"
+
+	"code/pkg/sniff"
+)
+
+// 客户端先发数据的协议可以嗅探出域名, SSH 这类服务端先发数据的协议等不到首包, 超时后按 IP 转发
+const sniffTimeout = 300 * time.Millisecond
+
+// 取原始目标的函数, 测试中替换掉以免依赖 iptables
+var lookupOriginalDst = originalDst
+
+// 透明代理: 被 iptables REDIRECT 到这里的连接, 通过 SO_ORIGINAL_DST 取出原始目标
+// 域名从 TLS SNI 或 HTTP Host 中嗅探, 解析到原始目标时用于访问控制、路由和解密,
+// 否则只记在日志里, 访问控制只按原始 IP 检查; 直连时始终连原始 IP
+//
+// 本机测试 (代理以 proxy 用户运行, 避免代理自己的连接也被重定向):
+//
+//	iptables -t nat -A OUTPUT -p tcp -m owner ! --uid-owner proxy -j REDIRECT --to-ports 8082
+//
+// 网关模式:
+//
+//	iptables -t nat -A PREROUTING -i eth1 -p tcp -j REDIRECT --to-ports 8082
+func handleTransparent(client net.Conn) {
+	defer client.Close()
+	dst, err := lookupOriginalDst(client)
+	if err != nil {
+		log.Printf("transparent %s: %v", client.RemoteAddr(), err)
+		return
+	}
+	if isSelfDst(client, dst) {
+		log.Printf("transparent %s: connection was not redirected", client.RemoteAddr())
+		return
+	}
+	req := &request{
+		client:      client,
+		transparent: true,
+		method:      "CONNECT",
+		host:        dst.IP.String(),
+		port:        dst.Port,
+		address:     net.JoinHostPort(dst.IP.String(), strconv.Itoa(dst.Port)),
+		dst:         dst.IP,
+	}
+	req.target = req.address
+	br, err := sniffTransparent(req)
+	if err != nil {
+		log.Printf("transparent %s -> %s: %v", client.RemoteAddr(), req.address, err)
+		return
+	}
+	verifySniffedHost(req)
+	proxyRequest(req, br)
+}
+
+// 嗅探到的域名由客户端决定, 可以对任意 IP 伪造一个允许的 SNI 或 Host,
+// 只有域名解析结果包含原始目标时才信任它, 否则换回原始 IP, 域名只用于日志
+func verifySniffedHost(req *request) {
+	if req.host == req.dst.String() {
+		return
+	}
+	ips, _ := lookupHost(req.host)
+	for _, ip := range ips {
+		if ip.Equal(req.dst) {
+			return
+		}
+	}
+	req.sniffed, req.host = req.host, req.dst.String()
+}
+
+// 嗅探首包中的域名, 返回的 reader 会重放已经读过的字节
+func sniffTransparent(req *request) (*bufio.Reader, error) {
+	client := req.client
+	br := bufio.NewReader(client)
+	client.SetReadDeadline(time.Now().Add(sniffTimeout))
+	defer client.SetReadDeadline(time.Time{})
+	if _, err := br.Peek(1); err != nil {
+		if errors.Is(err, os.ErrDeadlineExceeded) {
+			return br, nil
+		}
+		return nil, err
+	}
+	head, _ := br.Peek(min(br.Buffered(), 3))
+	if !sniff.IsTLS(head) {
+		if host := sniff.HTTPHost(peekBuffered(br)); host != "" {
+			req.host = host
+		}
+		return br, nil
+	}
+	req.tls = true
+	// ClientHello 可能跨多个包, 按拨号超时等它收全
+	client.SetReadDeadline(time.Now().Add(time.Duration(config.DialTimeout)))
+	hello, raw, err := sniff.ReadClientHello(br)
+	rd := bufio.NewReader(io.MultiReader(bytes.NewReader(raw), br))
+	if err != nil {
+		if errors.Is(err, os.ErrDeadlineExceeded) || errors.Is(err, io.EOF) {
+			return nil, err
+		}
+		// 不是合法的 ClientHello, 按 IP 原样转发
+		return rd, nil
+	}
+	if hello.ServerName != "" {
+		req.host = hello.ServerName
+	}
+	return rd, nil
+}
+
+// 原始目标就是本机监听地址时说明没有经过 REDIRECT, 直接转发会形成环路
+func isSelfDst(conn net.Conn, dst *net.TCPAddr) bool {
+	local, ok := conn.LocalAddr().(*net.TCPAddr)
+	return ok && local.Port == dst.Port && local.IP.Equal(dst.IP)
+}
+
+func peekBuffered(br *bufio.Reader) []byte {
+	b, _ := br.Peek(br.Buffered())
+	return b
+}
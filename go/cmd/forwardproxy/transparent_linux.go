@@ -0,0 +1,67 @@
+package main
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"net"
+	"unsafe"
+
+	"golang.org/x/sys/unix"
+)
+
+// IP6T_SO_ORIGINAL_DST, 与 SO_ORIGINAL_DST 取值相同但位于 SOL_IPV6
+const ip6tSoOriginalDst = 80
+
+// 取出被 iptables REDIRECT/DNAT 之前的目标地址
+func originalDst(conn net.Conn) (*net.TCPAddr, error) {
+	tc, ok := conn.(*net.TCPConn)
+	if !ok {
+		return nil, errors.New("transparent: not a tcp connection")
+	}
+	raw, err := tc.SyscallConn()
+	if err != nil {
+		return nil, err
+	}
+	var addr *net.TCPAddr
+	var sockErr error
+	err = raw.Control(func(fd uintptr) {
+		if local, ok := conn.LocalAddr().(*net.TCPAddr); ok && local.IP.To4() == nil {
+			// sockaddr_in6 放不进 IPv6Mreq, 借用同样以 sockaddr_in6 开头的 IPv6MTUInfo
+			var info *unix.IPv6MTUInfo
+			info, sockErr = unix.GetsockoptIPv6MTUInfo(int(fd), unix.SOL_IPV6, ip6tSoOriginalDst)
+			if sockErr == nil {
+				addr = &net.TCPAddr{
+					IP:   net.IP(info.Addr.Addr[:]).To16(),
+					Port: int(ntohs(info.Addr.Port)),
+				}
+			}
+			return
+		}
+		// 返回的 16 字节是 sockaddr_in: family(2) port(2) addr(4)
+		var mreq *unix.IPv6Mreq
+		mreq, sockErr = unix.GetsockoptIPv6Mreq(int(fd), unix.SOL_IP, unix.SO_ORIGINAL_DST)
+		if sockErr == nil {
+			b := mreq.Multiaddr
+			addr = &net.TCPAddr{
+				IP:   net.IPv4(b[4], b[5], b[6], b[7]),
+				Port: int(binary.BigEndian.Uint16(b[2:4])),
+			}
+		}
+	})
+	if err != nil {
+		return nil, err
+	}
+	if sockErr != nil {
+		// 没有经过 REDIRECT 的连接 conntrack 中查不到记录, 返回 ENOENT
+		return nil, fmt.Errorf("transparent: SO_ORIGINAL_DST: %w", sockErr)
+	}
+	return addr, nil
+}
+
+// sockaddr_in6 中的端口是网络字节序, 按本机字节序读出来后需要转换
+func ntohs(port uint16) uint16 {
+	var b [2]byte
+	*(*uint16)(unsafe.Pointer(&b[0])) = port
+	return binary.BigEndian.Uint16(b[:])
+}
@@ -0,0 +1,84 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"sync"
+
+	"code/pkg/sniff"
+)
+
+// 不能 splice 时使用的缓冲区大小, 从池中复用
+const copyBufferSize = 32 << 10
+
+var copyBuffers = sync.Pool{New: func() any {
+	b := make([]byte, copyBufferSize)
+	return &b
+}}
+
+// 双向转发 client 和 backend 的数据, 两个方向都结束后关闭连接
+// 一个方向读到 EOF 时只半关闭对端的写方向, 另一个方向继续转发; 出错时立即关闭两端
+func proxyRequest(client net.Conn, backend net.Conn) {
+	defer client.Close()
+	defer backend.Close()
+	errc := make(chan error, 2)
+	pipe := func(dst, src net.Conn) {
+		_, err := copyConn(dst, src)
+		if err == nil {
+			// 对端可能已经关闭, 半关闭失败不影响另一个方向
+			closeWrite(dst)
+		}
+		errc <- err
+	}
+	go pipe(backend, client)
+	go pipe(client, backend)
+	for i := 0; i < 2; i++ {
+		if err := <-errc; err != nil {
+			if !errors.Is(err, net.ErrClosed) {
+				fmt.Printf("Unable to forward, error: %s\n", err.Error())
+			}
+			// 关闭连接让另一个方向的 copy 返回
+			client.Close()
+			backend.Close()
+		}
+	}
+}
+
+// 两端都是内核 socket 且至少一端是 TCP 时 io.Copy 会走 splice(2), 否则使用池中的缓冲区
+func copyConn(dst, src net.Conn) (int64, error) {
+	if spliceable(dst, src) {
+		return io.Copy(dst, src)
+	}
+	buf := copyBuffers.Get().(*[]byte)
+	defer copyBuffers.Put(buf)
+	// 隐藏 ReaderFrom/WriterTo, 避免 io.CopyBuffer 绕过传入的缓冲区另外分配
+	return io.CopyBuffer(struct{ io.Writer }{dst}, struct{ io.Reader }{src}, *buf)
+}
+
+func spliceable(dst, src net.Conn) bool {
+	d, s := socketKind(dst), socketKind(src)
+	return d != "" && s != "" && (d == "tcp" || s == "tcp")
+}
+
+// sniff.Conn 会先写出嗅探时的数据再交给底层连接, 按底层连接判断
+func socketKind(c net.Conn) string {
+	if sc, ok := c.(*sniff.Conn); ok {
+		c = sc.Conn
+	}
+	switch c.(type) {
+	case *net.TCPConn:
+		return "tcp"
+	case *net.UnixConn:
+		return "unix"
+	}
+	return ""
+}
+
+func closeWrite(c net.Conn) error {
+	if cw, ok := c.(interface{ CloseWrite() error }); ok {
+		return cw.CloseWrite()
+	}
+	return c.Close()
+}
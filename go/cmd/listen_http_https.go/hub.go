@@ -0,0 +1,266 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"io"
+	"log"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+// 客户端与服务端之间的消息
+//
+//	-> {"type": "subscribe", "channel": "news"}
+//	-> {"type": "unsubscribe", "channel": "news"}
+//	-> {"type": "publish", "channel": "news", "data": {...}}
+//	<- {"type": "message", "channel": "news", "data": {...}}
+//	<- {"type": "error", "error": "..."}
+type wsMessage struct {
+	Type    string          `json:"type"`
+	Channel string          `json:"channel,omitempty"`
+	Data    json.RawMessage `json:"data,omitempty"`
+	Error   string          `json:"error,omitempty"`
+}
+
+// 服务端发布接口的请求体上限
+const maxPublishBody = 1 << 20
+
+// 按频道广播消息的 websocket 中心
+type Hub struct {
+	PingPeriod time.Duration // 发送 ping 的间隔, 超过 2 倍没有收到 pong 时断开
+	WriteWait  time.Duration // 单次写超时
+	QueueSize  int           // 每个客户端的发送队列长度, 队列满时认为客户端太慢并断开
+
+	mu       sync.Mutex
+	channels map[string]map[*wsClient]struct{}
+}
+
+func newHub() *Hub {
+	return &Hub{
+		PingPeriod: 30 * time.Second,
+		WriteWait:  10 * time.Second,
+		QueueSize:  64,
+		channels:   make(map[string]map[*wsClient]struct{}),
+	}
+}
+
+var hub = newHub()
+
+var upgrader = websocket.Upgrader{} // use default options
+func ws(w http.ResponseWriter, r *http.Request) {
+	hub.serveWS(w, r)
+}
+
+// 服务端发布: POST /publish?channel=news, 请求体为 JSON
+func publish(w http.ResponseWriter, r *http.Request) {
+	hub.servePublish(w, r)
+}
+
+type wsClient struct {
+	hub  *Hub
+	conn *websocket.Conn
+	send chan []byte
+
+	closeOnce sync.Once
+	closed    chan struct{}
+	closeMsg  []byte // 关闭时发给客户端的 close 帧
+}
+
+func (h *Hub) serveWS(w http.ResponseWriter, r *http.Request) {
+	c, err := upgrader.Upgrade(w, r, nil)
+	if err != nil {
+		log.Print("upgrade:", err)
+		return
+	}
+	client := &wsClient{
+		hub:    h,
+		conn:   c,
+		send:   make(chan []byte, h.QueueSize),
+		closed: make(chan struct{}),
+	}
+	go client.writePump()
+	client.readPump()
+}
+
+func (h *Hub) servePublish(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		w.Header().Set("Allow", http.MethodPost)
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	channel := r.URL.Query().Get("channel")
+	if channel == "" {
+		http.Error(w, "missing channel", http.StatusBadRequest)
+		return
+	}
+	data, err := io.ReadAll(io.LimitReader(r.Body, maxPublishBody+1))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if len(data) > maxPublishBody {
+		http.Error(w, "body too large", http.StatusRequestEntityTooLarge)
+		return
+	}
+	if !json.Valid(data) {
+		http.Error(w, "body is not valid json", http.StatusBadRequest)
+		return
+	}
+	n := h.publish(channel, data)
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusAccepted)
+	json.NewEncoder(w).Encode(map[string]int{"delivered": n})
+}
+
+// 把消息放进频道所有订阅者的发送队列, 返回投递的客户端数
+func (h *Hub) publish(channel string, data json.RawMessage) int {
+	msg, err := json.Marshal(wsMessage{Type: "message", Channel: channel, Data: data})
+	if err != nil {
+		return 0
+	}
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	n := 0
+	for c := range h.channels[channel] {
+		select {
+		case c.send <- msg:
+			n++
+		default:
+			// 慢消费者: 断开连接, 不拖慢其它订阅者
+			log.Printf("ws %s: send queue full, disconnecting", c.conn.RemoteAddr())
+			h.removeLocked(c)
+			c.close(websocket.ClosePolicyViolation, "slow consumer")
+		}
+	}
+	return n
+}
+
+func (h *Hub) subscribe(c *wsClient, channel string) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	subs := h.channels[channel]
+	if subs == nil {
+		subs = make(map[*wsClient]struct{})
+		h.channels[channel] = subs
+	}
+	subs[c] = struct{}{}
+}
+
+func (h *Hub) unsubscribe(c *wsClient, channel string) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if subs := h.channels[channel]; subs != nil {
+		delete(subs, c)
+		if len(subs) == 0 {
+			delete(h.channels, channel)
+		}
+	}
+}
+
+// 从所有频道移除, 调用方持有 h.mu
+func (h *Hub) removeLocked(c *wsClient) {
+	for channel, subs := range h.channels {
+		delete(subs, c)
+		if len(subs) == 0 {
+			delete(h.channels, channel)
+		}
+	}
+}
+
+// 通知 writePump 发送 close 帧并关闭连接
+func (c *wsClient) close(code int, text string) {
+	c.closeOnce.Do(func() {
+		c.closeMsg = websocket.FormatCloseMessage(code, text)
+		close(c.closed)
+	})
+}
+
+// 读取客户端的订阅和发布请求, 连接断开时退订所有频道
+func (c *wsClient) readPump() {
+	defer func() {
+		c.hub.mu.Lock()
+		c.hub.removeLocked(c)
+		c.hub.mu.Unlock()
+		c.close(websocket.CloseNormalClosure, "")
+		c.conn.Close()
+	}()
+	pongWait := 2 * c.hub.PingPeriod
+	c.conn.SetReadLimit(maxPublishBody)
+	c.conn.SetReadDeadline(time.Now().Add(pongWait))
+	c.conn.SetPongHandler(func(string) error {
+		return c.conn.SetReadDeadline(time.Now().Add(pongWait))
+	})
+	for {
+		var msg wsMessage
+		if err := c.conn.ReadJSON(&msg); err != nil {
+			var syntaxErr *json.SyntaxError
+			var typeErr *json.UnmarshalTypeError
+			if errors.As(err, &syntaxErr) || errors.As(err, &typeErr) {
+				c.reply(wsMessage{Type: "error", Error: "invalid json: " + err.Error()})
+				continue
+			}
+			if websocket.IsUnexpectedCloseError(err, websocket.CloseNormalClosure, websocket.CloseGoingAway) {
+				log.Println(err.Error())
+			}
+			return
+		}
+		if msg.Channel == "" {
+			c.reply(wsMessage{Type: "error", Error: "missing channel"})
+			continue
+		}
+		switch msg.Type {
+		case "subscribe":
+			c.hub.subscribe(c, msg.Channel)
+		case "unsubscribe":
+			c.hub.unsubscribe(c, msg.Channel)
+		case "publish":
+			if len(msg.Data) == 0 {
+				c.reply(wsMessage{Type: "error", Error: "missing data"})
+				continue
+			}
+			c.hub.publish(msg.Channel, msg.Data)
+		default:
+			c.reply(wsMessage{Type: "error", Error: "unknown type " + msg.Type})
+		}
+	}
+}
+
+// 回复只发给当前客户端, 同样经过发送队列
+func (c *wsClient) reply(msg wsMessage) {
+	b, _ := json.Marshal(msg)
+	select {
+	case c.send <- b:
+	default:
+	}
+}
+
+// 所有写操作都在这里, 定时发送 ping
+func (c *wsClient) writePump() {
+	ticker := time.NewTicker(c.hub.PingPeriod)
+	defer func() {
+		ticker.Stop()
+		c.conn.Close()
+	}()
+	for {
+		select {
+		case msg := <-c.send:
+			c.conn.SetWriteDeadline(time.Now().Add(c.hub.WriteWait))
+			if err := c.conn.WriteMessage(websocket.TextMessage, msg); err != nil {
+				return
+			}
+		case <-ticker.C:
+			c.conn.SetWriteDeadline(time.Now().Add(c.hub.WriteWait))
+			if err := c.conn.WriteMessage(websocket.PingMessage, nil); err != nil {
+				return
+			}
+		case <-c.closed:
+			c.conn.SetWriteDeadline(time.Now().Add(c.hub.WriteWait))
+			c.conn.WriteMessage(websocket.CloseMessage, c.closeMsg)
+			return
+		}
+	}
+}
@@ -1,34 +1,22 @@
 package main
 
 import (
-	"bytes"
 	"crypto/tls"
+	"flag"
 	"fmt"
 	"log"
 	"net"
 	"net/http"
 	"os"
+	"time"
 
-	"github.com/gorilla/websocket"
+	"code/pkg/certmgr"
+	"code/pkg/proxyproto"
+	"code/pkg/sniff"
+	"golang.org/x/net/http2"
+	"golang.org/x/net/http2/h2c"
 )
 
-var upgrader = websocket.Upgrader{} // use default options
-func ws(w http.ResponseWriter, r *http.Request) {
-	c, err := upgrader.Upgrade(w, r, nil)
-	if err != nil {
-		log.Print("upgrade:", err)
-		return
-	}
-	defer c.Close()
-	for {
-		_, _, err := c.ReadMessage()
-		if err != nil {
-			log.Println(err.Error())
-			return
-		}
-	}
-}
-
 func chunked(w http.ResponseWriter, r *http.Request) {
 	w.Header().Add("Transfer-Encoding", "chunked")
 	for i := 0; i < 1024; i++ {
@@ -40,97 +28,86 @@ func chunked(w http.ResponseWriter, r *http.Request) {
 }
 
 func main() {
-	http.HandleFunc("/ws", ws)
-	http.HandleFunc("/chunked", chunked)
+	configPath := flag.String("config", "", "routing config file (json)")
+	flag.Parse()
+	table := defaultRoutes()
+	routes.Store(&table)
+	if *configPath != "" {
+		if err := loadConfig(*configPath); err != nil {
+			panic(err)
+		}
+		go watchConfig(*configPath)
+	}
+	registerHandlers()
 
 	go HttpProxyServer()
 	go HttpsProxyServe()
-	proxylistener, err := net.Listen("tcp", ":58787")
+	proxylistener, err := net.Listen("tcp", config.Listen)
 	if err != nil {
 		panic(err)
 	}
 	defer proxylistener.Close()
-	for {
-		proxyconn, err := proxylistener.Accept()
-		if err != nil {
-			fmt.Printf("Unable to accept a request, error: %s\n", err.Error())
-			continue
-		}
+	// 先按首包识别协议, 再按路由表选择后端
+	mux := sniff.NewMux(proxylistener)
+	go forward(mux.Match(sniff.HTTP1(), sniff.HTTP2(), sniff.TLS(), sniff.SSH(), sniff.ProxyProtocol(), sniff.Any()))
+	if err := mux.Serve(); err != nil {
+		panic(err)
+	}
+}
 
-		// Read a header firstly in case you could have opportunity to check request
-		// whether to decline or proceed the request
-		buffer := make([]byte, 1024)
-		n, err := proxyconn.Read(buffer)
-		if err != nil {
-			//fmt.Printf("Unable to read from input, error: %s\n", err.Error())
-			continue
-		}
+func registerHandlers() {
+	http.HandleFunc("/ws", ws)
+	http.HandleFunc("/publish", publish)
+	http.HandleFunc("/chunked", chunked)
+}
 
-		var targetport string
-		if IsHTTPRequest(buffer) {
-			targetport = http_unix_path
-		} else {
-			targetport = https_unix_path
-		}
-		targetconn, err := net.Dial("unix", targetport)
-		if err != nil {
-			fmt.Printf("Unable to connect to: %d, error: %s\n", targetport, err.Error())
-			proxyconn.Close()
-			continue
-		}
-		_, err = targetconn.Write(buffer[:n])
+func forward(l net.Listener) {
+	for {
+		conn, err := l.Accept()
 		if err != nil {
-			fmt.Printf("Unable to write to output, error: %s\n", err.Error())
-			proxyconn.Close()
-			targetconn.Close()
-			continue
+			return
 		}
-		go proxyRequest(proxyconn, targetconn)
-		go proxyRequest(targetconn, proxyconn)
+		go route(conn.(*sniff.Conn))
 	}
 }
-func IsHTTPRequest(buffer []byte) bool {
-	httpMethod := []string{"GET", "PUT", "HEAD", "POST", "DELETE", "PATCH", "OPTIONS", "CONNECT", "TRACE"}
-	for cnt := 0; cnt < len(httpMethod); cnt++ {
-		if bytes.HasPrefix(buffer, []byte(httpMethod[cnt])) {
-			return true
+
+// 按路由表把连接转发到后端, 嗅探读到的数据由 sniff.Conn 重放
+func route(proxyconn *sniff.Conn) {
+	info := inspect(proxyconn)
+	r := findRoute(info)
+	if r == nil {
+		log.Printf("no route for %s %s (sni=%q host=%q)", proxyconn.RemoteAddr(), info.protocol, info.sni, info.host)
+		proxyconn.Close()
+		return
+	}
+	targetconn, backend, err := r.dial()
+	if err != nil {
+		fmt.Printf("Unable to connect to backend, error: %s\n", err.Error())
+		proxyconn.Close()
+		return
+	}
+	// 后端看到的是本进程的地址, 用 PROXY protocol 告诉它真实的客户端地址
+	if backend.ProxyProtocol != 0 {
+		if err := proxyproto.WriteHeader(targetconn, backend.ProxyProtocol, proxyconn.RemoteAddr(), proxyconn.LocalAddr()); err != nil {
+			fmt.Printf("Unable to write proxy header, error: %s\n", err.Error())
+			proxyconn.Close()
+			targetconn.Close()
+			return
 		}
 	}
-	return false
+	proxyRequest(proxyconn, targetconn)
 }
 
 var http_unix_path = "/tmp/localproxy-server.http"
 
-// Forward all requests from r to w
-func proxyRequest(r net.Conn, w net.Conn) {
-	defer r.Close()
-	defer w.Close()
-
-	var buffer = make([]byte, 4096000)
-	for {
-		n, err := r.Read(buffer)
-		if err != nil {
-			//fmt.Printf("Unable to read from input, error: %s\n", err.Error())
-			break
-		}
-
-		_, err = w.Write(buffer[:n])
-		if err != nil {
-			fmt.Printf("Unable to write to output, error: %s\n", err.Error())
-			break
-		}
-	}
-}
 func HttpProxyServer() {
 	os.Remove(http_unix_path)
 	httpUnix, err := net.Listen("unix", http_unix_path)
 	if err != nil {
 		panic(err)
 	}
-	server := http.Server{
-		Handler: http.DefaultServeMux,
-	}
-	err = server.Serve(httpUnix)
+	server := newHTTPServer()
+	err = server.Serve(proxyproto.NewListener(httpUnix))
 	if err != nil {
 		panic(err)
 	}
@@ -140,6 +117,55 @@ func HttpProxyServer() {
 
 }
 
+// 明文连接同时支持 h2c, 包括 prior knowledge 和 Upgrade: h2c 两种方式
+func newHTTPServer() *http.Server {
+	return &http.Server{
+		Handler: h2c.NewHandler(handler(), &http2.Server{}),
+	}
+}
+
+func newCertManager(c TLSConfig) (*certmgr.Manager, error) {
+	m, err := certmgr.New(c.CertDir)
+	if err != nil {
+		return nil, err
+	}
+	switch c.Generate {
+	case certmgr.GenerateOff:
+	case certmgr.GenerateSelfSigned:
+		err = m.EnableSelfSigned(c.GenerateNames...)
+	case certmgr.GenerateCA:
+		err = m.EnableCA(c.CACert, c.CAKey, c.GenerateNames...)
+	default:
+		err = fmt.Errorf("tls: unknown generate mode %q", c.Generate)
+	}
+	return m, err
+}
+
+// http 和 https 服务共用的处理链
+func handler() http.Handler {
+	return withClientIdentity(logRequests(authorizeClients(config.TLS.ClientPolicies, http.DefaultServeMux)))
+}
+
+// 请求日志, 经过 PROXY protocol 后 RemoteAddr 是真实的客户端地址, 客户端证书的身份记在最后
+func logRequests(h http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		log.Printf("%s %s %s %s %s", r.RemoteAddr, r.Method, r.Host, r.URL, clientIdentity(r.Context()))
+		h.ServeHTTP(w, r)
+	})
+}
+
+// http.Server.Serve 会为 ALPN 协商出 h2 的连接启用 HTTP/2
+func newTLSConfig(certs *certmgr.Manager, c TLSConfig) (*tls.Config, error) {
+	tlsConfig := &tls.Config{
+		GetCertificate: certs.GetCertificate,
+		NextProtos:     []string{"h2", "http/1.1"},
+	}
+	if err := configureClientAuth(tlsConfig, c); err != nil {
+		return nil, err
+	}
+	return tlsConfig, nil
+}
+
 var https_unix_path = "/tmp/localproxy-server.https"
 
 func HttpsProxyServe() {
@@ -148,19 +174,27 @@ func HttpsProxyServe() {
 		panic(err)
 	}
 
-	tlsConfig := &tls.Config{
-		Certificates: []tls.Certificate{cert},
+	certs, err := newCertManager(config.TLS)
+	if err != nil {
+		panic(err)
+	}
+	certs.Fallback = &cert
+	go certs.Watch(2 * time.Second)
+	tlsConfig, err := newTLSConfig(certs, config.TLS)
+	if err != nil {
+		panic(err)
 	}
 	os.Remove(https_unix_path)
-	httpsUnix, err := tls.Listen("unix", https_unix_path, tlsConfig)
+	httpsUnix, err := net.Listen("unix", https_unix_path)
 	if err != nil {
 		panic(err)
 	}
 	server := http.Server{
-		Handler: http.DefaultServeMux,
+		Handler: handler(),
 	}
 
-	err = server.Serve(httpsUnix)
+	// PROXY 头部在 TLS 握手之前
+	err = server.Serve(tls.NewListener(proxyproto.NewListener(httpsUnix), tlsConfig))
 	if err != nil {
 		panic(err)
 	}
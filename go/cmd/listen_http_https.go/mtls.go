@@ -0,0 +1,134 @@
+package main
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"strings"
+
+	"code/pkg/sniff"
+)
+
+// 客户端证书校验方式
+const (
+	ClientAuthOff           = ""
+	ClientAuthVerifyIfGiven = "verify_if_given" // 客户端提供证书时校验, 不提供也允许连接
+	ClientAuthRequire       = "require"         // 必须提供受信任的证书
+)
+
+// 按路径前缀限制可以访问的客户端, 第一条前缀命中的策略生效, 没有策略命中时放行
+// subjects 匹配证书的 CN 或完整 DN, sans 匹配 DNS/邮箱/URI, DNS 支持 *.example.com, "*" 表示任意受信任的证书
+type ClientPolicy struct {
+	Path     string   `json:"path"`
+	Subjects []string `json:"subjects"`
+	SANs     []string `json:"sans"`
+}
+
+// 校验通过的客户端身份
+type ClientIdentity struct {
+	Subject string
+	CN      string
+	SANs    []string
+}
+
+func (id *ClientIdentity) String() string {
+	if id == nil {
+		return "-"
+	}
+	return id.CN
+}
+
+type identityKey struct{}
+
+// handler 中取出客户端身份, 没有提供或没有通过校验的证书时返回 nil
+func clientIdentity(ctx context.Context) *ClientIdentity {
+	id, _ := ctx.Value(identityKey{}).(*ClientIdentity)
+	return id
+}
+
+// 按配置设置 tls.Config 中的客户端证书校验
+func configureClientAuth(tlsConfig *tls.Config, c TLSConfig) error {
+	var mode tls.ClientAuthType
+	switch c.ClientAuth {
+	case ClientAuthOff:
+		return nil
+	case ClientAuthVerifyIfGiven:
+		mode = tls.VerifyClientCertIfGiven
+	case ClientAuthRequire:
+		mode = tls.RequireAndVerifyClientCert
+	default:
+		return fmt.Errorf("tls: unknown client_auth %q", c.ClientAuth)
+	}
+	pem, err := os.ReadFile(c.ClientCA)
+	if err != nil {
+		return err
+	}
+	pool := x509.NewCertPool()
+	if !pool.AppendCertsFromPEM(pem) {
+		return errors.New("tls: no certificates in client_ca " + c.ClientCA)
+	}
+	tlsConfig.ClientAuth, tlsConfig.ClientCAs = mode, pool
+	return nil
+}
+
+// 把校验通过的客户端证书转成身份放进请求上下文
+func withClientIdentity(h http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.TLS != nil && len(r.TLS.VerifiedChains) > 0 {
+			cert := r.TLS.VerifiedChains[0][0]
+			id := &ClientIdentity{Subject: cert.Subject.String(), CN: cert.Subject.CommonName}
+			id.SANs = append(id.SANs, cert.DNSNames...)
+			id.SANs = append(id.SANs, cert.EmailAddresses...)
+			for _, u := range cert.URIs {
+				id.SANs = append(id.SANs, u.String())
+			}
+			r = r.WithContext(context.WithValue(r.Context(), identityKey{}, id))
+		}
+		h.ServeHTTP(w, r)
+	})
+}
+
+// 按路径执行客户端策略, 明文 HTTP 请求没有身份, 受限路径一律拒绝
+func authorizeClients(policies []ClientPolicy, h http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		for _, p := range policies {
+			if !strings.HasPrefix(r.URL.Path, p.Path) {
+				continue
+			}
+			if id := clientIdentity(r.Context()); !p.allow(id) {
+				log.Printf("deny %s %s: client %s not allowed by policy %s", r.RemoteAddr, r.URL.Path, id, p.Path)
+				http.Error(w, "client certificate not allowed", http.StatusForbidden)
+				return
+			}
+			break
+		}
+		h.ServeHTTP(w, r)
+	})
+}
+
+func (p *ClientPolicy) allow(id *ClientIdentity) bool {
+	if id == nil {
+		return false
+	}
+	for _, s := range p.Subjects {
+		if s == "*" || s == id.CN || s == id.Subject {
+			return true
+		}
+	}
+	for _, s := range p.SANs {
+		if s == "*" {
+			return true
+		}
+		for _, san := range id.SANs {
+			if s == san || sniff.MatchName([]string{s}, san) {
+				return true
+			}
+		}
+	}
+	return false
+}
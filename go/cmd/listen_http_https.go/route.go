@@ -0,0 +1,270 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"os"
+	"os/signal"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"syscall"
+	"time"
+
+	"code/pkg/sniff"
+)
+
+// 路由配置, 通过 -config 指定 JSON 文件, 文件修改或收到 SIGHUP 时重新加载 routes
+//
+//	{
+//	  "listen": ":58787",
+//	  "routes": [
+//	    {"protocol": "tls", "sni": ["*.dev.local"], "backends": [{"address": "127.0.0.1:8443", "weight": 2}, {"address": "127.0.0.1:9443"}]},
+//	    {"protocol": "http1", "host": ["api.local"], "backends": [{"address": "unix:/tmp/api.sock"}]},
+//	    {"protocol": "ssh", "backends": [{"address": "127.0.0.1:22"}]},
+//	    {"backends": [{"address": "unix:/tmp/localproxy-server.https", "proxy_protocol": 2}]}
+//	  ]
+//	}
+type Config struct {
+	Listen string    `json:"listen"` // 监听地址, 修改后需要重启
+	Routes []Route   `json:"routes"` // 按顺序匹配, 第一条命中的路由生效, 为空时使用默认路由
+	TLS    TLSConfig `json:"tls"`    // 内置 https 服务的证书, 修改后需要重启, 证书目录中的文件变化会自动加载
+}
+
+// 内置 https 服务按 SNI 选择证书, 没有命中时使用编译进来的证书
+type TLSConfig struct {
+	CertDir       string   `json:"cert_dir"`       // 证书目录, name.crt/name.pem 与 name.key 配对
+	Generate      string   `json:"generate"`       // 为未知域名签发证书: self-signed 或 ca
+	GenerateNames []string `json:"generate_names"` // 允许签发的域名, 支持 *.example.com, "*" 表示任意域名, generate 不为空时必须设置
+	CACert        string   `json:"ca_cert"`        // generate 为 ca 时使用的 CA 证书和私钥 (PEM)
+	CAKey         string   `json:"ca_key"`
+
+	ClientCA       string         `json:"client_ca"`       // 校验客户端证书的 CA (PEM, 可以有多张)
+	ClientAuth     string         `json:"client_auth"`     // verify_if_given 或 require, 为空时不要求客户端证书
+	ClientPolicies []ClientPolicy `json:"client_policies"` // 按路径限制客户端, 明文 HTTP 同样生效
+}
+
+// protocol 取值为 sniff 匹配器的名称: http1, http2, tls, ssh, proxy, any, 为空时匹配所有协议
+// sni/alpn 只对 tls 生效, host 只对 http1 生效, 都支持 *.example.com 通配符
+type Route struct {
+	Protocol string    `json:"protocol"`
+	SNI      []string  `json:"sni"`
+	ALPN     []string  `json:"alpn"`
+	Host     []string  `json:"host"`
+	Backends []Backend `json:"backends"`
+
+	mu sync.Mutex // 保护 current
+}
+
+// address 为 host:port 或 unix:/path, 以 / 开头的也视为 unix socket
+type Backend struct {
+	Address       string `json:"address"`
+	Weight        int    `json:"weight"`         // 默认 1
+	ProxyProtocol int    `json:"proxy_protocol"` // 连接后先发送 PROXY protocol 头部, 取值 1 或 2, 0 表示不发送
+
+	current int // 平滑加权轮询的当前权重
+}
+
+var config = Config{Listen: ":58787"}
+
+// 当前生效的路由表, 热加载时整体替换
+var routes atomic.Pointer[[]*Route]
+
+// 没有配置文件时保持原来的行为: 明文 HTTP/1 和 h2c 交给 http 服务, 其余都当作 https
+func defaultRoutes() []*Route {
+	return []*Route{
+		{Protocol: "http1", Backends: []Backend{{Address: "unix:" + http_unix_path, Weight: 1, ProxyProtocol: 2}}},
+		{Protocol: "http2", Backends: []Backend{{Address: "unix:" + http_unix_path, Weight: 1, ProxyProtocol: 2}}},
+		{Backends: []Backend{{Address: "unix:" + https_unix_path, Weight: 1, ProxyProtocol: 2}}},
+	}
+}
+
+func loadConfig(path string) error {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return err
+	}
+	c := config
+	c.Routes = nil
+	if err := json.Unmarshal(data, &c); err != nil {
+		return err
+	}
+	table := make([]*Route, len(c.Routes))
+	for i := range c.Routes {
+		r := &c.Routes[i]
+		if err := r.compile(); err != nil {
+			return fmt.Errorf("routes[%d]: %w", i, err)
+		}
+		table[i] = r
+	}
+	if len(table) == 0 {
+		table = defaultRoutes()
+	}
+	config = c
+	routes.Store(&table)
+	return nil
+}
+
+func (r *Route) compile() error {
+	switch r.Protocol {
+	case "", "http1", "http2", "tls", "ssh", "proxy", "any":
+	default:
+		return fmt.Errorf("unknown protocol %q", r.Protocol)
+	}
+	if len(r.Backends) == 0 {
+		return errors.New("no backends")
+	}
+	for i := range r.Backends {
+		b := &r.Backends[i]
+		if b.Weight < 0 {
+			return fmt.Errorf("backend %s: negative weight", b.Address)
+		}
+		if b.Weight == 0 {
+			b.Weight = 1
+		}
+		if b.ProxyProtocol < 0 || b.ProxyProtocol > 2 {
+			return fmt.Errorf("backend %s: unsupported proxy_protocol %d", b.Address, b.ProxyProtocol)
+		}
+	}
+	return nil
+}
+
+// 配置文件修改或收到 SIGHUP 时重新加载, 加载失败时保留原来的路由
+func watchConfig(path string) {
+	hup := make(chan os.Signal, 1)
+	signal.Notify(hup, syscall.SIGHUP)
+	var modTime time.Time
+	if fi, err := os.Stat(path); err == nil {
+		modTime = fi.ModTime()
+	}
+	tick := time.NewTicker(2 * time.Second)
+	defer tick.Stop()
+	for {
+		select {
+		case <-hup:
+		case <-tick.C:
+			fi, err := os.Stat(path)
+			if err != nil || fi.ModTime().Equal(modTime) {
+				continue
+			}
+			modTime = fi.ModTime()
+		}
+		if err := loadConfig(path); err != nil {
+			log.Printf("reload %s: %v", path, err)
+			continue
+		}
+		log.Printf("reloaded %s: %d routes", path, len(*routes.Load()))
+	}
+}
+
+// 路由需要的连接信息
+type connInfo struct {
+	protocol string
+	sni      string
+	alpn     []string
+	host     string
+}
+
+// 读取路由需要的 SNI/ALPN 或 Host, TLS 的 ClientHello 在分发时已经完整读到
+func inspect(c *sniff.Conn) connInfo {
+	info := connInfo{protocol: c.Protocol}
+	switch c.Protocol {
+	case "tls":
+		c.Sniff(sniff.Matcher{Match: func(r io.Reader) bool {
+			if hello, _, err := sniff.ReadClientHello(r); err == nil {
+				info.sni, info.alpn = hello.ServerName, hello.ALPN
+			}
+			return true
+		}}, sniff.DefaultTimeout)
+	case "http1":
+		c.Sniff(sniff.Matcher{Match: func(r io.Reader) bool {
+			info.host = sniff.ReadHTTPHost(r)
+			return true
+		}}, sniff.DefaultTimeout)
+	}
+	return info
+}
+
+func (r *Route) match(info connInfo) bool {
+	if r.Protocol != "" && r.Protocol != info.protocol {
+		return false
+	}
+	if len(r.SNI) > 0 && !sniff.MatchName(r.SNI, info.sni) {
+		return false
+	}
+	if len(r.ALPN) > 0 {
+		matched := false
+		for _, p := range info.alpn {
+			if sniff.MatchName(r.ALPN, p) {
+				matched = true
+				break
+			}
+		}
+		if !matched {
+			return false
+		}
+	}
+	return len(r.Host) == 0 || sniff.MatchName(r.Host, info.host)
+}
+
+func findRoute(info connInfo) *Route {
+	for _, r := range *routes.Load() {
+		if r.match(info) {
+			return r
+		}
+	}
+	return nil
+}
+
+// 平滑加权轮询 (同 nginx), exclude 中的后端本轮已经失败, 跳过
+func (r *Route) pick(exclude map[int]bool) (int, *Backend) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	best, total := -1, 0
+	for i := range r.Backends {
+		if exclude[i] {
+			continue
+		}
+		b := &r.Backends[i]
+		b.current += b.Weight
+		total += b.Weight
+		if best < 0 || b.current > r.Backends[best].current {
+			best = i
+		}
+	}
+	if best < 0 {
+		return -1, nil
+	}
+	r.Backends[best].current -= total
+	return best, &r.Backends[best]
+}
+
+func (b *Backend) dial() (net.Conn, error) {
+	network, address := "tcp", b.Address
+	if rest, ok := strings.CutPrefix(address, "unix:"); ok {
+		network, address = "unix", rest
+	} else if strings.HasPrefix(address, "/") {
+		network = "unix"
+	}
+	return net.DialTimeout(network, address, 5*time.Second)
+}
+
+// 依次尝试路由中的后端, 直到有一个能连上
+func (r *Route) dial() (net.Conn, *Backend, error) {
+	failed := make(map[int]bool)
+	var lastErr error
+	for len(failed) < len(r.Backends) {
+		i, b := r.pick(failed)
+		conn, err := b.dial()
+		if err == nil {
+			return conn, b, nil
+		}
+		log.Printf("backend %s: %v", b.Address, err)
+		failed[i], lastErr = true, err
+	}
+	return nil, nil, lastErr
+}
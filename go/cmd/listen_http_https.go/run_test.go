@@ -0,0 +1,869 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/json"
+	"encoding/pem"
+	"fmt"
+	"io"
+	"math/big"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"code/pkg/certmgr"
+	"code/pkg/proxyproto"
+	"code/pkg/sniff"
+
+	"github.com/gorilla/websocket"
+	"golang.org/x/net/http2"
+)
+
+// 改为 splice 之前的实现, 每个方向 4MB 缓冲区, 作为基准对比
+func legacyProxyRequest(client, backend net.Conn) {
+	pipe := func(r, w net.Conn) {
+		defer r.Close()
+		defer w.Close()
+		buffer := make([]byte, 4096000)
+		for {
+			n, err := r.Read(buffer)
+			if err != nil {
+				break
+			}
+			if _, err = w.Write(buffer[:n]); err != nil {
+				break
+			}
+		}
+	}
+	go pipe(client, backend)
+	go pipe(backend, client)
+}
+
+var implementations = []struct {
+	name    string
+	forward func(client, backend net.Conn)
+}{
+	{"legacy", legacyProxyRequest},
+	{"splice", func(client, backend net.Conn) { go proxyRequest(client, backend) }},
+}
+
+// 建立 客户端 -tcp-> 转发 -unix-> 后端 的链路, 返回客户端和后端两头
+func forwardPair(tb testing.TB, tcpL, unixL net.Listener, forward func(client, backend net.Conn)) (net.Conn, net.Conn) {
+	client, err := net.Dial("tcp", tcpL.Addr().String())
+	if err != nil {
+		tb.Fatal(err)
+	}
+	proxied, err := tcpL.Accept()
+	if err != nil {
+		tb.Fatal(err)
+	}
+	backend, err := net.Dial("unix", unixL.Addr().String())
+	if err != nil {
+		tb.Fatal(err)
+	}
+	peer, err := unixL.Accept()
+	if err != nil {
+		tb.Fatal(err)
+	}
+	forward(proxied, backend)
+	return client, peer
+}
+
+func listeners(tb testing.TB) (net.Listener, net.Listener) {
+	tcpL, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		tb.Fatal(err)
+	}
+	unixL, err := net.Listen("unix", filepath.Join(tb.TempDir(), "backend.sock"))
+	if err != nil {
+		tb.Fatal(err)
+	}
+	tb.Cleanup(func() {
+		tcpL.Close()
+		unixL.Close()
+	})
+	return tcpL, unixL
+}
+
+func TestProxyRequestHalfClose(t *testing.T) {
+	tcpL, unixL := listeners(t)
+	client, peer := forwardPair(t, tcpL, unixL, implementations[1].forward)
+	defer client.Close()
+	defer peer.Close()
+	io.WriteString(client, "request")
+	client.(*net.TCPConn).CloseWrite()
+	got, err := io.ReadAll(peer)
+	if err != nil || string(got) != "request" {
+		t.Fatalf("backend read %q, %v", got, err)
+	}
+	// 客户端半关闭后仍然能收到后端的响应
+	io.WriteString(peer, "response")
+	peer.Close()
+	got, err = io.ReadAll(client)
+	if err != nil || string(got) != "response" {
+		t.Fatalf("client read %q, %v", got, err)
+	}
+}
+
+func newHubServer(t *testing.T, h *Hub) *httptest.Server {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/ws", h.serveWS)
+	mux.HandleFunc("/publish", h.servePublish)
+	srv := httptest.NewServer(mux)
+	t.Cleanup(srv.Close)
+	return srv
+}
+
+func dialHub(t *testing.T, srv *httptest.Server) *websocket.Conn {
+	c, _, err := websocket.DefaultDialer.Dial("ws"+strings.TrimPrefix(srv.URL, "http")+"/ws", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { c.Close() })
+	return c
+}
+
+func readMessage(t *testing.T, c *websocket.Conn) wsMessage {
+	c.SetReadDeadline(time.Now().Add(2 * time.Second))
+	var msg wsMessage
+	if err := c.ReadJSON(&msg); err != nil {
+		t.Fatal(err)
+	}
+	return msg
+}
+
+// 订阅是异步处理的, 等到 hub 中出现订阅者
+func waitSubscribers(t *testing.T, h *Hub, channel string, n int) {
+	for i := 0; i < 100; i++ {
+		h.mu.Lock()
+		got := len(h.channels[channel])
+		h.mu.Unlock()
+		if got == n {
+			return
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	t.Fatalf("channel %s: want %d subscribers", channel, n)
+}
+
+func TestHubFanOut(t *testing.T) {
+	h := newHub()
+	srv := newHubServer(t, h)
+	a, b, other := dialHub(t, srv), dialHub(t, srv), dialHub(t, srv)
+	a.WriteJSON(wsMessage{Type: "subscribe", Channel: "news"})
+	b.WriteJSON(wsMessage{Type: "subscribe", Channel: "news"})
+	other.WriteJSON(wsMessage{Type: "subscribe", Channel: "sport"})
+	waitSubscribers(t, h, "news", 2)
+	waitSubscribers(t, h, "sport", 1)
+
+	a.WriteJSON(wsMessage{Type: "publish", Channel: "news", Data: json.RawMessage(`{"n":1}`)})
+	for _, c := range []*websocket.Conn{a, b} {
+		msg := readMessage(t, c)
+		if msg.Type != "message" || msg.Channel != "news" || string(msg.Data) != `{"n":1}` {
+			t.Fatalf("unexpected message %+v", msg)
+		}
+	}
+
+	resp, err := http.Post(srv.URL+"/publish?channel=sport", "application/json", strings.NewReader(`[1,2]`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	var result map[string]int
+	json.NewDecoder(resp.Body).Decode(&result)
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusAccepted || result["delivered"] != 1 {
+		t.Fatalf("publish: %d %v", resp.StatusCode, result)
+	}
+	if msg := readMessage(t, other); string(msg.Data) != `[1,2]` {
+		t.Fatalf("unexpected message %+v", msg)
+	}
+
+	b.WriteJSON(wsMessage{Type: "unsubscribe", Channel: "news"})
+	waitSubscribers(t, h, "news", 1)
+}
+
+func TestHubErrors(t *testing.T) {
+	srv := newHubServer(t, newHub())
+	c := dialHub(t, srv)
+	c.WriteMessage(websocket.TextMessage, []byte("not json"))
+	if msg := readMessage(t, c); msg.Type != "error" {
+		t.Fatalf("want error, got %+v", msg)
+	}
+	c.WriteJSON(wsMessage{Type: "bogus", Channel: "x"})
+	if msg := readMessage(t, c); msg.Type != "error" {
+		t.Fatalf("want error, got %+v", msg)
+	}
+	resp, err := http.Post(srv.URL+"/publish?channel=x", "application/json", strings.NewReader("{"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusBadRequest {
+		t.Fatalf("invalid body: status %d", resp.StatusCode)
+	}
+}
+
+// 不读数据的客户端在队列满后被断开, 其它订阅者不受影响
+func TestHubSlowConsumer(t *testing.T) {
+	h := newHub()
+	h.QueueSize = 4
+	srv := newHubServer(t, h)
+	slow, fast := dialHub(t, srv), dialHub(t, srv)
+	slow.WriteJSON(wsMessage{Type: "subscribe", Channel: "flood"})
+	fast.WriteJSON(wsMessage{Type: "subscribe", Channel: "flood"})
+	waitSubscribers(t, h, "flood", 2)
+
+	// 一条消息足够大, 写不进 slow 的 socket 缓冲区, writePump 阻塞后队列很快会满
+	payload, _ := json.Marshal(strings.Repeat("x", 256<<10))
+	// 等 fast 读完一条再发下一条, fast 的队列不会满
+	for i := 0; i < 100; i++ {
+		h.publish("flood", payload)
+		fast.SetReadDeadline(time.Now().Add(2 * time.Second))
+		if _, _, err := fast.ReadMessage(); err != nil {
+			t.Fatalf("fast consumer received %d messages: %v", i, err)
+		}
+	}
+	waitSubscribers(t, h, "flood", 1)
+}
+
+func TestHubKeepalive(t *testing.T) {
+	h := newHub()
+	h.PingPeriod = 50 * time.Millisecond
+	srv := newHubServer(t, h)
+	c := dialHub(t, srv)
+	pings := make(chan struct{}, 10)
+	c.SetPingHandler(func(data string) error {
+		pings <- struct{}{}
+		return c.WriteControl(websocket.PongMessage, []byte(data), time.Now().Add(time.Second))
+	})
+	go c.ReadMessage()
+	for i := 0; i < 3; i++ {
+		select {
+		case <-pings:
+		case <-time.After(time.Second):
+			t.Fatal("no ping from server")
+		}
+	}
+	// 回复了 pong 的连接超过 pongWait 仍然保持
+	c.WriteJSON(wsMessage{Type: "subscribe", Channel: "alive"})
+	waitSubscribers(t, h, "alive", 1)
+}
+
+// 单连接吞吐, 客户端写 1MB 后端读 1MB 为一次操作
+func BenchmarkThroughput(b *testing.B) {
+	for _, impl := range implementations {
+		b.Run(impl.name, func(b *testing.B) {
+			tcpL, unixL := listeners(b)
+			client, peer := forwardPair(b, tcpL, unixL, impl.forward)
+			defer client.Close()
+			defer peer.Close()
+			chunk := make([]byte, 1<<20)
+			done := make(chan struct{})
+			go func() {
+				io.CopyN(io.Discard, peer, int64(b.N)*int64(len(chunk)))
+				close(done)
+			}()
+			b.SetBytes(int64(len(chunk)))
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				client.Write(chunk)
+			}
+			<-done
+		})
+	}
+}
+
+// 空闲连接的内存占用, 报告每个连接的堆内存
+func BenchmarkIdleConnections(b *testing.B) {
+	const conns = 200
+	for _, impl := range implementations {
+		b.Run(impl.name, func(b *testing.B) {
+			for i := 0; i < b.N; i++ {
+				tcpL, unixL := listeners(b)
+				var before, after runtime.MemStats
+				runtime.GC()
+				runtime.ReadMemStats(&before)
+				var open []net.Conn
+				for j := 0; j < conns; j++ {
+					client, peer := forwardPair(b, tcpL, unixL, impl.forward)
+					open = append(open, client, peer)
+				}
+				// 等转发的 goroutine 都进入读等待
+				time.Sleep(100 * time.Millisecond)
+				runtime.ReadMemStats(&after)
+				b.ReportMetric(float64(after.HeapAlloc-before.HeapAlloc)/conns, "B/conn")
+				for _, c := range open {
+					c.Close()
+				}
+			}
+		})
+	}
+}
+
+// 替换路由表, 测试结束后恢复
+func setRoutes(t *testing.T, table []*Route) {
+	t.Helper()
+	for i, r := range table {
+		if err := r.compile(); err != nil {
+			t.Fatalf("routes[%d]: %v", i, err)
+		}
+	}
+	old := routes.Load()
+	t.Cleanup(func() { routes.Store(old) })
+	routes.Store(&table)
+}
+
+func TestLoadConfig(t *testing.T) {
+	old, oldConfig := routes.Load(), config
+	t.Cleanup(func() {
+		routes.Store(old)
+		config = oldConfig
+	})
+	path := filepath.Join(t.TempDir(), "config.json")
+	write := func(s string) {
+		if err := os.WriteFile(path, []byte(s), 0600); err != nil {
+			t.Fatal(err)
+		}
+	}
+	write(`{"routes": [{"protocol": "tls", "sni": ["*.dev.local"], "backends": [{"address": "127.0.0.1:8443", "weight": 2}, {"address": "/tmp/b.sock"}]}]}`)
+	if err := loadConfig(path); err != nil {
+		t.Fatal(err)
+	}
+	table := *routes.Load()
+	if len(table) != 1 || table[0].Backends[0].Weight != 2 || table[0].Backends[1].Weight != 1 {
+		t.Fatalf("routes = %+v", table)
+	}
+	// 加载失败时保留原来的路由
+	for _, bad := range []string{
+		`{"routes": [{"protocol": "quic", "backends": [{"address": "a:1"}]}]}`,
+		`{"routes": [{"protocol": "tls"}]}`,
+		`{"routes": [{"backends": [{"address": "a:1", "weight": -1}]}]}`,
+		`{"routes": [{"backends": [{"address": "a:1", "proxy_protocol": 3}]}]}`,
+		`{"routes": `,
+	} {
+		write(bad)
+		if err := loadConfig(path); err == nil {
+			t.Errorf("%s: no error", bad)
+		}
+		if got := *routes.Load(); len(got) != 1 || got[0] != table[0] {
+			t.Errorf("%s: routes replaced", bad)
+		}
+	}
+	// 没有路由时使用默认路由
+	write(`{}`)
+	if err := loadConfig(path); err != nil {
+		t.Fatal(err)
+	}
+	if got := *routes.Load(); len(got) != len(defaultRoutes()) {
+		t.Errorf("default routes = %d", len(got))
+	}
+}
+
+func TestFindRoute(t *testing.T) {
+	table := []*Route{
+		{Protocol: "tls", SNI: []string{"*.dev.local"}, ALPN: []string{"h2"}},
+		{Protocol: "tls", SNI: []string{"*.dev.local"}},
+		{Protocol: "http1", Host: []string{"api.local"}},
+		{Protocol: "ssh"},
+		{Protocol: "http1"},
+	}
+	for i, r := range table {
+		r.Backends = []Backend{{Address: fmt.Sprintf("backend%d:1", i)}}
+	}
+	setRoutes(t, table)
+	tests := []struct {
+		info connInfo
+		want int // -1 表示没有命中
+	}{
+		{connInfo{protocol: "tls", sni: "a.dev.local", alpn: []string{"http/1.1", "h2"}}, 0},
+		{connInfo{protocol: "tls", sni: "a.dev.local", alpn: []string{"http/1.1"}}, 1},
+		{connInfo{protocol: "tls", sni: "A.DEV.local."}, 1},
+		{connInfo{protocol: "tls", sni: "dev.local"}, -1},
+		{connInfo{protocol: "tls"}, -1},
+		{connInfo{protocol: "http1", host: "api.local"}, 2},
+		{connInfo{protocol: "http1", host: "www.local"}, 4},
+		{connInfo{protocol: "ssh"}, 3},
+		{connInfo{protocol: "any"}, -1},
+	}
+	for _, tt := range tests {
+		got := findRoute(tt.info)
+		if (tt.want < 0 && got != nil) || (tt.want >= 0 && got != table[tt.want]) {
+			t.Errorf("findRoute(%+v) = %v, want routes[%d]", tt.info, got, tt.want)
+		}
+	}
+}
+
+// 平滑加权轮询: 权重 5,1,1 的序列与 nginx 相同, 失败的后端被跳过
+func TestRoutePick(t *testing.T) {
+	r := &Route{Backends: []Backend{{Address: "a", Weight: 5}, {Address: "b", Weight: 1}, {Address: "c", Weight: 1}}}
+	var seq string
+	for i := 0; i < 14; i++ {
+		_, b := r.pick(nil)
+		seq += b.Address
+	}
+	if seq != "aabacaaaabacaa" {
+		t.Errorf("sequence = %s", seq)
+	}
+	counts := map[string]int{}
+	for i := 0; i < 60; i++ {
+		_, b := r.pick(map[int]bool{0: true})
+		counts[b.Address]++
+	}
+	if counts["a"] != 0 || counts["b"] != 30 || counts["c"] != 30 {
+		t.Errorf("excluding a: %v", counts)
+	}
+	if i, b := r.pick(map[int]bool{0: true, 1: true, 2: true}); i != -1 || b != nil {
+		t.Errorf("all excluded: %d %v", i, b)
+	}
+}
+
+// 后端 http 服务, 响应中带上服务名和看到的客户端地址
+func newBackend(t *testing.T, name string, proxyProtocol bool) *httptest.Server {
+	t.Helper()
+	srv := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprintf(w, "%s %s", name, r.RemoteAddr)
+	}))
+	if proxyProtocol {
+		srv.Listener = proxyproto.NewListener(srv.Listener)
+	}
+	srv.Start()
+	t.Cleanup(srv.Close)
+	return srv
+}
+
+// 在随机端口上运行与 main 相同的嗅探和转发
+func startRouter(t *testing.T) string {
+	t.Helper()
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	mux := sniff.NewMux(l)
+	go forward(mux.Match(sniff.HTTP1(), sniff.HTTP2(), sniff.TLS(), sniff.SSH(), sniff.ProxyProtocol(), sniff.Any()))
+	go mux.Serve()
+	t.Cleanup(func() { mux.Close() })
+	return l.Addr().String()
+}
+
+func TestRouteForward(t *testing.T) {
+	api := newBackend(t, "api", true)
+	web1 := newBackend(t, "web1", false)
+	web2 := newBackend(t, "web2", false)
+	dead, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	dead.Close()
+	setRoutes(t, []*Route{
+		{Protocol: "http1", Host: []string{"api.local"}, Backends: []Backend{{Address: api.Listener.Addr().String(), ProxyProtocol: 2}}},
+		{Protocol: "http1", Backends: []Backend{
+			{Address: dead.Addr().String(), Weight: 10},
+			{Address: web1.Listener.Addr().String()},
+			{Address: web2.Listener.Addr().String()},
+		}},
+	})
+	addr := startRouter(t)
+
+	// 返回响应的后端, 以及后端看到的是否是客户端的真实地址
+	get := func(host string) (string, bool) {
+		c, err := net.Dial("tcp", addr)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer c.Close()
+		req, _ := http.NewRequest("GET", "http://"+host+"/", nil)
+		req.Close = true
+		if err := req.Write(c); err != nil {
+			t.Fatal(err)
+		}
+		c.SetReadDeadline(time.Now().Add(5 * time.Second))
+		resp, err := http.ReadResponse(bufio.NewReader(c), req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer resp.Body.Close()
+		body, _ := io.ReadAll(resp.Body)
+		name, remote, _ := strings.Cut(string(body), " ")
+		return name, remote == c.LocalAddr().String()
+	}
+	// PROXY protocol 把真实的客户端地址传给后端
+	if name, real := get("api.local"); name != "api" || !real {
+		t.Errorf("api.local: %s real=%v", name, real)
+	}
+	// 连不上的后端被跳过, 其余后端按权重轮流
+	counts := map[string]int{}
+	for i := 0; i < 4; i++ {
+		name, _ := get("www.local")
+		counts[name]++
+	}
+	if counts["web1"] != 2 || counts["web2"] != 2 {
+		t.Errorf("balance: %v", counts)
+	}
+
+	// 没有路由的连接直接关闭
+	c, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	io.WriteString(c, "SSH-2.0-test\r\n")
+	c.SetReadDeadline(time.Now().Add(5 * time.Second))
+	if n, err := c.Read(make([]byte, 1)); err == nil {
+		t.Errorf("unrouted connection read %d bytes", n)
+	}
+}
+
+// 测试用 CA, 签发客户端证书
+type testCA struct {
+	cert *x509.Certificate
+	key  *ecdsa.PrivateKey
+	file string // PEM 文件
+}
+
+func newTestCA(t *testing.T, name string) *testCA {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tmpl := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: name},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		IsCA:                  true,
+		BasicConstraintsValid: true,
+		KeyUsage:              x509.KeyUsageCertSign,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cert, _ := x509.ParseCertificate(der)
+	file := filepath.Join(t.TempDir(), "ca.pem")
+	if err := os.WriteFile(file, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), 0600); err != nil {
+		t.Fatal(err)
+	}
+	return &testCA{cert: cert, key: key, file: file}
+}
+
+// 签发客户端证书, sans 中含 @ 的为邮箱, 含 :// 的为 URI, 其余为 DNS
+func (ca *testCA) client(t *testing.T, cn string, sans ...string) tls.Certificate {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tmpl := &x509.Certificate{
+		SerialNumber: big.NewInt(time.Now().UnixNano()),
+		Subject:      pkix.Name{CommonName: cn, Organization: []string{"test"}},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth},
+	}
+	for _, s := range sans {
+		switch {
+		case strings.Contains(s, "://"):
+			u, _ := url.Parse(s)
+			tmpl.URIs = append(tmpl.URIs, u)
+		case strings.Contains(s, "@"):
+			tmpl.EmailAddresses = append(tmpl.EmailAddresses, s)
+		default:
+			tmpl.DNSNames = append(tmpl.DNSNames, s)
+		}
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, ca.cert, &key.PublicKey, ca.key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return tls.Certificate{Certificate: [][]byte{der}, PrivateKey: key}
+}
+
+func TestConfigureClientAuth(t *testing.T) {
+	ca := newTestCA(t, "clients")
+	empty := filepath.Join(t.TempDir(), "empty.pem")
+	os.WriteFile(empty, []byte("not a certificate"), 0600)
+	tests := []struct {
+		c    TLSConfig
+		mode tls.ClientAuthType
+		ok   bool
+	}{
+		{TLSConfig{}, tls.NoClientCert, true},
+		{TLSConfig{ClientAuth: ClientAuthVerifyIfGiven, ClientCA: ca.file}, tls.VerifyClientCertIfGiven, true},
+		{TLSConfig{ClientAuth: ClientAuthRequire, ClientCA: ca.file}, tls.RequireAndVerifyClientCert, true},
+		{TLSConfig{ClientAuth: "optional", ClientCA: ca.file}, 0, false},
+		{TLSConfig{ClientAuth: ClientAuthRequire, ClientCA: empty}, 0, false},
+		{TLSConfig{ClientAuth: ClientAuthRequire, ClientCA: empty + ".missing"}, 0, false},
+	}
+	for _, tt := range tests {
+		var tc tls.Config
+		err := configureClientAuth(&tc, tt.c)
+		if (err == nil) != tt.ok {
+			t.Errorf("%+v: err = %v", tt.c, err)
+			continue
+		}
+		if err == nil && (tc.ClientAuth != tt.mode || (tt.mode != tls.NoClientCert && tc.ClientCAs == nil)) {
+			t.Errorf("%+v: mode = %v", tt.c, tc.ClientAuth)
+		}
+	}
+}
+
+func TestClientPolicy(t *testing.T) {
+	tests := []struct {
+		policy ClientPolicy
+		id     *ClientIdentity
+		want   bool
+	}{
+		{ClientPolicy{Subjects: []string{"*"}}, nil, false},
+		{ClientPolicy{Subjects: []string{"*"}}, &ClientIdentity{CN: "a"}, true},
+		{ClientPolicy{Subjects: []string{"alice"}}, &ClientIdentity{CN: "alice"}, true},
+		{ClientPolicy{Subjects: []string{"CN=alice,O=test"}}, &ClientIdentity{Subject: "CN=alice,O=test", CN: "alice"}, true},
+		{ClientPolicy{Subjects: []string{"alice"}}, &ClientIdentity{CN: "bob"}, false},
+		{ClientPolicy{SANs: []string{"*.svc.local"}}, &ClientIdentity{SANs: []string{"api.svc.local"}}, true},
+		{ClientPolicy{SANs: []string{"*.svc.local"}}, &ClientIdentity{SANs: []string{"a.b.svc.local"}}, false},
+		{ClientPolicy{SANs: []string{"ops@example.com"}}, &ClientIdentity{SANs: []string{"ops@example.com"}}, true},
+		{ClientPolicy{SANs: []string{"spiffe://example.org/api"}}, &ClientIdentity{SANs: []string{"spiffe://example.org/api"}}, true},
+		{ClientPolicy{SANs: []string{"*"}}, &ClientIdentity{}, true},
+		{ClientPolicy{}, &ClientIdentity{CN: "alice"}, false},
+	}
+	for _, tt := range tests {
+		if got := tt.policy.allow(tt.id); got != tt.want {
+			t.Errorf("%+v allow %+v = %v, want %v", tt.policy, tt.id, got, tt.want)
+		}
+	}
+}
+
+// 经过 TLS 握手的完整处理链: 校验客户端证书, 取出身份, 按路径执行策略
+func TestMTLS(t *testing.T) {
+	ca := newTestCA(t, "clients")
+	other := newTestCA(t, "other")
+	policies := []ClientPolicy{
+		{Path: "/admin", Subjects: []string{"alice"}},
+		{Path: "/api", SANs: []string{"*.svc.local"}},
+	}
+	mux := http.NewServeMux()
+	mux.HandleFunc("/", func(w http.ResponseWriter, r *http.Request) {
+		io.WriteString(w, clientIdentity(r.Context()).String())
+	})
+	newServer := func(mode string) *httptest.Server {
+		srv := httptest.NewUnstartedServer(withClientIdentity(authorizeClients(policies, mux)))
+		srv.TLS = &tls.Config{}
+		if err := configureClientAuth(srv.TLS, TLSConfig{ClientAuth: mode, ClientCA: ca.file}); err != nil {
+			t.Fatal(err)
+		}
+		srv.StartTLS()
+		t.Cleanup(srv.Close)
+		return srv
+	}
+	get := func(srv *httptest.Server, path string, cert *tls.Certificate) (int, string) {
+		tr := srv.Client().Transport.(*http.Transport).Clone()
+		if cert != nil {
+			tr.TLSClientConfig.Certificates = []tls.Certificate{*cert}
+		}
+		defer tr.CloseIdleConnections()
+		resp, err := (&http.Client{Transport: tr}).Get(srv.URL + path)
+		if err != nil {
+			return 0, ""
+		}
+		defer resp.Body.Close()
+		body, _ := io.ReadAll(resp.Body)
+		return resp.StatusCode, string(body)
+	}
+
+	alice := ca.client(t, "alice")
+	api := ca.client(t, "api", "api.svc.local")
+	mallory := other.client(t, "alice")
+	optional := newServer(ClientAuthVerifyIfGiven)
+	tests := []struct {
+		path   string
+		cert   *tls.Certificate
+		status int
+		body   string
+	}{
+		{"/public", nil, 200, "-"},
+		{"/public", &alice, 200, "alice"},
+		{"/admin", nil, 403, ""},
+		{"/admin", &alice, 200, "alice"},
+		{"/admin/users", &api, 403, ""},
+		{"/api/v1", &api, 200, "api"},
+		{"/api/v1", &alice, 403, ""},
+		// 其它 CA 签发的证书不会被当作身份
+		{"/public", &mallory, 200, "-"},
+		{"/admin", &mallory, 403, ""},
+	}
+	for _, tt := range tests {
+		status, body := get(optional, tt.path, tt.cert)
+		if status != tt.status || (status == 200 && body != tt.body) {
+			t.Errorf("%s with %v: %d %q, want %d %q", tt.path, tt.cert != nil, status, body, tt.status, tt.body)
+		}
+	}
+
+	required := newServer(ClientAuthRequire)
+	for _, cert := range []*tls.Certificate{nil, &mallory} {
+		if status, _ := get(required, "/public", cert); status != 0 {
+			t.Errorf("require without trusted certificate: %d", status)
+		}
+	}
+	if status, body := get(required, "/public", &alice); status != 200 || body != "alice" {
+		t.Errorf("require with certificate: %d %q", status, body)
+	}
+}
+
+var registerOnce sync.Once
+
+// 与 main 相同的路由: 明文 HTTP/1 和 h2c 交给 http 服务, 其余交给 https 服务, 后端都在 unix socket 上
+func startServers(t *testing.T) string {
+	t.Helper()
+	registerOnce.Do(registerHandlers)
+	dir := t.TempDir()
+	httpL, err := net.Listen("unix", filepath.Join(dir, "http.sock"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	httpsL, err := net.Listen("unix", filepath.Join(dir, "https.sock"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	httpServer := newHTTPServer()
+	go httpServer.Serve(proxyproto.NewListener(httpL))
+	t.Cleanup(func() { httpServer.Close() })
+
+	cert, err := tls.X509KeyPair([]byte(CERT), []byte(KEY))
+	if err != nil {
+		t.Fatal(err)
+	}
+	certs, err := certmgr.New("")
+	if err != nil {
+		t.Fatal(err)
+	}
+	certs.Fallback = &cert
+	tlsConfig, err := newTLSConfig(certs, TLSConfig{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	httpsServer := &http.Server{Handler: handler()}
+	go httpsServer.Serve(tls.NewListener(proxyproto.NewListener(httpsL), tlsConfig))
+	t.Cleanup(func() { httpsServer.Close() })
+
+	setRoutes(t, []*Route{
+		{Protocol: "http1", Backends: []Backend{{Address: "unix:" + httpL.Addr().String(), ProxyProtocol: 2}}},
+		{Protocol: "http2", Backends: []Backend{{Address: "unix:" + httpL.Addr().String(), ProxyProtocol: 2}}},
+		{Backends: []Backend{{Address: "unix:" + httpsL.Addr().String(), ProxyProtocol: 2}}},
+	})
+	return startRouter(t)
+}
+
+// /chunked 在各种协议下的响应都一样
+func checkChunked(t *testing.T, name string, resp *http.Response, err error, proto string) {
+	t.Helper()
+	if err != nil {
+		t.Errorf("%s: %v", name, err)
+		return
+	}
+	defer resp.Body.Close()
+	body, err := io.ReadAll(resp.Body)
+	if err != nil || resp.StatusCode != 200 || resp.Proto != proto || len(body) != 1024 || strings.Trim(string(body), "\xff") != "" {
+		t.Errorf("%s: %s %d, %d bytes, %v", name, resp.Proto, resp.StatusCode, len(body), err)
+	}
+}
+
+func TestHTTP2(t *testing.T) {
+	addr := startServers(t)
+	plainURL, tlsURL := "http://"+addr+"/chunked", "https://"+addr+"/chunked"
+	tlsClient := &tls.Config{InsecureSkipVerify: true, ServerName: "localhost"}
+
+	h1 := &http.Transport{}
+	defer h1.CloseIdleConnections()
+	resp, err := (&http.Client{Transport: h1}).Get(plainURL)
+	checkChunked(t, "http/1.1", resp, err, "HTTP/1.1")
+
+	// h2c prior knowledge: 连接以 HTTP/2 前言开头
+	h2c := &http2.Transport{
+		AllowHTTP: true,
+		DialTLSContext: func(ctx context.Context, network, addr string, _ *tls.Config) (net.Conn, error) {
+			var d net.Dialer
+			return d.DialContext(ctx, network, addr)
+		},
+	}
+	defer h2c.CloseIdleConnections()
+	resp, err = (&http.Client{Transport: h2c}).Get(plainURL)
+	checkChunked(t, "h2c prior knowledge", resp, err, "HTTP/2.0")
+
+	h1tls := &http.Transport{TLSClientConfig: tlsClient}
+	defer h1tls.CloseIdleConnections()
+	resp, err = (&http.Client{Transport: h1tls}).Get(tlsURL)
+	checkChunked(t, "https http/1.1", resp, err, "HTTP/1.1")
+
+	// ALPN 协商出 h2
+	h2 := &http2.Transport{TLSClientConfig: tlsClient}
+	defer h2.CloseIdleConnections()
+	resp, err = (&http.Client{Transport: h2}).Get(tlsURL)
+	checkChunked(t, "https h2", resp, err, "HTTP/2.0")
+}
+
+// Upgrade: h2c, 服务端回 101 后在同一连接上用 HTTP/2 的 stream 1 返回响应
+func TestH2CUpgrade(t *testing.T) {
+	addr := startServers(t)
+	c, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	c.SetDeadline(time.Now().Add(5 * time.Second))
+	io.WriteString(c, "GET /chunked HTTP/1.1\r\nHost: localhost\r\nConnection: Upgrade, HTTP2-Settings\r\nUpgrade: h2c\r\nHTTP2-Settings: \r\n\r\n")
+	br := bufio.NewReader(c)
+	resp, err := http.ReadResponse(br, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if resp.StatusCode != http.StatusSwitchingProtocols || resp.Header.Get("Upgrade") != "h2c" {
+		t.Fatalf("upgrade response: %s %v", resp.Status, resp.Header)
+	}
+	io.WriteString(c, http2.ClientPreface)
+	framer := http2.NewFramer(c, br)
+	if err := framer.WriteSettings(); err != nil {
+		t.Fatal(err)
+	}
+	var body []byte
+	headers := false
+	for {
+		f, err := framer.ReadFrame()
+		if err != nil {
+			t.Fatal(err)
+		}
+		switch f := f.(type) {
+		case *http2.SettingsFrame:
+			if !f.IsAck() {
+				framer.WriteSettingsAck()
+			}
+		case *http2.HeadersFrame:
+			headers = headers || f.StreamID == 1
+		case *http2.DataFrame:
+			if f.StreamID == 1 {
+				body = append(body, f.Data()...)
+				if f.StreamEnded() {
+					if !headers || len(body) != 1024 {
+						t.Errorf("stream 1: headers=%v, %d bytes", headers, len(body))
+					}
+					return
+				}
+			}
+		}
+	}
+}
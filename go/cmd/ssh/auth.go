@@ -0,0 +1,128 @@
+package main
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+
+	"golang.org/x/crypto/ssh"
+	"golang.org/x/crypto/ssh/agent"
+	"golang.org/x/term"
+)
+
+// 终端交互, 测试中替换
+var (
+	interactive = func() bool {
+		return term.IsTerminal(int(os.Stdin.Fd()))
+	}
+	promptLine = func(prompt string) (string, error) {
+		fmt.Fprint(os.Stderr, prompt)
+		line, err := bufio.NewReader(os.Stdin).ReadString('\n')
+		if err != nil && line == "" {
+			return "", err
+		}
+		return strings.TrimRight(line, "\r\n"), nil
+	}
+	promptPassword = func(prompt string) (string, error) {
+		fmt.Fprint(os.Stderr, prompt)
+		b, err := term.ReadPassword(int(os.Stdin.Fd()))
+		fmt.Fprintln(os.Stderr)
+		return string(b), err
+	}
+	logf = log.Printf
+
+	// 终端同一时间只问一个问题, pssh 并行连接多台主机时提示和输入不会交错
+	promptMu sync.Mutex
+)
+
+// 没有配置 IdentityFile 时按 ssh 的顺序尝试这些私钥
+var defaultIdentityFiles = []string{"~/.ssh/id_ed25519", "~/.ssh/id_ecdsa", "~/.ssh/id_rsa"}
+
+// 认证方式: ssh-agent 和私钥文件中的密钥一起作为 publickey 尝试, 然后是密码,
+// 都没有配置密码时在终端上询问
+func authMethods(user, host string, identityFiles []string, explicit bool, passphrase, password string) ([]ssh.AuthMethod, func()) {
+	var signers []ssh.Signer
+	cleanup := func() {}
+	if sock := os.Getenv("SSH_AUTH_SOCK"); sock != "" {
+		if conn, err := net.Dial("unix", sock); err != nil {
+			logf("ssh-agent %s: %v", sock, err)
+		} else {
+			cleanup = func() { conn.Close() }
+			if s, err := agent.NewClient(conn).Signers(); err != nil {
+				logf("ssh-agent %s: %v", sock, err)
+			} else {
+				signers = append(signers, s...)
+			}
+		}
+	}
+	for _, file := range identityFiles {
+		s, err := loadIdentity(file, passphrase)
+		if err != nil {
+			// 默认的私钥文件不存在时不提示
+			if explicit || !errors.Is(err, os.ErrNotExist) {
+				logf("identity %s: %v", file, err)
+			}
+			continue
+		}
+		signers = append(signers, s)
+	}
+
+	var methods []ssh.AuthMethod
+	if len(signers) > 0 {
+		methods = append(methods, ssh.PublicKeys(signers...))
+	}
+	if password != "" {
+		methods = append(methods, ssh.Password(password))
+	} else if interactive() {
+		methods = append(methods, ssh.RetryableAuthMethod(ssh.PasswordCallback(func() (string, error) {
+			promptMu.Lock()
+			defer promptMu.Unlock()
+			return promptPassword(fmt.Sprintf("%s@%s's password: ", user, host))
+		}), 3))
+	}
+	return methods, cleanup
+}
+
+// 读取私钥, 加密的私钥用配置的口令解开, 没有配置时在终端上询问
+func loadIdentity(file, passphrase string) (ssh.Signer, error) {
+	pem, err := os.ReadFile(file)
+	if err != nil {
+		return nil, err
+	}
+	signer, err := ssh.ParsePrivateKey(pem)
+	var missing *ssh.PassphraseMissingError
+	if !errors.As(err, &missing) {
+		return signer, err
+	}
+	if passphrase == "" {
+		if !interactive() {
+			return nil, errors.New("key is encrypted and no passphrase is configured")
+		}
+		promptMu.Lock()
+		passphrase, err = promptPassword(fmt.Sprintf("Enter passphrase for key '%s': ", file))
+		promptMu.Unlock()
+		if err != nil {
+			return nil, err
+		}
+	}
+	return ssh.ParsePrivateKeyWithPassphrase(pem, []byte(passphrase))
+}
+
+// 展开私钥路径, 没有配置时用默认的私钥文件
+func identityFiles(files []string, host, user string, port int) ([]string, bool) {
+	explicit := len(files) > 0
+	if !explicit {
+		files = defaultIdentityFiles
+	}
+	out := make([]string, 0, len(files))
+	for _, f := range files {
+		out = append(out, filepath.Clean(expandPath(f, host, user, port)))
+	}
+	return out, explicit
+}
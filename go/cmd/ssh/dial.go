@@ -0,0 +1,260 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"net"
+	"os/user"
+	"path/filepath"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+
+	"golang.org/x/crypto/ssh"
+)
+
+// 连接一台主机所需的配置, 没有填写的项从 ~/.ssh/config 中取
+type sshTarget struct {
+	Host          string      `json:"host"` // [user@]host[:port] 或 ~/.ssh/config 中的 Host 别名
+	User          string      `json:"user"`
+	Port          int         `json:"port"`
+	Password      string      `json:"password"`
+	IdentityFiles []string    `json:"identity_files"` // 私钥文件, 默认 ~/.ssh/id_ed25519 等
+	Passphrase    string      `json:"passphrase"`     // 加密私钥的口令, 为空时在终端上询问
+	HostKey       string      `json:"host_key"`       // strict, ask, accept-new, off, 默认取 StrictHostKeyChecking, 都没有时为 ask
+	KnownHosts    []string    `json:"known_hosts"`    // 默认 ~/.ssh/known_hosts
+	SSHConfig     string      `json:"ssh_config"`     // 默认 ~/.ssh/config, "none" 表示不读取
+	ProxyJump     string      `json:"proxy_jump"`     // 跳板机, 与 ssh -J 相同: [user@]host[:port],..., "none" 表示不用 ssh_config 中的 ProxyJump
+	Jump          []sshTarget `json:"jump"`           // 跳板机列表, 每一跳单独配置认证和主机密钥策略, 优先于 proxy_jump
+}
+
+// 最多经过的跳板机数
+const maxJumps = 8
+
+// 拆出 user@host:port, 端口可以省略, IPv6 地址需要方括号, 可以带 ssh:// 前缀
+func splitTarget(s string) (user, host string, port int) {
+	s = strings.TrimSuffix(strings.TrimPrefix(s, "ssh://"), "/")
+	if i := strings.LastIndex(s, "@"); i >= 0 {
+		user, s = s[:i], s[i+1:]
+	}
+	if h, p, err := net.SplitHostPort(s); err == nil {
+		if n, err := strconv.Atoi(p); err == nil {
+			return user, h, n
+		}
+	}
+	return user, strings.Trim(s, "[]"), 0
+}
+
+// ~/.ssh/config 中别名对应的配置
+func (t sshTarget) hostConfig(alias string) (hostConfig, error) {
+	if t.SSHConfig == "none" {
+		return hostConfig{HostName: alias}, nil
+	}
+	file := t.SSHConfig
+	if file == "" {
+		file = filepath.Join(homeDir(), ".ssh", "config")
+	}
+	c, err := loadSSHConfig(expandHome(file))
+	if err != nil {
+		return hostConfig{}, err
+	}
+	return c.lookup(alias), nil
+}
+
+// 合并命令行/JSON 配置和 ~/.ssh/config, 显式配置优先
+func (t sshTarget) clientConfig() (string, *ssh.ClientConfig, func(), error) {
+	userName, alias, port := splitTarget(t.Host)
+	if alias == "" {
+		return "", nil, nil, fmt.Errorf("ssh: missing host")
+	}
+	hc, err := t.hostConfig(alias)
+	if err != nil {
+		return "", nil, nil, err
+	}
+	if t.User != "" {
+		userName = t.User
+	}
+	if userName == "" {
+		userName = hc.User
+	}
+	if userName == "" {
+		if u, err := user.Current(); err == nil {
+			userName = u.Username
+		}
+	}
+	if t.Port != 0 {
+		port = t.Port
+	}
+	if port == 0 {
+		port = hc.Port
+	}
+	if port == 0 {
+		port = 22
+	}
+	addr := net.JoinHostPort(hc.HostName, strconv.Itoa(port))
+
+	policyName := t.HostKey
+	if policyName == "" {
+		policyName = hc.StrictHostKeyChecking
+	}
+	policy, err := hostKeyPolicy(policyName)
+	if err != nil {
+		return "", nil, nil, err
+	}
+	knownFiles := t.KnownHosts
+	if len(knownFiles) == 0 {
+		knownFiles = hc.UserKnownHostsFile
+	}
+	knownFiles = append([]string(nil), knownFiles...)
+	for i, f := range knownFiles {
+		knownFiles[i] = expandPath(f, hc.HostName, userName, port)
+	}
+	known, err := newKnownHosts(policy, knownFiles)
+	if err != nil {
+		return "", nil, nil, err
+	}
+
+	files := t.IdentityFiles
+	if len(files) == 0 {
+		files = hc.IdentityFiles
+	}
+	files, explicit := identityFiles(files, hc.HostName, userName, port)
+	auth, cleanup := authMethods(userName, hc.HostName, files, explicit, t.Passphrase, t.Password)
+	return addr, &ssh.ClientConfig{
+		User:              userName,
+		Auth:              auth,
+		HostKeyCallback:   known.callback,
+		HostKeyAlgorithms: known.algorithms(addr),
+		Timeout:           10 * time.Second,
+	}, cleanup, nil
+}
+
+// 直接连接的跳板机, 没有时为空
+func (t sshTarget) jumps() ([]sshTarget, error) {
+	if len(t.Jump) > 0 {
+		return t.Jump, nil
+	}
+	spec := t.ProxyJump
+	if spec == "" {
+		_, alias, _ := splitTarget(t.Host)
+		hc, err := t.hostConfig(alias)
+		if err != nil {
+			return nil, err
+		}
+		spec = hc.ProxyJump
+	}
+	if spec == "" || spec == "none" {
+		return nil, nil
+	}
+	// 经 ProxyJump 指定的跳板机使用各自在 ssh_config 中的配置
+	var hops []sshTarget
+	for _, host := range strings.Split(spec, ",") {
+		if host = strings.TrimSpace(host); host == "" {
+			return nil, fmt.Errorf("ssh: bad ProxyJump %q", spec)
+		}
+		hops = append(hops, sshTarget{Host: host, SSHConfig: t.SSHConfig, KnownHosts: t.KnownHosts})
+	}
+	return hops, nil
+}
+
+// 展开成依次连接的主机列表, 最后一个是目标本身;
+// 与 ssh 一样, 第一跳自己的跳板机也会展开, 后面的各跳经前一跳连接
+func (t sshTarget) chain() ([]sshTarget, error) {
+	var chain []sshTarget
+	for {
+		hops, err := t.jumps()
+		if err != nil {
+			return nil, err
+		}
+		chain = append(chain, t)
+		if len(hops) == 0 {
+			break
+		}
+		for i := len(hops) - 1; i > 0; i-- {
+			hop := hops[i]
+			hop.ProxyJump, hop.Jump = "none", nil
+			chain = append(chain, hop)
+		}
+		if len(chain) > maxJumps+1 {
+			return nil, fmt.Errorf("ssh: more than %d jump hosts", maxJumps)
+		}
+		t = hops[0]
+	}
+	slices.Reverse(chain)
+	return chain, nil
+}
+
+// 按配置建立 SSH 连接, 有跳板机时每一跳都经前一跳的连接建立,
+// 返回的连接关闭时跳板机的连接随之关闭
+func dialSSH(t sshTarget) (*ssh.Client, error) {
+	chain, err := t.chain()
+	if err != nil {
+		return nil, err
+	}
+	var clients []*ssh.Client
+	closeAll := func() {
+		for i := len(clients) - 1; i >= 0; i-- {
+			clients[i].Close()
+		}
+	}
+	for _, hop := range chain {
+		var via *ssh.Client
+		if len(clients) > 0 {
+			via = clients[len(clients)-1]
+		}
+		client, err := dialHop(via, hop)
+		if err != nil {
+			closeAll()
+			if len(chain) > 1 {
+				err = fmt.Errorf("ssh %s: %w", hop.Host, err)
+			}
+			return nil, err
+		}
+		clients = append(clients, client)
+	}
+	client := clients[len(clients)-1]
+	if len(clients) > 1 {
+		go func() {
+			client.Wait()
+			closeAll()
+		}()
+	}
+	return client, nil
+}
+
+// via 为空时直接连接
+func dialHop(via *ssh.Client, t sshTarget) (*ssh.Client, error) {
+	addr, config, cleanup, err := t.clientConfig()
+	if err != nil {
+		return nil, err
+	}
+	defer cleanup()
+	if via == nil {
+		return ssh.Dial("tcp", addr, config)
+	}
+	conn, err := via.Dial("tcp", addr)
+	if err != nil {
+		return nil, err
+	}
+	c, chans, reqs, err := ssh.NewClientConn(conn, addr, config)
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+	return ssh.NewClient(c, chans, reqs), nil
+}
+
+// 子命令共用的连接参数
+func targetFlags(fs *flag.FlagSet, t *sshTarget) {
+	fs.StringVar(&t.Host, "host", t.Host, "[user@]host[:port] or a Host alias from ~/.ssh/config")
+	fs.IntVar(&t.Port, "p", t.Port, "port, overrides ~/.ssh/config")
+	fs.StringVar(&t.Password, "password", t.Password, "password, prompted on the terminal when empty and keys fail")
+	fs.Func("i", "identity file, may be repeated", func(s string) error {
+		t.IdentityFiles = append(t.IdentityFiles, s)
+		return nil
+	})
+	fs.StringVar(&t.HostKey, "host-key", t.HostKey, "host key policy: strict, ask, accept-new or off")
+	fs.StringVar(&t.ProxyJump, "J", t.ProxyJump, "jump hosts, [user@]host[:port],...")
+	fs.StringVar(&t.SSHConfig, "F", t.SSHConfig, `ssh config file, "none" to skip (default ~/.ssh/config)`)
+}
@@ -0,0 +1,537 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"os"
+	"os/signal"
+	"sort"
+	"strings"
+	"syscall"
+	"text/tabwriter"
+	"time"
+
+	"github.com/docker/docker/api/types/container"
+	"github.com/docker/docker/api/types/image"
+	"github.com/docker/docker/errdefs"
+	"github.com/docker/docker/pkg/jsonmessage"
+	"github.com/docker/docker/pkg/stdcopy"
+	"github.com/docker/go-connections/nat"
+	"github.com/moby/moby/client"
+	"golang.org/x/crypto/ssh"
+	"golang.org/x/term"
+)
+
+// 远程 docker 命令, 经 SSH 连接到远程的 docker.sock:
+//
+//	docker -H ssh://root@10.0.0.1 ps -a
+//	docker -H ssh://root@10.0.0.1 run -d --name web -e K=V -p 8080:80 -v /data:/data nginx
+//	docker -H ssh://root@10.0.0.1 logs -f web
+//	docker -H ssh://root@10.0.0.1 exec -it web bash
+//
+// 不带 -H 时取 DOCKER_HOST
+var dockerCommands = map[string]func(ctx context.Context, d *dockerCLI, args []string) error{
+	"ps":      dockerPs,
+	"run":     dockerRun,
+	"stop":    dockerStop,
+	"rm":      dockerRm,
+	"logs":    dockerLogs,
+	"exec":    dockerExec,
+	"pull":    dockerPull,
+	"inspect": dockerInspect,
+}
+
+// 命令执行完成但退出码不为 0
+type exitError int
+
+func (e exitError) Error() string {
+	return fmt.Sprintf("exit status %d", int(e))
+}
+
+type dockerCLI struct {
+	api    *client.Client
+	stdin  io.Reader
+	stdout io.Writer
+	stderr io.Writer
+}
+
+// 可重复的参数, 如 -e -p -v
+type stringList []string
+
+func (l *stringList) String() string {
+	return strings.Join(*l, ",")
+}
+
+func (l *stringList) Set(s string) error {
+	*l = append(*l, s)
+	return nil
+}
+
+func runDocker(args []string) {
+	fs := flag.NewFlagSet("docker", flag.ExitOnError)
+	var target sshTarget
+	targetFlags(fs, &target)
+	dockerHost := fs.String("H", os.Getenv("DOCKER_HOST"), "ssh://[user@]host[:port], defaults to $DOCKER_HOST")
+	socket := fs.String("socket", "/var/run/docker.sock", "docker socket on the remote host")
+	fs.Usage = func() {
+		names := make([]string, 0, len(dockerCommands))
+		for name := range dockerCommands {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+		fmt.Fprintf(fs.Output(), "usage: docker [flags] %s [args]\n", strings.Join(names, "|"))
+		fs.PrintDefaults()
+	}
+	fs.Parse(args)
+	if fs.NArg() == 0 || dockerCommands[fs.Arg(0)] == nil {
+		fs.Usage()
+		os.Exit(2)
+	}
+	if target.Host == "" {
+		if !strings.HasPrefix(*dockerHost, "ssh://") {
+			fmt.Fprintf(os.Stderr, "docker: -H must be an ssh:// URL, got %q\n", *dockerHost)
+			os.Exit(2)
+		}
+		target.Host = *dockerHost
+	}
+
+	sc, err := dialSSH(target)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+	defer sc.Close()
+	api, err := newDockerClient(sc, *socket)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+	defer api.Close()
+
+	ctx, cancel := signal.NotifyContext(context.Background(), syscall.SIGINT, syscall.SIGTERM)
+	err = dockerCommands[fs.Arg(0)](ctx, &dockerCLI{api: api, stdin: os.Stdin, stdout: os.Stdout, stderr: os.Stderr}, fs.Args()[1:])
+	cancel()
+	var exit exitError
+	switch {
+	case errors.As(err, &exit):
+		sc.Close()
+		os.Exit(int(exit))
+	case err != nil:
+		fmt.Fprintln(os.Stderr, err)
+		sc.Close()
+		os.Exit(1)
+	}
+}
+
+// 所有请求, 包括 attach/exec 的 hijack 连接, 都经 SSH 连到远程的 unix socket
+func newDockerClient(sc *ssh.Client, socket string) (*client.Client, error) {
+	return client.NewClientWithOpts(
+		client.WithHost("unix://"+socket),
+		client.WithHTTPClient(&http.Client{
+			Transport: &http.Transport{
+				DialContext: func(ctx context.Context, network, addr string) (net.Conn, error) {
+					return sc.Dial("unix", socket)
+				},
+			},
+		}),
+		client.WithAPIVersionNegotiation(),
+	)
+}
+
+func shortID(id string) string {
+	if len(id) > 12 {
+		return id[:12]
+	}
+	return id
+}
+
+func dockerPs(ctx context.Context, d *dockerCLI, args []string) error {
+	fs := flag.NewFlagSet("ps", flag.ContinueOnError)
+	all := fs.Bool("a", false, "show all containers")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	list, err := d.api.ContainerList(ctx, container.ListOptions{All: *all})
+	if err != nil {
+		return err
+	}
+	w := tabwriter.NewWriter(d.stdout, 0, 8, 3, ' ', 0)
+	fmt.Fprintln(w, "CONTAINER ID\tIMAGE\tCOMMAND\tSTATUS\tPORTS\tNAMES")
+	for _, c := range list {
+		var ports []string
+		for _, p := range c.Ports {
+			if p.PublicPort != 0 {
+				ports = append(ports, fmt.Sprintf("%s:%d->%d/%s", p.IP, p.PublicPort, p.PrivatePort, p.Type))
+			} else {
+				ports = append(ports, fmt.Sprintf("%d/%s", p.PrivatePort, p.Type))
+			}
+		}
+		names := make([]string, len(c.Names))
+		for i, n := range c.Names {
+			names[i] = strings.TrimPrefix(n, "/")
+		}
+		command := c.Command
+		if len(command) > 20 {
+			command = command[:19] + "…"
+		}
+		fmt.Fprintf(w, "%s\t%s\t%q\t%s\t%s\t%s\n", shortID(c.ID), c.Image, command, c.Status, strings.Join(ports, ", "), strings.Join(names, ","))
+	}
+	return w.Flush()
+}
+
+func dockerRun(ctx context.Context, d *dockerCLI, args []string) error {
+	fs := flag.NewFlagSet("run", flag.ContinueOnError)
+	name := fs.String("name", "", "container name")
+	detach := fs.Bool("d", false, "run in background and print the container id")
+	remove := fs.Bool("rm", false, "remove the container when it exits")
+	var env, ports, volumes stringList
+	fs.Var(&env, "e", "environment variable KEY=VALUE, may be repeated")
+	fs.Var(&ports, "p", "publish port [ip:][hostPort:]containerPort[/proto], may be repeated")
+	fs.Var(&volumes, "v", "bind mount /host:/container[:ro], may be repeated")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	if fs.NArg() == 0 {
+		return errors.New("run: missing image")
+	}
+	exposed, bindings, err := nat.ParsePortSpecs(ports)
+	if err != nil {
+		return err
+	}
+	for _, v := range volumes {
+		if parts := strings.Split(v, ":"); len(parts) < 2 || len(parts) > 3 {
+			return fmt.Errorf("run: bad volume %q", v)
+		}
+	}
+	config := &container.Config{
+		Image:        fs.Arg(0),
+		Cmd:          fs.Args()[1:],
+		Env:          env,
+		ExposedPorts: exposed,
+		AttachStdout: !*detach,
+		AttachStderr: !*detach,
+	}
+	hostConfig := &container.HostConfig{
+		PortBindings: bindings,
+		Binds:        volumes,
+		AutoRemove:   *remove,
+	}
+	created, err := d.api.ContainerCreate(ctx, config, hostConfig, nil, nil, *name)
+	if errdefs.IsNotFound(err) {
+		// 与 docker run 一样, 镜像不存在时先拉取
+		fmt.Fprintf(d.stderr, "Unable to find image '%s' locally\n", config.Image)
+		if err := pullImage(ctx, d, config.Image, d.stderr); err != nil {
+			return err
+		}
+		created, err = d.api.ContainerCreate(ctx, config, hostConfig, nil, nil, *name)
+	}
+	if err != nil {
+		return err
+	}
+	for _, w := range created.Warnings {
+		fmt.Fprintln(d.stderr, "WARNING:", w)
+	}
+	if *detach {
+		if err := d.api.ContainerStart(ctx, created.ID, container.StartOptions{}); err != nil {
+			return err
+		}
+		fmt.Fprintln(d.stdout, created.ID)
+		return nil
+	}
+
+	// 前台运行: 先 attach 再启动, 输出不丢
+	attach, err := d.api.ContainerAttach(ctx, created.ID, container.AttachOptions{Stream: true, Stdout: true, Stderr: true})
+	if err != nil {
+		return err
+	}
+	defer attach.Close()
+	waitC, errC := d.api.ContainerWait(ctx, created.ID, container.WaitConditionNextExit)
+	if err := d.api.ContainerStart(ctx, created.ID, container.StartOptions{}); err != nil {
+		return err
+	}
+	if _, err := stdcopy.StdCopy(d.stdout, d.stderr, attach.Reader); err != nil && !errors.Is(err, io.EOF) {
+		return err
+	}
+	select {
+	case res := <-waitC:
+		if res.Error != nil {
+			return errors.New(res.Error.Message)
+		}
+		if res.StatusCode != 0 {
+			return exitError(res.StatusCode)
+		}
+		return nil
+	case err := <-errC:
+		return err
+	}
+}
+
+func dockerStop(ctx context.Context, d *dockerCLI, args []string) error {
+	fs := flag.NewFlagSet("stop", flag.ContinueOnError)
+	timeout := fs.Int("t", -1, "seconds to wait before killing the container, -1 uses the container default")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	var opts container.StopOptions
+	if *timeout >= 0 {
+		opts.Timeout = timeout
+	}
+	return eachContainer(fs.Args(), d, func(id string) error {
+		return d.api.ContainerStop(ctx, id, opts)
+	})
+}
+
+func dockerRm(ctx context.Context, d *dockerCLI, args []string) error {
+	fs := flag.NewFlagSet("rm", flag.ContinueOnError)
+	force := fs.Bool("f", false, "force removal of a running container")
+	volumes := fs.Bool("v", false, "remove anonymous volumes")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	return eachContainer(fs.Args(), d, func(id string) error {
+		return d.api.ContainerRemove(ctx, id, container.RemoveOptions{Force: *force, RemoveVolumes: *volumes})
+	})
+}
+
+// 与 docker 一样逐个处理, 成功的打印名字, 失败的继续处理后面的
+func eachContainer(ids []string, d *dockerCLI, fn func(id string) error) error {
+	if len(ids) == 0 {
+		return errors.New("at least one container is required")
+	}
+	failed := 0
+	for _, id := range ids {
+		if err := fn(id); err != nil {
+			fmt.Fprintln(d.stderr, "Error:", err)
+			failed++
+			continue
+		}
+		fmt.Fprintln(d.stdout, id)
+	}
+	if failed > 0 {
+		return exitError(1)
+	}
+	return nil
+}
+
+func dockerLogs(ctx context.Context, d *dockerCLI, args []string) error {
+	fs := flag.NewFlagSet("logs", flag.ContinueOnError)
+	follow := fs.Bool("f", false, "follow log output")
+	tail := fs.String("tail", "all", "number of lines to show from the end")
+	timestamps := fs.Bool("t", false, "show timestamps")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	if fs.NArg() != 1 {
+		return errors.New("logs: exactly one container is required")
+	}
+	info, err := d.api.ContainerInspect(ctx, fs.Arg(0))
+	if err != nil {
+		return err
+	}
+	rc, err := d.api.ContainerLogs(ctx, info.ID, container.LogsOptions{
+		ShowStdout: true,
+		ShowStderr: true,
+		Follow:     *follow,
+		Tail:       *tail,
+		Timestamps: *timestamps,
+	})
+	if err != nil {
+		return err
+	}
+	defer rc.Close()
+	// 有 TTY 的容器输出不分流
+	if info.Config != nil && info.Config.Tty {
+		_, err = io.Copy(d.stdout, rc)
+	} else {
+		_, err = stdcopy.StdCopy(d.stdout, d.stderr, rc)
+	}
+	if ctx.Err() != nil {
+		return nil
+	}
+	return err
+}
+
+func dockerExec(ctx context.Context, d *dockerCLI, args []string) error {
+	fs := flag.NewFlagSet("exec", flag.ContinueOnError)
+	tty := fs.Bool("t", false, "allocate a pseudo-TTY")
+	interactive := fs.Bool("i", false, "keep stdin open")
+	fs.BoolFunc("it", "same as -i -t", func(string) error {
+		*tty, *interactive = true, true
+		return nil
+	})
+	user := fs.String("u", "", "user")
+	workdir := fs.String("w", "", "working directory")
+	var env stringList
+	fs.Var(&env, "e", "environment variable KEY=VALUE, may be repeated")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	if fs.NArg() < 2 {
+		return errors.New("exec: container and command are required")
+	}
+	opts := container.ExecOptions{
+		User:         *user,
+		WorkingDir:   *workdir,
+		Env:          env,
+		Tty:          *tty,
+		AttachStdin:  *interactive,
+		AttachStdout: true,
+		AttachStderr: true,
+		Cmd:          fs.Args()[1:],
+	}
+	stdinFd := -1
+	if f, ok := d.stdin.(*os.File); ok && term.IsTerminal(int(f.Fd())) {
+		stdinFd = int(f.Fd())
+	}
+	if *tty && stdinFd >= 0 {
+		if w, h, err := term.GetSize(stdinFd); err == nil {
+			opts.ConsoleSize = &[2]uint{uint(h), uint(w)}
+		}
+	}
+	created, err := d.api.ContainerExecCreate(ctx, fs.Arg(0), opts)
+	if err != nil {
+		return err
+	}
+	resp, err := d.api.ContainerExecAttach(ctx, created.ID, container.ExecAttachOptions{Tty: *tty, ConsoleSize: opts.ConsoleSize})
+	if err != nil {
+		return err
+	}
+	defer resp.Close()
+
+	if *tty && stdinFd >= 0 {
+		if *interactive {
+			state, err := term.MakeRaw(stdinFd)
+			if err != nil {
+				return err
+			}
+			defer term.Restore(stdinFd, state)
+		}
+		stop := resizeOnWinch(stdinFd, func(w, h int) {
+			d.api.ContainerExecResize(ctx, created.ID, container.ResizeOptions{Width: uint(w), Height: uint(h)})
+		})
+		defer stop()
+	}
+
+	if *interactive {
+		go func() {
+			io.Copy(resp.Conn, d.stdin)
+			resp.CloseWrite()
+		}()
+	}
+	if *tty {
+		_, err = io.Copy(d.stdout, resp.Reader)
+	} else {
+		_, err = stdcopy.StdCopy(d.stdout, d.stderr, resp.Reader)
+	}
+	if err != nil && !errors.Is(err, io.EOF) {
+		return err
+	}
+	// 连接关闭后进程可能还没有被标记为结束
+	for i := 0; ; i++ {
+		info, err := d.api.ContainerExecInspect(ctx, created.ID)
+		if err != nil {
+			return err
+		}
+		if !info.Running || i == 50 {
+			if info.ExitCode != 0 {
+				return exitError(info.ExitCode)
+			}
+			return nil
+		}
+		time.Sleep(20 * time.Millisecond)
+	}
+}
+
+// 终端大小变化时通知远程, 开始时同步一次
+func resizeOnWinch(fd int, resize func(w, h int)) (stop func()) {
+	sig := make(chan os.Signal, 1)
+	signal.Notify(sig, syscall.SIGWINCH)
+	done := make(chan struct{})
+	go func() {
+		for {
+			if w, h, err := term.GetSize(fd); err == nil {
+				resize(w, h)
+			}
+			select {
+			case <-sig:
+			case <-done:
+				return
+			}
+		}
+	}()
+	return func() {
+		signal.Stop(sig)
+		close(done)
+	}
+}
+
+func dockerPull(ctx context.Context, d *dockerCLI, args []string) error {
+	fs := flag.NewFlagSet("pull", flag.ContinueOnError)
+	platform := fs.String("platform", "", "platform, e.g. linux/amd64")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	if fs.NArg() != 1 {
+		return errors.New("pull: exactly one image is required")
+	}
+	return pullImageWith(ctx, d, fs.Arg(0), image.PullOptions{Platform: *platform}, d.stdout)
+}
+
+func pullImage(ctx context.Context, d *dockerCLI, ref string, out io.Writer) error {
+	return pullImageWith(ctx, d, ref, image.PullOptions{}, out)
+}
+
+// 拉取镜像, 输出到终端时显示每一层的进度条
+func pullImageWith(ctx context.Context, d *dockerCLI, ref string, opts image.PullOptions, out io.Writer) error {
+	rc, err := d.api.ImagePull(ctx, ref, opts)
+	if err != nil {
+		return err
+	}
+	defer rc.Close()
+	var fd uintptr
+	isTerminal := false
+	if f, ok := out.(*os.File); ok {
+		fd, isTerminal = f.Fd(), term.IsTerminal(int(f.Fd()))
+	}
+	return jsonmessage.DisplayJSONMessagesStream(rc, out, fd, isTerminal, nil)
+}
+
+func dockerInspect(ctx context.Context, d *dockerCLI, args []string) error {
+	fs := flag.NewFlagSet("inspect", flag.ContinueOnError)
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	if fs.NArg() == 0 {
+		return errors.New("inspect: at least one container is required")
+	}
+	var raws []json.RawMessage
+	var firstErr error
+	for _, id := range fs.Args() {
+		_, raw, err := d.api.ContainerInspectWithRaw(ctx, id, false)
+		if err != nil {
+			fmt.Fprintln(d.stderr, "Error:", err)
+			firstErr = exitError(1)
+			continue
+		}
+		raws = append(raws, raw)
+	}
+	// 与 docker inspect 一样输出 JSON 数组
+	var buf bytes.Buffer
+	b, _ := json.Marshal(raws)
+	if len(raws) == 0 {
+		b = []byte("[]")
+	}
+	json.Indent(&buf, b, "", "    ")
+	buf.WriteByte('\n')
+	if _, err := d.stdout.Write(buf.Bytes()); err != nil {
+		return err
+	}
+	return firstErr
+}
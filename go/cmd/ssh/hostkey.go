@@ -0,0 +1,206 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+
+	"golang.org/x/crypto/ssh"
+	"golang.org/x/crypto/ssh/knownhosts"
+)
+
+// 主机密钥校验策略, 对应 StrictHostKeyChecking
+const (
+	HostKeyStrict    = "strict"     // 只接受 known_hosts 中已有的密钥
+	HostKeyAsk       = "ask"        // 未知主机在终端上询问, 确认后写入 known_hosts (trust on first use)
+	HostKeyAcceptNew = "accept-new" // 未知主机直接写入 known_hosts
+	HostKeyOff       = "off"        // 不校验, 只用于测试环境
+)
+
+// 把 ssh_config 的 StrictHostKeyChecking 取值换成策略名
+func hostKeyPolicy(s string) (string, error) {
+	switch strings.ToLower(s) {
+	case "", "ask":
+		return HostKeyAsk, nil
+	case "strict", "yes":
+		return HostKeyStrict, nil
+	case "accept-new":
+		return HostKeyAcceptNew, nil
+	case "off", "no":
+		return HostKeyOff, nil
+	}
+	return "", fmt.Errorf("unknown host key policy %q", s)
+}
+
+// 按 known_hosts 校验主机密钥, 新接受的密钥追加到第一个文件
+type knownHosts struct {
+	policy string
+	files  []string
+	check  ssh.HostKeyCallback // 文件都不存在时为 nil
+
+	mu       sync.Mutex
+	accepted map[string][]ssh.PublicKey // 本进程内新接受的密钥, 避免重连时重复询问
+}
+
+func newKnownHosts(policy string, files []string) (*knownHosts, error) {
+	if len(files) == 0 {
+		files = []string{filepath.Join(homeDir(), ".ssh", "known_hosts")}
+	}
+	k := &knownHosts{policy: policy, files: files, accepted: map[string][]ssh.PublicKey{}}
+	var existing []string
+	for _, f := range files {
+		if _, err := os.Stat(f); err == nil {
+			existing = append(existing, f)
+		}
+	}
+	if len(existing) > 0 {
+		check, err := knownhosts.New(existing...)
+		if err != nil {
+			return nil, err
+		}
+		k.check = check
+	}
+	return k, nil
+}
+
+// 已知的密钥算法, 用于 ClientConfig.HostKeyAlgorithms, 让服务端优先出示 known_hosts 中有的那种密钥
+func (k *knownHosts) algorithms(addr string) []string {
+	if k.policy == HostKeyOff {
+		return nil
+	}
+	var keys []knownhosts.KnownKey
+	if k.check != nil {
+		var keyErr *knownhosts.KeyError
+		if err := k.check(addr, &net.TCPAddr{}, dummyKey{}); errors.As(err, &keyErr) {
+			keys = keyErr.Want
+		}
+	}
+	var algos []string
+	seen := map[string]bool{}
+	add := func(key ssh.PublicKey) {
+		for _, algo := range keyAlgorithms(key.Type()) {
+			if !seen[algo] {
+				seen[algo] = true
+				algos = append(algos, algo)
+			}
+		}
+	}
+	for _, key := range keys {
+		add(key.Key)
+	}
+	k.mu.Lock()
+	for _, key := range k.accepted[knownhosts.Normalize(addr)] {
+		add(key)
+	}
+	k.mu.Unlock()
+	return algos
+}
+
+// 密钥类型对应的签名算法, RSA 密钥可以用 SHA-2 签名
+func keyAlgorithms(keyType string) []string {
+	if keyType == ssh.KeyAlgoRSA {
+		return []string{ssh.KeyAlgoRSASHA512, ssh.KeyAlgoRSASHA256, ssh.KeyAlgoRSA}
+	}
+	return []string{keyType}
+}
+
+func (k *knownHosts) callback(hostname string, remote net.Addr, key ssh.PublicKey) error {
+	if k.policy == HostKeyOff {
+		return nil
+	}
+	host := knownhosts.Normalize(hostname)
+	k.mu.Lock()
+	for _, accepted := range k.accepted[host] {
+		if string(accepted.Marshal()) == string(key.Marshal()) {
+			k.mu.Unlock()
+			return nil
+		}
+	}
+	k.mu.Unlock()
+
+	var keyErr *knownhosts.KeyError
+	if k.check != nil {
+		err := k.check(hostname, remote, key)
+		if err == nil {
+			return nil
+		}
+		if !errors.As(err, &keyErr) {
+			// 被 @revoked 标记等
+			return err
+		}
+		if len(keyErr.Want) > 0 {
+			// 密钥变了: 任何策略都不接受
+			want := keyErr.Want[0]
+			return fmt.Errorf("host key for %s has changed (got %s %s, %s:%d has %s %s); "+
+				"this may be a man-in-the-middle attack, remove the old entry if the change is expected",
+				host, key.Type(), ssh.FingerprintSHA256(key),
+				want.Filename, want.Line, want.Key.Type(), ssh.FingerprintSHA256(want.Key))
+		}
+	}
+
+	// 未知主机
+	fingerprint := ssh.FingerprintSHA256(key)
+	switch k.policy {
+	case HostKeyStrict:
+		return fmt.Errorf("host key for %s is not in %s (%s %s); add it or use host_key accept-new",
+			host, strings.Join(k.files, ", "), key.Type(), fingerprint)
+	case HostKeyAsk:
+		if !interactive() {
+			return fmt.Errorf("host key for %s is unknown (%s %s) and there is no terminal to confirm it; "+
+				"connect once interactively or use host_key accept-new", host, key.Type(), fingerprint)
+		}
+		promptMu.Lock()
+		defer promptMu.Unlock()
+		question := fmt.Sprintf("The authenticity of host '%s' can't be established.\n"+
+			"%s key fingerprint is %s.\n"+
+			"Are you sure you want to continue connecting (yes/no)? ", host, key.Type(), fingerprint)
+		for {
+			answer, err := promptLine(question)
+			if err != nil {
+				return err
+			}
+			switch strings.ToLower(strings.TrimSpace(answer)) {
+			case "yes":
+			case "no":
+				return fmt.Errorf("host key for %s rejected by user", host)
+			default:
+				question = "Please type 'yes' or 'no': "
+				continue
+			}
+			break
+		}
+	}
+	return k.add(host, key)
+}
+
+// 追加到第一个 known_hosts 文件, 目录和文件不存在时创建
+func (k *knownHosts) add(host string, key ssh.PublicKey) error {
+	k.mu.Lock()
+	defer k.mu.Unlock()
+	k.accepted[host] = append(k.accepted[host], key)
+	file := k.files[0]
+	if err := os.MkdirAll(filepath.Dir(file), 0700); err != nil {
+		return err
+	}
+	f, err := os.OpenFile(file, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0600)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	if _, err := fmt.Fprintln(f, knownhosts.Line([]string{host}, key)); err != nil {
+		return err
+	}
+	logf("Warning: Permanently added '%s' (%s) to the list of known hosts.", host, key.Type())
+	return nil
+}
+
+// 只用来从 knownhosts 的 KeyError 中取出已知密钥
+type dummyKey struct{}
+
+func (dummyKey) Type() string                                 { return "dummy" }
+func (dummyKey) Marshal() []byte                              { return nil }
+func (dummyKey) Verify(data []byte, sig *ssh.Signature) error { return errors.New("dummy key") }
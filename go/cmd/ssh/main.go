@@ -1,51 +1,35 @@
 package main
 
 import (
-	"context"
-	"net"
-	"net/http"
-
-	"github.com/docker/docker/api/types/container"
-	"github.com/moby/moby/client"
-	"golang.org/x/crypto/ssh"
+	"fmt"
+	"os"
 )
 
+// 子命令:
+//
+//	tunnel -config tunnels.json             按配置保持 -L/-R/-D 隧道
+//	docker -H ssh://user@host ps|run|...    经 SSH 操作远程 docker
+//	pssh -hosts hosts.txt command ...       在一批主机上并行执行命令
+//	cp [-r] src... [user@]host:dst           经 SFTP 上传下载, 反过来写为下载
+//
+// 连接参数见 targetFlags
 func main() {
-	config := &ssh.ClientConfig{
-		User:            "root",
-		Auth:            []ssh.AuthMethod{ssh.Password("password")},
-		HostKeyCallback: ssh.InsecureIgnoreHostKey(),
-	}
-	sc, err := ssh.Dial("tcp", "9.135.90.17:36000", config)
-	if err != nil {
-		panic(err)
-	}
-	defer sc.Close()
-	// 获取一个可作为转发通道的ssh connection
-
-	dc, err := client.NewClientWithOpts(client.WithHTTPClient(&http.Client{
-		Transport: &http.Transport{
-			DialContext: func(ctx context.Context, network, addr string) (net.Conn, error) {
-				return sc.Dial("unix", "/var/run/docker.sock")
-			},
-		},
-	}),
-		client.WithAPIVersionNegotiation(),
-	)
-	if err != nil {
-		panic(err)
-	}
-	dc.ContainerRemove(context.Background(), "demo", container.RemoveOptions{
-		Force: true,
-	})
-	c, err := dc.ContainerCreate(context.Background(), &container.Config{
-		Image: "ccr.ccs.tencentyun.com/yxing-xyz/linux:ubuntu-devel",
-	}, nil, nil, nil, "demo")
-	if err != nil {
-		panic(err)
-	}
-	err = dc.ContainerStart(context.Background(), c.ID, container.StartOptions{})
-	if err != nil {
-		panic(err)
+	if len(os.Args) > 1 {
+		switch os.Args[1] {
+		case "tunnel":
+			runTunnel(os.Args[2:])
+			return
+		case "docker":
+			runDocker(os.Args[2:])
+			return
+		case "pssh":
+			runPssh(os.Args[2:])
+			return
+		case "cp":
+			runCp(os.Args[2:])
+			return
+		}
 	}
+	fmt.Fprintln(os.Stderr, "usage: ssh tunnel|docker|pssh|cp [flags] ...")
+	os.Exit(2)
 }
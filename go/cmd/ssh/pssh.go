@@ -0,0 +1,333 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"os/signal"
+	"strings"
+	"sync"
+	"syscall"
+	"text/tabwriter"
+	"time"
+
+	"golang.org/x/crypto/ssh"
+)
+
+// 在一批主机上并行执行同一条命令:
+//
+//	pssh -hosts hosts.txt -c 20 -timeout 30s uptime
+//	pssh -hosts hosts.json -mode collect -- df -h /
+//
+// 主机清单每行一个 [user@]host[:port] 或 ~/.ssh/config 中的别名, # 开头为注释;
+// 也可以是 sshTarget 的 JSON 数组, 每台主机单独配置认证, 没有填写的项取命令行参数
+type psshOptions struct {
+	Concurrency int
+	Timeout     time.Duration
+	Mode        string // prefix: 每行输出加主机名前缀实时打印; collect: 每台主机结束后整块打印
+}
+
+type hostResult struct {
+	Host     string        `json:"host"`
+	ExitCode int           `json:"exit_code"` // 没有拿到退出码时为 -1
+	Error    string        `json:"error,omitempty"`
+	Stdout   string        `json:"stdout,omitempty"`
+	Stderr   string        `json:"stderr,omitempty"`
+	Start    time.Time     `json:"start"`
+	Duration time.Duration `json:"duration_ns"`
+}
+
+func (r hostResult) ok() bool {
+	return r.ExitCode == 0 && r.Error == ""
+}
+
+func runPssh(args []string) {
+	fs := flag.NewFlagSet("pssh", flag.ExitOnError)
+	var defaults sshTarget
+	targetFlags(fs, &defaults)
+	hostsFile := fs.String("hosts", "hosts.txt", "inventory file, one host per line or a json array")
+	opts := psshOptions{}
+	fs.IntVar(&opts.Concurrency, "c", 32, "max hosts running at the same time")
+	fs.DurationVar(&opts.Timeout, "timeout", time.Minute, "per host timeout, including connecting")
+	fs.StringVar(&opts.Mode, "mode", "prefix", "output mode: prefix or collect")
+	jsonOut := fs.Bool("json", false, "print results as json instead of text")
+	fs.Parse(args)
+	if fs.NArg() == 0 {
+		fmt.Fprintln(os.Stderr, "usage: pssh [flags] command ...")
+		os.Exit(2)
+	}
+	if opts.Mode != "prefix" && opts.Mode != "collect" {
+		fmt.Fprintf(os.Stderr, "pssh: unknown mode %q\n", opts.Mode)
+		os.Exit(2)
+	}
+	hosts, err := loadInventory(*hostsFile, defaults)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(2)
+	}
+	ctx, cancel := signal.NotifyContext(context.Background(), syscall.SIGINT, syscall.SIGTERM)
+	defer cancel()
+	var results []hostResult
+	if *jsonOut {
+		// json 输出时不实时打印, 输出都放在结果里
+		opts.Mode = "collect"
+		results = runParallel(ctx, hosts, strings.Join(fs.Args(), " "), opts, io.Discard)
+		enc := json.NewEncoder(os.Stdout)
+		enc.SetIndent("", "  ")
+		enc.Encode(results)
+	} else {
+		results = runParallel(ctx, hosts, strings.Join(fs.Args(), " "), opts, os.Stdout)
+		printSummary(os.Stdout, results)
+	}
+	for _, r := range results {
+		if !r.ok() {
+			os.Exit(1)
+		}
+	}
+}
+
+// 读取主机清单, defaults 中的项作为每台主机的默认值
+func loadInventory(file string, defaults sshTarget) ([]sshTarget, error) {
+	data, err := os.ReadFile(file)
+	if err != nil {
+		return nil, err
+	}
+	var hosts []sshTarget
+	if trimmed := bytes.TrimSpace(data); len(trimmed) > 0 && trimmed[0] == '[' {
+		if err := json.Unmarshal(trimmed, &hosts); err != nil {
+			return nil, fmt.Errorf("%s: %w", file, err)
+		}
+	} else {
+		scanner := bufio.NewScanner(bytes.NewReader(data))
+		for scanner.Scan() {
+			line := strings.TrimSpace(scanner.Text())
+			if line == "" || line[0] == '#' {
+				continue
+			}
+			hosts = append(hosts, sshTarget{Host: strings.Fields(line)[0]})
+		}
+	}
+	if len(hosts) == 0 {
+		return nil, fmt.Errorf("%s: no hosts", file)
+	}
+	for i := range hosts {
+		h := &hosts[i]
+		if h.Host == "" {
+			return nil, fmt.Errorf("%s: host %d has no address", file, i+1)
+		}
+		if h.Port == 0 {
+			h.Port = defaults.Port
+		}
+		if h.Password == "" {
+			h.Password = defaults.Password
+		}
+		if len(h.IdentityFiles) == 0 {
+			h.IdentityFiles = defaults.IdentityFiles
+		}
+		if h.HostKey == "" {
+			h.HostKey = defaults.HostKey
+		}
+		if h.SSHConfig == "" {
+			h.SSHConfig = defaults.SSHConfig
+		}
+		if h.ProxyJump == "" && len(h.Jump) == 0 {
+			h.ProxyJump = defaults.ProxyJump
+		}
+	}
+	return hosts, nil
+}
+
+// 并发执行, 单台主机失败不影响其它主机, 结果按清单顺序返回
+func runParallel(ctx context.Context, hosts []sshTarget, command string, opts psshOptions, out io.Writer) []hostResult {
+	results := make([]hostResult, len(hosts))
+	concurrency := opts.Concurrency
+	if concurrency <= 0 {
+		concurrency = len(hosts)
+	}
+	sem := make(chan struct{}, concurrency)
+	var outMu sync.Mutex
+	var wg sync.WaitGroup
+	done := 0
+	for i, h := range hosts {
+		wg.Add(1)
+		sem <- struct{}{}
+		go func() {
+			defer wg.Done()
+			defer func() { <-sem }()
+			var stdout, stderr io.Writer = io.Discard, io.Discard
+			var prefixed []*prefixWriter
+			if opts.Mode == "prefix" {
+				o := &prefixWriter{mu: &outMu, out: out, prefix: h.Host + " | "}
+				e := &prefixWriter{mu: &outMu, out: out, prefix: h.Host + " ! "}
+				prefixed = append(prefixed, o, e)
+				stdout, stderr = o, e
+			}
+			r := runHost(ctx, h, command, opts.Timeout, stdout, stderr, opts.Mode == "collect")
+			for _, p := range prefixed {
+				p.flush()
+			}
+			results[i] = r
+			if opts.Mode == "collect" {
+				outMu.Lock()
+				done++
+				printCollected(out, done, r)
+				outMu.Unlock()
+			}
+		}()
+	}
+	wg.Wait()
+	return results
+}
+
+// 连接并执行命令, 超时包括建立连接的时间
+func runHost(ctx context.Context, t sshTarget, command string, timeout time.Duration, stdout, stderr io.Writer, keep bool) (r hostResult) {
+	r = hostResult{Host: t.Host, ExitCode: -1, Start: time.Now()}
+	defer func() { r.Duration = time.Since(r.Start) }()
+	if timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, timeout)
+		defer cancel()
+	}
+	var outBuf, errBuf bytes.Buffer
+	if keep {
+		stdout, stderr = io.MultiWriter(stdout, &outBuf), io.MultiWriter(stderr, &errBuf)
+		defer func() { r.Stdout, r.Stderr = outBuf.String(), errBuf.String() }()
+	}
+
+	type dialed struct {
+		client *ssh.Client
+		err    error
+	}
+	dialc := make(chan dialed, 1)
+	go func() {
+		c, err := dialSSH(t)
+		dialc <- dialed{c, err}
+	}()
+	var client *ssh.Client
+	select {
+	case d := <-dialc:
+		if d.err != nil {
+			r.Error = d.err.Error()
+			return r
+		}
+		client = d.client
+	case <-ctx.Done():
+		go func() {
+			if d := <-dialc; d.client != nil {
+				d.client.Close()
+			}
+		}()
+		r.Error = contextError(ctx, timeout)
+		return r
+	}
+	defer client.Close()
+
+	session, err := client.NewSession()
+	if err != nil {
+		r.Error = err.Error()
+		return r
+	}
+	defer session.Close()
+	session.Stdout, session.Stderr = stdout, stderr
+	errc := make(chan error, 1)
+	go func() { errc <- session.Run(command) }()
+	select {
+	case err = <-errc:
+	case <-ctx.Done():
+		session.Signal(ssh.SIGKILL)
+		client.Close()
+		<-errc
+		r.Error = contextError(ctx, timeout)
+		return r
+	}
+	var exitErr *ssh.ExitError
+	switch {
+	case err == nil:
+		r.ExitCode = 0
+	case errors.As(err, &exitErr):
+		r.ExitCode = exitErr.ExitStatus()
+		if exitErr.Signal() != "" {
+			r.Error = "killed by signal " + exitErr.Signal()
+		}
+	default:
+		r.Error = err.Error()
+	}
+	return r
+}
+
+func contextError(ctx context.Context, timeout time.Duration) string {
+	if errors.Is(ctx.Err(), context.DeadlineExceeded) {
+		return fmt.Sprintf("timeout after %v", timeout)
+	}
+	return ctx.Err().Error()
+}
+
+// 按行加前缀写到共享的输出, 行不会交错
+type prefixWriter struct {
+	mu     *sync.Mutex
+	out    io.Writer
+	prefix string
+	buf    []byte
+}
+
+func (w *prefixWriter) Write(p []byte) (int, error) {
+	w.buf = append(w.buf, p...)
+	for {
+		i := bytes.IndexByte(w.buf, '\n')
+		if i < 0 {
+			break
+		}
+		w.mu.Lock()
+		fmt.Fprintf(w.out, "%s%s\n", w.prefix, w.buf[:i])
+		w.mu.Unlock()
+		w.buf = w.buf[i+1:]
+	}
+	return len(p), nil
+}
+
+// 输出最后没有换行的部分
+func (w *prefixWriter) flush() {
+	if len(w.buf) > 0 {
+		w.Write([]byte("\n"))
+	}
+}
+
+// 与 pssh -i 的格式相同
+func printCollected(out io.Writer, n int, r hostResult) {
+	status := "SUCCESS"
+	if !r.ok() {
+		status = "FAILURE"
+	}
+	fmt.Fprintf(out, "[%d] %s [%s] %s", n, r.Start.Add(r.Duration).Format("15:04:05"), status, r.Host)
+	if r.Error != "" {
+		fmt.Fprintf(out, " %s", r.Error)
+	} else if r.ExitCode != 0 {
+		fmt.Fprintf(out, " Exited with error code %d", r.ExitCode)
+	}
+	fmt.Fprintln(out)
+	io.WriteString(out, r.Stdout)
+	if r.Stderr != "" {
+		fmt.Fprintln(out, "Stderr:", strings.TrimSuffix(r.Stderr, "\n"))
+	}
+}
+
+// 每台主机一行的汇总表
+func printSummary(out io.Writer, results []hostResult) {
+	w := tabwriter.NewWriter(out, 0, 8, 2, ' ', 0)
+	fmt.Fprintln(w, "HOST\tEXIT\tTIME\tERROR")
+	failed := 0
+	for _, r := range results {
+		if !r.ok() {
+			failed++
+		}
+		fmt.Fprintf(w, "%s\t%d\t%v\t%s\n", r.Host, r.ExitCode, r.Duration.Round(time.Millisecond), r.Error)
+	}
+	w.Flush()
+	fmt.Fprintf(out, "%d hosts, %d ok, %d failed\n", len(results), len(results)-failed, failed)
+}
@@ -0,0 +1,1610 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"crypto/ed25519"
+	"crypto/rand"
+	"encoding/json"
+	"encoding/pem"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"code/pkg/sshd"
+
+	"github.com/docker/docker/api/types"
+	"github.com/docker/docker/api/types/container"
+	"github.com/docker/docker/pkg/stdcopy"
+	"golang.org/x/crypto/ssh"
+	"golang.org/x/crypto/ssh/agent"
+	"golang.org/x/crypto/ssh/knownhosts"
+	"golang.org/x/net/proxy"
+)
+
+// 测试用的 SSH 服务端, 基于 pkg/sshd, 用户 test 密码 secret
+// 额外记录登录次数和当前连接, 可以断开所有连接模拟网络中断
+type testSSHServer struct {
+	*sshd.Server
+	ln      net.Listener
+	hostKey ssh.PublicKey
+
+	mu         sync.Mutex
+	conns      map[net.Conn]struct{}
+	authorized []ssh.PublicKey // 用户 test 可以用这些公钥登录
+	logins     int             // 认证成功的连接数
+}
+
+func newTestSSHServer(t testing.TB) *testSSHServer {
+	t.Helper()
+	_, priv, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	signer, err := ssh.NewSignerFromKey(priv)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := &testSSHServer{hostKey: signer.PublicKey(), conns: map[net.Conn]struct{}{}}
+	s.ln = &trackingListener{Listener: ln, s: s}
+	s.Server = &sshd.Server{
+		HostKeys:     []ssh.Signer{signer},
+		PasswordAuth: sshd.Passwords(map[string]string{"test": "secret"}),
+		PublicKeyAuth: func(user string, key ssh.PublicKey) bool {
+			s.mu.Lock()
+			defer s.mu.Unlock()
+			for _, k := range s.authorized {
+				if user == "test" && bytes.Equal(k.Marshal(), key.Marshal()) {
+					return true
+				}
+			}
+			return false
+		},
+		Logf: func(format string, args ...any) {
+			if strings.HasSuffix(format, "logged in") {
+				s.mu.Lock()
+				s.logins++
+				s.mu.Unlock()
+			}
+			t.Logf(format, args...)
+		},
+	}
+	go s.Serve(s.ln)
+	t.Cleanup(func() { s.Close() })
+	return s
+}
+
+// 记录服务端接受的连接, 连接关闭时移除
+type trackingListener struct {
+	net.Listener
+	s *testSSHServer
+}
+
+func (l *trackingListener) Accept() (net.Conn, error) {
+	c, err := l.Listener.Accept()
+	if err != nil {
+		return nil, err
+	}
+	tc := &trackedConn{Conn: c, s: l.s}
+	l.s.mu.Lock()
+	l.s.conns[tc] = struct{}{}
+	l.s.mu.Unlock()
+	return tc, nil
+}
+
+type trackedConn struct {
+	net.Conn
+	s *testSSHServer
+}
+
+func (c *trackedConn) Close() error {
+	c.s.mu.Lock()
+	delete(c.s.conns, c)
+	c.s.mu.Unlock()
+	return c.Conn.Close()
+}
+
+func (s *testSSHServer) addr() string {
+	return s.ln.Addr().String()
+}
+
+func (s *testSSHServer) authorize(key ssh.PublicKey) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.authorized = append(s.authorized, key)
+}
+
+func (s *testSSHServer) counts() (logins, active int) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.logins, len(s.conns)
+}
+
+// 断开所有已建立的连接, 模拟网络中断
+func (s *testSSHServer) dropConnections() {
+	s.mu.Lock()
+	conns := make([]net.Conn, 0, len(s.conns))
+	for c := range s.conns {
+		conns = append(conns, c)
+	}
+	s.mu.Unlock()
+	for _, c := range conns {
+		c.Close()
+	}
+}
+
+// 回显服务, 用作隧道目标
+func echoServer(t testing.TB, network, addr string) net.Listener {
+	ln, err := net.Listen(network, addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { ln.Close() })
+	go func() {
+		for {
+			c, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer c.Close()
+				io.Copy(c, c)
+			}()
+		}
+	}()
+	return ln
+}
+
+func expectEcho(t *testing.T, c net.Conn, msg string) {
+	t.Helper()
+	defer c.Close()
+	c.SetDeadline(time.Now().Add(3 * time.Second))
+	if _, err := io.WriteString(c, msg); err != nil {
+		t.Fatal(err)
+	}
+	buf := make([]byte, len(msg))
+	if _, err := io.ReadFull(c, buf); err != nil || string(buf) != msg {
+		t.Fatalf("echo: got %q, %v", buf, err)
+	}
+}
+
+// 空闲端口, 用于 -L/-D 的本地监听
+func freePort(t *testing.T) string {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+	return strconv.Itoa(ln.Addr().(*net.TCPAddr).Port)
+}
+
+func passwordDialer(addr string) func() (*ssh.Client, error) {
+	return func() (*ssh.Client, error) {
+		return ssh.Dial("tcp", addr, &ssh.ClientConfig{
+			User:            "test",
+			Auth:            []ssh.AuthMethod{ssh.Password("secret")},
+			HostKeyCallback: ssh.InsecureIgnoreHostKey(),
+			Timeout:         time.Second,
+		})
+	}
+}
+
+func waitFor(t *testing.T, what string, cond func() bool) {
+	t.Helper()
+	for i := 0; i < 300; i++ {
+		if cond() {
+			return
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	t.Fatalf("timeout waiting for %s", what)
+}
+
+func TestParseForward(t *testing.T) {
+	cases := []struct {
+		spec           string
+		kind           byte
+		listen, target string
+	}{
+		{"-L 8080:example.com:80", 'L', "tcp:localhost:8080", "tcp:example.com:80"},
+		{"-L *:8080:example.com:80", 'L', "tcp::8080", "tcp:example.com:80"},
+		{"-L [::1]:8080:[fe80::1]:80", 'L', "tcp:[::1]:8080", "tcp:[fe80::1]:80"},
+		{"-L 2375:/var/run/docker.sock", 'L', "tcp:localhost:2375", "unix:/var/run/docker.sock"},
+		{"-L /tmp/d.sock:/var/run/docker.sock", 'L', "unix:/tmp/d.sock", "unix:/var/run/docker.sock"},
+		{"-L /tmp/web.sock:localhost:80", 'L', "unix:/tmp/web.sock", "tcp:localhost:80"},
+		{"-R 9000:localhost:9000", 'R', "tcp:localhost:9000", "tcp:localhost:9000"},
+		{"-R *:9000:localhost:9000", 'R', "tcp:0.0.0.0:9000", "tcp:localhost:9000"},
+		{"-R 127.0.0.1:9000:/tmp/web.sock", 'R', "tcp:127.0.0.1:9000", "unix:/tmp/web.sock"},
+		{"-R /tmp/r.sock:localhost:22", 'R', "unix:/tmp/r.sock", "tcp:localhost:22"},
+		{"-D 1080", 'D', "tcp:localhost:1080", ":"},
+		{"-D 0.0.0.0:1080", 'D', "tcp:0.0.0.0:1080", ":"},
+	}
+	for _, c := range cases {
+		kind, listen, target, err := parseForward(c.spec)
+		if err != nil {
+			t.Errorf("%s: %v", c.spec, err)
+			continue
+		}
+		if kind != c.kind || listen.String() != c.listen || target.String() != c.target {
+			t.Errorf("%s: got %c %s %s", c.spec, kind, listen, target)
+		}
+	}
+	for _, bad := range []string{"-X 1:2:3", "-L 8080", "-L host:port:x:80", "-D"} {
+		if _, _, _, err := parseForward(bad); err == nil {
+			t.Errorf("%s: expected error", bad)
+		}
+	}
+}
+
+func TestTunnelManager(t *testing.T) {
+	server := newTestSSHServer(t)
+	dir := t.TempDir()
+	tcpEcho := echoServer(t, "tcp", "127.0.0.1:0")
+	unixEcho := echoServer(t, "unix", filepath.Join(dir, "echo.sock"))
+	localPort, unixTargetPort, socksPort := freePort(t), freePort(t), freePort(t)
+	localSock := filepath.Join(dir, "local.sock")
+
+	cfg := TunnelConfig{
+		Keepalive: Duration(100 * time.Millisecond),
+		Tunnels: []TunnelSpec{
+			{Name: "tcp", Forward: "-L 127.0.0.1:" + localPort + ":" + tcpEcho.Addr().String()},
+			{Name: "to-unix", Forward: "-L 127.0.0.1:" + unixTargetPort + ":" + unixEcho.Addr().String()},
+			{Name: "from-unix", Forward: "-L " + localSock + ":" + tcpEcho.Addr().String()},
+			{Name: "remote", Forward: "-R 127.0.0.1:0:" + tcpEcho.Addr().String()},
+			{Name: "socks", Forward: "-D 127.0.0.1:" + socksPort},
+		},
+	}
+	m, err := newTunnelManager(server.addr(), passwordDialer(server.addr()), cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	m.minBackoff, m.maxBackoff = 10*time.Millisecond, 50*time.Millisecond
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan error)
+	go func() { done <- m.run(ctx) }()
+	connected := func() bool {
+		s := m.status()
+		return s.State == "connected" && s.Tunnels[3].State == "listening"
+	}
+	waitFor(t, "connect", connected)
+
+	check := func() {
+		for _, addr := range []string{"127.0.0.1:" + localPort, "127.0.0.1:" + unixTargetPort} {
+			c, err := net.Dial("tcp", addr)
+			if err != nil {
+				t.Fatal(err)
+			}
+			expectEcho(t, c, "hello "+addr)
+		}
+		c, err := net.Dial("unix", localSock)
+		if err != nil {
+			t.Fatal(err)
+		}
+		expectEcho(t, c, "hello unix")
+
+		socks, err := proxy.SOCKS5("tcp", "127.0.0.1:"+socksPort, nil, proxy.Direct)
+		if err != nil {
+			t.Fatal(err)
+		}
+		c, err = socks.Dial("tcp", tcpEcho.Addr().String())
+		if err != nil {
+			t.Fatal(err)
+		}
+		expectEcho(t, c, "hello socks")
+	}
+	check()
+
+	// 服务端断开后自动重连, 本地监听保持不变
+	server.dropConnections()
+	waitFor(t, "reconnect", func() bool { return m.status().Reconnects >= 1 && connected() })
+	check()
+
+	// keepalive 保持连接空闲时不被判断为断开
+	time.Sleep(300 * time.Millisecond)
+	if s := m.status(); s.Reconnects != 1 || s.State != "connected" {
+		t.Fatalf("unexpected status after idle: %+v", s)
+	}
+
+	rec := httptest.NewRecorder()
+	m.ServeHTTP(rec, httptest.NewRequest("GET", "/", nil))
+	var status managerStatus
+	if err := json.Unmarshal(rec.Body.Bytes(), &status); err != nil {
+		t.Fatal(err)
+	}
+	if len(status.Tunnels) != 5 || status.Tunnels[0].Total != 2 {
+		t.Fatalf("unexpected status: %s", rec.Body)
+	}
+
+	cancel()
+	if err := <-done; err != nil {
+		t.Fatal(err)
+	}
+}
+
+// -R 省略地址时与 ssh 一样只在服务端本机监听, * 监听所有地址
+func TestTunnelRemoteForward(t *testing.T) {
+	addr := newTestSSHServer(t).addr()
+	dir := t.TempDir()
+	tcpEcho := echoServer(t, "tcp", "127.0.0.1:0")
+	unixEcho := echoServer(t, "unix", filepath.Join(dir, "echo.sock"))
+	defaultPort, anyPort, unixPort := freePort(t), freePort(t), freePort(t)
+	remoteSock := filepath.Join(dir, "remote.sock")
+	cfg := TunnelConfig{
+		Tunnels: []TunnelSpec{
+			{Name: "default", Forward: "-R " + defaultPort + ":" + tcpEcho.Addr().String()},
+			{Name: "any", Forward: "-R *:" + anyPort + ":" + tcpEcho.Addr().String()},
+			{Name: "to-unix", Forward: "-R " + unixPort + ":" + unixEcho.Addr().String()},
+			{Name: "from-unix", Forward: "-R " + remoteSock + ":" + tcpEcho.Addr().String()},
+		},
+	}
+	m, err := newTunnelManager(addr, passwordDialer(addr), cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go m.run(ctx)
+	waitFor(t, "remote listeners", func() bool {
+		s := m.status()
+		for _, f := range s.Tunnels {
+			if f.State != "listening" {
+				return false
+			}
+		}
+		return s.State == "connected"
+	})
+	if s := m.status(); s.LastError != "" {
+		t.Fatalf("status: %+v", s)
+	}
+
+	for _, port := range []string{defaultPort, anyPort, unixPort} {
+		c, err := net.Dial("tcp", "127.0.0.1:"+port)
+		if err != nil {
+			t.Fatal(err)
+		}
+		expectEcho(t, c, "hello "+port)
+	}
+	c, err := net.Dial("unix", remoteSock)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expectEcho(t, c, "hello unix")
+
+	// 默认只监听本机, * 监听所有地址
+	listening := func(host, port string) bool {
+		l, err := net.Listen("tcp", net.JoinHostPort(host, port))
+		if err != nil {
+			return true
+		}
+		l.Close()
+		return false
+	}
+	if !listening("0.0.0.0", anyPort) {
+		t.Errorf("*:%s is not bound to all addresses", anyPort)
+	}
+	if ip := nonLoopbackIP(); ip != "" && listening(ip, defaultPort) {
+		t.Errorf("%s is bound on %s", defaultPort, ip)
+	}
+}
+
+// 本机的非回环地址, 没有时返回空
+func nonLoopbackIP() string {
+	addrs, _ := net.InterfaceAddrs()
+	for _, a := range addrs {
+		if n, ok := a.(*net.IPNet); ok && !n.IP.IsLoopback() && n.IP.To4() != nil {
+			return n.IP.String()
+		}
+	}
+	return ""
+}
+
+// 连不上时按退避重试, 服务端恢复后连上
+func TestTunnelManagerBackoff(t *testing.T) {
+	server := newTestSSHServer(t)
+	attempts := 0
+	dial := passwordDialer(server.addr())
+	m, err := newTunnelManager(server.addr(), func() (*ssh.Client, error) {
+		if attempts++; attempts < 3 {
+			return nil, fmt.Errorf("attempt %d refused", attempts)
+		}
+		return dial()
+	}, TunnelConfig{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	m.minBackoff, m.maxBackoff = 10*time.Millisecond, 20*time.Millisecond
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go m.run(ctx)
+	waitFor(t, "connect", func() bool { return m.status().State == "connected" })
+	if s := m.status(); s.LastError != "attempt 2 refused" {
+		t.Fatalf("unexpected status: %+v", s)
+	}
+}
+
+// 隔离 HOME 和 ssh-agent, 终端交互默认关闭
+func isolateSSHEnv(t *testing.T) string {
+	home := t.TempDir()
+	t.Setenv("HOME", home)
+	t.Setenv("SSH_AUTH_SOCK", "")
+	oldInteractive, oldLine, oldPassword, oldLogf := interactive, promptLine, promptPassword, logf
+	interactive = func() bool { return false }
+	logf = t.Logf
+	t.Cleanup(func() {
+		interactive, promptLine, promptPassword, logf = oldInteractive, oldLine, oldPassword, oldLogf
+	})
+	return home
+}
+
+func TestSSHConfig(t *testing.T) {
+	home := isolateSSHEnv(t)
+	os.MkdirAll(filepath.Join(home, ".ssh"), 0700)
+	os.WriteFile(filepath.Join(home, ".ssh", "extra"), []byte("Host inc\n  HostName included.example.com\n"), 0600)
+	file := filepath.Join(home, ".ssh", "config")
+	os.WriteFile(file, []byte(`
+# 注释
+Host web web2
+  HostName 10.0.0.%h
+  User deploy
+  Port=2222
+  IdentityFile ~/.ssh/web_key
+
+Host *.internal !bad.internal
+  User ops
+  IdentityFile "~/.ssh/internal key"
+  StrictHostKeyChecking accept-new
+
+Match host web
+  User ignored
+
+Include extra
+
+Host *
+  User fallback
+  Port 22
+  IdentityFile ~/.ssh/id_ed25519
+  UserKnownHostsFile ~/.ssh/known_hosts ~/.ssh/known_hosts2
+`), 0600)
+	c, err := loadSSHConfig(file)
+	if err != nil {
+		t.Fatal(err)
+	}
+	h := c.lookup("web")
+	if h.HostName != "10.0.0.web" || h.User != "deploy" || h.Port != 2222 ||
+		len(h.IdentityFiles) != 2 || h.IdentityFiles[0] != "~/.ssh/web_key" || len(h.UserKnownHostsFile) != 2 {
+		t.Fatalf("web: %+v", h)
+	}
+	if h := c.lookup("db.internal"); h.HostName != "db.internal" || h.User != "ops" || h.Port != 22 ||
+		h.IdentityFiles[0] != "~/.ssh/internal key" || h.StrictHostKeyChecking != "accept-new" {
+		t.Fatalf("db.internal: %+v", h)
+	}
+	if h := c.lookup("bad.internal"); h.User != "fallback" {
+		t.Fatalf("bad.internal: %+v", h)
+	}
+	if h := c.lookup("inc"); h.HostName != "included.example.com" || h.User != "fallback" {
+		t.Fatalf("inc: %+v", h)
+	}
+	if c, err := loadSSHConfig(filepath.Join(home, "missing")); err != nil || c.lookup("x").HostName != "x" {
+		t.Fatalf("missing config: %v", err)
+	}
+
+	// 显式配置优先于 ssh_config
+	addr, config, _, err := sshTarget{Host: "admin@web:2200", SSHConfig: file, HostKey: HostKeyOff}.clientConfig()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if addr != "10.0.0.web:2200" || config.User != "admin" {
+		t.Fatalf("got %s %s", addr, config.User)
+	}
+}
+
+func TestHostKeyPolicy(t *testing.T) {
+	home := isolateSSHEnv(t)
+	server := newTestSSHServer(t)
+	known := filepath.Join(home, ".ssh", "known_hosts")
+	dial := func(policy string) error {
+		c, err := dialSSH(sshTarget{Host: "test@" + server.addr(), Password: "secret", HostKey: policy, SSHConfig: "none"})
+		if err == nil {
+			c.Close()
+		}
+		return err
+	}
+
+	if err := dial(HostKeyStrict); err == nil || !strings.Contains(err.Error(), "is not in") {
+		t.Fatalf("strict with unknown host: %v", err)
+	}
+	if err := dial(HostKeyAsk); err == nil || !strings.Contains(err.Error(), "no terminal") {
+		t.Fatalf("ask without terminal: %v", err)
+	}
+
+	// 终端上回答 no 时拒绝, yes 时写入 known_hosts
+	interactive = func() bool { return true }
+	answer := "no"
+	promptLine = func(string) (string, error) { return answer, nil }
+	if err := dial(HostKeyAsk); err == nil || !strings.Contains(err.Error(), "rejected by user") {
+		t.Fatalf("ask, answered no: %v", err)
+	}
+	answer = "yes"
+	if err := dial(HostKeyAsk); err != nil {
+		t.Fatal(err)
+	}
+	interactive = func() bool { return false }
+	if err := dial(HostKeyStrict); err != nil {
+		t.Fatalf("strict after accepting: %v", err)
+	}
+
+	// accept-new 写入另一台主机
+	other := newTestSSHServer(t)
+	c, err := dialSSH(sshTarget{Host: "test@" + other.addr(), Password: "secret", HostKey: HostKeyAcceptNew, SSHConfig: "none"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	c.Close()
+	data, _ := os.ReadFile(known)
+	if lines := strings.Count(string(data), "\n"); lines != 2 {
+		t.Fatalf("known_hosts has %d lines:\n%s", lines, data)
+	}
+
+	// 密钥变化时任何策略都拒绝
+	os.WriteFile(known, []byte(knownhosts.Line([]string{knownhosts.Normalize(server.addr())}, other.hostKey)+"\n"), 0600)
+	for _, policy := range []string{HostKeyStrict, HostKeyAsk, HostKeyAcceptNew} {
+		if err := dial(policy); err == nil || !strings.Contains(err.Error(), "has changed") {
+			t.Fatalf("%s with changed key: %v", policy, err)
+		}
+	}
+	if err := dial(HostKeyOff); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestKeyAuth(t *testing.T) {
+	home := isolateSSHEnv(t)
+	server := newTestSSHServer(t)
+	pub, priv, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	sshPub, _ := ssh.NewPublicKey(pub)
+	server.authorize(sshPub)
+
+	block, err := ssh.MarshalPrivateKeyWithPassphrase(priv, "test key", []byte("letmein"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	keyFile := filepath.Join(home, "id_test")
+	os.WriteFile(keyFile, pem.EncodeToMemory(block), 0600)
+	dial := func(target sshTarget) error {
+		target.Host, target.HostKey, target.SSHConfig = "test@"+server.addr(), HostKeyOff, "none"
+		c, err := dialSSH(target)
+		if err == nil {
+			c.Close()
+		}
+		return err
+	}
+
+	if err := dial(sshTarget{IdentityFiles: []string{keyFile}, Passphrase: "letmein"}); err != nil {
+		t.Fatalf("encrypted key with passphrase: %v", err)
+	}
+	if err := dial(sshTarget{IdentityFiles: []string{keyFile}}); err == nil {
+		t.Fatal("encrypted key without passphrase should fail")
+	}
+	interactive = func() bool { return true }
+	prompts := 0
+	promptPassword = func(prompt string) (string, error) {
+		prompts++
+		if !strings.Contains(prompt, "id_test") {
+			return "", fmt.Errorf("unexpected prompt %q", prompt)
+		}
+		return "letmein", nil
+	}
+	if err := dial(sshTarget{IdentityFiles: []string{keyFile}}); err != nil || prompts != 1 {
+		t.Fatalf("passphrase prompt: %v, %d prompts", err, prompts)
+	}
+	interactive = func() bool { return false }
+
+	// ssh-agent
+	keyring := agent.NewKeyring()
+	keyring.Add(agent.AddedKey{PrivateKey: priv})
+	sock := filepath.Join(home, "agent.sock")
+	ln, err := net.Listen("unix", sock)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+	go func() {
+		for {
+			c, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer c.Close()
+				agent.ServeAgent(keyring, c)
+			}()
+		}
+	}()
+	t.Setenv("SSH_AUTH_SOCK", sock)
+	if err := dial(sshTarget{}); err != nil {
+		t.Fatalf("agent: %v", err)
+	}
+}
+
+func TestJumpHosts(t *testing.T) {
+	home := isolateSSHEnv(t)
+	bastion, inner, target := newTestSSHServer(t), newTestSSHServer(t), newTestSSHServer(t)
+	_, priv, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	signer, _ := ssh.NewSignerFromKey(priv)
+	for _, s := range []*testSSHServer{inner, target} {
+		s.authorize(signer.PublicKey())
+	}
+	block, _ := ssh.MarshalPrivateKey(priv, "")
+	keyFile := filepath.Join(home, "id_jump")
+	os.WriteFile(keyFile, pem.EncodeToMemory(block), 0600)
+	echo := echoServer(t, "tcp", "127.0.0.1:0")
+	use := func(client *ssh.Client) {
+		t.Helper()
+		c, err := client.Dial("tcp", echo.Addr().String())
+		if err != nil {
+			t.Fatal(err)
+		}
+		expectEcho(t, c, "through the chain")
+	}
+
+	// 配置中的跳板机列表, 每一跳单独认证和校验主机密钥
+	cfg := sshTarget{
+		Host:          "test@" + target.addr(),
+		IdentityFiles: []string{keyFile},
+		HostKey:       HostKeyAcceptNew,
+		SSHConfig:     "none",
+		Jump: []sshTarget{
+			{Host: "test@" + bastion.addr(), Password: "secret", HostKey: HostKeyOff, SSHConfig: "none"},
+			{Host: "test@" + inner.addr(), IdentityFiles: []string{keyFile}, HostKey: HostKeyOff, SSHConfig: "none"},
+		},
+	}
+	client, err := dialSSH(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	use(client)
+	for name, s := range map[string]*testSSHServer{"bastion": bastion, "inner": inner, "target": target} {
+		if logins, _ := s.counts(); logins != 1 {
+			t.Fatalf("%s: %d logins", name, logins)
+		}
+	}
+	data, _ := os.ReadFile(filepath.Join(home, ".ssh", "known_hosts"))
+	if n := strings.Count(string(data), "\n"); n != 1 || !strings.Contains(string(data), knownhosts.Normalize(target.addr())) {
+		t.Fatalf("known_hosts:\n%s", data)
+	}
+	// 关闭目标连接后跳板机的连接也关闭
+	client.Close()
+	waitFor(t, "jump connections closed", func() bool {
+		_, a := bastion.counts()
+		_, b := inner.counts()
+		return a == 0 && b == 0
+	})
+
+	// 跳板机的主机密钥校验失败时报告是哪一跳
+	strict := cfg
+	strict.Jump = []sshTarget{{Host: "test@" + bastion.addr(), Password: "secret", HostKey: HostKeyStrict, SSHConfig: "none"}}
+	if _, err := dialSSH(strict); err == nil || !strings.Contains(err.Error(), "ssh test@"+bastion.addr()) || !strings.Contains(err.Error(), "is not in") {
+		t.Fatalf("strict bastion: %v", err)
+	}
+
+	// ssh_config 中的 ProxyJump, 跳板机自己的 ProxyJump 也会展开
+	sshConfigFile := filepath.Join(home, "config")
+	_, bastionPort, _ := net.SplitHostPort(bastion.addr())
+	_, innerPort, _ := net.SplitHostPort(inner.addr())
+	_, targetPort, _ := net.SplitHostPort(target.addr())
+	os.WriteFile(sshConfigFile, []byte(fmt.Sprintf(`
+Host docker
+  HostName 127.0.0.1
+  Port %s
+  ProxyJump inner
+Host inner
+  HostName 127.0.0.1
+  Port %s
+  ProxyJump bastion
+Host bastion
+  HostName 127.0.0.1
+  Port %s
+Host *
+  User test
+  IdentityFile %s
+  StrictHostKeyChecking no
+`, targetPort, innerPort, bastionPort, keyFile)), 0600)
+	bastion.authorize(signer.PublicKey())
+	client, err = dialSSH(sshTarget{Host: "docker", SSHConfig: sshConfigFile})
+	if err != nil {
+		t.Fatal(err)
+	}
+	use(client)
+	client.Close()
+	for name, s := range map[string]*testSSHServer{"bastion": bastion, "inner": inner, "target": target} {
+		if logins, _ := s.counts(); logins != 2 {
+			t.Fatalf("%s: %d logins", name, logins)
+		}
+	}
+
+	// -J 的写法, 隧道经跳板机转发
+	localPort := freePort(t)
+	chained := sshTarget{Host: "docker", SSHConfig: sshConfigFile, ProxyJump: "bastion,test@127.0.0.1:" + innerPort}
+	m, err := newTunnelManager(chained.Host, func() (*ssh.Client, error) { return dialSSH(chained) }, TunnelConfig{
+		Tunnels: []TunnelSpec{{Forward: "-L 127.0.0.1:" + localPort + ":" + echo.Addr().String()}},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan error)
+	go func() { done <- m.run(ctx) }()
+	waitFor(t, "connect", func() bool { return m.status().State == "connected" })
+	c, err := net.Dial("tcp", "127.0.0.1:"+localPort)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expectEcho(t, c, "tunnel through the chain")
+	cancel()
+	<-done
+	for name, s := range map[string]*testSSHServer{"bastion": bastion, "inner": inner, "target": target} {
+		if logins, _ := s.counts(); logins != 3 {
+			t.Fatalf("%s: %d logins", name, logins)
+		}
+	}
+}
+
+// 假的 docker API, 监听 unix socket, 只实现 CLI 用到的接口;
+// 容器的输出是命令本身, 命令为 sleep 时一直运行到 stop, 否则立即以 EXIT_CODE 退出
+type fakeDocker struct {
+	t      *testing.T
+	mu     sync.Mutex
+	images map[string]bool
+	byID   map[string]*fakeContainer
+	execs  map[string]*fakeExec
+	nextID int
+}
+
+type fakeContainer struct {
+	id, name  string
+	config    container.Config
+	host      container.HostConfig
+	running   bool
+	exitCode  int
+	started   chan struct{}
+	stopped   chan struct{}
+	logs      bytes.Buffer // 多路复用格式
+	startOnce sync.Once
+}
+
+type fakeExec struct {
+	container string
+	opts      container.ExecOptions
+	running   bool
+	exitCode  int
+}
+
+func newFakeDocker(t *testing.T, sock string) *fakeDocker {
+	f := &fakeDocker{t: t, images: map[string]bool{"alpine": true}, byID: map[string]*fakeContainer{}, execs: map[string]*fakeExec{}}
+	mux := http.NewServeMux()
+	mux.HandleFunc("GET /_ping", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("API-Version", "1.46")
+		io.WriteString(w, "OK")
+	})
+	mux.HandleFunc("HEAD /_ping", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("API-Version", "1.46")
+	})
+	mux.HandleFunc("POST /images/create", f.pull)
+	mux.HandleFunc("GET /containers/json", f.list)
+	mux.HandleFunc("POST /containers/create", f.create)
+	mux.HandleFunc("POST /containers/{id}/attach", f.attach)
+	mux.HandleFunc("POST /containers/{id}/start", f.start)
+	mux.HandleFunc("POST /containers/{id}/wait", f.wait)
+	mux.HandleFunc("POST /containers/{id}/stop", f.stop)
+	mux.HandleFunc("DELETE /containers/{id}", f.remove)
+	mux.HandleFunc("GET /containers/{id}/json", f.inspect)
+	mux.HandleFunc("GET /containers/{id}/logs", f.containerLogs)
+	mux.HandleFunc("POST /containers/{id}/exec", f.execCreate)
+	mux.HandleFunc("POST /exec/{id}/start", f.execStart)
+	mux.HandleFunc("POST /exec/{id}/resize", func(w http.ResponseWriter, r *http.Request) {})
+	mux.HandleFunc("GET /exec/{id}/json", f.execInspect)
+	version := regexp.MustCompile(`^/v[0-9.]+/`)
+	ln, err := net.Listen("unix", sock)
+	if err != nil {
+		t.Fatal(err)
+	}
+	srv := &http.Server{Handler: http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		r.URL.Path = version.ReplaceAllString(r.URL.Path, "/")
+		mux.ServeHTTP(w, r)
+	})}
+	go srv.Serve(ln)
+	t.Cleanup(func() { srv.Close() })
+	return f
+}
+
+func dockerError(w http.ResponseWriter, code int, format string, args ...any) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(code)
+	json.NewEncoder(w).Encode(map[string]string{"message": fmt.Sprintf(format, args...)})
+}
+
+func writeJSON(w http.ResponseWriter, code int, v any) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(code)
+	json.NewEncoder(w).Encode(v)
+}
+
+// 按 ID、ID 前缀或名字查找
+func (f *fakeDocker) lookup(ref string) *fakeContainer {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	for _, c := range f.byID {
+		if c.id == ref || c.name == ref || strings.HasPrefix(c.id, ref) {
+			return c
+		}
+	}
+	return nil
+}
+
+func (f *fakeDocker) container(w http.ResponseWriter, r *http.Request) *fakeContainer {
+	c := f.lookup(r.PathValue("id"))
+	if c == nil {
+		dockerError(w, http.StatusNotFound, "No such container: %s", r.PathValue("id"))
+	}
+	return c
+}
+
+func (f *fakeDocker) pull(w http.ResponseWriter, r *http.Request) {
+	ref := r.URL.Query().Get("fromImage")
+	w.Header().Set("Content-Type", "application/json")
+	enc := json.NewEncoder(w)
+	if ref == "missing" {
+		enc.Encode(map[string]any{"errorDetail": map[string]string{"message": "manifest unknown"}, "error": "manifest unknown"})
+		return
+	}
+	enc.Encode(map[string]string{"status": "Pulling from library/" + ref, "id": "latest"})
+	for _, n := range []int{0, 512, 1024} {
+		enc.Encode(map[string]any{"status": "Downloading", "id": "deadbeef", "progressDetail": map[string]int{"current": n, "total": 1024}})
+	}
+	enc.Encode(map[string]string{"status": "Pull complete", "id": "deadbeef"})
+	enc.Encode(map[string]string{"status": "Status: Downloaded newer image for " + ref + ":latest"})
+	f.mu.Lock()
+	f.images[ref] = true
+	f.mu.Unlock()
+}
+
+func (f *fakeDocker) list(w http.ResponseWriter, r *http.Request) {
+	all := r.URL.Query().Get("all") == "1"
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	list := []types.Container{}
+	for _, c := range f.byID {
+		if !c.running && !all {
+			continue
+		}
+		item := types.Container{ID: c.id, Names: []string{"/" + c.name}, Image: c.config.Image, Command: strings.Join(c.config.Cmd, " "), Status: "Exited"}
+		if c.running {
+			item.Status = "Up"
+		}
+		for port, bindings := range c.host.PortBindings {
+			for _, b := range bindings {
+				hostPort, _ := strconv.Atoi(b.HostPort)
+				ip := b.HostIP
+				if ip == "" {
+					ip = "0.0.0.0"
+				}
+				item.Ports = append(item.Ports, types.Port{IP: ip, PrivatePort: uint16(port.Int()), PublicPort: uint16(hostPort), Type: port.Proto()})
+			}
+		}
+		list = append(list, item)
+	}
+	writeJSON(w, http.StatusOK, list)
+}
+
+func (f *fakeDocker) create(w http.ResponseWriter, r *http.Request) {
+	var body struct {
+		container.Config
+		HostConfig container.HostConfig
+	}
+	if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
+		dockerError(w, http.StatusBadRequest, "%v", err)
+		return
+	}
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if !f.images[body.Image] {
+		dockerError(w, http.StatusNotFound, "No such image: %s", body.Image)
+		return
+	}
+	f.nextID++
+	id := fmt.Sprintf("%064x", f.nextID)
+	name := r.URL.Query().Get("name")
+	if name == "" {
+		name = "container" + strconv.Itoa(f.nextID)
+	}
+	f.byID[id] = &fakeContainer{id: id, name: name, config: body.Config, host: body.HostConfig, started: make(chan struct{}), stopped: make(chan struct{})}
+	writeJSON(w, http.StatusCreated, container.CreateResponse{ID: id})
+}
+
+func (f *fakeDocker) start(w http.ResponseWriter, r *http.Request) {
+	c := f.container(w, r)
+	if c == nil {
+		return
+	}
+	f.mu.Lock()
+	c.running = true
+	stdout := stdcopy.NewStdWriter(&c.logs, stdcopy.Stdout)
+	stderr := stdcopy.NewStdWriter(&c.logs, stdcopy.Stderr)
+	fmt.Fprintln(stdout, strings.Join(c.config.Cmd, " "))
+	fmt.Fprintln(stderr, "started "+c.name)
+	sleeping := len(c.config.Cmd) > 0 && c.config.Cmd[0] == "sleep"
+	if !sleeping {
+		c.running = false
+		for _, e := range c.config.Env {
+			if code, ok := strings.CutPrefix(e, "EXIT_CODE="); ok {
+				c.exitCode, _ = strconv.Atoi(code)
+			}
+		}
+	}
+	f.mu.Unlock()
+	close(c.started)
+	if !sleeping {
+		close(c.stopped)
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func (f *fakeDocker) stop(w http.ResponseWriter, r *http.Request) {
+	c := f.container(w, r)
+	if c == nil {
+		return
+	}
+	f.mu.Lock()
+	wasRunning := c.running
+	c.running = false
+	f.mu.Unlock()
+	if wasRunning {
+		close(c.stopped)
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func (f *fakeDocker) remove(w http.ResponseWriter, r *http.Request) {
+	c := f.container(w, r)
+	if c == nil {
+		return
+	}
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if c.running && r.URL.Query().Get("force") != "1" {
+		dockerError(w, http.StatusConflict, "cannot remove running container %s", c.name)
+		return
+	}
+	delete(f.byID, c.id)
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func (f *fakeDocker) wait(w http.ResponseWriter, r *http.Request) {
+	c := f.container(w, r)
+	if c == nil {
+		return
+	}
+	// 先回复头, 与 docker 一样在容器退出时才写 body
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	w.(http.Flusher).Flush()
+	<-c.stopped
+	f.mu.Lock()
+	code := c.exitCode
+	f.mu.Unlock()
+	json.NewEncoder(w).Encode(container.WaitResponse{StatusCode: int64(code)})
+}
+
+func (f *fakeDocker) inspect(w http.ResponseWriter, r *http.Request) {
+	c := f.container(w, r)
+	if c == nil {
+		return
+	}
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	config := c.config
+	writeJSON(w, http.StatusOK, types.ContainerJSON{
+		ContainerJSONBase: &types.ContainerJSONBase{ID: c.id, Name: "/" + c.name, Image: c.config.Image, State: &types.ContainerState{Running: c.running}},
+		Config:            &config,
+	})
+}
+
+// 把连接劫持为原始流, 与 docker 的 attach/exec 相同
+func hijack(w http.ResponseWriter) (net.Conn, *bufio.ReadWriter) {
+	conn, rw, err := w.(http.Hijacker).Hijack()
+	if err != nil {
+		panic(err)
+	}
+	rw.WriteString("HTTP/1.1 101 UPGRADED\r\nContent-Type: application/vnd.docker.raw-stream\r\nConnection: Upgrade\r\nUpgrade: tcp\r\n\r\n")
+	rw.Flush()
+	return conn, rw
+}
+
+func (f *fakeDocker) attach(w http.ResponseWriter, r *http.Request) {
+	c := f.container(w, r)
+	if c == nil {
+		return
+	}
+	conn, rw := hijack(w)
+	defer conn.Close()
+	<-c.started
+	f.mu.Lock()
+	rw.Write(c.logs.Bytes())
+	f.mu.Unlock()
+	rw.Flush()
+	<-c.stopped
+}
+
+func (f *fakeDocker) containerLogs(w http.ResponseWriter, r *http.Request) {
+	c := f.container(w, r)
+	if c == nil {
+		return
+	}
+	f.mu.Lock()
+	w.Write(c.logs.Bytes())
+	f.mu.Unlock()
+	w.(http.Flusher).Flush()
+	if r.URL.Query().Get("follow") == "1" {
+		select {
+		case <-c.stopped:
+		case <-r.Context().Done():
+		}
+	}
+}
+
+func (f *fakeDocker) execCreate(w http.ResponseWriter, r *http.Request) {
+	c := f.container(w, r)
+	if c == nil {
+		return
+	}
+	var opts container.ExecOptions
+	json.NewDecoder(r.Body).Decode(&opts)
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.nextID++
+	id := fmt.Sprintf("exec%d", f.nextID)
+	f.execs[id] = &fakeExec{container: c.id, opts: opts, running: true}
+	writeJSON(w, http.StatusCreated, map[string]string{"Id": id})
+}
+
+// cat 回显 stdin, "sh -c exit N" 以 N 退出, 其它命令输出命令本身
+func (f *fakeDocker) execStart(w http.ResponseWriter, r *http.Request) {
+	f.mu.Lock()
+	e := f.execs[r.PathValue("id")]
+	f.mu.Unlock()
+	if e == nil {
+		dockerError(w, http.StatusNotFound, "No such exec instance")
+		return
+	}
+	io.Copy(io.Discard, r.Body)
+	conn, rw := hijack(w)
+	defer conn.Close()
+	var out io.Writer = rw
+	if !e.opts.Tty {
+		out = stdcopy.NewStdWriter(rw, stdcopy.Stdout)
+	}
+	code := 0
+	switch cmd := e.opts.Cmd; {
+	case cmd[0] == "cat":
+		io.Copy(out, rw)
+	case len(cmd) == 3 && cmd[0] == "sh" && strings.HasPrefix(cmd[2], "exit "):
+		code, _ = strconv.Atoi(strings.TrimPrefix(cmd[2], "exit "))
+	default:
+		fmt.Fprintln(out, strings.Join(cmd, " "))
+	}
+	rw.Flush()
+	f.mu.Lock()
+	e.running, e.exitCode = false, code
+	f.mu.Unlock()
+}
+
+func (f *fakeDocker) execInspect(w http.ResponseWriter, r *http.Request) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	e := f.execs[r.PathValue("id")]
+	if e == nil {
+		dockerError(w, http.StatusNotFound, "No such exec instance")
+		return
+	}
+	writeJSON(w, http.StatusOK, container.ExecInspect{ExecID: r.PathValue("id"), ContainerID: e.container, Running: e.running, ExitCode: e.exitCode})
+}
+
+// 并发写安全的 buffer
+type lockedBuffer struct {
+	mu  sync.Mutex
+	buf bytes.Buffer
+}
+
+func (b *lockedBuffer) Write(p []byte) (int, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.buf.Write(p)
+}
+
+func (b *lockedBuffer) String() string {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.buf.String()
+}
+
+func TestDocker(t *testing.T) {
+	isolateSSHEnv(t)
+	server := newTestSSHServer(t)
+	sock := filepath.Join(t.TempDir(), "docker.sock")
+	fake := newFakeDocker(t, sock)
+	sc, err := dialSSH(sshTarget{Host: "ssh://test@" + server.addr(), Password: "secret", HostKey: HostKeyOff, SSHConfig: "none"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer sc.Close()
+	api, err := newDockerClient(sc, sock)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer api.Close()
+	ctx := context.Background()
+	docker := func(stdin string, args ...string) (string, string, error) {
+		t.Helper()
+		var stdout, stderr lockedBuffer
+		err := dockerCommands[args[0]](ctx, &dockerCLI{api: api, stdin: strings.NewReader(stdin), stdout: &stdout, stderr: &stderr}, args[1:])
+		return stdout.String(), stderr.String(), err
+	}
+
+	out, _, err := docker("", "pull", "nginx")
+	if err != nil || !strings.Contains(out, "Downloaded newer image for nginx:latest") {
+		t.Fatalf("pull: %v\n%s", err, out)
+	}
+	if _, _, err := docker("", "pull", "missing"); err == nil || !strings.Contains(err.Error(), "manifest unknown") {
+		t.Fatalf("pull missing: %v", err)
+	}
+
+	out, _, err = docker("", "run", "-d", "--name", "web", "-e", "A=1", "-e", "B=2", "-p", "127.0.0.1:8080:80", "-v", "/data:/data:ro", "nginx", "sleep", "infinity")
+	if err != nil {
+		t.Fatal(err)
+	}
+	web := fake.lookup("web")
+	if web == nil || strings.TrimSpace(out) != web.id {
+		t.Fatalf("run -d printed %q", out)
+	}
+	if b := web.host.PortBindings["80/tcp"]; len(b) != 1 || b[0].HostIP != "127.0.0.1" || b[0].HostPort != "8080" ||
+		len(web.config.Env) != 2 || len(web.host.Binds) != 1 || web.host.Binds[0] != "/data:/data:ro" {
+		t.Fatalf("run -d config: %+v %+v", web.config, web.host)
+	}
+
+	// 前台运行, 镜像不存在时先拉取, 返回容器的退出码
+	out, errOut, err := docker("", "run", "--name", "job", "-e", "EXIT_CODE=3", "busybox", "echo", "hi")
+	if code, ok := err.(exitError); !ok || code != 3 {
+		t.Fatalf("run: %v", err)
+	}
+	if out != "echo hi\n" || !strings.Contains(errOut, "Unable to find image 'busybox'") || !strings.Contains(errOut, "started job") {
+		t.Fatalf("run output: %q %q", out, errOut)
+	}
+
+	out, _, err = docker("", "ps")
+	if err != nil || !strings.Contains(out, "web") || strings.Contains(out, "job") || !strings.Contains(out, "127.0.0.1:8080->80/tcp") {
+		t.Fatalf("ps: %v\n%s", err, out)
+	}
+	if out, _, _ := docker("", "ps", "-a"); !strings.Contains(out, "job") {
+		t.Fatalf("ps -a:\n%s", out)
+	}
+
+	out, _, err = docker("", "inspect", "web")
+	var inspected []types.ContainerJSON
+	if err != nil || json.Unmarshal([]byte(out), &inspected) != nil || len(inspected) != 1 || inspected[0].Name != "/web" {
+		t.Fatalf("inspect: %v\n%s", err, out)
+	}
+	if _, errOut, err := docker("", "inspect", "web", "nope"); err == nil || !strings.Contains(errOut, "No such container: nope") {
+		t.Fatalf("inspect missing: %v %s", err, errOut)
+	}
+
+	out, _, err = docker("hello\nworld\n", "exec", "-it", "web", "cat")
+	if err != nil || out != "hello\nworld\n" {
+		t.Fatalf("exec -it: %v %q", err, out)
+	}
+	out, _, err = docker("", "exec", "web", "uname", "-a")
+	if err != nil || out != "uname -a\n" {
+		t.Fatalf("exec: %v %q", err, out)
+	}
+	if _, _, err := docker("", "exec", "web", "sh", "-c", "exit 5"); err != exitError(5) {
+		t.Fatalf("exec exit code: %v", err)
+	}
+
+	// logs -f 在容器停止时结束
+	var logs lockedBuffer
+	logsDone := make(chan error)
+	go func() {
+		logsDone <- dockerLogs(ctx, &dockerCLI{api: api, stdout: &logs, stderr: &logs}, []string{"-f", "web"})
+	}()
+	waitFor(t, "logs", func() bool { return strings.Contains(logs.String(), "started web") })
+	select {
+	case err := <-logsDone:
+		t.Fatalf("logs -f returned early: %v", err)
+	case <-time.After(50 * time.Millisecond):
+	}
+	if _, _, err := docker("", "rm", "web"); err == nil {
+		t.Fatal("rm of a running container should fail")
+	}
+	if out, _, err := docker("", "stop", "-t", "1", "web"); err != nil || out != "web\n" {
+		t.Fatalf("stop: %v %q", err, out)
+	}
+	if err := <-logsDone; err != nil || logs.String() != "sleep infinity\nstarted web\n" {
+		t.Fatalf("logs: %v %q", err, logs.String())
+	}
+
+	out, errOut, err = docker("", "rm", "web", "nope", "job")
+	if err != exitError(1) || out != "web\njob\n" || !strings.Contains(errOut, "nope") {
+		t.Fatalf("rm: %v %q %q", err, out, errOut)
+	}
+	if out, _, _ := docker("", "ps", "-a"); strings.Count(out, "\n") != 1 {
+		t.Fatalf("ps after rm:\n%s", out)
+	}
+}
+
+func TestPssh(t *testing.T) {
+	home := isolateSSHEnv(t)
+	servers := map[string]*testSSHServer{}
+	for _, name := range []string{"good", "bad", "slow"} {
+		s := newTestSSHServer(t)
+		s.Env = []string{"NAME=" + name}
+		servers[name] = s
+	}
+	unreachable := "127.0.0.1:" + freePort(t)
+
+	// 文本清单和命令行默认值
+	text := filepath.Join(home, "hosts.txt")
+	os.WriteFile(text, []byte("# fleet\ntest@"+servers["good"].addr()+"\n\n  test@"+servers["bad"].addr()+"  # db\n"), 0600)
+	hosts, err := loadInventory(text, sshTarget{Password: "secret", HostKey: HostKeyOff, SSHConfig: "none"})
+	if err != nil || len(hosts) != 2 || hosts[1].Host != "test@"+servers["bad"].addr() || hosts[1].Password != "secret" {
+		t.Fatalf("text inventory: %v %+v", err, hosts)
+	}
+
+	// json 清单, 每台主机单独认证
+	inventory := []sshTarget{
+		{Host: "test@" + servers["good"].addr()},
+		{Host: "test@" + servers["bad"].addr()},
+		{Host: "test@" + servers["slow"].addr()},
+		{Host: "test@" + unreachable},
+		{Host: "test@" + servers["good"].addr(), Password: "wrong"},
+	}
+	data, _ := json.Marshal(inventory)
+	file := filepath.Join(home, "hosts.json")
+	os.WriteFile(file, data, 0600)
+	hosts, err = loadInventory(file, sshTarget{Password: "secret", HostKey: HostKeyOff, SSHConfig: "none"})
+	if err != nil || len(hosts) != 5 || hosts[4].Password != "wrong" || hosts[0].Password != "secret" {
+		t.Fatalf("json inventory: %v %+v", err, hosts)
+	}
+
+	command := `echo out $NAME; echo err $NAME >&2; case $NAME in bad) exit 3;; slow) sleep 10;; esac`
+	opts := psshOptions{Concurrency: 2, Timeout: 500 * time.Millisecond, Mode: "collect"}
+	var out lockedBuffer
+	start := time.Now()
+	results := runParallel(context.Background(), hosts, command, opts, &out)
+	if elapsed := time.Since(start); elapsed > 3*time.Second {
+		t.Fatalf("took %v", elapsed)
+	}
+	check := func(i, code int, stdout, errPart string) {
+		t.Helper()
+		r := results[i]
+		if r.Host != hosts[i].Host || r.ExitCode != code || (stdout != "" && r.Stdout != stdout) || !strings.Contains(r.Error, errPart) || (errPart == "") != (r.Error == "") {
+			t.Errorf("host %d: %+v", i, r)
+		}
+	}
+	check(0, 0, "out good\n", "")
+	check(1, 3, "out bad\n", "")
+	check(2, -1, "out slow\n", "timeout after 500ms")
+	check(3, -1, "", "connect")
+	check(4, -1, "", "unable to authenticate")
+	if results[0].Stderr != "err good\n" {
+		t.Errorf("stderr: %q", results[0].Stderr)
+	}
+	if s := out.String(); !strings.Contains(s, "[SUCCESS] test@"+servers["good"].addr()+"\nout good\nStderr: err good\n") ||
+		!strings.Contains(s, "[FAILURE] test@"+servers["bad"].addr()+" Exited with error code 3\n") {
+		t.Errorf("collect output:\n%s", s)
+	}
+
+	// 实时输出, 每行带主机名
+	var prefixed lockedBuffer
+	opts.Mode = "prefix"
+	results = runParallel(context.Background(), hosts[:2], "printf 'a\\nb'; echo e >&2", opts, &prefixed)
+	for _, want := range []string{"test@" + servers["good"].addr() + " | a\n", "test@" + servers["good"].addr() + " | b\n", "test@" + servers["bad"].addr() + " ! e\n"} {
+		if !strings.Contains(prefixed.String(), want) {
+			t.Errorf("prefix output missing %q:\n%s", want, prefixed.String())
+		}
+	}
+	if results[0].Stdout != "" {
+		t.Errorf("prefix mode should not keep output: %+v", results[0])
+	}
+
+	var summary bytes.Buffer
+	printSummary(&summary, results)
+	if !strings.Contains(summary.String(), "HOST") || !strings.Contains(summary.String(), "2 hosts, 2 ok, 0 failed") {
+		t.Errorf("summary:\n%s", summary.String())
+	}
+
+	// 并行连接时主机密钥确认和密码提示逐个出现, 不会同时读终端
+	interactive = func() bool { return true }
+	var asking, overlaps, prompts atomic.Int32
+	prompt := func(answer string) (string, error) {
+		if asking.Add(1) > 1 {
+			overlaps.Add(1)
+		}
+		prompts.Add(1)
+		time.Sleep(20 * time.Millisecond)
+		asking.Add(-1)
+		return answer, nil
+	}
+	promptLine = func(string) (string, error) { return prompt("yes") }
+	promptPassword = func(string) (string, error) { return prompt("secret") }
+	var interactiveHosts []sshTarget
+	for _, name := range []string{"good", "bad", "slow"} {
+		interactiveHosts = append(interactiveHosts, sshTarget{Host: "test@" + servers[name].addr(), HostKey: HostKeyAsk, SSHConfig: "none"})
+	}
+	opts = psshOptions{Concurrency: 3, Timeout: 5 * time.Second, Mode: "collect"}
+	for i, r := range runParallel(context.Background(), interactiveHosts, "true", opts, io.Discard) {
+		if !r.ok() {
+			t.Errorf("interactive host %d: %+v", i, r)
+		}
+	}
+	if prompts.Load() != 6 || overlaps.Load() != 0 {
+		t.Errorf("%d prompts, %d overlapping", prompts.Load(), overlaps.Load())
+	}
+}
+
+func TestSFTPCopy(t *testing.T) {
+	isolateSSHEnv(t)
+	server := newTestSSHServer(t)
+	sc, err := dialSSH(sshTarget{Host: "test@" + server.addr(), Password: "secret", HostKey: HostKeyOff, SSHConfig: "none"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer sc.Close()
+	remote, err := newRemoteFS(sc)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer remote.Close()
+
+	// 本地目录树, 权限和时间各不相同
+	local, remoteDir := t.TempDir(), t.TempDir()
+	src := filepath.Join(local, "conf")
+	mtime := time.Date(2020, 1, 2, 3, 4, 5, 0, time.UTC)
+	big := make([]byte, 1<<20)
+	rand.Read(big)
+	files := map[string]struct {
+		data []byte
+		mode os.FileMode
+	}{
+		"app.yaml":        {[]byte("listen: :80\n"), 0640},
+		"bin/run.sh":      {[]byte("#!/bin/sh\necho hi\n"), 0755},
+		"data/large.bin":  {big, 0600},
+		"data/empty.conf": {nil, 0644},
+	}
+	for name, f := range files {
+		p := filepath.Join(src, name)
+		os.MkdirAll(filepath.Dir(p), 0755)
+		os.WriteFile(p, f.data, f.mode)
+		os.Chmod(p, f.mode)
+		os.Chtimes(p, mtime, mtime)
+	}
+	os.Chmod(filepath.Join(src, "bin"), 0750)
+	os.Chtimes(filepath.Join(src, "bin"), mtime, mtime)
+
+	verify := func(root string) {
+		t.Helper()
+		for name, f := range files {
+			p := filepath.Join(root, name)
+			st, err := os.Stat(p)
+			if err != nil {
+				t.Fatal(err)
+			}
+			data, _ := os.ReadFile(p)
+			if !bytes.Equal(data, f.data) || st.Mode().Perm() != f.mode || !st.ModTime().Equal(mtime) {
+				t.Fatalf("%s: mode %v mtime %v, %d bytes", p, st.Mode(), st.ModTime(), len(data))
+			}
+		}
+		if st, _ := os.Stat(filepath.Join(root, "bin")); st.Mode().Perm() != 0750 || !st.ModTime().Equal(mtime) {
+			t.Fatalf("bin dir: %v %v", st.Mode(), st.ModTime())
+		}
+	}
+
+	var progress bytes.Buffer
+	upload := &copier{src: localFS{}, dst: remote, recursive: true, progress: &progress}
+	if err := upload.copy(src, remoteDir, false); err != nil {
+		t.Fatal(err)
+	}
+	verify(filepath.Join(remoteDir, "conf"))
+	if upload.copied != 4 || upload.skipped != 0 || upload.bytes != int64(len(big))+30 {
+		t.Fatalf("upload stats: %+v", upload)
+	}
+	if !strings.Contains(progress.String(), "large.bin 100.0% 1.0MiB/1.0MiB") {
+		t.Fatalf("progress:\n%s", progress.String())
+	}
+
+	// 再次上传时全部跳过; 大小相同修改时间不同的文件重新上传
+	again := &copier{src: localFS{}, dst: remote, recursive: true}
+	if err := again.copy(src, remoteDir, false); err != nil || again.copied != 0 || again.skipped != 4 || again.bytes != 0 {
+		t.Fatalf("second upload: %v %+v", err, again)
+	}
+	os.WriteFile(filepath.Join(remoteDir, "conf", "app.yaml"), []byte("listen: :81\n"), 0640)
+	again = &copier{src: localFS{}, dst: remote, recursive: true}
+	if err := again.copy(src, remoteDir, false); err != nil || again.copied != 1 || again.skipped != 3 {
+		t.Fatalf("changed file: %v %+v", err, again)
+	}
+	// 大小和修改时间都相同时不读内容, -verify 时按校验和发现不同
+	remoteApp := filepath.Join(remoteDir, "conf", "app.yaml")
+	os.WriteFile(remoteApp, []byte("listen: :82\n"), 0640)
+	os.Chtimes(remoteApp, mtime, mtime)
+	again = &copier{src: localFS{}, dst: remote, recursive: true}
+	if err := again.copy(src, remoteDir, false); err != nil || again.copied != 0 || again.skipped != 4 {
+		t.Fatalf("same size and mtime: %v %+v", err, again)
+	}
+	again = &copier{src: localFS{}, dst: remote, recursive: true, verify: true}
+	if err := again.copy(src, remoteDir, false); err != nil || again.copied != 1 || again.skipped != 3 {
+		t.Fatalf("verify: %v %+v", err, again)
+	}
+
+	// 断点续传: .part 中已有前一半
+	dst := filepath.Join(remoteDir, "resume.bin")
+	os.WriteFile(dst+".part", big[:len(big)/2], 0600)
+	resume := &copier{src: localFS{}, dst: remote}
+	if err := resume.copy(filepath.Join(src, "data", "large.bin"), dst, false); err != nil {
+		t.Fatal(err)
+	}
+	if data, _ := os.ReadFile(dst); !bytes.Equal(data, big) || resume.resumed != 1 || resume.bytes != int64(len(big)/2) {
+		t.Fatalf("resume: %d bytes, %+v", len(data), resume)
+	}
+	if _, err := os.Stat(dst + ".part"); !os.IsNotExist(err) {
+		t.Fatalf(".part left behind: %v", err)
+	}
+	// 断点前的内容与源文件不一致时续传前就发现, 直接从头传
+	os.Remove(dst)
+	os.WriteFile(dst+".part", make([]byte, 1000), 0600)
+	resume = &copier{src: localFS{}, dst: remote}
+	if err := resume.copy(filepath.Join(src, "data", "large.bin"), dst, false); err != nil {
+		t.Fatal(err)
+	}
+	if data, _ := os.ReadFile(dst); !bytes.Equal(data, big) || resume.resumed != 0 || resume.bytes != int64(len(big)) {
+		t.Fatalf("corrupt resume: %d bytes, %+v", len(data), resume)
+	}
+	// 只比较断点前最后一块, 更早的损坏在 -verify 时由整个文件的校验和发现
+	os.Remove(dst)
+	corrupt := append([]byte(nil), big[:len(big)/2]...)
+	corrupt[0] ^= 0xff
+	os.WriteFile(dst+".part", corrupt, 0600)
+	resume = &copier{src: localFS{}, dst: remote, verify: true}
+	if err := resume.copy(filepath.Join(src, "data", "large.bin"), dst, false); err != nil {
+		t.Fatal(err)
+	}
+	if data, _ := os.ReadFile(dst); !bytes.Equal(data, big) || resume.resumed != 1 || resume.bytes != int64(len(big))*3/2 {
+		t.Fatalf("verified resume: %d bytes, %+v", len(data), resume)
+	}
+
+	// 下载回另一个目录
+	back := t.TempDir()
+	download := &copier{src: remote, dst: localFS{}, recursive: true}
+	os.WriteFile(filepath.Join(remoteDir, "conf", "app.yaml"), files["app.yaml"].data, 0640)
+	os.Chtimes(filepath.Join(remoteDir, "conf", "app.yaml"), mtime, mtime)
+	if err := download.copy(filepath.Join(remoteDir, "conf"), back, false); err != nil {
+		t.Fatal(err)
+	}
+	verify(filepath.Join(back, "conf"))
+
+	if err := (&copier{src: remote, dst: localFS{}}).copy(filepath.Join(remoteDir, "conf"), back, false); err == nil {
+		t.Fatal("directory without -r should fail")
+	}
+
+	for _, c := range []struct{ in, host, path string }{
+		{"web:/etc/app", "web", "/etc/app"},
+		{"root@10.0.0.1:", "root@10.0.0.1", "."},
+		{"[::1]:/tmp", "[::1]", "/tmp"},
+	} {
+		if host, p, remote := splitRemote(c.in); !remote || host != c.host || p != c.path {
+			t.Errorf("%s: %s %s %v", c.in, host, p, remote)
+		}
+	}
+	for _, local := range []string{"./a:b", "/tmp/x", "file.txt"} {
+		if _, _, remote := splitRemote(local); remote {
+			t.Errorf("%s should be local", local)
+		}
+	}
+}
+
+// 目录中的符号链接: 指向目录的复制为链接, 不会因为环路无限递归
+func TestSFTPCopySymlinks(t *testing.T) {
+	isolateSSHEnv(t)
+	addr := newTestSSHServer(t).addr()
+	sc, err := dialSSH(sshTarget{Host: "test@" + addr, Password: "secret", HostKey: HostKeyOff, SSHConfig: "none"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer sc.Close()
+	remote, err := newRemoteFS(sc)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer remote.Close()
+
+	src := filepath.Join(t.TempDir(), "tree")
+	os.MkdirAll(filepath.Join(src, "sub"), 0755)
+	os.WriteFile(filepath.Join(src, "sub", "file"), []byte("data"), 0644)
+	links := map[string]string{
+		"parent":   "..",
+		"self":     ".",
+		"sub/up":   "../sub",
+		"sub/root": src,
+	}
+	for name, target := range links {
+		if err := os.Symlink(target, filepath.Join(src, name)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	os.Symlink("sub/file", filepath.Join(src, "file.lnk"))
+
+	check := func(root string) {
+		t.Helper()
+		for name, want := range links {
+			if got, err := os.Readlink(filepath.Join(root, name)); err != nil || got != want {
+				t.Errorf("%s: link %q %v, want %q", name, got, err, want)
+			}
+		}
+		st, err := os.Lstat(filepath.Join(root, "file.lnk"))
+		if data, _ := os.ReadFile(filepath.Join(root, "file.lnk")); err != nil || !st.Mode().IsRegular() || string(data) != "data" {
+			t.Errorf("file.lnk: %v %v %q", st, err, data)
+		}
+	}
+
+	remoteDir := t.TempDir()
+	done := make(chan error, 1)
+	upload := &copier{src: localFS{}, dst: remote, recursive: true}
+	go func() { done <- upload.copy(src, remoteDir, false) }()
+	select {
+	case err := <-done:
+		if err != nil {
+			t.Fatal(err)
+		}
+	case <-time.After(30 * time.Second):
+		t.Fatal("copy did not finish, following a symlink loop?")
+	}
+	check(filepath.Join(remoteDir, "tree"))
+	if upload.copied != 6 {
+		t.Errorf("upload stats: %+v", upload)
+	}
+
+	// 再次上传时链接已经存在, 跳过; 指向不同目标的链接被替换
+	os.Remove(filepath.Join(remoteDir, "tree", "self"))
+	os.Symlink("sub", filepath.Join(remoteDir, "tree", "self"))
+	again := &copier{src: localFS{}, dst: remote, recursive: true}
+	if err := again.copy(src, remoteDir, false); err != nil || again.copied != 1 || again.skipped != 5 {
+		t.Fatalf("second upload: %v %+v", err, again)
+	}
+	check(filepath.Join(remoteDir, "tree"))
+
+	back := t.TempDir()
+	download := &copier{src: remote, dst: localFS{}, recursive: true}
+	if err := download.copy(filepath.Join(remoteDir, "tree"), back, false); err != nil {
+		t.Fatal(err)
+	}
+	check(filepath.Join(back, "tree"))
+}
@@ -0,0 +1,535 @@
+package main
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"flag"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/pkg/sftp"
+	"golang.org/x/crypto/ssh"
+	"golang.org/x/term"
+)
+
+// 经 SFTP 上传下载文件和目录, 路径写法与 scp 相同:
+//
+//	cp -r ./conf root@web:/etc/app        上传
+//	cp web:/var/log/app.log ./logs/       下载
+//
+// 保留权限和修改时间; 目标已存在且大小和修改时间相同时跳过, -verify 时改为比较校验和;
+// 先写到 .part 文件, 中断后再次执行时从断点继续
+// -r 时目录中指向文件的符号链接复制内容, 指向目录的符号链接复制为链接
+func runCp(args []string) {
+	fs := flag.NewFlagSet("cp", flag.ExitOnError)
+	var target sshTarget
+	targetFlags(fs, &target)
+	recursive := fs.Bool("r", false, "copy directories recursively")
+	quiet := fs.Bool("q", false, "do not show progress")
+	verify := fs.Bool("verify", false, "compare checksums instead of size and mtime, and check resumed files end to end")
+	fs.Parse(args)
+	if fs.NArg() < 2 {
+		fmt.Fprintln(os.Stderr, "usage: cp [flags] src... dst, remote paths are [user@]host:path")
+		os.Exit(2)
+	}
+	srcs, dst := fs.Args()[:fs.NArg()-1], fs.Arg(fs.NArg()-1)
+	host, dstPath, upload := splitRemote(dst)
+	var srcPaths []string
+	for _, s := range srcs {
+		h, p, remote := splitRemote(s)
+		if remote == upload || (remote && host != "" && h != host) {
+			fmt.Fprintln(os.Stderr, "cp: exactly one side must be remote, and all remote paths must be on the same host")
+			os.Exit(2)
+		}
+		if remote {
+			host = h
+		}
+		srcPaths = append(srcPaths, p)
+	}
+	if !upload {
+		dstPath = dst
+	}
+	target.Host = host
+
+	sc, err := dialSSH(target)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+	defer sc.Close()
+	remote, err := newRemoteFS(sc)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+	defer remote.Close()
+
+	c := &copier{src: remote, dst: localFS{}, recursive: *recursive, verify: *verify}
+	if upload {
+		c.src, c.dst = localFS{}, remote
+	}
+	if !*quiet {
+		c.progress = os.Stderr
+	}
+	failed := false
+	for _, src := range srcPaths {
+		if err := c.copy(src, dstPath, len(srcPaths) > 1); err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			failed = true
+		}
+	}
+	fmt.Fprintf(os.Stderr, "%d copied, %d skipped, %d resumed, %s transferred\n", c.copied, c.skipped, c.resumed, formatBytes(c.bytes))
+	if failed {
+		os.Exit(1)
+	}
+}
+
+// 与 scp 一样, 第一个 / 之前有冒号的是远程路径
+func splitRemote(s string) (host, p string, remote bool) {
+	i := strings.Index(s, ":")
+	if i <= 0 || (strings.Contains(s[:i], "/") && !strings.HasPrefix(s, "[")) {
+		return "", s, false
+	}
+	// [ipv6]:path
+	if strings.HasPrefix(s, "[") {
+		j := strings.Index(s, "]:")
+		if j < 0 {
+			return "", s, false
+		}
+		return s[:j+1], s[j+2:], true
+	}
+	p = s[i+1:]
+	if p == "" {
+		p = "."
+	}
+	return s[:i], p, true
+}
+
+// 本地和远程文件系统的公共部分
+type fileSystem interface {
+	Stat(name string) (fs.FileInfo, error)
+	ReadDir(name string) ([]fs.FileInfo, error)
+	Open(name string) (io.ReadSeekCloser, error)
+	OpenFile(name string, flag int) (io.WriteSeeker, func() error, error)
+	MkdirAll(name string) error
+	Chmod(name string, mode fs.FileMode) error
+	Chtimes(name string, atime, mtime time.Time) error
+	Rename(oldname, newname string) error
+	Remove(name string) error
+	ReadLink(name string) (string, error)
+	Symlink(oldname, newname string) error
+	Checksum(name string) (string, error)
+	Join(elem ...string) string
+	Base(name string) string
+}
+
+type localFS struct{}
+
+func (localFS) Stat(name string) (fs.FileInfo, error) { return os.Stat(name) }
+
+func (localFS) ReadDir(name string) ([]fs.FileInfo, error) {
+	entries, err := os.ReadDir(name)
+	if err != nil {
+		return nil, err
+	}
+	infos := make([]fs.FileInfo, 0, len(entries))
+	for _, e := range entries {
+		info, err := e.Info()
+		if err != nil {
+			return nil, err
+		}
+		infos = append(infos, info)
+	}
+	return infos, nil
+}
+
+func (localFS) Open(name string) (io.ReadSeekCloser, error) { return os.Open(name) }
+
+func (localFS) OpenFile(name string, flag int) (io.WriteSeeker, func() error, error) {
+	f, err := os.OpenFile(name, flag, 0600)
+	if err != nil {
+		return nil, nil, err
+	}
+	return f, f.Close, nil
+}
+
+func (localFS) MkdirAll(name string) error                { return os.MkdirAll(name, 0755) }
+func (localFS) Chmod(name string, mode fs.FileMode) error { return os.Chmod(name, mode) }
+func (localFS) Chtimes(name string, a, m time.Time) error { return os.Chtimes(name, a, m) }
+func (localFS) Rename(oldname, newname string) error      { return os.Rename(oldname, newname) }
+func (localFS) Remove(name string) error                  { return os.Remove(name) }
+func (localFS) ReadLink(name string) (string, error)      { return os.Readlink(name) }
+func (localFS) Symlink(oldname, newname string) error     { return os.Symlink(oldname, newname) }
+func (localFS) Join(elem ...string) string                { return filepath.Join(elem...) }
+func (localFS) Base(name string) string                   { return filepath.Base(name) }
+func (localFS) Checksum(name string) (string, error)      { return readChecksum(os.Open(name)) }
+
+// 远程文件系统, 校验和优先在远程执行 sha256sum, 不可用时读回来计算
+type remoteFS struct {
+	*sftp.Client
+	ssh *ssh.Client
+}
+
+func newRemoteFS(sc *ssh.Client) (*remoteFS, error) {
+	c, err := sftp.NewClient(sc)
+	if err != nil {
+		return nil, fmt.Errorf("sftp: %w", err)
+	}
+	return &remoteFS{Client: c, ssh: sc}, nil
+}
+
+func (r *remoteFS) Open(name string) (io.ReadSeekCloser, error) { return r.Client.Open(name) }
+
+func (r *remoteFS) OpenFile(name string, flag int) (io.WriteSeeker, func() error, error) {
+	f, err := r.Client.OpenFile(name, flag)
+	if err != nil {
+		return nil, nil, err
+	}
+	return f, f.Close, nil
+}
+
+func (r *remoteFS) Rename(oldname, newname string) error { return r.PosixRename(oldname, newname) }
+func (r *remoteFS) Join(elem ...string) string           { return path.Join(elem...) }
+func (r *remoteFS) Base(name string) string              { return path.Base(name) }
+
+func (r *remoteFS) Checksum(name string) (string, error) {
+	if session, err := r.ssh.NewSession(); err == nil {
+		out, err := session.Output("sha256sum -- " + shellQuote(name))
+		session.Close()
+		if sum, _, ok := strings.Cut(string(out), " "); err == nil && ok && len(sum) == sha256.Size*2 {
+			return sum, nil
+		}
+	}
+	f, err := r.Client.Open(name)
+	return readChecksum(f, err)
+}
+
+func readChecksum(f io.ReadCloser, err error) (string, error) {
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+	h := sha256.New()
+	if _, err := io.Copy(h, f); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(h.Sum(nil)), nil
+}
+
+func shellQuote(s string) string {
+	return "'" + strings.ReplaceAll(s, "'", `'\''`) + "'"
+}
+
+// 在两个文件系统之间复制, 记录统计
+type copier struct {
+	src, dst  fileSystem
+	recursive bool
+	verify    bool      // 用校验和判断内容是否相同, 续传完成后校验整个文件
+	progress  io.Writer // 为空时不显示进度
+
+	copied, skipped, resumed int
+	bytes                    int64
+}
+
+// 目标是已存在的目录或有多个源时复制到目录里面, 与 cp 相同
+func (c *copier) copy(src, dst string, intoDir bool) error {
+	info, err := c.src.Stat(src)
+	if err != nil {
+		return err
+	}
+	if info.IsDir() && !c.recursive {
+		return fmt.Errorf("%s is a directory (use -r)", src)
+	}
+	if st, err := c.dst.Stat(dst); (err == nil && st.IsDir()) || intoDir {
+		dst = c.dst.Join(dst, c.src.Base(src))
+	}
+	return c.copyPath(src, dst, info)
+}
+
+func (c *copier) copyPath(src, dst string, info fs.FileInfo) error {
+	if !info.IsDir() {
+		if !info.Mode().IsRegular() {
+			// 设备、管道等跳过
+			return nil
+		}
+		return c.copyFile(src, dst, info)
+	}
+	if err := c.dst.MkdirAll(dst); err != nil {
+		return err
+	}
+	entries, err := c.src.ReadDir(src)
+	if err != nil {
+		return err
+	}
+	for _, e := range entries {
+		name := e.Name()
+		// 指向文件的符号链接复制内容; 指向目录的复制为链接, 跟随下去可能形成环路
+		if e.Mode()&fs.ModeSymlink != 0 {
+			target, err := c.src.Stat(c.src.Join(src, name))
+			if err != nil {
+				return err
+			}
+			if target.IsDir() {
+				if err := c.copyLink(c.src.Join(src, name), c.dst.Join(dst, name)); err != nil {
+					return err
+				}
+				continue
+			}
+			e = target
+		}
+		if err := c.copyPath(c.src.Join(src, name), c.dst.Join(dst, name), e); err != nil {
+			return err
+		}
+	}
+	// 子项写完后再设置目录的时间, 否则会被改掉
+	return c.setAttrs(dst, info)
+}
+
+// 按原样创建符号链接, 目标已经是同样的链接时跳过
+func (c *copier) copyLink(src, dst string) error {
+	target, err := c.src.ReadLink(src)
+	if err != nil {
+		return err
+	}
+	if cur, err := c.dst.ReadLink(dst); err == nil {
+		if cur == target {
+			c.skipped++
+			return nil
+		}
+		if err := c.dst.Remove(dst); err != nil {
+			return err
+		}
+	}
+	if err := c.dst.Symlink(target, dst); err != nil {
+		return err
+	}
+	c.copied++
+	return nil
+}
+
+func (c *copier) setAttrs(dst string, info fs.FileInfo) error {
+	if err := c.dst.Chmod(dst, info.Mode().Perm()); err != nil {
+		return err
+	}
+	return c.dst.Chtimes(dst, info.ModTime(), info.ModTime())
+}
+
+func (c *copier) copyFile(src, dst string, info fs.FileInfo) error {
+	// 大小和修改时间 (SFTP 只有秒) 都相同时认为内容相同, 只同步属性
+	if st, err := c.dst.Stat(dst); err == nil && st.Mode().IsRegular() && st.Size() == info.Size() {
+		same := st.ModTime().Unix() == info.ModTime().Unix()
+		if c.verify {
+			if same, err = c.sameContent(src, dst); err != nil {
+				return err
+			}
+		}
+		if same {
+			c.skipped++
+			return c.setAttrs(dst, info)
+		}
+	}
+	part := dst + ".part"
+	var offset int64
+	if st, err := c.dst.Stat(part); err == nil && st.Mode().IsRegular() && st.Size() <= info.Size() {
+		offset = st.Size()
+	}
+	// 断点前最后一块与源文件不同时说明源文件变了或 .part 已损坏, 从头传
+	if offset > 0 {
+		same, err := c.sameTail(src, part, offset)
+		if err != nil {
+			return err
+		}
+		if !same {
+			offset = 0
+		}
+	}
+	if err := c.transfer(src, part, info, offset); err != nil {
+		return err
+	}
+	if offset > 0 {
+		c.resumed++
+		if c.verify {
+			same, err := c.sameContent(src, part)
+			if err != nil {
+				return err
+			}
+			if !same {
+				if err := c.transfer(src, part, info, 0); err != nil {
+					return err
+				}
+			}
+		}
+	}
+	if err := c.dst.Rename(part, dst); err != nil {
+		c.dst.Remove(part)
+		return err
+	}
+	c.copied++
+	return c.setAttrs(dst, info)
+}
+
+// 续传前比较的断点之前的字节数
+const resumeCheckSize = 64 << 10
+
+// 比较两个文件在 offset 之前的最后 resumeCheckSize 字节
+func (c *copier) sameTail(src, dst string, offset int64) (bool, error) {
+	start := max(offset-resumeCheckSize, 0)
+	a, err := readRange(c.src, src, start, offset-start)
+	if err != nil {
+		return false, err
+	}
+	b, err := readRange(c.dst, dst, start, offset-start)
+	if err != nil {
+		return false, nil
+	}
+	return bytes.Equal(a, b), nil
+}
+
+func readRange(fsys fileSystem, name string, offset, n int64) ([]byte, error) {
+	f, err := fsys.Open(name)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	if _, err := f.Seek(offset, io.SeekStart); err != nil {
+		return nil, err
+	}
+	buf := make([]byte, n)
+	if _, err := io.ReadFull(f, buf); err != nil {
+		return nil, err
+	}
+	return buf, nil
+}
+
+func (c *copier) sameContent(src, dst string) (bool, error) {
+	var srcSum, dstSum string
+	var srcErr, dstErr error
+	var wg sync.WaitGroup
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		srcSum, srcErr = c.src.Checksum(src)
+	}()
+	dstSum, dstErr = c.dst.Checksum(dst)
+	wg.Wait()
+	if srcErr != nil {
+		return false, srcErr
+	}
+	return dstErr == nil && srcSum == dstSum, nil
+}
+
+// 从 offset 开始把 src 写到 dst, offset 为 0 时截断重写
+func (c *copier) transfer(src, dst string, info fs.FileInfo, offset int64) error {
+	in, err := c.src.Open(src)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+	flag := os.O_WRONLY | os.O_CREATE
+	if offset == 0 {
+		flag |= os.O_TRUNC
+	}
+	out, closeOut, err := c.dst.OpenFile(dst, flag)
+	if err != nil {
+		return err
+	}
+	if _, err := in.Seek(offset, io.SeekStart); err != nil {
+		closeOut()
+		return err
+	}
+	if _, err := out.Seek(offset, io.SeekStart); err != nil {
+		closeOut()
+		return err
+	}
+	p := newProgress(c.progress, src, info.Size(), offset)
+	n, err := io.Copy(out, io.TeeReader(in, p))
+	p.done(err)
+	c.bytes += n
+	if cerr := closeOut(); err == nil {
+		err = cerr
+	}
+	return err
+}
+
+// 单个文件的进度, 终端上原地刷新, 否则只在结束时输出一行
+type progress struct {
+	out      io.Writer
+	name     string
+	total    int64
+	current  int64
+	start    time.Time
+	offset   int64
+	last     time.Time
+	terminal bool
+}
+
+func newProgress(out io.Writer, name string, total, offset int64) *progress {
+	p := &progress{out: out, name: name, total: total, current: offset, offset: offset, start: time.Now()}
+	if f, ok := out.(*os.File); ok {
+		p.terminal = term.IsTerminal(int(f.Fd()))
+	}
+	return p
+}
+
+func (p *progress) Write(b []byte) (int, error) {
+	p.current += int64(len(b))
+	if p.out != nil && p.terminal && time.Since(p.last) > 200*time.Millisecond {
+		p.last = time.Now()
+		fmt.Fprintf(p.out, "\r%s", p.line())
+	}
+	return len(b), nil
+}
+
+func (p *progress) line() string {
+	percent := 100.0
+	if p.total > 0 {
+		percent = float64(p.current) * 100 / float64(p.total)
+	}
+	elapsed := time.Since(p.start).Seconds()
+	rate := 0.0
+	if elapsed > 0 {
+		rate = float64(p.current-p.offset) / elapsed
+	}
+	var b bytes.Buffer
+	fmt.Fprintf(&b, "%s %5.1f%% %s/%s %s/s", p.name, percent, formatBytes(p.current), formatBytes(p.total), formatBytes(int64(rate)))
+	if p.offset > 0 {
+		fmt.Fprintf(&b, " (resumed at %s)", formatBytes(p.offset))
+	}
+	return b.String()
+}
+
+func (p *progress) done(err error) {
+	if p.out == nil {
+		return
+	}
+	line := p.line()
+	if err != nil {
+		line += ": " + err.Error()
+	}
+	if p.terminal {
+		fmt.Fprintf(p.out, "\r%s\033[K\n", line)
+	} else {
+		fmt.Fprintln(p.out, line)
+	}
+}
+
+func formatBytes(n int64) string {
+	const unit = 1024
+	if n < unit {
+		return fmt.Sprintf("%dB", n)
+	}
+	div, exp := int64(unit), 0
+	for m := n / unit; m >= unit; m /= unit {
+		div *= unit
+		exp++
+	}
+	return fmt.Sprintf("%.1f%ciB", float64(n)/float64(div), "KMGTPE"[exp])
+}
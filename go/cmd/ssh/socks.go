@@ -0,0 +1,88 @@
+package main
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+)
+
+// -D 使用的最小 SOCKS5 实现 (RFC 1928): 无认证, 只支持 CONNECT
+const (
+	socks5Version   = 0x05
+	socks5NoAuth    = 0x00
+	socks5Connect   = 0x01
+	socks5AtypIPv4  = 0x01
+	socks5AtypFQDN  = 0x03
+	socks5AtypIPv6  = 0x04
+	socks5Succeeded = 0x00
+	socks5Failure   = 0x01
+	socks5CmdNotSup = 0x07
+)
+
+// 完成握手并读出 CONNECT 的目标地址
+func socks5Handshake(conn net.Conn) (string, error) {
+	var head [2]byte
+	if _, err := io.ReadFull(conn, head[:]); err != nil {
+		return "", err
+	}
+	if head[0] != socks5Version {
+		return "", fmt.Errorf("unsupported version %d", head[0])
+	}
+	methods := make([]byte, head[1])
+	if _, err := io.ReadFull(conn, methods); err != nil {
+		return "", err
+	}
+	if _, err := conn.Write([]byte{socks5Version, socks5NoAuth}); err != nil {
+		return "", err
+	}
+	var req [4]byte
+	if _, err := io.ReadFull(conn, req[:]); err != nil {
+		return "", err
+	}
+	if req[1] != socks5Connect {
+		conn.Write([]byte{socks5Version, socks5CmdNotSup, 0, socks5AtypIPv4, 0, 0, 0, 0, 0, 0})
+		return "", errors.New("only CONNECT is supported")
+	}
+	var host string
+	switch req[3] {
+	case socks5AtypIPv4, socks5AtypIPv6:
+		ip := make(net.IP, 4)
+		if req[3] == socks5AtypIPv6 {
+			ip = make(net.IP, 16)
+		}
+		if _, err := io.ReadFull(conn, ip); err != nil {
+			return "", err
+		}
+		host = ip.String()
+	case socks5AtypFQDN:
+		var n [1]byte
+		if _, err := io.ReadFull(conn, n[:]); err != nil {
+			return "", err
+		}
+		name := make([]byte, n[0])
+		if _, err := io.ReadFull(conn, name); err != nil {
+			return "", err
+		}
+		host = string(name)
+	default:
+		return "", fmt.Errorf("unsupported address type %d", req[3])
+	}
+	var port [2]byte
+	if _, err := io.ReadFull(conn, port[:]); err != nil {
+		return "", err
+	}
+	return net.JoinHostPort(host, strconv.Itoa(int(binary.BigEndian.Uint16(port[:])))), nil
+}
+
+// 连接目标后回复客户端, 绑定地址填 0
+func socks5Reply(conn net.Conn, dialErr error) error {
+	rep := byte(socks5Succeeded)
+	if dialErr != nil {
+		rep = socks5Failure
+	}
+	_, err := conn.Write([]byte{socks5Version, rep, 0, socks5AtypIPv4, 0, 0, 0, 0, 0, 0})
+	return err
+}
@@ -0,0 +1,205 @@
+package main
+
+import (
+	"bufio"
+	"os"
+	"os/user"
+	"path"
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
+// ~/.ssh/config 中用到的部分, 语义与 OpenSSH 相同: 按出现顺序第一个取到的值生效, IdentityFile 可以有多个
+// 支持 Host (含 * ? 通配符和 ! 排除) 和 Include, Match 块整体忽略
+type hostConfig struct {
+	HostName              string
+	User                  string
+	Port                  int
+	IdentityFiles         []string
+	StrictHostKeyChecking string
+	UserKnownHostsFile    []string
+	ProxyJump             string
+}
+
+type sshConfigBlock struct {
+	patterns []string // nil 表示文件开头不属于任何 Host 的部分, 对所有主机生效
+	match    bool     // Match 块, 不支持, 跳过
+	options  [][2]string
+}
+
+type sshConfig struct {
+	blocks []sshConfigBlock
+}
+
+func homeDir() string {
+	if home, err := os.UserHomeDir(); err == nil {
+		return home
+	}
+	return "."
+}
+
+// 读取配置文件, 文件不存在时返回空配置
+func loadSSHConfig(file string) (*sshConfig, error) {
+	c := &sshConfig{}
+	if err := c.parseFile(file, 0); err != nil && !os.IsNotExist(err) {
+		return nil, err
+	}
+	return c, nil
+}
+
+func (c *sshConfig) parseFile(file string, depth int) error {
+	f, err := os.Open(file)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	c.blocks = append(c.blocks, sshConfigBlock{})
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		key, value := splitConfigLine(scanner.Text())
+		if key == "" {
+			continue
+		}
+		switch key {
+		case "host":
+			c.blocks = append(c.blocks, sshConfigBlock{patterns: strings.Fields(value)})
+		case "match":
+			c.blocks = append(c.blocks, sshConfigBlock{match: true})
+		case "include":
+			// Include 在当前位置展开, 相对路径相对于 ~/.ssh
+			if depth > 8 {
+				continue
+			}
+			for _, pattern := range strings.Fields(value) {
+				pattern = expandHome(pattern)
+				if !filepath.IsAbs(pattern) {
+					pattern = filepath.Join(homeDir(), ".ssh", pattern)
+				}
+				files, _ := filepath.Glob(pattern)
+				for _, inc := range files {
+					last := c.blocks[len(c.blocks)-1]
+					c.parseFile(inc, depth+1)
+					// Include 之后的内容仍属于原来的 Host 块
+					c.blocks = append(c.blocks, sshConfigBlock{patterns: last.patterns, match: last.match})
+				}
+			}
+		default:
+			b := &c.blocks[len(c.blocks)-1]
+			b.options = append(b.options, [2]string{key, value})
+		}
+	}
+	return scanner.Err()
+}
+
+// 拆出关键字 (小写) 和参数, 支持 "Key Value" 和 "Key=Value", 参数可以用双引号括起来
+func splitConfigLine(line string) (string, string) {
+	line = strings.TrimSpace(line)
+	if line == "" || line[0] == '#' {
+		return "", ""
+	}
+	i := strings.IndexAny(line, " \t=")
+	if i < 0 {
+		return strings.ToLower(line), ""
+	}
+	key := strings.ToLower(line[:i])
+	value := strings.TrimSpace(line[i:])
+	value = strings.TrimSpace(strings.TrimPrefix(value, "="))
+	if len(value) >= 2 && value[0] == '"' && value[len(value)-1] == '"' {
+		value = value[1 : len(value)-1]
+	}
+	return key, value
+}
+
+// Host 行中任一模式命中且没有被 ! 排除
+func (b *sshConfigBlock) matches(alias string) bool {
+	if b.match {
+		return false
+	}
+	if b.patterns == nil {
+		return true
+	}
+	matched := false
+	for _, p := range b.patterns {
+		if neg, ok := strings.CutPrefix(p, "!"); ok {
+			if ok, _ := path.Match(neg, alias); ok {
+				return false
+			}
+			continue
+		}
+		if ok, _ := path.Match(p, alias); ok {
+			matched = true
+		}
+	}
+	return matched
+}
+
+// 查出别名对应的配置, 没有配置 HostName 时就是别名本身
+func (c *sshConfig) lookup(alias string) hostConfig {
+	var h hostConfig
+	seen := map[string]bool{}
+	for i := range c.blocks {
+		b := &c.blocks[i]
+		if !b.matches(alias) {
+			continue
+		}
+		for _, opt := range b.options {
+			key, value := opt[0], opt[1]
+			if key == "identityfile" {
+				h.IdentityFiles = append(h.IdentityFiles, value)
+				continue
+			}
+			if seen[key] {
+				continue
+			}
+			seen[key] = true
+			switch key {
+			case "hostname":
+				h.HostName = value
+			case "user":
+				h.User = value
+			case "port":
+				h.Port, _ = strconv.Atoi(value)
+			case "stricthostkeychecking":
+				h.StrictHostKeyChecking = strings.ToLower(value)
+			case "userknownhostsfile":
+				h.UserKnownHostsFile = strings.Fields(value)
+			case "proxyjump":
+				h.ProxyJump = value
+			}
+		}
+	}
+	if h.HostName == "" {
+		h.HostName = alias
+	} else {
+		h.HostName = strings.ReplaceAll(h.HostName, "%h", alias)
+	}
+	return h
+}
+
+// 展开路径中的 ~ 和 %d %h %u %r %p
+func expandPath(p, host, remoteUser string, port int) string {
+	p = expandHome(p)
+	local := ""
+	if u, err := user.Current(); err == nil {
+		local = u.Username
+	}
+	return strings.NewReplacer(
+		"%d", homeDir(),
+		"%h", host,
+		"%u", local,
+		"%r", remoteUser,
+		"%p", strconv.Itoa(port),
+		"%%", "%",
+	).Replace(p)
+}
+
+func expandHome(p string) string {
+	if p == "~" {
+		return homeDir()
+	}
+	if rest, ok := strings.CutPrefix(p, "~/"); ok {
+		return filepath.Join(homeDir(), rest)
+	}
+	return p
+}
@@ -0,0 +1,560 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"net/http"
+	"os"
+	"os/signal"
+	"strconv"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+
+	"golang.org/x/crypto/ssh"
+)
+
+// 隧道配置, 转发规则与 ssh 命令行相同:
+//
+//	{
+//	  "host": "root@10.0.0.1:22",
+//	  "identity_files": ["~/.ssh/id_ed25519"],
+//	  "host_key": "accept-new",
+//	  "jump": [{"host": "ops@bastion.example.com", "password": "...", "host_key": "strict"}],
+//	  "keepalive": "30s",
+//	  "status": "127.0.0.1:7070",
+//	  "tunnels": [
+//	    {"name": "docker", "forward": "-L /tmp/docker.sock:/var/run/docker.sock"},
+//	    {"name": "web", "forward": "-L 8080:localhost:80"},
+//	    {"name": "expose", "forward": "-R 0.0.0.0:9000:127.0.0.1:9000"},
+//	    {"name": "socks", "forward": "-D 127.0.0.1:1080"}
+//	  ]
+//	}
+type TunnelConfig struct {
+	sshTarget
+	Keepalive Duration     `json:"keepalive"` // 发送 keepalive 请求的间隔, 超过一个间隔没有回复时重连, 默认 30s
+	Status    string       `json:"status"`    // 状态接口监听地址, 为空时不开启
+	Tunnels   []TunnelSpec `json:"tunnels"`
+}
+
+type TunnelSpec struct {
+	Name    string `json:"name"`
+	Forward string `json:"forward"` // -L/-R/-D 加 ssh 语法的参数
+}
+
+// 支持 "30s" 这样的字符串
+type Duration time.Duration
+
+func (d *Duration) UnmarshalJSON(b []byte) error {
+	var s string
+	if err := json.Unmarshal(b, &s); err != nil {
+		return err
+	}
+	v, err := time.ParseDuration(s)
+	*d = Duration(v)
+	return err
+}
+
+func (d Duration) MarshalJSON() ([]byte, error) {
+	return json.Marshal(time.Duration(d).String())
+}
+
+// 重连退避
+const (
+	minBackoff = time.Second
+	maxBackoff = time.Minute
+)
+
+func runTunnel(args []string) {
+	fs := flag.NewFlagSet("tunnel", flag.ExitOnError)
+	configPath := fs.String("config", "tunnels.json", "tunnel config file (json)")
+	fs.Parse(args)
+	data, err := os.ReadFile(*configPath)
+	if err != nil {
+		log.Fatal(err)
+	}
+	cfg := TunnelConfig{Keepalive: Duration(30 * time.Second)}
+	if err := json.Unmarshal(data, &cfg); err != nil {
+		log.Fatal(err)
+	}
+	m, err := newTunnelManager(cfg.Host, func() (*ssh.Client, error) {
+		return dialSSH(cfg.sshTarget)
+	}, cfg)
+	if err != nil {
+		log.Fatal(err)
+	}
+	ctx, cancel := signal.NotifyContext(context.Background(), syscall.SIGINT, syscall.SIGTERM)
+	defer cancel()
+	if cfg.Status != "" {
+		go func() {
+			log.Println(http.ListenAndServe(cfg.Status, m))
+		}()
+	}
+	if err := m.run(ctx); err != nil {
+		log.Fatal(err)
+	}
+}
+
+// 转发的一端, network 为 tcp 或 unix
+type endpoint struct {
+	network string
+	address string
+}
+
+func (e endpoint) String() string {
+	return e.network + ":" + e.address
+}
+
+// 与 ssh 一样, bind 为 * 时监听所有地址
+func tcpEndpoint(host, port string) endpoint {
+	if host == "*" {
+		host = ""
+	}
+	return endpoint{"tcp", net.JoinHostPort(host, port)}
+}
+
+func isSocketPath(s string) bool {
+	return strings.Contains(s, "/")
+}
+
+// 按冒号拆分, 方括号中的 IPv6 地址不拆
+func splitSpec(s string) []string {
+	var parts []string
+	depth, start := 0, 0
+	for i, c := range s {
+		switch c {
+		case '[':
+			depth++
+		case ']':
+			depth--
+		case ':':
+			if depth == 0 {
+				parts = append(parts, strings.Trim(s[start:i], "[]"))
+				start = i + 1
+			}
+		}
+	}
+	return append(parts, strings.Trim(s[start:], "[]"))
+}
+
+// 解析 "-L [bind:]port:host:hostport" 这样的规则, 省略 bind 时与 ssh 一样只监听本机
+func parseForward(spec string) (kind byte, listen, target endpoint, err error) {
+	flagPart, arg, _ := strings.Cut(strings.TrimSpace(spec), " ")
+	arg = strings.TrimSpace(arg)
+	if len(flagPart) != 2 || flagPart[0] != '-' || !strings.ContainsRune("LRD", rune(flagPart[1])) {
+		return 0, listen, target, fmt.Errorf("forward %q: must start with -L, -R or -D", spec)
+	}
+	kind = flagPart[1]
+	parts := splitSpec(arg)
+	bad := fmt.Errorf("forward %q: bad %c specification", spec, kind)
+	listenOf := func(bind, port string) endpoint {
+		switch {
+		case bind == "":
+			bind = "localhost"
+		case bind == "*" && kind == 'R':
+			// -R 的地址由 ssh.Client.Listen 在本地解析, 空地址会以 "<nil>" 发给服务端
+			bind = "0.0.0.0"
+		}
+		return tcpEndpoint(bind, port)
+	}
+	if kind == 'D' {
+		switch {
+		case len(parts) == 1 && isSocketPath(parts[0]):
+			listen = endpoint{"unix", parts[0]}
+		case len(parts) == 1:
+			listen = listenOf("", parts[0])
+		case len(parts) == 2:
+			listen = listenOf(parts[0], parts[1])
+		default:
+			return 0, listen, target, bad
+		}
+	} else {
+		switch len(parts) {
+		case 4:
+			listen, target = listenOf(parts[0], parts[1]), tcpEndpoint(parts[2], parts[3])
+		case 3:
+			switch {
+			case isSocketPath(parts[0]):
+				listen, target = endpoint{"unix", parts[0]}, tcpEndpoint(parts[1], parts[2])
+			case isSocketPath(parts[2]):
+				listen, target = listenOf(parts[0], parts[1]), endpoint{"unix", parts[2]}
+			default:
+				listen, target = listenOf("", parts[0]), tcpEndpoint(parts[1], parts[2])
+			}
+		case 2:
+			if !isSocketPath(parts[1]) {
+				return 0, listen, target, bad
+			}
+			target = endpoint{"unix", parts[1]}
+			if isSocketPath(parts[0]) {
+				listen = endpoint{"unix", parts[0]}
+			} else {
+				listen = listenOf("", parts[0])
+			}
+		default:
+			return 0, listen, target, bad
+		}
+	}
+	if listen.network == "tcp" {
+		if _, port, _ := net.SplitHostPort(listen.address); port == "" {
+			return 0, listen, target, bad
+		} else if _, err := strconv.ParseUint(port, 10, 16); err != nil {
+			return 0, listen, target, bad
+		}
+	}
+	return kind, listen, target, nil
+}
+
+// 单条转发规则及其状态
+type forward struct {
+	name   string
+	spec   string
+	kind   byte
+	listen endpoint
+	target endpoint
+
+	mu      sync.Mutex
+	state   string // listening, down, error
+	lastErr string
+	active  int
+	total   int64
+	ln      net.Listener // -L/-D 的本地监听, 重连期间保持
+}
+
+func (f *forward) setState(state string, err error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.state = state
+	if err != nil {
+		f.lastErr = err.Error()
+		log.Printf("tunnel %s: %s: %v", f.name, state, err)
+	}
+}
+
+// 转发一个连接, 结束时更新计数
+func (f *forward) pipe(a, b net.Conn) {
+	f.mu.Lock()
+	f.active++
+	f.total++
+	f.mu.Unlock()
+	defer func() {
+		f.mu.Lock()
+		f.active--
+		f.mu.Unlock()
+	}()
+	pipe(a, b)
+}
+
+// 双向转发, 一个方向结束时半关闭另一端, 两个方向都结束后关闭
+func pipe(a, b net.Conn) {
+	defer a.Close()
+	defer b.Close()
+	done := make(chan struct{}, 2)
+	cp := func(dst, src net.Conn) {
+		io.Copy(dst, src)
+		if cw, ok := dst.(interface{ CloseWrite() error }); ok {
+			cw.CloseWrite()
+		} else {
+			dst.Close()
+		}
+		done <- struct{}{}
+	}
+	go cp(a, b)
+	go cp(b, a)
+	<-done
+	<-done
+}
+
+// 一个 SSH 连接上的所有隧道, 连接断开后按退避时间重连
+type tunnelManager struct {
+	host       string
+	dial       func() (*ssh.Client, error)
+	keepalive  time.Duration
+	forwards   []*forward
+	minBackoff time.Duration
+	maxBackoff time.Duration
+
+	mu         sync.Mutex
+	client     *ssh.Client
+	state      string // connecting, connected, backoff, stopped
+	since      time.Time
+	lastErr    string
+	reconnects int
+}
+
+func newTunnelManager(host string, dial func() (*ssh.Client, error), cfg TunnelConfig) (*tunnelManager, error) {
+	m := &tunnelManager{
+		host:       host,
+		dial:       dial,
+		keepalive:  time.Duration(cfg.Keepalive),
+		minBackoff: minBackoff,
+		maxBackoff: maxBackoff,
+		state:      "connecting",
+		since:      time.Now(),
+	}
+	for i, t := range cfg.Tunnels {
+		kind, listen, target, err := parseForward(t.Forward)
+		if err != nil {
+			return nil, err
+		}
+		name := t.Name
+		if name == "" {
+			name = strconv.Itoa(i)
+		}
+		m.forwards = append(m.forwards, &forward{name: name, spec: t.Forward, kind: kind, listen: listen, target: target, state: "down"})
+	}
+	return m, nil
+}
+
+func (m *tunnelManager) setState(state string, client *ssh.Client, err error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if state != m.state {
+		m.since = time.Now()
+	}
+	m.state, m.client = state, client
+	if err != nil {
+		m.lastErr = err.Error()
+	}
+}
+
+func (m *tunnelManager) current() *ssh.Client {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return m.client
+}
+
+// 打开本地监听并保持连接, 直到 ctx 结束
+func (m *tunnelManager) run(ctx context.Context) error {
+	for _, f := range m.forwards {
+		if f.kind == 'R' {
+			continue
+		}
+		if f.listen.network == "unix" {
+			os.Remove(f.listen.address)
+		}
+		ln, err := net.Listen(f.listen.network, f.listen.address)
+		if err != nil {
+			m.closeListeners()
+			return fmt.Errorf("tunnel %s: %w", f.name, err)
+		}
+		f.ln = ln
+		go m.acceptLocal(f)
+	}
+	defer m.closeListeners()
+
+	backoff := m.minBackoff
+	for ctx.Err() == nil {
+		m.setState("connecting", nil, nil)
+		client, err := m.dial()
+		if err != nil {
+			log.Printf("ssh %s: %v; retrying in %v", m.host, err, backoff)
+			m.setState("backoff", nil, err)
+			select {
+			case <-time.After(backoff):
+			case <-ctx.Done():
+			}
+			if backoff *= 2; backoff > m.maxBackoff {
+				backoff = m.maxBackoff
+			}
+			continue
+		}
+		log.Printf("ssh %s: connected", m.host)
+		m.setState("connected", client, nil)
+		started := time.Now()
+		err = m.serve(ctx, client)
+		m.mu.Lock()
+		m.reconnects++
+		m.mu.Unlock()
+		m.setState("backoff", nil, err)
+		if ctx.Err() != nil {
+			break
+		}
+		log.Printf("ssh %s: disconnected: %v", m.host, err)
+		// 连接稳定过一段时间后退避从头开始
+		if time.Since(started) > m.maxBackoff {
+			backoff = m.minBackoff
+		}
+		select {
+		case <-time.After(backoff):
+		case <-ctx.Done():
+		}
+		if backoff *= 2; backoff > m.maxBackoff {
+			backoff = m.maxBackoff
+		}
+	}
+	m.setState("stopped", nil, nil)
+	return nil
+}
+
+// 在一个连接上运行远程转发和 keepalive, 连接断开时返回
+func (m *tunnelManager) serve(ctx context.Context, client *ssh.Client) error {
+	defer client.Close()
+	done := make(chan error, 1)
+	go func() { done <- client.Wait() }()
+	for _, f := range m.forwards {
+		switch f.kind {
+		case 'R':
+			go m.serveRemote(client, f)
+		default:
+			f.setState("listening", nil)
+		}
+	}
+	defer func() {
+		for _, f := range m.forwards {
+			f.setState("down", nil)
+		}
+	}()
+	var tick <-chan time.Time
+	if m.keepalive > 0 {
+		t := time.NewTicker(m.keepalive)
+		defer t.Stop()
+		tick = t.C
+	}
+	for {
+		select {
+		case err := <-done:
+			if err == nil {
+				err = io.EOF
+			}
+			return err
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-tick:
+			if err := m.ping(client); err != nil {
+				return err
+			}
+		}
+	}
+}
+
+// 发送 keepalive 请求, 服务端不认识这个请求也会回复失败, 一个间隔内没有回复视为连接已断
+func (m *tunnelManager) ping(client *ssh.Client) error {
+	errc := make(chan error, 1)
+	go func() {
+		_, _, err := client.SendRequest("keepalive@openssh.com", true, nil)
+		errc <- err
+	}()
+	select {
+	case err := <-errc:
+		return err
+	case <-time.After(m.keepalive):
+		return errors.New("keepalive timeout")
+	}
+}
+
+func (m *tunnelManager) closeListeners() {
+	for _, f := range m.forwards {
+		if f.ln != nil {
+			f.ln.Close()
+		}
+	}
+}
+
+// -L/-D: 本地连接经 SSH 连到目标, 断线期间到来的连接直接关闭
+func (m *tunnelManager) acceptLocal(f *forward) {
+	for {
+		conn, err := f.ln.Accept()
+		if err != nil {
+			return
+		}
+		go func() {
+			client := m.current()
+			if client == nil {
+				conn.Close()
+				return
+			}
+			target := f.target
+			if f.kind == 'D' {
+				addr, err := socks5Handshake(conn)
+				if err != nil {
+					log.Printf("tunnel %s: socks: %v", f.name, err)
+					conn.Close()
+					return
+				}
+				target = endpoint{"tcp", addr}
+			}
+			remote, err := client.Dial(target.network, target.address)
+			if f.kind == 'D' {
+				socks5Reply(conn, err)
+			}
+			if err != nil {
+				log.Printf("tunnel %s: dial %s: %v", f.name, target, err)
+				conn.Close()
+				return
+			}
+			f.pipe(conn, remote)
+		}()
+	}
+}
+
+// -R: 服务端监听, 连接转到本地目标
+func (m *tunnelManager) serveRemote(client *ssh.Client, f *forward) {
+	ln, err := client.Listen(f.listen.network, f.listen.address)
+	if err != nil {
+		f.setState("error", err)
+		return
+	}
+	defer ln.Close()
+	f.setState("listening", nil)
+	for {
+		conn, err := ln.Accept()
+		if err != nil {
+			return
+		}
+		go func() {
+			local, err := net.DialTimeout(f.target.network, f.target.address, 10*time.Second)
+			if err != nil {
+				log.Printf("tunnel %s: dial %s: %v", f.name, f.target, err)
+				conn.Close()
+				return
+			}
+			f.pipe(conn, local)
+		}()
+	}
+}
+
+type forwardStatus struct {
+	Name      string `json:"name"`
+	Forward   string `json:"forward"`
+	State     string `json:"state"`
+	Active    int    `json:"active"`
+	Total     int64  `json:"total"`
+	LastError string `json:"last_error,omitempty"`
+}
+
+type managerStatus struct {
+	Host       string          `json:"host"`
+	State      string          `json:"state"`
+	Since      time.Time       `json:"since"`
+	Reconnects int             `json:"reconnects"`
+	LastError  string          `json:"last_error,omitempty"`
+	Tunnels    []forwardStatus `json:"tunnels"`
+}
+
+func (m *tunnelManager) status() managerStatus {
+	m.mu.Lock()
+	s := managerStatus{Host: m.host, State: m.state, Since: m.since, Reconnects: m.reconnects, LastError: m.lastErr}
+	m.mu.Unlock()
+	for _, f := range m.forwards {
+		f.mu.Lock()
+		s.Tunnels = append(s.Tunnels, forwardStatus{Name: f.name, Forward: f.spec, State: f.state, Active: f.active, Total: f.total, LastError: f.lastErr})
+		f.mu.Unlock()
+	}
+	return s
+}
+
+// 状态接口, 返回 JSON
+func (m *tunnelManager) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "  ")
+	enc.Encode(m.status())
+}
@@ -0,0 +1,123 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"flag"
+	"log"
+	"os"
+	"os/signal"
+	"syscall"
+
+	"code/pkg/sshd"
+
+	"golang.org/x/crypto/ssh"
+)
+
+// 服务端配置, 通过 -config 指定 JSON 文件加载:
+//
+//	{
+//	  "listen": ":2222",
+//	  "host_key": "/etc/sshd/ssh_host_ed25519_key",
+//	  "users": [
+//	    {"name": "root", "password": "...", "authorized_keys": "/root/.ssh/authorized_keys"}
+//	  ]
+//	}
+type Config struct {
+	Listen            string   `json:"listen"`             // 监听地址
+	HostKey           string   `json:"host_key"`           // 主机私钥, 不存在时生成
+	Shell             string   `json:"shell"`              // 默认 $SHELL 或 /bin/sh
+	Env               []string `json:"env"`                // 附加到会话的环境变量
+	DisableForwarding bool     `json:"disable_forwarding"` // 禁止端口和 unix socket 转发
+	DisableSFTP       bool     `json:"disable_sftp"`
+	Users             []User   `json:"users"`
+}
+
+type User struct {
+	Name           string   `json:"name"`
+	Password       string   `json:"password"`        // 为空时不允许密码登录
+	AuthorizedKeys string   `json:"authorized_keys"` // authorized_keys 文件
+	Keys           []string `json:"keys"`            // authorized_keys 格式的公钥
+}
+
+var config = Config{
+	Listen:  ":2222",
+	HostKey: "ssh_host_ed25519_key",
+}
+
+func loadConfig(path string) error {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return err
+	}
+	return json.Unmarshal(data, &config)
+}
+
+// 按配置创建服务端, 读取公钥和主机密钥
+func newServer(c Config) (*sshd.Server, error) {
+	hostKey, err := sshd.LoadOrGenerateHostKey(c.HostKey)
+	if err != nil {
+		return nil, err
+	}
+	passwords := map[string]string{}
+	keys := map[string][]ssh.PublicKey{}
+	for _, u := range c.Users {
+		if u.Password != "" {
+			passwords[u.Name] = u.Password
+		}
+		if u.AuthorizedKeys != "" {
+			k, err := sshd.LoadAuthorizedKeys(u.AuthorizedKeys)
+			if err != nil {
+				return nil, err
+			}
+			keys[u.Name] = append(keys[u.Name], k...)
+		}
+		for _, line := range u.Keys {
+			k, _, _, _, err := ssh.ParseAuthorizedKey([]byte(line))
+			if err != nil {
+				return nil, err
+			}
+			keys[u.Name] = append(keys[u.Name], k)
+		}
+	}
+	s := &sshd.Server{
+		Addr:              c.Listen,
+		HostKeys:          []ssh.Signer{hostKey},
+		Shell:             c.Shell,
+		Env:               c.Env,
+		DisableForwarding: c.DisableForwarding,
+		DisableSFTP:       c.DisableSFTP,
+	}
+	if len(passwords) > 0 {
+		s.PasswordAuth = sshd.Passwords(passwords)
+	}
+	if len(keys) > 0 {
+		s.PublicKeyAuth = sshd.AuthorizedKeys(keys)
+	}
+	log.Printf("host key %s %s", hostKey.PublicKey().Type(), ssh.FingerprintSHA256(hostKey.PublicKey()))
+	return s, nil
+}
+
+func main() {
+	configPath := flag.String("config", "", "config file (json)")
+	flag.Parse()
+	if *configPath != "" {
+		if err := loadConfig(*configPath); err != nil {
+			log.Fatal(err)
+		}
+	}
+	s, err := newServer(config)
+	if err != nil {
+		log.Fatal(err)
+	}
+	ctx, cancel := signal.NotifyContext(context.Background(), syscall.SIGINT, syscall.SIGTERM)
+	defer cancel()
+	go func() {
+		<-ctx.Done()
+		s.Close()
+	}()
+	log.Printf("listening on %s", config.Listen)
+	if err := s.ListenAndServe(); err != sshd.ErrServerClosed {
+		log.Fatal(err)
+	}
+}
@@ -0,0 +1,375 @@
+package main
+
+import (
+	"bytes"
+	"crypto/ed25519"
+	"crypto/rand"
+	"errors"
+	"io"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"code/pkg/sshd"
+
+	"github.com/pkg/sftp"
+	"golang.org/x/crypto/ssh"
+)
+
+// 按配置启动服务端, 返回监听地址
+func startServer(t *testing.T, c Config) (string, *sshd.Server) {
+	t.Helper()
+	dir := t.TempDir()
+	if c.HostKey == "" {
+		c.HostKey = filepath.Join(dir, "host_key")
+	}
+	if c.Shell == "" {
+		c.Shell = "/bin/sh"
+	}
+	s, err := newServer(c)
+	if err != nil {
+		t.Fatal(err)
+	}
+	s.Logf = t.Logf
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	done := make(chan error, 1)
+	go func() { done <- s.Serve(l) }()
+	t.Cleanup(func() {
+		s.Close()
+		if err := <-done; err != sshd.ErrServerClosed {
+			t.Errorf("Serve: %v", err)
+		}
+	})
+	return l.Addr().String(), s
+}
+
+func dial(t *testing.T, addr, user string, auth ...ssh.AuthMethod) *ssh.Client {
+	t.Helper()
+	client, err := ssh.Dial("tcp", addr, &ssh.ClientConfig{
+		User:            user,
+		Auth:            auth,
+		HostKeyCallback: ssh.InsecureIgnoreHostKey(),
+		Timeout:         5 * time.Second,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { client.Close() })
+	return client
+}
+
+func newSigner(t *testing.T) ssh.Signer {
+	_, priv, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	signer, err := ssh.NewSignerFromKey(priv)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return signer
+}
+
+// 运行命令, 返回 stdout、stderr 和 Wait 的错误
+func run(t *testing.T, client *ssh.Client, cmd string, setup func(*ssh.Session)) (string, string, error) {
+	t.Helper()
+	sess, err := client.NewSession()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer sess.Close()
+	var stdout, stderr bytes.Buffer
+	sess.Stdout, sess.Stderr = &stdout, &stderr
+	if setup != nil {
+		setup(sess)
+	}
+	err = sess.Run(cmd)
+	return stdout.String(), stderr.String(), err
+}
+
+// 在 l 上回显, 用于测试转发
+func echoServer(t *testing.T, l net.Listener) {
+	t.Cleanup(func() { l.Close() })
+	go func() {
+		for {
+			c, err := l.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer c.Close()
+				io.Copy(c, c)
+			}()
+		}
+	}()
+}
+
+func checkEcho(t *testing.T, c net.Conn, msg string) {
+	t.Helper()
+	defer c.Close()
+	c.SetDeadline(time.Now().Add(5 * time.Second))
+	if _, err := c.Write([]byte(msg)); err != nil {
+		t.Fatal(err)
+	}
+	buf := make([]byte, len(msg))
+	if _, err := io.ReadFull(c, buf); err != nil {
+		t.Fatal(err)
+	}
+	if string(buf) != msg {
+		t.Fatalf("echo = %q, want %q", buf, msg)
+	}
+}
+
+func TestAuth(t *testing.T) {
+	dir := t.TempDir()
+	alice, bob := newSigner(t), newSigner(t)
+	keyFile := filepath.Join(dir, "authorized_keys")
+	os.WriteFile(keyFile, append([]byte("# comment\n"), ssh.MarshalAuthorizedKey(alice.PublicKey())...), 0600)
+	hostKey := filepath.Join(dir, "keys", "host_key")
+	addr, _ := startServer(t, Config{
+		HostKey: hostKey,
+		Users: []User{
+			{Name: "alice", AuthorizedKeys: keyFile},
+			{Name: "bob", Password: "secret", Keys: []string{string(ssh.MarshalAuthorizedKey(bob.PublicKey()))}},
+		},
+	})
+
+	if out, _, err := run(t, dial(t, addr, "alice", ssh.PublicKeys(alice)), "echo $USER", nil); err != nil || out != "alice\n" {
+		t.Errorf("alice: %q %v", out, err)
+	}
+	dial(t, addr, "bob", ssh.Password("secret"))
+	dial(t, addr, "bob", ssh.PublicKeys(bob))
+
+	for name, auth := range map[string]ssh.AuthMethod{
+		"wrong password": ssh.Password("wrong"),
+		"no password":    ssh.Password(""),
+		"other user key": ssh.PublicKeys(alice),
+		"unknown key":    ssh.PublicKeys(newSigner(t)),
+		"alice password": ssh.Password("secret"),
+	} {
+		user := "bob"
+		if strings.HasPrefix(name, "alice") {
+			user = "alice"
+		}
+		_, err := ssh.Dial("tcp", addr, &ssh.ClientConfig{User: user, Auth: []ssh.AuthMethod{auth}, HostKeyCallback: ssh.InsecureIgnoreHostKey()})
+		if err == nil || !strings.Contains(err.Error(), "unable to authenticate") {
+			t.Errorf("%s: err = %v", name, err)
+		}
+	}
+
+	// 主机密钥保存后复用
+	first, err := os.ReadFile(hostKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	signer, err := sshd.LoadOrGenerateHostKey(hostKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	parsed, _ := ssh.ParsePrivateKey(first)
+	if !bytes.Equal(signer.PublicKey().Marshal(), parsed.PublicKey().Marshal()) {
+		t.Error("host key regenerated")
+	}
+}
+
+func TestExec(t *testing.T) {
+	addr, _ := startServer(t, Config{
+		Env:   []string{"GREETING=hello"},
+		Users: []User{{Name: "test", Password: "pw"}},
+	})
+	client := dial(t, addr, "test", ssh.Password("pw"))
+
+	stdout, stderr, err := run(t, client, "echo out; echo err >&2; exit 3", nil)
+	var exitErr *ssh.ExitError
+	if !errors.As(err, &exitErr) || exitErr.ExitStatus() != 3 {
+		t.Errorf("exit: %v", err)
+	}
+	if stdout != "out\n" || stderr != "err\n" {
+		t.Errorf("stdout %q stderr %q", stdout, stderr)
+	}
+
+	stdout, _, err = run(t, client, "echo $GREETING $LANG; test -t 0 || echo notty; echo $SSH_CONNECTION", func(s *ssh.Session) {
+		s.Setenv("LANG", "C.UTF-8")
+	})
+	lines := strings.Split(stdout, "\n")
+	if err != nil || len(lines) < 3 || lines[0] != "hello C.UTF-8" || lines[1] != "notty" || !strings.HasPrefix(lines[2], "127.0.0.1 ") {
+		t.Errorf("env: %q %v", stdout, err)
+	}
+
+	// stdin 结束后命令退出
+	stdout, _, err = run(t, client, "tr a-z A-Z", func(s *ssh.Session) {
+		s.Stdin = strings.NewReader("hello\n")
+	})
+	if err != nil || stdout != "HELLO\n" {
+		t.Errorf("stdin: %q %v", stdout, err)
+	}
+
+	// 进程被信号结束时返回 exit-signal
+	sess, err := client.NewSession()
+	if err != nil {
+		t.Fatal(err)
+	}
+	stdoutPipe, _ := sess.StdoutPipe()
+	if err := sess.Start("echo ready; exec sleep 10"); err != nil {
+		t.Fatal(err)
+	}
+	buf := make([]byte, 6)
+	io.ReadFull(stdoutPipe, buf)
+	if err := sess.Signal(ssh.SIGTERM); err != nil {
+		t.Fatal(err)
+	}
+	err = sess.Wait()
+	if !errors.As(err, &exitErr) || exitErr.Signal() != "TERM" {
+		t.Errorf("signal: %v", err)
+	}
+}
+
+func TestPTY(t *testing.T) {
+	addr, _ := startServer(t, Config{Users: []User{{Name: "test", Password: "pw"}}})
+	client := dial(t, addr, "test", ssh.Password("pw"))
+
+	stdout, _, err := run(t, client, "test -t 0 && echo tty $TERM; stty size", func(s *ssh.Session) {
+		if err := s.RequestPty("xterm", 30, 100, ssh.TerminalModes{}); err != nil {
+			t.Fatal(err)
+		}
+	})
+	if err != nil || stdout != "tty xterm\r\n30 100\r\n" {
+		t.Errorf("pty: %q %v", stdout, err)
+	}
+
+	// shell 会话, 改变窗口大小后 stty 能看到
+	sess, err := client.NewSession()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer sess.Close()
+	if err := sess.RequestPty("vt100", 24, 80, ssh.TerminalModes{ssh.ECHO: 0}); err != nil {
+		t.Fatal(err)
+	}
+	stdin, _ := sess.StdinPipe()
+	var out bytes.Buffer
+	sess.Stdout = &out
+	if err := sess.Shell(); err != nil {
+		t.Fatal(err)
+	}
+	if err := sess.WindowChange(50, 132); err != nil {
+		t.Fatal(err)
+	}
+	io.WriteString(stdin, "stty -echo; stty size; exit 7\n")
+	err = sess.Wait()
+	var exitErr *ssh.ExitError
+	if !errors.As(err, &exitErr) || exitErr.ExitStatus() != 7 {
+		t.Errorf("shell exit: %v", err)
+	}
+	if !strings.Contains(out.String(), "50 132") {
+		t.Errorf("shell output %q", out.String())
+	}
+}
+
+func TestForwarding(t *testing.T) {
+	dir := t.TempDir()
+	addr, _ := startServer(t, Config{Users: []User{{Name: "test", Password: "pw"}}})
+	client := dial(t, addr, "test", ssh.Password("pw"))
+
+	// direct-tcpip 和 direct-streamlocal
+	tl, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	echoServer(t, tl)
+	c, err := client.Dial("tcp", tl.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	checkEcho(t, c, "tcp")
+
+	sock := filepath.Join(dir, "echo.sock")
+	ul, err := net.Listen("unix", sock)
+	if err != nil {
+		t.Fatal(err)
+	}
+	echoServer(t, ul)
+	c, err = client.Dial("unix", sock)
+	if err != nil {
+		t.Fatal(err)
+	}
+	checkEcho(t, c, "unix")
+
+	if _, err := client.Dial("tcp", "127.0.0.1:1"); err == nil {
+		t.Error("dial closed port succeeded")
+	}
+
+	// tcpip-forward, 端口 0 由服务端分配
+	rl, err := client.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	echoServer(t, rl)
+	c, err = net.Dial("tcp", rl.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	checkEcho(t, c, "remote tcp")
+	rl.Close()
+	time.Sleep(100 * time.Millisecond)
+	if c, err := net.DialTimeout("tcp", rl.Addr().String(), time.Second); err == nil {
+		c.Close()
+		t.Error("remote listener still open after cancel")
+	}
+
+	// streamlocal-forward
+	rsock := filepath.Join(dir, "remote.sock")
+	rul, err := client.ListenUnix(rsock)
+	if err != nil {
+		t.Fatal(err)
+	}
+	echoServer(t, rul)
+	c, err = net.Dial("unix", rsock)
+	if err != nil {
+		t.Fatal(err)
+	}
+	checkEcho(t, c, "remote unix")
+
+	// 关闭转发
+	addr2, _ := startServer(t, Config{DisableForwarding: true, Users: []User{{Name: "test", Password: "pw"}}})
+	client2 := dial(t, addr2, "test", ssh.Password("pw"))
+	if _, err := client2.Dial("tcp", tl.Addr().String()); err == nil {
+		t.Error("direct-tcpip allowed with forwarding disabled")
+	}
+	if _, err := client2.Listen("tcp", "127.0.0.1:0"); err == nil {
+		t.Error("tcpip-forward allowed with forwarding disabled")
+	}
+}
+
+func TestSFTP(t *testing.T) {
+	dir := t.TempDir()
+	addr, _ := startServer(t, Config{Users: []User{{Name: "test", Password: "pw"}}})
+	client := dial(t, addr, "test", ssh.Password("pw"))
+
+	sc, err := sftp.NewClient(client)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer sc.Close()
+	path := filepath.Join(dir, "file.txt")
+	f, err := sc.Create(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	f.Write([]byte("hello sftp"))
+	f.Close()
+	if data, err := os.ReadFile(path); err != nil || string(data) != "hello sftp" {
+		t.Errorf("file: %q %v", data, err)
+	}
+
+	addr2, _ := startServer(t, Config{DisableSFTP: true, Users: []User{{Name: "test", Password: "pw"}}})
+	if _, err := sftp.NewClient(dial(t, addr2, "test", ssh.Password("pw"))); err == nil {
+		t.Error("sftp allowed when disabled")
+	}
+}
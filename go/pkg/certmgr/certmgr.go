@@ -0,0 +1,321 @@
+// Package certmgr 按 SNI 选择证书: 从目录加载多对证书和私钥, 支持通配符,
+// 可以为未知域名现场签发自签名或本地 CA 签名的证书, 目录变化时自动重新加载
+package certmgr
+
+import (
+	"container/list"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"errors"
+	"fmt"
+	"log"
+	"math/big"
+	"net"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// 现场签发证书的方式
+const (
+	GenerateOff        = ""
+	GenerateSelfSigned = "self-signed"
+	GenerateCA         = "ca"
+)
+
+// 现场签发的证书有效期
+const generatedValidity = 90 * 24 * time.Hour
+
+// 最多缓存的签发证书, 超过后淘汰最久没有用到的
+const maxGenerated = 1024
+
+type Manager struct {
+	dir      string
+	generate string
+	ca       *x509.Certificate
+	caKey    any
+	key      *ecdsa.PrivateKey // 签发证书共用的私钥
+	names    []string          // 允许签发的域名
+
+	// 没有证书命中且不签发时使用
+	Fallback *tls.Certificate
+
+	mu        sync.RWMutex
+	byName    map[string][]*tls.Certificate // 证书中的域名 (含 *.example.com) 和 IP
+	generated map[string]*list.Element      // 值为 *generatedCert, 按使用时间排在 lru 中
+	lru       *list.List
+	signature string // 目录内容的摘要, 用于判断是否需要重新加载
+}
+
+type generatedCert struct {
+	name string
+	cert *tls.Certificate
+}
+
+// dir 为空时不加载任何证书, 只靠签发或 Fallback
+func New(dir string) (*Manager, error) {
+	m := &Manager{dir: dir, byName: map[string][]*tls.Certificate{}, generated: map[string]*list.Element{}, lru: list.New()}
+	if err := m.Reload(); err != nil {
+		return nil, err
+	}
+	return m, nil
+}
+
+// 对 names 命中的未知域名生成自签名证书, names 支持 *.example.com, "*" 表示任意域名
+func (m *Manager) EnableSelfSigned(names ...string) error {
+	return m.enableGenerate(GenerateSelfSigned, nil, nil, names)
+}
+
+// 对 names 命中的未知域名用本地 CA 签发证书, 客户端信任该 CA 后不会报错
+func (m *Manager) EnableCA(certFile, keyFile string, names ...string) error {
+	pair, err := tls.LoadX509KeyPair(certFile, keyFile)
+	if err != nil {
+		return err
+	}
+	ca, err := x509.ParseCertificate(pair.Certificate[0])
+	if err != nil {
+		return err
+	}
+	if !ca.IsCA {
+		return errors.New("certmgr: not a CA certificate: " + certFile)
+	}
+	return m.enableGenerate(GenerateCA, ca, pair.PrivateKey, names)
+}
+
+func (m *Manager) enableGenerate(mode string, ca *x509.Certificate, caKey any, names []string) error {
+	// 不限制域名时任何客户端都能让服务端不停签发证书
+	if len(names) == 0 {
+		return errors.New("certmgr: no names allowed for generated certificates")
+	}
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return err
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.generate, m.ca, m.caKey, m.key = mode, ca, caKey, key
+	m.names = make([]string, len(names))
+	for i, n := range names {
+		m.names[i] = strings.ToLower(n)
+	}
+	m.generated, m.lru = map[string]*list.Element{}, list.New()
+	return nil
+}
+
+// 域名是否允许签发, 通配符只匹配一级子域名
+func (m *Manager) allowed(name string) bool {
+	for _, p := range m.names {
+		if p == "*" || p == name {
+			return true
+		}
+		if suffix, ok := strings.CutPrefix(p, "*."); ok {
+			if label, rest, ok := strings.Cut(name, "."); ok && label != "" && rest == suffix {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// 用作 tls.Config.GetCertificate
+func (m *Manager) GetCertificate(hello *tls.ClientHelloInfo) (*tls.Certificate, error) {
+	name := strings.ToLower(strings.TrimSuffix(hello.ServerName, "."))
+	if name == "" && hello.Conn != nil {
+		// 没有 SNI (直接用 IP 访问) 时按本地地址选择
+		if addr, ok := hello.Conn.LocalAddr().(*net.TCPAddr); ok {
+			name = addr.IP.String()
+		}
+	}
+	if cert := m.lookup(hello, name); cert != nil {
+		return cert, nil
+	}
+	m.mu.RLock()
+	generate := m.generate != GenerateOff && name != "" && m.allowed(name)
+	m.mu.RUnlock()
+	if generate {
+		return m.issue(name)
+	}
+	if m.Fallback != nil {
+		return m.Fallback, nil
+	}
+	return nil, fmt.Errorf("certmgr: no certificate for %q", name)
+}
+
+// 先精确匹配, 再匹配上一级的通配符, 同名有多张证书时选客户端支持的那张
+func (m *Manager) lookup(hello *tls.ClientHelloInfo, name string) *tls.Certificate {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	candidates := m.byName[name]
+	if len(candidates) == 0 {
+		if _, parent, ok := strings.Cut(name, "."); ok {
+			candidates = m.byName["*."+parent]
+		}
+	}
+	for _, c := range candidates {
+		if hello.SupportsCertificate(c) == nil {
+			return c
+		}
+	}
+	if len(candidates) > 0 {
+		return candidates[0]
+	}
+	return nil
+}
+
+func (m *Manager) issue(name string) (*tls.Certificate, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if e, ok := m.generated[name]; ok {
+		if cert := e.Value.(*generatedCert).cert; time.Now().Before(cert.Leaf.NotAfter) {
+			m.lru.MoveToFront(e)
+			return cert, nil
+		}
+		m.lru.Remove(e)
+		delete(m.generated, name)
+	}
+	serial, err := rand.Int(rand.Reader, new(big.Int).Lsh(big.NewInt(1), 128))
+	if err != nil {
+		return nil, err
+	}
+	tmpl := &x509.Certificate{
+		SerialNumber: serial,
+		Subject:      pkix.Name{CommonName: name, Organization: []string{"certmgr"}},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(generatedValidity),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+	}
+	if ip := net.ParseIP(name); ip != nil {
+		tmpl.IPAddresses = []net.IP{ip}
+	} else {
+		tmpl.DNSNames = []string{name}
+	}
+	parent, signer := tmpl, any(m.key)
+	if m.generate == GenerateCA {
+		parent, signer = m.ca, m.caKey
+		if tmpl.NotAfter.After(m.ca.NotAfter) {
+			tmpl.NotAfter = m.ca.NotAfter
+		}
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, parent, &m.key.PublicKey, signer)
+	if err != nil {
+		return nil, err
+	}
+	leaf, err := x509.ParseCertificate(der)
+	if err != nil {
+		return nil, err
+	}
+	cert := &tls.Certificate{Certificate: [][]byte{der}, PrivateKey: m.key, Leaf: leaf}
+	if m.generate == GenerateCA {
+		cert.Certificate = append(cert.Certificate, m.ca.Raw)
+	}
+	m.generated[name] = m.lru.PushFront(&generatedCert{name: name, cert: cert})
+	for m.lru.Len() > maxGenerated {
+		oldest := m.lru.Back()
+		m.lru.Remove(oldest)
+		delete(m.generated, oldest.Value.(*generatedCert).name)
+	}
+	log.Printf("certmgr: issued %s certificate for %s", m.generate, name)
+	return cert, nil
+}
+
+// 重新加载目录中的证书: name.crt 或 name.pem 与同名的 name.key 配对, 没有 .key 时认为私钥在同一个文件中
+// 某一对加载失败只打日志, 不影响其它证书
+func (m *Manager) Reload() error {
+	if m.dir == "" {
+		return nil
+	}
+	sig, files, err := m.scan()
+	if err != nil {
+		return err
+	}
+	byName := map[string][]*tls.Certificate{}
+	for _, certFile := range files {
+		keyFile := strings.TrimSuffix(certFile, filepath.Ext(certFile)) + ".key"
+		if _, err := os.Stat(keyFile); err != nil {
+			keyFile = certFile
+		}
+		cert, err := tls.LoadX509KeyPair(certFile, keyFile)
+		if err != nil {
+			log.Printf("certmgr: %s: %v", certFile, err)
+			continue
+		}
+		for _, name := range certNames(cert.Leaf) {
+			byName[name] = append(byName[name], &cert)
+		}
+	}
+	m.mu.Lock()
+	m.byName, m.signature = byName, sig
+	m.mu.Unlock()
+	return nil
+}
+
+// 证书文件列表和目录内容摘要 (文件名、大小、修改时间)
+func (m *Manager) scan() (string, []string, error) {
+	entries, err := os.ReadDir(m.dir)
+	if err != nil {
+		return "", nil, err
+	}
+	var sig strings.Builder
+	var files []string
+	for _, e := range entries {
+		info, err := e.Info()
+		if err != nil || !info.Mode().IsRegular() {
+			continue
+		}
+		fmt.Fprintf(&sig, "%s %d %d\n", e.Name(), info.Size(), info.ModTime().UnixNano())
+		switch filepath.Ext(e.Name()) {
+		case ".crt", ".pem", ".cer":
+			files = append(files, filepath.Join(m.dir, e.Name()))
+		}
+	}
+	sort.Strings(files)
+	return sig.String(), files, nil
+}
+
+// 目录内容变化时重新加载, 已经建立的连接不受影响
+func (m *Manager) Watch(interval time.Duration) {
+	if m.dir == "" {
+		return
+	}
+	for range time.Tick(interval) {
+		sig, _, err := m.scan()
+		if err != nil {
+			log.Printf("certmgr: %v", err)
+			continue
+		}
+		m.mu.RLock()
+		changed := sig != m.signature
+		m.mu.RUnlock()
+		if !changed {
+			continue
+		}
+		if err := m.Reload(); err != nil {
+			log.Printf("certmgr: reload: %v", err)
+			continue
+		}
+		log.Printf("certmgr: reloaded %s", m.dir)
+	}
+}
+
+// 证书覆盖的名字, 有 SAN 时忽略 CN
+func certNames(leaf *x509.Certificate) []string {
+	var names []string
+	for _, n := range leaf.DNSNames {
+		names = append(names, strings.ToLower(n))
+	}
+	for _, ip := range leaf.IPAddresses {
+		names = append(names, ip.String())
+	}
+	if len(names) == 0 && leaf.Subject.CommonName != "" {
+		names = append(names, strings.ToLower(leaf.Subject.CommonName))
+	}
+	return names
+}
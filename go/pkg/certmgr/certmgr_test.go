@@ -0,0 +1,268 @@
+package certmgr
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"fmt"
+	"math/big"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// 生成证书, ca 为 nil 时自签名; names 中的 IP 写入 IPAddresses
+func newCert(t *testing.T, key crypto.Signer, cn string, isCA bool, ca *x509.Certificate, caKey crypto.Signer, names ...string) *x509.Certificate {
+	t.Helper()
+	tmpl := &x509.Certificate{
+		SerialNumber:          big.NewInt(time.Now().UnixNano()),
+		Subject:               pkix.Name{CommonName: cn},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(24 * time.Hour),
+		IsCA:                  isCA,
+		BasicConstraintsValid: true,
+		KeyUsage:              x509.KeyUsageDigitalSignature | x509.KeyUsageCertSign,
+	}
+	for _, n := range names {
+		if ip := net.ParseIP(n); ip != nil {
+			tmpl.IPAddresses = append(tmpl.IPAddresses, ip)
+		} else {
+			tmpl.DNSNames = append(tmpl.DNSNames, n)
+		}
+	}
+	if ca == nil {
+		ca, caKey = tmpl, key
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, ca, key.Public(), caKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return cert
+}
+
+func ecKey(t *testing.T) *ecdsa.PrivateKey {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return key
+}
+
+// 写入 dir/base.crt 和 dir/base.key, combined 时私钥写在证书文件中
+func writePair(t *testing.T, dir, base string, cert *x509.Certificate, key crypto.Signer, combined bool) {
+	t.Helper()
+	keyDER, err := x509.MarshalPKCS8PrivateKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	certPEM := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: cert.Raw})
+	keyPEM := pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: keyDER})
+	if combined {
+		certPEM = append(certPEM, keyPEM...)
+	} else if err := os.WriteFile(filepath.Join(dir, base+".key"), keyPEM, 0600); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(filepath.Join(dir, base+".crt"), certPEM, 0600); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// 按 CN 区分选中的证书
+func commonName(t *testing.T, cert *tls.Certificate, err error) string {
+	t.Helper()
+	if err != nil {
+		return "error"
+	}
+	leaf := cert.Leaf
+	if leaf == nil {
+		leaf, _ = x509.ParseCertificate(cert.Certificate[0])
+	}
+	return leaf.Subject.CommonName
+}
+
+// 只有 LocalAddr 的连接, 用于测试没有 SNI 时按本地地址选择
+type localConn struct {
+	net.Conn
+	addr net.Addr
+}
+
+func (c localConn) LocalAddr() net.Addr { return c.addr }
+
+func TestGetCertificate(t *testing.T) {
+	dir := t.TempDir()
+	ec := ecKey(t)
+	rsaKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	writePair(t, dir, "exact", newCert(t, ec, "exact", false, nil, nil, "www.example.com"), ec, false)
+	writePair(t, dir, "wild", newCert(t, ec, "wild", false, nil, nil, "*.example.com"), ec, true)
+	writePair(t, dir, "ip", newCert(t, ec, "ip", false, nil, nil, "127.0.0.1"), ec, false)
+	// 同名的 ECDSA 和 RSA 证书, 按客户端支持的签名算法选择
+	writePair(t, dir, "dual-ec", newCert(t, ec, "dual-ec", false, nil, nil, "dual.test"), ec, false)
+	writePair(t, dir, "dual-rsa", newCert(t, rsaKey, "dual-rsa", false, nil, nil, "dual.test"), rsaKey, false)
+	// 没有 SAN 时使用 CN
+	writePair(t, dir, "cn", newCert(t, ec, "CN.Test", false, nil, nil), ec, false)
+	// 私钥不匹配的证书被跳过
+	writePair(t, dir, "broken", newCert(t, ec, "broken", false, nil, nil, "broken.test"), ecKey(t), false)
+
+	m, err := New(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	rsaOnly := []tls.SignatureScheme{tls.PSSWithSHA256, tls.PKCS1WithSHA256}
+	tests := []struct {
+		hello *tls.ClientHelloInfo
+		want  string
+	}{
+		{&tls.ClientHelloInfo{ServerName: "www.example.com"}, "exact"},
+		{&tls.ClientHelloInfo{ServerName: "WWW.Example.com."}, "exact"},
+		{&tls.ClientHelloInfo{ServerName: "api.example.com"}, "wild"},
+		{&tls.ClientHelloInfo{ServerName: "a.b.example.com"}, "error"},
+		{&tls.ClientHelloInfo{ServerName: "example.com"}, "error"},
+		{&tls.ClientHelloInfo{Conn: localConn{addr: &net.TCPAddr{IP: net.IPv4(127, 0, 0, 1), Port: 443}}}, "ip"},
+		{&tls.ClientHelloInfo{ServerName: "dual.test", SignatureSchemes: rsaOnly}, "dual-rsa"},
+		{&tls.ClientHelloInfo{ServerName: "dual.test", SignatureSchemes: []tls.SignatureScheme{tls.ECDSAWithP256AndSHA256}}, "dual-ec"},
+		{&tls.ClientHelloInfo{ServerName: "cn.test"}, "CN.Test"},
+		{&tls.ClientHelloInfo{ServerName: "broken.test"}, "error"},
+		{&tls.ClientHelloInfo{}, "error"},
+	}
+	for _, tt := range tests {
+		// 补齐 SupportsCertificate 需要的字段
+		if tt.hello.SignatureSchemes == nil {
+			tt.hello.SignatureSchemes = []tls.SignatureScheme{tls.ECDSAWithP256AndSHA256, tls.PSSWithSHA256}
+		}
+		tt.hello.SupportedVersions = []uint16{tls.VersionTLS13, tls.VersionTLS12}
+		tt.hello.SupportedCurves = []tls.CurveID{tls.CurveP256}
+		tt.hello.CipherSuites = []uint16{tls.TLS_ECDHE_ECDSA_WITH_AES_128_GCM_SHA256, tls.TLS_ECDHE_RSA_WITH_AES_128_GCM_SHA256}
+		cert, err := m.GetCertificate(tt.hello)
+		if got := commonName(t, cert, err); got != tt.want {
+			t.Errorf("%q: got %s, want %s", tt.hello.ServerName, got, tt.want)
+		}
+	}
+
+	// 没有命中时使用 Fallback
+	fallback := &tls.Certificate{Leaf: &x509.Certificate{Subject: pkix.Name{CommonName: "fallback"}}}
+	m.Fallback = fallback
+	if cert, err := m.GetCertificate(&tls.ClientHelloInfo{ServerName: "unknown.test"}); err != nil || cert != fallback {
+		t.Errorf("fallback: %v %v", cert, err)
+	}
+}
+
+func TestReload(t *testing.T) {
+	dir := t.TempDir()
+	ec := ecKey(t)
+	writePair(t, dir, "a", newCert(t, ec, "v1", false, nil, nil, "a.test"), ec, false)
+	m, err := New(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	get := func(name string) string {
+		cert, err := m.GetCertificate(&tls.ClientHelloInfo{ServerName: name})
+		return commonName(t, cert, err)
+	}
+	if got := get("a.test"); got != "v1" {
+		t.Fatalf("before reload: %s", got)
+	}
+	writePair(t, dir, "a", newCert(t, ec, "v2", false, nil, nil, "a.test"), ec, false)
+	writePair(t, dir, "b", newCert(t, ec, "b", false, nil, nil, "b.test"), ec, false)
+	if got := get("a.test"); got != "v1" {
+		t.Errorf("changed without reload: %s", got)
+	}
+	if err := m.Reload(); err != nil {
+		t.Fatal(err)
+	}
+	if a, b := get("a.test"), get("b.test"); a != "v2" || b != "b" {
+		t.Errorf("after reload: %s %s", a, b)
+	}
+	os.Remove(filepath.Join(dir, "b.crt"))
+	if err := m.Reload(); err != nil {
+		t.Fatal(err)
+	}
+	if got := get("b.test"); got != "error" {
+		t.Errorf("removed certificate still served: %s", got)
+	}
+
+	// Watch 在目录变化后自动加载
+	go m.Watch(10 * time.Millisecond)
+	writePair(t, dir, "c", newCert(t, ec, "c", false, nil, nil, "c.test"), ec, false)
+	deadline := time.Now().Add(5 * time.Second)
+	for get("c.test") != "c" {
+		if time.Now().After(deadline) {
+			t.Fatal("watch did not reload")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	if _, err := New(filepath.Join(dir, "missing")); err == nil {
+		t.Error("missing directory accepted")
+	}
+}
+
+func TestGenerate(t *testing.T) {
+	m, err := New("")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := m.EnableSelfSigned(); err == nil {
+		t.Fatal("generate without names accepted")
+	}
+
+	caKey := ecKey(t)
+	ca := newCert(t, caKey, "test ca", true, nil, nil)
+	dir := t.TempDir()
+	writePair(t, dir, "ca", ca, caKey, false)
+	if err := m.EnableCA(filepath.Join(dir, "ca.crt"), filepath.Join(dir, "ca.key"), "*.dev.test", "10.0.0.1"); err != nil {
+		t.Fatal(err)
+	}
+	pool := x509.NewCertPool()
+	pool.AddCert(ca)
+	for _, name := range []string{"a.dev.test", "10.0.0.1"} {
+		cert, err := m.GetCertificate(&tls.ClientHelloInfo{ServerName: name})
+		if err != nil {
+			t.Fatalf("%s: %v", name, err)
+		}
+		if _, err := cert.Leaf.Verify(x509.VerifyOptions{DNSName: name, Roots: pool}); err != nil {
+			t.Errorf("%s: %v", name, err)
+		}
+		if again, _ := m.GetCertificate(&tls.ClientHelloInfo{ServerName: name}); again != cert {
+			t.Errorf("%s: certificate not cached", name)
+		}
+	}
+	// 不在允许列表中的域名不签发
+	for _, name := range []string{"dev.test", "a.b.dev.test", "other.test", "10.0.0.2"} {
+		if cert, err := m.GetCertificate(&tls.ClientHelloInfo{ServerName: name}); err == nil {
+			t.Errorf("%s: issued %v", name, cert.Leaf.DNSNames)
+		}
+	}
+
+	// 缓存有上限, 最久没有用到的先淘汰
+	if err := m.EnableSelfSigned("*"); err != nil {
+		t.Fatal(err)
+	}
+	first, _ := m.GetCertificate(&tls.ClientHelloInfo{ServerName: "first.test"})
+	for i := 0; i < maxGenerated+10; i++ {
+		if _, err := m.GetCertificate(&tls.ClientHelloInfo{ServerName: fmt.Sprintf("h%d.test", i)}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if len(m.generated) != maxGenerated || m.lru.Len() != maxGenerated {
+		t.Errorf("cache holds %d/%d certificates", len(m.generated), m.lru.Len())
+	}
+	if again, _ := m.GetCertificate(&tls.ClientHelloInfo{ServerName: "first.test"}); again == first {
+		t.Error("least recently used certificate not evicted")
+	}
+}
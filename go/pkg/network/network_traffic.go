@@ -1,7 +1,9 @@
 package network
 
 import (
+	"code/pkg/network/portsketch"
 	"code/utils"
+	"encoding/binary"
 	"fmt"
 	"net"
 	"os"
@@ -17,19 +19,67 @@ import (
 	"golang.org/x/net/bpf"
 )
 
+// 每个 IP 最多记录的端口数, 端口扫描时内存也不会增长
+const portSketchSize = 128
+
+// 四层协议
+type Protocol = portsketch.Protocol
+
+const (
+	ProtoOther = portsketch.ProtoOther
+	ProtoTCP   = portsketch.ProtoTCP
+	ProtoUDP   = portsketch.ProtoUDP
+	ProtoICMP  = portsketch.ProtoICMP
+)
+
+// 端口的流量, 见 portsketch.Stats
+type PortStats = portsketch.Stats
+
 // 流量统计项
 type TrafficStats struct {
 	ToInternal   uint64 // 访问内网流量
 	FromInternal uint64 // 来自内网的流量
 	ToExternal   uint64 // 访问外网流量
 	FromExternal uint64 // 来自外网的流量
+
+	// 按四层协议统计, 包括收和发
+	TCP   ProtoStats
+	UDP   ProtoStats
+	ICMP  ProtoStats
+	Other ProtoStats
+}
+
+type ProtoStats struct {
+	Bytes   uint64
+	Packets uint64
+}
+
+func (s *TrafficStats) proto(p Protocol) *ProtoStats {
+	switch p {
+	case ProtoTCP:
+		return &s.TCP
+	case ProtoUDP:
+		return &s.UDP
+	case ProtoICMP:
+		return &s.ICMP
+	}
+	return &s.Other
+}
+
+// 抓到的一个包
+type packetInfo struct {
+	srcIP, dstIP     net.IP
+	length           uint32
+	proto            Protocol
+	srcPort, dstPort uint16 // 只有 TCP 和 UDP 有端口
 }
 
 // 流量统计管理器
 type TrafficManager struct {
-	stats      map[string]*TrafficStats // IP地址到统计数据的映射
-	ipSet      map[string]struct{}      // 关注的IP集合
-	mu         sync.RWMutex             // 读写锁保护共享数据
+	stats      map[string]*TrafficStats      // IP地址到统计数据的映射
+	ports      map[string]*portsketch.Sketch // IP地址到端口统计的映射
+	ipSet      map[string]struct{}           // 关注的IP集合
+	mu         sync.RWMutex                  // 读写锁保护共享数据
 	stopCh     chan struct{}
 	wg         sync.WaitGroup // 等待协程完成
 	flushTimer *time.Timer    // 定期刷新统计数据的计时器
@@ -42,6 +92,7 @@ func NewTrafficManager(ifaceName, syntax string,
 	tm := &TrafficManager{
 		stopCh:  make(chan struct{}),
 		stats:   make(map[string]*TrafficStats),
+		ports:   make(map[string]*portsketch.Sketch),
 		ipSet:   make(map[string]struct{}),
 		lockMap: make(map[string]*sync.Mutex),
 	}
@@ -62,8 +113,17 @@ func NewTrafficManager(ifaceName, syntax string,
 	return tm
 }
 
-// 添加关注的IP地址
+// 统一 IP 地址的写法, 使 IPv6 地址与抓包得到的 String() 一致
+func normalizeIP(ip string) string {
+	if parsed := net.ParseIP(ip); parsed != nil {
+		return parsed.String()
+	}
+	return ip
+}
+
+// 添加关注的IP地址, 支持 IPv4 和 IPv6
 func (tm *TrafficManager) AddIP(ip string) {
+	ip = normalizeIP(ip)
 	tm.mu.Lock()
 	defer tm.mu.Unlock()
 	tm.ipSet[ip] = struct{}{}
@@ -73,67 +133,97 @@ func (tm *TrafficManager) AddIP(ip string) {
 	}
 }
 
+// 取关注的IP的锁和统计项, 不关注时返回 nil
+func (tm *TrafficManager) entry(ip string) (*sync.Mutex, *TrafficStats, *portsketch.Sketch) {
+	tm.mu.RLock()
+	_, watched := tm.ipSet[ip]
+	lock, stats, ports := tm.lockMap[ip], tm.stats[ip], tm.ports[ip]
+	tm.mu.RUnlock()
+	if !watched {
+		return nil, nil, nil
+	}
+	if stats == nil || ports == nil {
+		tm.mu.Lock()
+		if stats = tm.stats[ip]; stats == nil {
+			stats = &TrafficStats{}
+			tm.stats[ip] = stats
+		}
+		if ports = tm.ports[ip]; ports == nil {
+			ports = portsketch.New(portSketchSize)
+			tm.ports[ip] = ports
+		}
+		tm.mu.Unlock()
+	}
+	return lock, stats, ports
+}
+
 // 更新统计数据
-// 更新统计数据
-func (tm *TrafficManager) updateStats(srcIP, dstIP net.IP, length uint32) {
-	srcIPStr := srcIP.String()
-	dstIPStr := dstIP.String()
-	length64 := uint64(length)
+func (tm *TrafficManager) updateStats(p *packetInfo) {
+	length64 := uint64(p.length)
 
 	// 检查源IP是否在内网
-	srcIsInternal := utils.IsInternalIP(srcIP)
+	srcIsInternal := utils.IsInternalIP(p.srcIP)
 	// 检查目的IP是否在内网
-	dstIsInternal := utils.IsInternalIP(dstIP)
-
-	// 检查是否需要统计此IP
-	tm.mu.RLock()
-	_, srcWatched := tm.ipSet[srcIPStr]
-	_, dstWatched := tm.ipSet[dstIPStr]
-	tm.mu.RUnlock()
+	dstIsInternal := utils.IsInternalIP(p.dstIP)
 
 	// 更新源IP的统计（如果关注）
-	if srcWatched {
-		lock := tm.lockMap[srcIPStr]
+	if lock, stats, ports := tm.entry(p.srcIP.String()); stats != nil {
 		lock.Lock()
-		if _, exists := tm.stats[srcIPStr]; !exists {
-			tm.stats[srcIPStr] = &TrafficStats{}
-		}
-		stats := tm.stats[srcIPStr]
-
 		if srcIsInternal && !dstIsInternal {
 			atomic.AddUint64(&stats.ToExternal, length64) // 访问外网的流量
 		} else if srcIsInternal && dstIsInternal {
 			atomic.AddUint64(&stats.ToInternal, length64) // 访问内网的流量
 		}
+		updateProto(stats, ports, p, p.srcPort, p.dstPort)
 		lock.Unlock()
 	}
 
 	// 更新目的IP的统计（如果关注）
-	if dstWatched {
-		lock := tm.lockMap[dstIPStr]
+	if lock, stats, ports := tm.entry(p.dstIP.String()); stats != nil {
 		lock.Lock()
-		if _, exists := tm.stats[dstIPStr]; !exists {
-			tm.stats[dstIPStr] = &TrafficStats{}
-		}
-		stats := tm.stats[dstIPStr]
-
 		if !srcIsInternal && dstIsInternal {
 			atomic.AddUint64(&stats.FromExternal, length64) // 来自外网的流量
 		} else if srcIsInternal && dstIsInternal {
 			atomic.AddUint64(&stats.FromInternal, length64) // 来自内网的流量
 		}
+		updateProto(stats, ports, p, p.dstPort, p.srcPort)
 		lock.Unlock()
 	}
 }
 
+// 按协议和本端、对端端口统计, 调用方持有该IP的锁
+func updateProto(stats *TrafficStats, ports *portsketch.Sketch, p *packetInfo, localPort, remotePort uint16) {
+	proto := stats.proto(p.proto)
+	atomic.AddUint64(&proto.Bytes, uint64(p.length))
+	atomic.AddUint64(&proto.Packets, 1)
+	if p.proto == ProtoTCP || p.proto == ProtoUDP {
+		ports.Add(portsketch.Key{Proto: p.proto, Port: localPort, Local: true}, uint64(p.length))
+		ports.Add(portsketch.Key{Proto: p.proto, Port: remotePort}, uint64(p.length))
+	}
+}
+
 // 获取特定IP的统计数据
 func (tm *TrafficManager) GetStats(ip string) (*TrafficStats, bool) {
 	tm.mu.RLock()
 	defer tm.mu.RUnlock()
-	stats, exists := tm.stats[ip]
+	stats, exists := tm.stats[normalizeIP(ip)]
 	return stats, exists
 }
 
+// 获取特定IP流量最多的 n 个端口, 本端和对端端口分别计数
+func (tm *TrafficManager) TopPorts(ip string, n int) []PortStats {
+	ip = normalizeIP(ip)
+	tm.mu.RLock()
+	lock, ports := tm.lockMap[ip], tm.ports[ip]
+	tm.mu.RUnlock()
+	if lock == nil || ports == nil {
+		return nil
+	}
+	lock.Lock()
+	defer lock.Unlock()
+	return ports.Top(n)
+}
+
 // 获取所有IP的统计数据
 func (tm *TrafficManager) GetAllStats() map[string]*TrafficStats {
 	tm.mu.RLock()
@@ -152,6 +242,7 @@ func (tm *TrafficManager) FlushStats() {
 	tm.mu.Lock()
 	defer tm.mu.Unlock()
 	tm.stats = map[string]*TrafficStats{}
+	tm.ports = map[string]*portsketch.Sketch{}
 }
 
 // 关闭流量管理器
@@ -230,16 +321,40 @@ func (tm *TrafficManager) capture(ifaceName, syntax string) {
 			}
 			// 使用 gopacket 解析数据
 			packet := gopacket.NewPacket(data, layers.LinkTypeEthernet, gopacket.Default)
-			if ethernetLayer := packet.Layer(layers.LayerTypeEthernet); ethernetLayer != nil {
-				ethernetPacket, _ := ethernetLayer.(*layers.Ethernet)
-				if ethernetPacket.EthernetType == layers.EthernetTypeIPv4 {
-					if ipLayer := packet.Layer(layers.LayerTypeIPv4); ipLayer != nil {
-						// 转换为 IPv4 对象
-						ip, _ := ipLayer.(*layers.IPv4)
-						tm.updateStats(ip.SrcIP, ip.DstIP, uint32(len(packet.LinkLayer().LayerPayload())))
-					}
+			var p packetInfo
+			switch ip := packet.NetworkLayer().(type) {
+			case *layers.IPv4:
+				p = packetInfo{srcIP: ip.SrcIP, dstIP: ip.DstIP, length: uint32(len(packet.LinkLayer().LayerPayload()))}
+			case *layers.IPv6:
+				p = packetInfo{srcIP: ip.SrcIP, dstIP: ip.DstIP, length: ipv6Length(ip)}
+			default:
+				continue
+			}
+			// 四层协议, gopacket 已跳过 IPv6 扩展头
+			switch l4 := packet.TransportLayer().(type) {
+			case *layers.TCP:
+				p.proto, p.srcPort, p.dstPort = ProtoTCP, uint16(l4.SrcPort), uint16(l4.DstPort)
+			case *layers.UDP:
+				p.proto, p.srcPort, p.dstPort = ProtoUDP, uint16(l4.SrcPort), uint16(l4.DstPort)
+			default:
+				if packet.Layer(layers.LayerTypeICMPv4) != nil || packet.Layer(layers.LayerTypeICMPv6) != nil {
+					p.proto = ProtoICMP
 				}
 			}
+			tm.updateStats(&p)
+		}
+	}
+}
+
+// IPv6 包长度: 40 字节固定头加载荷长度, 载荷长度已包含扩展头;
+// 巨型帧的载荷长度为 0, 实际长度在逐跳选项里
+func ipv6Length(ip *layers.IPv6) uint32 {
+	if ip.Length == 0 && ip.HopByHop != nil {
+		for _, opt := range ip.HopByHop.Options {
+			if opt.OptionType == layers.IPv6HopByHopOptionJumbogram && len(opt.OptionData) == 4 {
+				return 40 + binary.BigEndian.Uint32(opt.OptionData)
+			}
 		}
 	}
+	return 40 + uint32(ip.Length)
 }
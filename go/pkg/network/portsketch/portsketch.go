@@ -0,0 +1,140 @@
+// Package portsketch 在固定内存内统计流量最多的端口
+package portsketch
+
+import (
+	"container/heap"
+	"sort"
+)
+
+// 四层协议
+type Protocol uint8
+
+const (
+	ProtoOther Protocol = iota
+	ProtoTCP
+	ProtoUDP
+	ProtoICMP
+)
+
+func (p Protocol) String() string {
+	switch p {
+	case ProtoTCP:
+		return "tcp"
+	case ProtoUDP:
+		return "udp"
+	case ProtoICMP:
+		return "icmp"
+	}
+	return "other"
+}
+
+// 端口的流量, 由 Space-Saving 算法估计:
+// Bytes 和 Packets 不小于真实值, 真实字节数不小于 Bytes-Error
+type Stats struct {
+	Protocol Protocol
+	Port     uint16
+	Local    bool // true 为关注的 IP 一端的端口, false 为对端端口
+	Bytes    uint64
+	Packets  uint64
+	Error    uint64
+}
+
+type Key struct {
+	Proto Protocol
+	Port  uint16
+	Local bool
+}
+
+type portCounter struct {
+	key     Key
+	bytes   uint64
+	packets uint64
+	err     uint64
+	index   int // 在堆中的位置
+}
+
+// 按字节数的最小堆
+type portHeap []*portCounter
+
+func (h portHeap) Len() int           { return len(h) }
+func (h portHeap) Less(i, j int) bool { return h[i].bytes < h[j].bytes }
+func (h portHeap) Swap(i, j int) {
+	h[i], h[j] = h[j], h[i]
+	h[i].index = i
+	h[j].index = j
+}
+
+func (h *portHeap) Push(x any) {
+	c := x.(*portCounter)
+	c.index = len(*h)
+	*h = append(*h, c)
+}
+
+func (h *portHeap) Pop() any {
+	old := *h
+	c := old[len(old)-1]
+	*h = old[:len(old)-1]
+	return c
+}
+
+// 带权重的 Space-Saving: 满了以后新端口替换字节数最少的计数器并继承它的计数
+type Sketch struct {
+	capacity int
+	counters map[Key]*portCounter
+	heap     portHeap
+}
+
+// 最多记录 capacity 个端口, 小于 1 时按 1 处理
+func New(capacity int) *Sketch {
+	capacity = max(capacity, 1)
+	return &Sketch{
+		capacity: capacity,
+		counters: make(map[Key]*portCounter, capacity),
+	}
+}
+
+// 记录一个 bytes 字节的包
+func (s *Sketch) Add(key Key, bytes uint64) {
+	if c, ok := s.counters[key]; ok {
+		c.bytes += bytes
+		c.packets++
+		heap.Fix(&s.heap, c.index)
+		return
+	}
+	if len(s.heap) < s.capacity {
+		c := &portCounter{key: key, bytes: bytes, packets: 1}
+		s.counters[key] = c
+		heap.Push(&s.heap, c)
+		return
+	}
+	c := s.heap[0]
+	delete(s.counters, c.key)
+	c.key = key
+	c.err = c.bytes
+	c.bytes += bytes
+	c.packets++
+	s.counters[key] = c
+	heap.Fix(&s.heap, 0)
+}
+
+// 字节数最多的 n 个端口, n <= 0 时返回全部
+func (s *Sketch) Top(n int) []Stats {
+	result := make([]Stats, 0, len(s.heap))
+	for _, c := range s.heap {
+		result = append(result, Stats{
+			Protocol: c.key.Proto,
+			Port:     c.key.Port,
+			Local:    c.key.Local,
+			Bytes:    c.bytes,
+			Packets:  c.packets,
+			Error:    c.err,
+		})
+	}
+	sort.Slice(result, func(i, j int) bool {
+		return result[i].Bytes > result[j].Bytes
+	})
+	if n > 0 && n < len(result) {
+		result = result[:n]
+	}
+	return result
+}
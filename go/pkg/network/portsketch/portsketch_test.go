@@ -0,0 +1,134 @@
+package portsketch
+
+import (
+	"math/rand"
+	"testing"
+)
+
+func TestTopOrder(t *testing.T) {
+	s := New(8)
+	tcp := func(port uint16) Key { return Key{Proto: ProtoTCP, Port: port} }
+	for i, bytes := range []uint64{100, 300, 200} {
+		s.Add(tcp(uint16(i+1)), bytes)
+	}
+	s.Add(tcp(1), 250)
+	s.Add(Key{Proto: ProtoUDP, Port: 1}, 50)
+	s.Add(Key{Proto: ProtoTCP, Port: 1, Local: true}, 10)
+
+	want := []Stats{
+		{Protocol: ProtoTCP, Port: 1, Bytes: 350, Packets: 2},
+		{Protocol: ProtoTCP, Port: 2, Bytes: 300, Packets: 1},
+		{Protocol: ProtoTCP, Port: 3, Bytes: 200, Packets: 1},
+		{Protocol: ProtoUDP, Port: 1, Bytes: 50, Packets: 1},
+		{Protocol: ProtoTCP, Port: 1, Local: true, Bytes: 10, Packets: 1},
+	}
+	got := s.Top(0)
+	if len(got) != len(want) {
+		t.Fatalf("top(0) = %v", got)
+	}
+	for i := range want {
+		if got[i] != want[i] {
+			t.Errorf("top[%d] = %+v, want %+v", i, got[i], want[i])
+		}
+	}
+	if top := s.Top(2); len(top) != 2 || top[0] != want[0] || top[1] != want[1] {
+		t.Errorf("top(2) = %v", top)
+	}
+	if top := s.Top(100); len(top) != len(want) {
+		t.Errorf("top(100) returned %d ports", len(top))
+	}
+	if top := New(4).Top(3); len(top) != 0 {
+		t.Errorf("empty sketch top = %v", top)
+	}
+}
+
+// 满了以后替换字节数最少的端口, 新端口继承它的计数作为误差
+func TestEviction(t *testing.T) {
+	s := New(2)
+	s.Add(Key{Port: 1}, 100)
+	s.Add(Key{Port: 2}, 10)
+	s.Add(Key{Port: 3}, 5)
+
+	top := s.Top(0)
+	if len(top) != 2 {
+		t.Fatalf("sketch holds %d ports", len(top))
+	}
+	if top[0].Port != 1 || top[0].Error != 0 {
+		t.Errorf("heavy port = %+v", top[0])
+	}
+	if e := top[1]; e.Port != 3 || e.Bytes != 15 || e.Packets != 2 || e.Error != 10 {
+		t.Errorf("evicting port = %+v", e)
+	}
+	// 被替换的端口再出现时重新计数
+	s.Add(Key{Port: 2}, 1)
+	for _, p := range s.Top(0) {
+		if p.Port == 3 {
+			t.Errorf("port 3 not evicted: %v", s.Top(0))
+		}
+		if p.Port == 2 && p.Error != 15 {
+			t.Errorf("port 2 = %+v", p)
+		}
+	}
+}
+
+// 容量不大于 0 时至少保留一个端口, 不会在替换时越界
+func TestZeroCapacity(t *testing.T) {
+	for _, capacity := range []int{0, -1} {
+		s := New(capacity)
+		s.Add(Key{Port: 1}, 10)
+		s.Add(Key{Port: 2}, 5)
+		top := s.Top(0)
+		if len(top) != 1 || top[0].Port != 2 || top[0].Bytes != 15 || top[0].Error != 10 {
+			t.Errorf("New(%d): top = %+v", capacity, top)
+		}
+	}
+}
+
+// 随机的长尾流量下检查 Space-Saving 的误差界:
+// 真实值在 [Bytes-Error, Bytes] 内, 且大于总量/容量的端口一定被保留
+func TestErrorBound(t *testing.T) {
+	const capacity = 32
+	r := rand.New(rand.NewSource(1))
+	s := New(capacity)
+	truth := map[Key]uint64{}
+	var total uint64
+	for i := 0; i < 100000; i++ {
+		var key Key
+		if r.Intn(2) == 0 {
+			// 少数热点端口占一半流量
+			key = Key{Proto: ProtoTCP, Port: uint16(r.Intn(5) + 1), Local: true}
+		} else {
+			key = Key{Proto: ProtoUDP, Port: uint16(r.Intn(5000) + 1000)}
+		}
+		bytes := uint64(r.Intn(1500) + 40)
+		s.Add(key, bytes)
+		truth[key] += bytes
+		total += bytes
+	}
+
+	top := s.Top(0)
+	if len(top) != capacity {
+		t.Fatalf("sketch holds %d ports", len(top))
+	}
+	kept := map[Key]bool{}
+	for _, p := range top {
+		key := Key{Proto: p.Protocol, Port: p.Port, Local: p.Local}
+		kept[key] = true
+		if real := truth[key]; real > p.Bytes || real < p.Bytes-p.Error {
+			t.Errorf("%+v: true bytes %d outside bound", p, real)
+		}
+		if p.Error > total/capacity {
+			t.Errorf("%+v: error above total/capacity %d", p, total/capacity)
+		}
+	}
+	for key, bytes := range truth {
+		if bytes > total/capacity && !kept[key] {
+			t.Errorf("heavy port %+v with %d bytes evicted", key, bytes)
+		}
+	}
+	for i := 0; i < 5; i++ {
+		if p := top[i]; p.Protocol != ProtoTCP || !p.Local {
+			t.Errorf("top[%d] = %+v, want a hot port", i, p)
+		}
+	}
+}
@@ -0,0 +1,105 @@
+package proxyproto
+
+import (
+	"bufio"
+	"net"
+	"sync"
+	"time"
+)
+
+// 默认等待 PROXY 头部的时间
+const DefaultHeaderTimeout = 5 * time.Second
+
+// 解析 PROXY 头部的监听器, 连接的 RemoteAddr/LocalAddr 返回头部中的原始地址
+// 头部是可选的, 没有头部的连接保持原来的地址, 因此只应该监听在不对外的地址或 unix socket 上,
+// 或者设置 Trusted 只接受来自转发方的头部
+type Listener struct {
+	net.Listener
+	HeaderTimeout time.Duration
+	Trusted       func(addr net.Addr) bool // 为 nil 时信任所有来源; 不受信任的连接不解析头部, 数据原样交给上层
+}
+
+// 只信任来自 cidrs 的连接, unix socket 总是可信
+func TrustCIDRs(cidrs ...*net.IPNet) func(net.Addr) bool {
+	return func(addr net.Addr) bool {
+		tcp, ok := addr.(*net.TCPAddr)
+		if !ok {
+			return addr.Network() == "unix"
+		}
+		for _, n := range cidrs {
+			if n.Contains(tcp.IP) {
+				return true
+			}
+		}
+		return false
+	}
+}
+
+func NewListener(l net.Listener) *Listener {
+	return &Listener{Listener: l, HeaderTimeout: DefaultHeaderTimeout}
+}
+
+// 头部在第一次 Read 或取地址时才解析, 不阻塞 Accept
+func (l *Listener) Accept() (net.Conn, error) {
+	conn, err := l.Listener.Accept()
+	if err != nil {
+		return nil, err
+	}
+	untrusted := l.Trusted != nil && !l.Trusted(conn.RemoteAddr())
+	return &Conn{Conn: conn, r: bufio.NewReader(conn), timeout: l.HeaderTimeout, untrusted: untrusted}, nil
+}
+
+type Conn struct {
+	net.Conn
+	r         *bufio.Reader
+	timeout   time.Duration
+	untrusted bool
+
+	once   sync.Once
+	header *Header
+	err    error
+}
+
+func (c *Conn) parse() {
+	c.once.Do(func() {
+		if c.untrusted {
+			return
+		}
+		if c.timeout > 0 {
+			c.Conn.SetReadDeadline(time.Now().Add(c.timeout))
+			defer c.Conn.SetReadDeadline(time.Time{})
+		}
+		c.header, c.err = ReadHeader(c.r)
+		// 超时内没有收到数据, 当作没有头部, 以免服务端先发数据的协议无法使用
+		if ne, ok := c.err.(net.Error); ok && ne.Timeout() {
+			c.err = nil
+		}
+	})
+}
+
+// 解析到的头部, 没有头部时返回 nil
+func (c *Conn) Header() (*Header, error) {
+	c.parse()
+	return c.header, c.err
+}
+
+func (c *Conn) Read(p []byte) (int, error) {
+	if c.parse(); c.err != nil {
+		return 0, c.err
+	}
+	return c.r.Read(p)
+}
+
+func (c *Conn) RemoteAddr() net.Addr {
+	if c.parse(); c.header != nil && c.header.Source != nil {
+		return c.header.Source
+	}
+	return c.Conn.RemoteAddr()
+}
+
+func (c *Conn) LocalAddr() net.Addr {
+	if c.parse(); c.header != nil && c.header.Destination != nil {
+		return c.header.Destination
+	}
+	return c.Conn.LocalAddr()
+}
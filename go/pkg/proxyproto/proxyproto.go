@@ -0,0 +1,194 @@
+// Package proxyproto 实现 HAProxy PROXY protocol v1/v2, 用于在转发连接时把客户端地址传给后端
+// 见 https://www.haproxy.org/download/2.9/doc/proxy-protocol.txt
+package proxyproto
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"strings"
+)
+
+// v2 头部的 12 字节签名
+const signatureV2 = "\r\n\r\n\x00\r\nQUIT\n"
+
+// v1 头部最长 107 字节
+const maxV1Length = 107
+
+const (
+	cmdLocal = 0x0
+	cmdProxy = 0x1
+
+	famUnspec = 0x00
+	famTCP4   = 0x11
+	famTCP6   = 0x21
+)
+
+var ErrInvalidHeader = errors.New("proxyproto: invalid header")
+
+// 解析出的头部, LOCAL 命令 (健康检查等) 和 UNKNOWN 协议时 Source/Destination 为 nil
+type Header struct {
+	Version     int
+	Source      net.Addr
+	Destination net.Addr
+}
+
+// 写入 PROXY 头部, src/dst 不是 TCP 地址或者地址族不一致时写 UNKNOWN (v1) 或 LOCAL (v2)
+func WriteHeader(w io.Writer, version int, src, dst net.Addr) error {
+	var b []byte
+	switch version {
+	case 1:
+		b = encodeV1(src, dst)
+	case 2:
+		b = encodeV2(src, dst)
+	default:
+		return fmt.Errorf("proxyproto: unsupported version %d", version)
+	}
+	_, err := w.Write(b)
+	return err
+}
+
+// 两个地址都是 TCP 且属于同一地址族时返回它们
+func tcpPair(src, dst net.Addr) (*net.TCPAddr, *net.TCPAddr, bool) {
+	s, ok1 := src.(*net.TCPAddr)
+	d, ok2 := dst.(*net.TCPAddr)
+	if !ok1 || !ok2 || (s.IP.To4() == nil) != (d.IP.To4() == nil) {
+		return nil, nil, false
+	}
+	return s, d, true
+}
+
+func encodeV1(src, dst net.Addr) []byte {
+	s, d, ok := tcpPair(src, dst)
+	if !ok {
+		return []byte("PROXY UNKNOWN\r\n")
+	}
+	proto := "TCP4"
+	if s.IP.To4() == nil {
+		proto = "TCP6"
+	}
+	return []byte(fmt.Sprintf("PROXY %s %s %s %d %d\r\n", proto, s.IP, d.IP, s.Port, d.Port))
+}
+
+func encodeV2(src, dst net.Addr) []byte {
+	var buf bytes.Buffer
+	buf.WriteString(signatureV2)
+	s, d, ok := tcpPair(src, dst)
+	if !ok {
+		buf.Write([]byte{0x20 | cmdLocal, famUnspec, 0, 0})
+		return buf.Bytes()
+	}
+	var addrs []byte
+	fam := byte(famTCP4)
+	if s4, d4 := s.IP.To4(), d.IP.To4(); s4 != nil {
+		addrs = append(append(addrs, s4...), d4...)
+	} else {
+		fam = famTCP6
+		addrs = append(append(addrs, s.IP.To16()...), d.IP.To16()...)
+	}
+	addrs = binary.BigEndian.AppendUint16(addrs, uint16(s.Port))
+	addrs = binary.BigEndian.AppendUint16(addrs, uint16(d.Port))
+	buf.Write([]byte{0x20 | cmdProxy, fam})
+	binary.Write(&buf, binary.BigEndian, uint16(len(addrs)))
+	buf.Write(addrs)
+	return buf.Bytes()
+}
+
+// 读取 PROXY 头部, 数据不是以 PROXY 头部开头时返回 nil, nil 且不消耗任何数据
+func ReadHeader(r *bufio.Reader) (*Header, error) {
+	b, err := r.Peek(1)
+	if err != nil {
+		return nil, err
+	}
+	switch b[0] {
+	case 'P':
+		if b, err := r.Peek(6); err != nil || string(b) != "PROXY " {
+			return nil, nil
+		}
+		return readV1(r)
+	case '\r':
+		if b, err := r.Peek(len(signatureV2)); err != nil || string(b) != signatureV2 {
+			return nil, nil
+		}
+		return readV2(r)
+	}
+	return nil, nil
+}
+
+func readV1(r *bufio.Reader) (*Header, error) {
+	var line []byte
+	for len(line) < maxV1Length {
+		c, err := r.ReadByte()
+		if err != nil {
+			return nil, err
+		}
+		line = append(line, c)
+		if c == '\n' {
+			break
+		}
+	}
+	if !bytes.HasSuffix(line, []byte("\r\n")) {
+		return nil, ErrInvalidHeader
+	}
+	fields := strings.Fields(string(line[:len(line)-2]))
+	h := &Header{Version: 1}
+	if len(fields) >= 2 && fields[1] == "UNKNOWN" {
+		return h, nil
+	}
+	if len(fields) != 6 || (fields[1] != "TCP4" && fields[1] != "TCP6") {
+		return nil, ErrInvalidHeader
+	}
+	src, dst := net.ParseIP(fields[2]), net.ParseIP(fields[3])
+	sport, err1 := strconv.ParseUint(fields[4], 10, 16)
+	dport, err2 := strconv.ParseUint(fields[5], 10, 16)
+	if src == nil || dst == nil || err1 != nil || err2 != nil {
+		return nil, ErrInvalidHeader
+	}
+	h.Source = &net.TCPAddr{IP: src, Port: int(sport)}
+	h.Destination = &net.TCPAddr{IP: dst, Port: int(dport)}
+	return h, nil
+}
+
+func readV2(r *bufio.Reader) (*Header, error) {
+	var fixed [16]byte
+	if _, err := io.ReadFull(r, fixed[:]); err != nil {
+		return nil, err
+	}
+	if fixed[12]>>4 != 2 {
+		return nil, ErrInvalidHeader
+	}
+	length := int(binary.BigEndian.Uint16(fixed[14:16]))
+	payload := make([]byte, length)
+	if _, err := io.ReadFull(r, payload); err != nil {
+		return nil, err
+	}
+	h := &Header{Version: 2}
+	switch fixed[12] & 0x0f {
+	case cmdLocal:
+		return h, nil
+	case cmdProxy:
+	default:
+		return nil, ErrInvalidHeader
+	}
+	// 地址之后的 TLV 不关心, 直接跳过
+	switch fixed[13] {
+	case famTCP4:
+		if length < 12 {
+			return nil, ErrInvalidHeader
+		}
+		h.Source = &net.TCPAddr{IP: net.IP(payload[0:4]), Port: int(binary.BigEndian.Uint16(payload[8:10]))}
+		h.Destination = &net.TCPAddr{IP: net.IP(payload[4:8]), Port: int(binary.BigEndian.Uint16(payload[10:12]))}
+	case famTCP6:
+		if length < 36 {
+			return nil, ErrInvalidHeader
+		}
+		h.Source = &net.TCPAddr{IP: net.IP(payload[0:16]), Port: int(binary.BigEndian.Uint16(payload[32:34]))}
+		h.Destination = &net.TCPAddr{IP: net.IP(payload[16:32]), Port: int(binary.BigEndian.Uint16(payload[34:36]))}
+	}
+	return h, nil
+}
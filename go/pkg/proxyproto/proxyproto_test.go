@@ -0,0 +1,268 @@
+package proxyproto
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"io"
+	"net"
+	"strings"
+	"testing"
+	"time"
+)
+
+func tcpAddr(s string) *net.TCPAddr {
+	a, err := net.ResolveTCPAddr("tcp", s)
+	if err != nil {
+		panic(err)
+	}
+	return a
+}
+
+// 拼出 v2 头部, payload 为地址和 TLV
+func v2(cmd, fam byte, payload []byte) string {
+	b := []byte(signatureV2)
+	b = append(b, 0x20|cmd, fam)
+	b = binary.BigEndian.AppendUint16(b, uint16(len(payload)))
+	return string(append(b, payload...))
+}
+
+func TestReadHeader(t *testing.T) {
+	addr4 := []byte{1, 2, 3, 4, 5, 6, 7, 8, 0x30, 0x39, 0x01, 0xbb}
+	addr6 := append(append(net.ParseIP("2001:db8::1").To16(), net.ParseIP("2001:db8::2").To16()...), 0x30, 0x39, 0x01, 0xbb)
+	// PP2_TYPE_AUTHORITY 和 PP2_TYPE_NOOP
+	tlvs := []byte{0x02, 0x00, 0x03, 'a', '.', 'b', 0x04, 0x00, 0x00}
+	tests := []struct {
+		name     string
+		data     string
+		version  int
+		src, dst string
+		err      error
+		rest     string // 头部之后剩下的数据
+	}{
+		{name: "v1 tcp4", data: "PROXY TCP4 1.2.3.4 5.6.7.8 12345 443\r\nGET", version: 1, src: "1.2.3.4:12345", dst: "5.6.7.8:443", rest: "GET"},
+		{name: "v1 tcp6", data: "PROXY TCP6 2001:db8::1 2001:db8::2 12345 443\r\n", version: 1, src: "[2001:db8::1]:12345", dst: "[2001:db8::2]:443"},
+		{name: "v1 unknown", data: "PROXY UNKNOWN\r\nrest", version: 1, rest: "rest"},
+		{name: "v1 unknown with addresses", data: "PROXY UNKNOWN ffff::1 ffff::2 1 2\r\n", version: 1},
+		{name: "v1 bad port", data: "PROXY TCP4 1.2.3.4 5.6.7.8 70000 443\r\n", err: ErrInvalidHeader},
+		{name: "v1 bad ip", data: "PROXY TCP4 1.2.3 5.6.7.8 1 443\r\n", err: ErrInvalidHeader},
+		{name: "v1 bad protocol", data: "PROXY UDP4 1.2.3.4 5.6.7.8 1 2\r\n", err: ErrInvalidHeader},
+		{name: "v1 missing field", data: "PROXY TCP4 1.2.3.4 5.6.7.8 1\r\n", err: ErrInvalidHeader},
+		{name: "v1 bare newline", data: "PROXY TCP4 1.2.3.4 5.6.7.8 1 2\n", err: ErrInvalidHeader},
+		{name: "v1 too long", data: "PROXY TCP4 " + strings.Repeat("1", maxV1Length) + "\r\n", err: ErrInvalidHeader},
+		{name: "v1 truncated", data: "PROXY TCP4 1.2.3.4", err: io.EOF},
+		{name: "v2 tcp4", data: v2(cmdProxy, famTCP4, addr4) + "GET", version: 2, src: "1.2.3.4:12345", dst: "5.6.7.8:443", rest: "GET"},
+		{name: "v2 tcp6", data: v2(cmdProxy, famTCP6, addr6), version: 2, src: "[2001:db8::1]:12345", dst: "[2001:db8::2]:443"},
+		{name: "v2 tlvs skipped", data: v2(cmdProxy, famTCP4, append(append([]byte(nil), addr4...), tlvs...)) + "GET", version: 2, src: "1.2.3.4:12345", dst: "5.6.7.8:443", rest: "GET"},
+		{name: "v2 local", data: v2(cmdLocal, famUnspec, nil) + "x", version: 2, rest: "x"},
+		{name: "v2 local with tlvs", data: v2(cmdLocal, famTCP4, tlvs) + "x", version: 2, rest: "x"},
+		{name: "v2 unspec", data: v2(cmdProxy, famUnspec, tlvs), version: 2},
+		{name: "v2 bad command", data: v2(0x2, famTCP4, addr4), err: ErrInvalidHeader},
+		{name: "v2 bad version", data: signatureV2 + "\x11\x11\x00\x00", err: ErrInvalidHeader},
+		{name: "v2 short tcp4", data: v2(cmdProxy, famTCP4, addr4[:8]), err: ErrInvalidHeader},
+		{name: "v2 short tcp6", data: v2(cmdProxy, famTCP6, addr6[:32]), err: ErrInvalidHeader},
+		{name: "v2 truncated fixed", data: signatureV2 + "\x21", err: io.ErrUnexpectedEOF},
+		{name: "v2 truncated payload", data: v2(cmdProxy, famTCP4, addr4)[:20], err: io.ErrUnexpectedEOF},
+		{name: "no header", data: "GET / HTTP/1.1\r\n", rest: "GET / HTTP/1.1\r\n"},
+		{name: "partial v1 signature", data: "PROX", rest: "PROX"},
+		{name: "partial v2 signature", data: "\r\n\r\n", rest: "\r\n\r\n"},
+		{name: "empty", data: "", err: io.EOF},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := bufio.NewReader(strings.NewReader(tt.data))
+			h, err := ReadHeader(r)
+			if !errors.Is(err, tt.err) {
+				t.Fatalf("err = %v, want %v", err, tt.err)
+			}
+			if err != nil {
+				return
+			}
+			if tt.version == 0 {
+				if h != nil {
+					t.Fatalf("header = %+v, want nil", h)
+				}
+			} else {
+				if h == nil || h.Version != tt.version {
+					t.Fatalf("header = %+v, want version %d", h, tt.version)
+				}
+				if got := addrString(h.Source); got != tt.src {
+					t.Errorf("source = %s, want %s", got, tt.src)
+				}
+				if got := addrString(h.Destination); got != tt.dst {
+					t.Errorf("destination = %s, want %s", got, tt.dst)
+				}
+			}
+			// 头部之后的数据不受影响, 没有头部时一个字节也不消耗
+			if rest, _ := io.ReadAll(r); string(rest) != tt.rest {
+				t.Errorf("rest = %q, want %q", rest, tt.rest)
+			}
+		})
+	}
+}
+
+func addrString(a net.Addr) string {
+	if a == nil {
+		return ""
+	}
+	return a.String()
+}
+
+func TestWriteHeader(t *testing.T) {
+	tests := []struct {
+		name     string
+		src, dst net.Addr
+		v1       string
+		local    bool // 无法表示的地址写 UNKNOWN/LOCAL
+	}{
+		{"tcp4", tcpAddr("1.2.3.4:1"), tcpAddr("5.6.7.8:2"), "PROXY TCP4 1.2.3.4 5.6.7.8 1 2\r\n", false},
+		{"tcp6", tcpAddr("[2001:db8::1]:1"), tcpAddr("[2001:db8::2]:2"), "PROXY TCP6 2001:db8::1 2001:db8::2 1 2\r\n", false},
+		{"mixed family", tcpAddr("1.2.3.4:1"), tcpAddr("[2001:db8::2]:2"), "PROXY UNKNOWN\r\n", true},
+		{"unix", &net.UnixAddr{Name: "/a", Net: "unix"}, &net.UnixAddr{Name: "/b", Net: "unix"}, "PROXY UNKNOWN\r\n", true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var buf bytes.Buffer
+			if err := WriteHeader(&buf, 1, tt.src, tt.dst); err != nil || buf.String() != tt.v1 {
+				t.Errorf("v1 = %q %v, want %q", buf.String(), err, tt.v1)
+			}
+			// v1 和 v2 写出的头部都能原样读回
+			for _, version := range []int{1, 2} {
+				buf.Reset()
+				WriteHeader(&buf, version, tt.src, tt.dst)
+				h, err := ReadHeader(bufio.NewReader(&buf))
+				if err != nil || h == nil || h.Version != version {
+					t.Fatalf("v%d: %+v %v", version, h, err)
+				}
+				if tt.local {
+					if h.Source != nil || h.Destination != nil {
+						t.Errorf("v%d: %v -> %v, want no addresses", version, h.Source, h.Destination)
+					}
+				} else if h.Source.String() != tt.src.String() || h.Destination.String() != tt.dst.String() {
+					t.Errorf("v%d: %v -> %v", version, h.Source, h.Destination)
+				}
+			}
+		})
+	}
+	if err := WriteHeader(io.Discard, 3, nil, nil); err == nil {
+		t.Error("version 3 accepted")
+	}
+}
+
+// 建立一个经过 Listener 的连接, 客户端先发送 data
+func accept(t *testing.T, l *Listener, data string) (net.Conn, net.Conn) {
+	t.Helper()
+	c, err := net.Dial("tcp", l.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { c.Close() })
+	if data != "" {
+		io.WriteString(c, data)
+	}
+	server, err := l.Accept()
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { server.Close() })
+	return c, server
+}
+
+func newListener(t *testing.T) *Listener {
+	t.Helper()
+	inner, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	l := NewListener(inner)
+	t.Cleanup(func() { l.Close() })
+	return l
+}
+
+func TestListener(t *testing.T) {
+	l := newListener(t)
+	_, server := accept(t, l, "PROXY TCP4 1.2.3.4 5.6.7.8 1000 443\r\nhello")
+	if got := server.RemoteAddr().String(); got != "1.2.3.4:1000" {
+		t.Errorf("remote = %s", got)
+	}
+	if got := server.LocalAddr().String(); got != "5.6.7.8:443" {
+		t.Errorf("local = %s", got)
+	}
+	buf := make([]byte, 5)
+	if _, err := io.ReadFull(server, buf); err != nil || string(buf) != "hello" {
+		t.Errorf("read %q %v", buf, err)
+	}
+
+	// 没有头部时保持原来的地址
+	c, server := accept(t, l, "hello")
+	if server.RemoteAddr().String() != c.LocalAddr().String() {
+		t.Errorf("remote = %s, want %s", server.RemoteAddr(), c.LocalAddr())
+	}
+	if _, err := io.ReadFull(server, buf); err != nil || string(buf) != "hello" {
+		t.Errorf("read %q %v", buf, err)
+	}
+
+	// 头部不合法时读取返回错误
+	_, server = accept(t, l, "PROXY TCP4 bogus\r\n")
+	if _, err := server.Read(buf); !errors.Is(err, ErrInvalidHeader) {
+		t.Errorf("invalid header read: %v", err)
+	}
+	if h, err := server.(*Conn).Header(); h != nil || !errors.Is(err, ErrInvalidHeader) {
+		t.Errorf("header = %v %v", h, err)
+	}
+}
+
+// 服务端先发数据的协议等不到头部, 超时后当作没有头部
+func TestListenerHeaderTimeout(t *testing.T) {
+	l := newListener(t)
+	l.HeaderTimeout = 50 * time.Millisecond
+	c, server := accept(t, l, "")
+	start := time.Now()
+	if server.RemoteAddr().String() != c.LocalAddr().String() {
+		t.Errorf("remote = %s", server.RemoteAddr())
+	}
+	if d := time.Since(start); d > time.Second {
+		t.Errorf("waited %v for header", d)
+	}
+	// 超时之后读取不受期限影响
+	go func() {
+		time.Sleep(100 * time.Millisecond)
+		io.WriteString(c, "late")
+	}()
+	buf := make([]byte, 4)
+	if _, err := io.ReadFull(server, buf); err != nil || string(buf) != "late" {
+		t.Errorf("read %q %v", buf, err)
+	}
+}
+
+// 不受信任的来源不能伪造地址, 头部原样交给上层
+func TestListenerUntrusted(t *testing.T) {
+	header := "PROXY TCP4 1.2.3.4 5.6.7.8 1000 443\r\n"
+	_, loopback, _ := net.ParseCIDR("127.0.0.0/8")
+	_, other, _ := net.ParseCIDR("10.0.0.0/8")
+
+	l := newListener(t)
+	l.Trusted = TrustCIDRs(other)
+	c, server := accept(t, l, header)
+	if server.RemoteAddr().String() != c.LocalAddr().String() {
+		t.Errorf("untrusted remote = %s", server.RemoteAddr())
+	}
+	if h, err := server.(*Conn).Header(); h != nil || err != nil {
+		t.Errorf("untrusted header = %v %v", h, err)
+	}
+	buf := make([]byte, len(header))
+	if _, err := io.ReadFull(server, buf); err != nil || string(buf) != header {
+		t.Errorf("untrusted read %q %v", buf, err)
+	}
+
+	l.Trusted = TrustCIDRs(other, loopback)
+	_, server = accept(t, l, header)
+	if got := server.RemoteAddr().String(); got != "1.2.3.4:1000" {
+		t.Errorf("trusted remote = %s", got)
+	}
+
+	if !TrustCIDRs()(&net.UnixAddr{Name: "/tmp/a.sock", Net: "unix"}) {
+		t.Error("unix socket not trusted")
+	}
+}
@@ -0,0 +1,212 @@
+package sniff
+
+import (
+	"bytes"
+	"io"
+	"strings"
+	"time"
+)
+
+// 协议匹配器, Match 从连接开头读取数据判断是否为该协议, 读到的数据会重放给最终的处理者
+// Timeout 为 0 时使用 Mux 的默认超时, 超时视为不匹配
+type Matcher struct {
+	Name    string
+	Match   func(r io.Reader) bool
+	Timeout time.Duration
+}
+
+// 返回设置了读取超时的副本
+func (m Matcher) WithTimeout(d time.Duration) Matcher {
+	m.Timeout = d
+	return m
+}
+
+// 匹配所有连接, 不读取数据, 一般放在最后兜底
+func Any() Matcher {
+	return Matcher{Name: "any", Match: func(io.Reader) bool { return true }}
+}
+
+// 以任意一个前缀开头
+func Prefix(prefixes ...string) Matcher {
+	max := 0
+	for _, p := range prefixes {
+		if len(p) > max {
+			max = len(p)
+		}
+	}
+	return Matcher{Name: "prefix", Match: func(r io.Reader) bool {
+		buf := make([]byte, max)
+		// 逐步读取, 短前缀命中后不再等待更多数据
+		n := 0
+		for n < max {
+			m, err := r.Read(buf[n:])
+			n += m
+			for _, p := range prefixes {
+				if n >= len(p) && string(buf[:len(p)]) == p {
+					return true
+				}
+			}
+			if err != nil {
+				return false
+			}
+			if !possiblePrefix(buf[:n], prefixes) {
+				return false
+			}
+		}
+		return false
+	}}
+}
+
+// 已读到的数据是否还可能是某个前缀的开头
+func possiblePrefix(b []byte, prefixes []string) bool {
+	for _, p := range prefixes {
+		if len(b) <= len(p) && strings.HasPrefix(p, string(b)) {
+			return true
+		}
+	}
+	return false
+}
+
+var httpMethods = []string{"GET", "PUT", "HEAD", "POST", "DELETE", "PATCH", "OPTIONS", "CONNECT", "TRACE"}
+
+// 方法名加空格, 用于逐步判断请求行开头
+var httpMethodPrefixes = func() []string {
+	p := make([]string, len(httpMethods))
+	for i, m := range httpMethods {
+		p[i] = m + " "
+	}
+	return p
+}()
+
+// HTTP/1.x 请求行最大长度, 超过后不再等待
+const maxRequestLine = 8192
+
+// HTTP/1.x 请求: 请求行形如 "GET /path HTTP/1.1"
+// 已读到的数据不可能是方法名时立即返回, 不等待整行
+func HTTP1() Matcher {
+	return Matcher{Name: "http1", Match: func(r io.Reader) bool {
+		line, ok := readRequestLine(r, maxRequestLine)
+		if !ok {
+			return false
+		}
+		return isHTTP1RequestLine(line)
+	}}
+}
+
+func isHTTP1RequestLine(line string) bool {
+	_, rest, ok := strings.Cut(line, " ")
+	if !ok {
+		return false
+	}
+	i := strings.LastIndexByte(rest, ' ')
+	return i > 0 && strings.HasPrefix(rest[i+1:], "HTTP/1.")
+}
+
+// 读取请求行, 去掉行尾的 \r\n; 方法名不合法或超过 max 时返回 false
+func readRequestLine(r io.Reader, max int) (string, bool) {
+	buf := make([]byte, 0, 512)
+	for len(buf) < max {
+		if len(buf) == cap(buf) {
+			buf = append(buf, 0)[:len(buf)]
+		}
+		n, err := r.Read(buf[len(buf):min(cap(buf), max)])
+		buf = buf[:len(buf)+n]
+		// 方法名和之后的空格读全之前, 每次都检查是否还可能是已知方法
+		if sp := bytes.IndexByte(buf, ' '); sp < 0 {
+			if !possiblePrefix(buf, httpMethodPrefixes) {
+				return "", false
+			}
+		} else if !possiblePrefix(buf[:sp+1], httpMethodPrefixes) {
+			return "", false
+		} else if i := bytes.IndexByte(buf, '\n'); i >= 0 {
+			return strings.TrimRight(string(buf[:i]), "\r"), true
+		}
+		if err != nil {
+			return "", false
+		}
+	}
+	return "", false
+}
+
+// HTTP/2 连接前言, 见 RFC 9113 3.4
+const HTTP2Preface = "PRI * HTTP/2.0\r\n\r\nSM\r\n\r\n"
+
+// 明文 HTTP/2 (h2c prior knowledge)
+func HTTP2() Matcher {
+	m := Prefix(HTTP2Preface)
+	m.Name = "http2"
+	return m
+}
+
+// SSH 客户端版本串, 见 RFC 4253 4.2
+func SSH() Matcher {
+	m := Prefix("SSH-")
+	m.Name = "ssh"
+	return m
+}
+
+// PROXY protocol v2 签名
+const proxyV2Signature = "\r\n\r\n\x00\r\nQUIT\n"
+
+// PROXY protocol v1 或 v2 头部
+func ProxyProtocol() Matcher {
+	m := Prefix("PROXY ", proxyV2Signature)
+	m.Name = "proxy"
+	return m
+}
+
+// TLS ClientHello, names 不为空时还要求 SNI 命中其中之一, 支持 *.example.com 形式的通配符
+func TLS(names ...string) Matcher {
+	return Matcher{Name: "tls", Match: func(r io.Reader) bool {
+		hello, ok := readHello(r)
+		if !ok {
+			return false
+		}
+		return len(names) == 0 || MatchName(names, hello.ServerName)
+	}}
+}
+
+// TLS ClientHello 中的 ALPN 包含 protos 之一
+func ALPN(protos ...string) Matcher {
+	return Matcher{Name: "alpn", Match: func(r io.Reader) bool {
+		hello, ok := readHello(r)
+		if !ok {
+			return false
+		}
+		for _, p := range hello.ALPN {
+			for _, want := range protos {
+				if p == want {
+					return true
+				}
+			}
+		}
+		return false
+	}}
+}
+
+func readHello(r io.Reader) (*ClientHello, bool) {
+	head := make([]byte, 3)
+	if _, err := io.ReadFull(r, head); err != nil || !IsTLS(head) {
+		return nil, false
+	}
+	hello, _, err := ReadClientHello(io.MultiReader(bytes.NewReader(head), r))
+	return hello, err == nil
+}
+
+// 域名是否命中列表, 列表项可以是精确域名或 *.example.com
+func MatchName(patterns []string, name string) bool {
+	name = strings.ToLower(strings.TrimSuffix(name, "."))
+	for _, p := range patterns {
+		p = strings.ToLower(p)
+		if p == name {
+			return true
+		}
+		// 通配符只匹配一级子域名, 与证书的规则一致
+		if suffix, ok := strings.CutPrefix(p, "*."); ok {
+			if label, rest, ok := strings.Cut(name, "."); ok && label != "" && rest == suffix {
+				return true
+			}
+		}
+	}
+	return false
+}
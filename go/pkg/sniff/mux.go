@@ -0,0 +1,195 @@
+package sniff
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"log"
+	"net"
+	"sync"
+	"time"
+)
+
+// 默认的嗅探超时
+const DefaultTimeout = 2 * time.Second
+
+// 在一个监听端口上按协议分发连接, 用法类似 cmux:
+//
+//	m := sniff.NewMux(l)
+//	httpL := m.Match(sniff.HTTP1())
+//	tlsL := m.Match(sniff.TLS())
+//	other := m.Match(sniff.Any())
+//	go m.Serve()
+//
+// 按 Match 调用的顺序逐个尝试, 第一个命中的监听器得到连接, 嗅探读到的字节会重放
+// 客户端不先发数据的协议 (如 SSH 服务端先发版本串) 会在每个匹配器上等到超时, 应把 Any 放在最后
+type Mux struct {
+	root    net.Listener
+	Timeout time.Duration // 匹配器没有单独设置超时时使用, 默认 DefaultTimeout
+
+	mu        sync.Mutex
+	listeners []*muxListener
+	done      chan struct{}
+	closeOnce sync.Once
+}
+
+func NewMux(l net.Listener) *Mux {
+	return &Mux{root: l, Timeout: DefaultTimeout, done: make(chan struct{})}
+}
+
+// 注册一组匹配器, 任一命中的连接由返回的监听器接收
+func (m *Mux) Match(matchers ...Matcher) net.Listener {
+	l := &muxListener{mux: m, matchers: matchers, conns: make(chan net.Conn), closed: make(chan struct{})}
+	m.mu.Lock()
+	m.listeners = append(m.listeners, l)
+	m.mu.Unlock()
+	return l
+}
+
+// 接受连接并分发, 直到底层监听关闭
+func (m *Mux) Serve() error {
+	defer m.Close()
+	var delay time.Duration
+	for {
+		conn, err := m.root.Accept()
+		if err != nil {
+			if errors.Is(err, net.ErrClosed) {
+				return nil
+			}
+			var ne net.Error
+			if errors.As(err, &ne) && ne.Timeout() {
+				continue
+			}
+			// 文件描述符耗尽之类的临时错误, 退避后重试
+			if delay == 0 {
+				delay = 5 * time.Millisecond
+			} else if delay *= 2; delay > time.Second {
+				delay = time.Second
+			}
+			log.Printf("sniff: accept error: %v; retrying in %v", err, delay)
+			time.Sleep(delay)
+			continue
+		}
+		delay = 0
+		go m.dispatch(conn)
+	}
+}
+
+// 关闭底层监听和所有子监听器
+func (m *Mux) Close() error {
+	var err error
+	m.closeOnce.Do(func() {
+		close(m.done)
+		err = m.root.Close()
+	})
+	return err
+}
+
+func (m *Mux) dispatch(conn net.Conn) {
+	c := &Conn{Conn: conn}
+	m.mu.Lock()
+	listeners := append([]*muxListener(nil), m.listeners...)
+	m.mu.Unlock()
+	for _, l := range listeners {
+		for _, matcher := range l.matchers {
+			timeout := matcher.Timeout
+			if timeout <= 0 {
+				timeout = m.Timeout
+			}
+			if !c.Sniff(matcher, timeout) {
+				continue
+			}
+			c.Protocol = matcher.Name
+			select {
+			case l.conns <- c:
+			case <-l.closed:
+				conn.Close()
+			case <-m.done:
+				conn.Close()
+			}
+			return
+		}
+	}
+	conn.Close()
+}
+
+// 嗅探后的连接, 先返回嗅探时读到的数据
+type Conn struct {
+	net.Conn
+	Protocol string // 命中的匹配器名称
+
+	buf bytes.Buffer
+}
+
+// 用 timeout 作为读取期限运行匹配器, 读到的数据都留在 buf 中
+// 分发之后也可以继续调用, 用来读取路由需要的更多信息, 但必须在第一次 Read 之前
+func (c *Conn) Sniff(m Matcher, timeout time.Duration) bool {
+	c.Conn.SetReadDeadline(time.Now().Add(timeout))
+	defer c.Conn.SetReadDeadline(time.Time{})
+	r := io.MultiReader(bytes.NewReader(c.buf.Bytes()), io.TeeReader(c.Conn, &c.buf))
+	return m.Match(r)
+}
+
+// 嗅探时读到的数据
+func (c *Conn) Sniffed() []byte {
+	return c.buf.Bytes()
+}
+
+func (c *Conn) Read(p []byte) (int, error) {
+	if c.buf.Len() > 0 {
+		return c.buf.Read(p)
+	}
+	return c.Conn.Read(p)
+}
+
+// 先写出嗅探时读到的数据, 之后交给底层连接, TCP 连接可以用 splice 转发到 TCP/unix 连接
+func (c *Conn) WriteTo(w io.Writer) (int64, error) {
+	n, err := c.buf.WriteTo(w)
+	if err != nil {
+		return n, err
+	}
+	m, err := io.Copy(w, c.Conn)
+	return n + m, err
+}
+
+// 写入方向没有缓冲, 直接交给底层连接的 ReadFrom
+func (c *Conn) ReadFrom(r io.Reader) (int64, error) {
+	return io.Copy(c.Conn, r)
+}
+
+// 支持半关闭时透传给底层连接
+func (c *Conn) CloseWrite() error {
+	if cw, ok := c.Conn.(interface{ CloseWrite() error }); ok {
+		return cw.CloseWrite()
+	}
+	return c.Conn.Close()
+}
+
+type muxListener struct {
+	mux      *Mux
+	matchers []Matcher
+	conns    chan net.Conn
+	closed   chan struct{}
+	once     sync.Once
+}
+
+func (l *muxListener) Accept() (net.Conn, error) {
+	select {
+	case c := <-l.conns:
+		return c, nil
+	case <-l.closed:
+		return nil, net.ErrClosed
+	case <-l.mux.done:
+		return nil, net.ErrClosed
+	}
+}
+
+// 只关闭这一个子监听器, 之后命中它的连接会被直接关闭
+func (l *muxListener) Close() error {
+	l.once.Do(func() { close(l.closed) })
+	return nil
+}
+
+func (l *muxListener) Addr() net.Addr {
+	return l.mux.root.Addr()
+}
@@ -0,0 +1,81 @@
+// Package sniff 从连接的前几个字节中识别协议并取出路由需要的信息,
+// 例如 TLS ClientHello 中的 SNI/ALPN 和 HTTP 请求的 Host; Mux 按协议把一个监听端口上的连接分发给多个监听器
+package sniff
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/tls"
+	"errors"
+	"io"
+	"net"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// ClientHello 中关心的字段
+type ClientHello struct {
+	ServerName string
+	ALPN       []string
+}
+
+// 是否像 TLS 握手记录: ContentType=22, 主版本号为 3
+func IsTLS(b []byte) bool {
+	return len(b) >= 3 && b[0] == 0x16 && b[1] == 0x03
+}
+
+var errHelloCaptured = errors.New("sniff: client hello captured")
+
+// 从 r 中读取一个完整的 ClientHello, 返回解析结果和读取过的原始字节, 调用方需要把这些字节重放给真正的处理者
+// 解析借助 crypto/tls: 在 GetConfigForClient 中拿到 ClientHelloInfo 后中止握手
+func ReadClientHello(r io.Reader) (*ClientHello, []byte, error) {
+	var raw bytes.Buffer
+	var hello *ClientHello
+	conn := tls.Server(readOnlyConn{r: io.TeeReader(r, &raw)}, &tls.Config{
+		GetConfigForClient: func(info *tls.ClientHelloInfo) (*tls.Config, error) {
+			hello = &ClientHello{ServerName: info.ServerName, ALPN: append([]string(nil), info.SupportedProtos...)}
+			return nil, errHelloCaptured
+		},
+	})
+	err := conn.Handshake()
+	if hello != nil {
+		return hello, raw.Bytes(), nil
+	}
+	if err == nil {
+		err = errors.New("sniff: not a tls client hello")
+	}
+	return nil, raw.Bytes(), err
+}
+
+// 取出 HTTP/1.x 请求头中的 Host, data 不完整或不是 HTTP 请求时返回空字符串
+func HTTPHost(data []byte) string {
+	return ReadHTTPHost(bytes.NewReader(data))
+}
+
+// 从 r 中读取 HTTP/1.x 请求头并取出 Host, 不读取请求体
+func ReadHTTPHost(r io.Reader) string {
+	req, err := http.ReadRequest(bufio.NewReader(r))
+	if err != nil {
+		return ""
+	}
+	host := req.Host
+	if h, _, err := net.SplitHostPort(host); err == nil {
+		host = h
+	}
+	return strings.ToLower(host)
+}
+
+// 只读连接, 写入全部丢弃, 用于让 crypto/tls 解析 ClientHello
+type readOnlyConn struct {
+	r io.Reader
+}
+
+func (c readOnlyConn) Read(p []byte) (int, error)         { return c.r.Read(p) }
+func (c readOnlyConn) Write(p []byte) (int, error)        { return 0, io.ErrClosedPipe }
+func (c readOnlyConn) Close() error                       { return nil }
+func (c readOnlyConn) LocalAddr() net.Addr                { return nil }
+func (c readOnlyConn) RemoteAddr() net.Addr               { return nil }
+func (c readOnlyConn) SetDeadline(t time.Time) error      { return nil }
+func (c readOnlyConn) SetReadDeadline(t time.Time) error  { return nil }
+func (c readOnlyConn) SetWriteDeadline(t time.Time) error { return nil }
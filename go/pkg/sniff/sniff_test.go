@@ -0,0 +1,301 @@
+package sniff
+
+import (
+	"bytes"
+	"crypto/tls"
+	"io"
+	"net"
+	"strings"
+	"testing"
+	"time"
+)
+
+// 用 crypto/tls 生成一个真实的 ClientHello
+func clientHello(t *testing.T, sni string, alpn ...string) []byte {
+	t.Helper()
+	c1, c2 := net.Pipe()
+	defer c2.Close()
+	go func() {
+		tls.Client(c1, &tls.Config{ServerName: sni, NextProtos: alpn, InsecureSkipVerify: true}).Handshake()
+		c1.Close()
+	}()
+	_, raw, err := ReadClientHello(c2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return raw
+}
+
+// 数据读完后阻塞而不是返回 EOF, 模拟客户端发完首包后等待响应
+type stallReader struct {
+	r     io.Reader
+	stall chan struct{}
+}
+
+func (s *stallReader) Read(p []byte) (int, error) {
+	n, err := s.r.Read(p)
+	if err == io.EOF {
+		<-s.stall
+	}
+	return n, err
+}
+
+func TestMatchers(t *testing.T) {
+	hello := string(clientHello(t, "api.example.com", "h2", "http/1.1"))
+	tests := []struct {
+		name    string
+		matcher Matcher
+		data    string
+		want    bool
+	}{
+		{"any", Any(), "", true},
+		{"prefix", Prefix("AB", "XYZ"), "XYZW", true},
+		{"prefix short", Prefix("AB", "XYZ"), "AB", true},
+		{"prefix miss", Prefix("AB", "XYZ"), "XYQ", false},
+		{"prefix eof", Prefix("XYZ"), "XY", false},
+		{"http1 get", HTTP1(), "GET / HTTP/1.1\r\nHost: a\r\n\r\n", true},
+		{"http1 options", HTTP1(), "OPTIONS * HTTP/1.0\n", true},
+		{"http1 connect", HTTP1(), "CONNECT a:443 HTTP/1.1\r\n", true},
+		{"http1 unknown method", HTTP1(), "FETCH / HTTP/1.1\r\n", false},
+		{"http1 lowercase", HTTP1(), "get / HTTP/1.1\r\n", false},
+		{"http1 no version", HTTP1(), "GET /\r\n", false},
+		{"http1 http2", HTTP1(), HTTP2Preface, false},
+		{"http1 partial", HTTP1(), "GET / HTTP/1.1", false},
+		{"http1 too long", HTTP1(), "GET /" + strings.Repeat("a", maxRequestLine) + " HTTP/1.1\r\n", false},
+		{"http2", HTTP2(), HTTP2Preface + "\x00\x00", true},
+		{"http2 http1", HTTP2(), "PRI / HTTP/1.1\r\n", false},
+		{"ssh", SSH(), "SSH-2.0-OpenSSH_9.6\r\n", true},
+		{"ssh miss", SSH(), "SSL-", false},
+		{"proxy v1", ProxyProtocol(), "PROXY TCP4 1.2.3.4 5.6.7.8 1 2\r\n", true},
+		{"proxy v2", ProxyProtocol(), proxyV2Signature + "\x21\x11", true},
+		{"proxy miss", ProxyProtocol(), "PROXZ", false},
+		{"tls", TLS(), hello, true},
+		{"tls exact", TLS("API.example.com"), hello, true},
+		{"tls wildcard", TLS("*.example.com"), hello, true},
+		{"tls other name", TLS("www.example.com", "*.other.com"), hello, false},
+		{"tls not tls", TLS(), "GET / HTTP/1.1\r\n\r\n", false},
+		{"tls truncated", TLS(), hello[:len(hello)/2], false},
+		{"alpn", ALPN("h2"), hello, true},
+		{"alpn miss", ALPN("h3"), hello, false},
+		{"alpn not tls", ALPN("h2"), "SSH-2.0\r\n", false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := tt.matcher.Match(strings.NewReader(tt.data)); got != tt.want {
+				t.Errorf("%s.Match(%q) = %v, want %v", tt.matcher.Name, tt.data, got, tt.want)
+			}
+		})
+	}
+}
+
+// 开头不可能是方法名时不等待换行, 否则非 HTTP 协议要等到超时才能尝试下一个匹配器
+func TestHTTP1RejectsEarly(t *testing.T) {
+	for _, data := range []string{"\x16\x03\x01", "SSH-", "G", "GETX", "POST/", "PRI * HTTP/2.0"} {
+		stall := make(chan struct{})
+		r := &stallReader{r: strings.NewReader(data), stall: stall}
+		done := make(chan bool, 1)
+		go func() { done <- HTTP1().Match(r) }()
+		select {
+		case got := <-done:
+			// 只有 "G" 还可能是 GET, 应该继续等待
+			if got || data == "G" {
+				t.Errorf("%q: match = %v", data, got)
+			}
+		case <-time.After(time.Second):
+			if data != "G" {
+				t.Errorf("%q: matcher waited for more data", data)
+			}
+		}
+		close(stall)
+	}
+}
+
+func TestMatchName(t *testing.T) {
+	tests := []struct {
+		patterns []string
+		name     string
+		want     bool
+	}{
+		{[]string{"example.com"}, "example.com", true},
+		{[]string{"example.com"}, "EXAMPLE.com.", true},
+		{[]string{"*.example.com"}, "a.example.com", true},
+		{[]string{"*.example.com"}, "example.com", false},
+		{[]string{"*.example.com"}, "a.b.example.com", false},
+		{[]string{"*.example.com"}, ".example.com", false},
+		{[]string{"a.com", "b.com"}, "b.com", true},
+		{nil, "a.com", false},
+	}
+	for _, tt := range tests {
+		if got := MatchName(tt.patterns, tt.name); got != tt.want {
+			t.Errorf("MatchName(%v, %q) = %v, want %v", tt.patterns, tt.name, got, tt.want)
+		}
+	}
+}
+
+func TestHTTPHost(t *testing.T) {
+	if h := HTTPHost([]byte("GET / HTTP/1.1\r\nHost: WWW.Example.com:8080\r\n\r\n")); h != "www.example.com" {
+		t.Errorf("host = %q", h)
+	}
+	if h := HTTPHost([]byte("GET / HTTP/1.1\r\nHost: a")); h != "" {
+		t.Errorf("incomplete request host = %q", h)
+	}
+}
+
+func newTestMux(t *testing.T) (*Mux, string) {
+	t.Helper()
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	m := NewMux(l)
+	m.Timeout = 200 * time.Millisecond
+	t.Cleanup(func() { m.Close() })
+	return m, l.Addr().String()
+}
+
+// 连接上发送 data, 返回接收方收到的连接
+func dial(t *testing.T, addr, data string) net.Conn {
+	t.Helper()
+	c, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { c.Close() })
+	if data != "" {
+		if _, err := io.WriteString(c, data); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return c
+}
+
+func accept(t *testing.T, l net.Listener) *Conn {
+	t.Helper()
+	type result struct {
+		c   net.Conn
+		err error
+	}
+	ch := make(chan result, 1)
+	go func() {
+		c, err := l.Accept()
+		ch <- result{c, err}
+	}()
+	select {
+	case r := <-ch:
+		if r.err != nil {
+			t.Fatal(r.err)
+		}
+		return r.c.(*Conn)
+	case <-time.After(5 * time.Second):
+		t.Fatal("accept timed out")
+	}
+	return nil
+}
+
+func TestMux(t *testing.T) {
+	m, addr := newTestMux(t)
+	httpL := m.Match(HTTP1())
+	tlsL := m.Match(TLS("*.example.com"))
+	sshL := m.Match(SSH(), ProxyProtocol())
+	anyL := m.Match(Any())
+	go m.Serve()
+
+	tests := []struct {
+		data     string
+		l        net.Listener
+		protocol string
+	}{
+		{"GET / HTTP/1.1\r\nHost: a\r\n\r\n", httpL, "http1"},
+		{string(clientHello(t, "a.example.com")), tlsL, "tls"},
+		{"SSH-2.0-test\r\n", sshL, "ssh"},
+		{"PROXY TCP4 1.2.3.4 5.6.7.8 1 2\r\n", sshL, "proxy"},
+		// SNI 不在列表中的 TLS 落到兜底监听器
+		{string(clientHello(t, "other.com")), anyL, "any"},
+		{"hello", anyL, "any"},
+	}
+	for _, tt := range tests {
+		c := dial(t, addr, tt.data)
+		got := accept(t, tt.l)
+		if got.Protocol != tt.protocol {
+			t.Errorf("protocol = %q, want %q", got.Protocol, tt.protocol)
+		}
+		// 嗅探读到的字节原样重放, 之后的数据继续从连接读取
+		io.WriteString(c, "!")
+		buf := make([]byte, len(tt.data)+1)
+		if _, err := io.ReadFull(got, buf); err != nil || string(buf) != tt.data+"!" {
+			t.Errorf("%s replay = %q %v", tt.protocol, buf, err)
+		}
+		got.Close()
+	}
+}
+
+// 客户端不发数据时每个匹配器都等到超时, 最后交给 Any
+func TestMuxTimeout(t *testing.T) {
+	m, addr := newTestMux(t)
+	m.Match(HTTP1().WithTimeout(50 * time.Millisecond))
+	anyL := m.Match(Any())
+	go m.Serve()
+
+	start := time.Now()
+	dial(t, addr, "")
+	c := accept(t, anyL)
+	if c.Protocol != "any" || len(c.Sniffed()) != 0 {
+		t.Errorf("protocol = %q sniffed = %q", c.Protocol, c.Sniffed())
+	}
+	if d := time.Since(start); d > m.Timeout {
+		t.Errorf("matcher timeout ignored, took %v", d)
+	}
+	c.Close()
+}
+
+// 命中已关闭的子监听器或没有匹配器命中时关闭连接
+func TestMuxClose(t *testing.T) {
+	m, addr := newTestMux(t)
+	closed := m.Match(SSH())
+	httpL := m.Match(HTTP1())
+	go m.Serve()
+	closed.Close()
+	if _, err := closed.Accept(); err != net.ErrClosed {
+		t.Errorf("accept on closed listener: %v", err)
+	}
+	for _, data := range []string{"SSH-2.0-test\r\n", "hello\r\n"} {
+		c := dial(t, addr, data)
+		c.SetReadDeadline(time.Now().Add(5 * time.Second))
+		if n, err := c.Read(make([]byte, 1)); err == nil {
+			t.Errorf("%q: read %d bytes from unmatched connection", data, n)
+		}
+	}
+
+	m.Close()
+	if _, err := httpL.Accept(); err != net.ErrClosed {
+		t.Errorf("accept after mux close: %v", err)
+	}
+	if err := m.Serve(); err != nil {
+		t.Errorf("serve after close: %v", err)
+	}
+}
+
+func TestConnSniffAfterDispatch(t *testing.T) {
+	m, addr := newTestMux(t)
+	l := m.Match(HTTP1())
+	go m.Serve()
+	req := "GET / HTTP/1.1\r\nHost: Example.com\r\n\r\n"
+	dial(t, addr, req)
+	c := accept(t, l)
+	// 分发后继续嗅探 Host, 不影响之后的读取
+	var host string
+	c.Sniff(Matcher{Match: func(r io.Reader) bool {
+		host = ReadHTTPHost(r)
+		return true
+	}}, time.Second)
+	if host != "example.com" {
+		t.Errorf("host = %q", host)
+	}
+	var buf bytes.Buffer
+	c.SetReadDeadline(time.Now().Add(100 * time.Millisecond))
+	io.Copy(&buf, c)
+	if buf.String() != req {
+		t.Errorf("replay = %q", buf.String())
+	}
+	c.Close()
+}
@@ -0,0 +1,229 @@
+package sshd
+
+import (
+	"io"
+	"net"
+	"os"
+	"strconv"
+	"sync"
+	"time"
+
+	"golang.org/x/crypto/ssh"
+)
+
+// 转发相关消息, 见 RFC 4254 第 7 节和 OpenSSH PROTOCOL 文件
+type directTCPIPMsg struct {
+	Host       string
+	Port       uint32
+	OriginHost string
+	OriginPort uint32
+}
+
+type directStreamLocalMsg struct {
+	SocketPath string
+	Reserved0  string
+	Reserved1  uint32
+}
+
+type tcpipForwardMsg struct {
+	Addr string
+	Port uint32
+}
+
+type forwardedTCPIPMsg struct {
+	Addr       string
+	Port       uint32
+	OriginAddr string
+	OriginPort uint32
+}
+
+type streamLocalForwardMsg struct {
+	SocketPath string
+}
+
+type forwardedStreamLocalMsg struct {
+	SocketPath string
+	Reserved0  string
+}
+
+// -L/-D: 客户端请求连接服务端能访问到的地址
+func (s *Server) handleDirect(nch ssh.NewChannel) {
+	var network, addr string
+	if nch.ChannelType() == "direct-tcpip" {
+		var m directTCPIPMsg
+		if err := ssh.Unmarshal(nch.ExtraData(), &m); err != nil {
+			nch.Reject(ssh.ConnectionFailed, "bad payload")
+			return
+		}
+		network, addr = "tcp", net.JoinHostPort(m.Host, strconv.Itoa(int(m.Port)))
+	} else {
+		var m directStreamLocalMsg
+		if err := ssh.Unmarshal(nch.ExtraData(), &m); err != nil {
+			nch.Reject(ssh.ConnectionFailed, "bad payload")
+			return
+		}
+		network, addr = "unix", m.SocketPath
+	}
+	target, err := net.DialTimeout(network, addr, 10*time.Second)
+	if err != nil {
+		nch.Reject(ssh.ConnectionFailed, err.Error())
+		return
+	}
+	ch, reqs, err := nch.Accept()
+	if err != nil {
+		target.Close()
+		return
+	}
+	go ssh.DiscardRequests(reqs)
+	pipe(ch, target)
+}
+
+// 双向复制, 一个方向结束时半关闭另一端, 两个方向都结束后关闭
+func pipe(ch ssh.Channel, conn net.Conn) {
+	defer ch.Close()
+	defer conn.Close()
+	done := make(chan struct{})
+	go func() {
+		io.Copy(ch, conn)
+		ch.CloseWrite()
+		close(done)
+	}()
+	io.Copy(conn, ch)
+	if cw, ok := conn.(interface{ CloseWrite() error }); ok {
+		cw.CloseWrite()
+		<-done
+	}
+}
+
+// 一个连接上的远程转发, 连接断开时关闭所有监听
+type remoteForwards struct {
+	conn *ssh.ServerConn
+
+	mu        sync.Mutex
+	listeners map[string]net.Listener
+}
+
+func newRemoteForwards(conn *ssh.ServerConn) *remoteForwards {
+	return &remoteForwards{conn: conn, listeners: make(map[string]net.Listener)}
+}
+
+func (f *remoteForwards) closeAll() {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	for key, l := range f.listeners {
+		l.Close()
+		delete(f.listeners, key)
+	}
+}
+
+func (f *remoteForwards) cancel(key string) bool {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	l, ok := f.listeners[key]
+	if ok {
+		l.Close()
+		delete(f.listeners, key)
+	}
+	return ok
+}
+
+func (s *Server) handleGlobal(conn *ssh.ServerConn, fwd *remoteForwards, reqs <-chan *ssh.Request) {
+	for req := range reqs {
+		switch req.Type {
+		case "tcpip-forward", "cancel-tcpip-forward":
+			var m tcpipForwardMsg
+			if s.DisableForwarding || ssh.Unmarshal(req.Payload, &m) != nil {
+				req.Reply(false, nil)
+				continue
+			}
+			if req.Type == "cancel-tcpip-forward" {
+				req.Reply(fwd.cancel(net.JoinHostPort(m.Addr, strconv.Itoa(int(m.Port)))), nil)
+				continue
+			}
+			s.forwardTCP(fwd, req, m)
+		case "streamlocal-forward@openssh.com", "cancel-streamlocal-forward@openssh.com":
+			var m streamLocalForwardMsg
+			if s.DisableForwarding || ssh.Unmarshal(req.Payload, &m) != nil {
+				req.Reply(false, nil)
+				continue
+			}
+			if req.Type == "cancel-streamlocal-forward@openssh.com" {
+				req.Reply(fwd.cancel("unix:"+m.SocketPath), nil)
+				continue
+			}
+			s.forwardUnix(fwd, req, m)
+		case "keepalive@openssh.com":
+			req.Reply(true, nil)
+		default:
+			if req.WantReply {
+				req.Reply(false, nil)
+			}
+		}
+	}
+}
+
+// -R: 服务端监听, 连接通过 forwarded-tcpip 通道交给客户端; 端口为 0 时回复实际端口
+func (s *Server) forwardTCP(fwd *remoteForwards, req *ssh.Request, m tcpipForwardMsg) {
+	l, err := net.Listen("tcp", net.JoinHostPort(m.Addr, strconv.Itoa(int(m.Port))))
+	if err != nil {
+		s.logf("sshd: tcpip-forward %s:%d: %v", m.Addr, m.Port, err)
+		req.Reply(false, nil)
+		return
+	}
+	port := uint32(l.Addr().(*net.TCPAddr).Port)
+	fwd.mu.Lock()
+	fwd.listeners[net.JoinHostPort(m.Addr, strconv.Itoa(int(port)))] = l
+	fwd.mu.Unlock()
+	var reply []byte
+	if m.Port == 0 {
+		reply = ssh.Marshal(struct{ Port uint32 }{port})
+	}
+	req.Reply(true, reply)
+	go func() {
+		for {
+			c, err := l.Accept()
+			if err != nil {
+				return
+			}
+			origin, _ := c.RemoteAddr().(*net.TCPAddr)
+			msg := forwardedTCPIPMsg{Addr: m.Addr, Port: port}
+			if origin != nil {
+				msg.OriginAddr, msg.OriginPort = origin.IP.String(), uint32(origin.Port)
+			}
+			go openForwarded(fwd.conn, "forwarded-tcpip", ssh.Marshal(msg), c)
+		}
+	}()
+}
+
+func (s *Server) forwardUnix(fwd *remoteForwards, req *ssh.Request, m streamLocalForwardMsg) {
+	os.Remove(m.SocketPath)
+	l, err := net.Listen("unix", m.SocketPath)
+	if err != nil {
+		s.logf("sshd: streamlocal-forward %s: %v", m.SocketPath, err)
+		req.Reply(false, nil)
+		return
+	}
+	fwd.mu.Lock()
+	fwd.listeners["unix:"+m.SocketPath] = l
+	fwd.mu.Unlock()
+	req.Reply(true, nil)
+	go func() {
+		for {
+			c, err := l.Accept()
+			if err != nil {
+				return
+			}
+			go openForwarded(fwd.conn, "forwarded-streamlocal@openssh.com", ssh.Marshal(forwardedStreamLocalMsg{SocketPath: m.SocketPath}), c)
+		}
+	}()
+}
+
+func openForwarded(conn *ssh.ServerConn, kind string, payload []byte, c net.Conn) {
+	ch, reqs, err := conn.OpenChannel(kind, payload)
+	if err != nil {
+		c.Close()
+		return
+	}
+	go ssh.DiscardRequests(reqs)
+	pipe(ch, c)
+}
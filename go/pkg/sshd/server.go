@@ -0,0 +1,273 @@
+// Package sshd 是基于 x/crypto/ssh 的小型 SSH 服务端, 用于测试 SSH 工具或在容器里充当 sshd.
+//
+// 支持密码和公钥认证, exec/shell (可分配 PTY) 和 sftp 子系统,
+// direct-tcpip、direct-streamlocal 本地转发以及 tcpip-forward、streamlocal-forward 远程转发.
+// 命令以服务端进程自身的用户运行, 登录用户名只用于认证.
+package sshd
+
+import (
+	"bytes"
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/subtle"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"golang.org/x/crypto/ssh"
+)
+
+type Server struct {
+	Addr     string
+	HostKeys []ssh.Signer
+
+	// 认证, 都为空时拒绝所有登录
+	PasswordAuth  func(user, password string) bool
+	PublicKeyAuth func(user string, key ssh.PublicKey) bool
+
+	Shell             string   // 默认 $SHELL, 没有时为 /bin/sh
+	Env               []string // 附加到会话的环境变量
+	DisableForwarding bool     // 禁止本地和远程转发
+	DisableSFTP       bool
+	Logf              func(format string, args ...any) // 默认 log.Printf
+
+	mu        sync.Mutex
+	listeners map[net.Listener]struct{}
+	conns     map[*ssh.ServerConn]struct{}
+	closed    bool
+}
+
+// 服务端已关闭
+var ErrServerClosed = errors.New("sshd: server closed")
+
+func (s *Server) logf(format string, args ...any) {
+	if s.Logf != nil {
+		s.Logf(format, args...)
+		return
+	}
+	log.Printf(format, args...)
+}
+
+func (s *Server) config() (*ssh.ServerConfig, error) {
+	if len(s.HostKeys) == 0 {
+		return nil, errors.New("sshd: no host keys")
+	}
+	config := &ssh.ServerConfig{}
+	if s.PasswordAuth != nil {
+		config.PasswordCallback = func(c ssh.ConnMetadata, password []byte) (*ssh.Permissions, error) {
+			if s.PasswordAuth(c.User(), string(password)) {
+				return nil, nil
+			}
+			return nil, fmt.Errorf("password rejected for %q", c.User())
+		}
+	}
+	if s.PublicKeyAuth != nil {
+		config.PublicKeyCallback = func(c ssh.ConnMetadata, key ssh.PublicKey) (*ssh.Permissions, error) {
+			if s.PublicKeyAuth(c.User(), key) {
+				return &ssh.Permissions{Extensions: map[string]string{"pubkey-fp": ssh.FingerprintSHA256(key)}}, nil
+			}
+			return nil, fmt.Errorf("public key rejected for %q", c.User())
+		}
+	}
+	for _, k := range s.HostKeys {
+		config.AddHostKey(k)
+	}
+	return config, nil
+}
+
+func (s *Server) ListenAndServe() error {
+	addr := s.Addr
+	if addr == "" {
+		addr = ":22"
+	}
+	l, err := net.Listen("tcp", addr)
+	if err != nil {
+		return err
+	}
+	return s.Serve(l)
+}
+
+// 接受连接直到 l 关闭, Close 之后返回 ErrServerClosed
+func (s *Server) Serve(l net.Listener) error {
+	config, err := s.config()
+	if err != nil {
+		return err
+	}
+	if !s.track(l, true) {
+		return ErrServerClosed
+	}
+	defer s.track(l, false)
+	var delay time.Duration
+	for {
+		conn, err := l.Accept()
+		if err != nil {
+			if s.isClosed() {
+				return ErrServerClosed
+			}
+			var ne net.Error
+			if errors.As(err, &ne) && ne.Timeout() {
+				if delay = max(2*delay, 5*time.Millisecond); delay > time.Second {
+					delay = time.Second
+				}
+				time.Sleep(delay)
+				continue
+			}
+			return err
+		}
+		delay = 0
+		go s.handleConn(conn, config)
+	}
+}
+
+func (s *Server) track(l net.Listener, add bool) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if add {
+		if s.closed {
+			return false
+		}
+		if s.listeners == nil {
+			s.listeners = make(map[net.Listener]struct{})
+		}
+		s.listeners[l] = struct{}{}
+	} else {
+		delete(s.listeners, l)
+	}
+	return true
+}
+
+func (s *Server) isClosed() bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.closed
+}
+
+// 关闭监听和所有连接
+func (s *Server) Close() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.closed = true
+	for l := range s.listeners {
+		l.Close()
+	}
+	for c := range s.conns {
+		c.Close()
+	}
+	return nil
+}
+
+func (s *Server) handleConn(nc net.Conn, config *ssh.ServerConfig) {
+	nc.SetDeadline(time.Now().Add(time.Minute))
+	conn, chans, reqs, err := ssh.NewServerConn(nc, config)
+	if err != nil {
+		nc.Close()
+		return
+	}
+	nc.SetDeadline(time.Time{})
+	s.mu.Lock()
+	if s.closed {
+		s.mu.Unlock()
+		conn.Close()
+		return
+	}
+	if s.conns == nil {
+		s.conns = make(map[*ssh.ServerConn]struct{})
+	}
+	s.conns[conn] = struct{}{}
+	s.mu.Unlock()
+	defer func() {
+		s.mu.Lock()
+		delete(s.conns, conn)
+		s.mu.Unlock()
+	}()
+	s.logf("sshd: %s@%s logged in", conn.User(), conn.RemoteAddr())
+
+	fwd := newRemoteForwards(conn)
+	defer fwd.closeAll()
+	go s.handleGlobal(conn, fwd, reqs)
+	for nch := range chans {
+		switch nch.ChannelType() {
+		case "session":
+			go s.handleSession(conn, nch)
+		case "direct-tcpip", "direct-streamlocal@openssh.com":
+			if s.DisableForwarding {
+				nch.Reject(ssh.Prohibited, "forwarding is disabled")
+				continue
+			}
+			go s.handleDirect(nch)
+		default:
+			nch.Reject(ssh.UnknownChannelType, "unsupported channel type "+nch.ChannelType())
+		}
+	}
+	conn.Wait()
+}
+
+// 用户名到密码的表, 用于 PasswordAuth
+func Passwords(users map[string]string) func(user, password string) bool {
+	return func(user, password string) bool {
+		want, ok := users[user]
+		return ok && subtle.ConstantTimeCompare([]byte(want), []byte(password)) == 1
+	}
+}
+
+// 用户名到公钥的表, 用于 PublicKeyAuth
+func AuthorizedKeys(users map[string][]ssh.PublicKey) func(user string, key ssh.PublicKey) bool {
+	return func(user string, key ssh.PublicKey) bool {
+		for _, k := range users[user] {
+			if bytes.Equal(k.Marshal(), key.Marshal()) {
+				return true
+			}
+		}
+		return false
+	}
+}
+
+// 读取 authorized_keys 格式的文件
+func LoadAuthorizedKeys(file string) ([]ssh.PublicKey, error) {
+	data, err := os.ReadFile(file)
+	if err != nil {
+		return nil, err
+	}
+	var keys []ssh.PublicKey
+	for len(bytes.TrimSpace(data)) > 0 {
+		key, _, _, rest, err := ssh.ParseAuthorizedKey(data)
+		if err != nil {
+			return nil, fmt.Errorf("%s: %w", file, err)
+		}
+		keys = append(keys, key)
+		data = rest
+	}
+	return keys, nil
+}
+
+// 读取主机私钥, 文件不存在时生成 ed25519 密钥并保存, 容器重启后指纹不变
+func LoadOrGenerateHostKey(file string) (ssh.Signer, error) {
+	data, err := os.ReadFile(file)
+	if err == nil {
+		return ssh.ParsePrivateKey(data)
+	}
+	if !os.IsNotExist(err) {
+		return nil, err
+	}
+	_, priv, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		return nil, err
+	}
+	block, err := ssh.MarshalPrivateKey(priv, "")
+	if err != nil {
+		return nil, err
+	}
+	if err := os.MkdirAll(filepath.Dir(file), 0700); err != nil {
+		return nil, err
+	}
+	if err := os.WriteFile(file, pem.EncodeToMemory(block), 0600); err != nil {
+		return nil, err
+	}
+	return ssh.NewSignerFromKey(priv)
+}
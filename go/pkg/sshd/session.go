@@ -0,0 +1,309 @@
+package sshd
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"os/exec"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/creack/pty"
+	"github.com/pkg/sftp"
+	"golang.org/x/crypto/ssh"
+)
+
+// 会话请求的消息, 见 RFC 4254 第 6 节
+type ptyRequestMsg struct {
+	Term     string
+	Columns  uint32
+	Rows     uint32
+	Width    uint32
+	Height   uint32
+	Modelist string
+}
+
+type windowChangeMsg struct {
+	Columns uint32
+	Rows    uint32
+	Width   uint32
+	Height  uint32
+}
+
+type envMsg struct {
+	Name  string
+	Value string
+}
+
+type execMsg struct {
+	Command string
+}
+
+type signalMsg struct {
+	Signal string
+}
+
+type exitStatusMsg struct {
+	Status uint32
+}
+
+type exitSignalMsg struct {
+	Signal     string
+	CoreDumped bool
+	Error      string
+	Lang       string
+}
+
+var signals = map[string]syscall.Signal{
+	"ABRT": syscall.SIGABRT,
+	"ALRM": syscall.SIGALRM,
+	"FPE":  syscall.SIGFPE,
+	"HUP":  syscall.SIGHUP,
+	"ILL":  syscall.SIGILL,
+	"INT":  syscall.SIGINT,
+	"KILL": syscall.SIGKILL,
+	"PIPE": syscall.SIGPIPE,
+	"QUIT": syscall.SIGQUIT,
+	"SEGV": syscall.SIGSEGV,
+	"TERM": syscall.SIGTERM,
+	"USR1": syscall.SIGUSR1,
+	"USR2": syscall.SIGUSR2,
+}
+
+func signalName(sig syscall.Signal) string {
+	for name, s := range signals {
+		if s == sig {
+			return name
+		}
+	}
+	return fmt.Sprintf("SIG%d", int(sig))
+}
+
+// 一个会话通道, 只能启动一次 shell/exec/subsystem
+type session struct {
+	server *Server
+	conn   *ssh.ServerConn
+	ch     ssh.Channel
+
+	mu      sync.Mutex
+	env     []string
+	pty     *ptyRequestMsg
+	ptmx    *os.File
+	cmd     *exec.Cmd
+	started bool
+	exited  bool
+}
+
+func (s *Server) handleSession(conn *ssh.ServerConn, nch ssh.NewChannel) {
+	ch, reqs, err := nch.Accept()
+	if err != nil {
+		return
+	}
+	sess := &session{server: s, conn: conn, ch: ch}
+	for req := range reqs {
+		ok := sess.handleRequest(req)
+		if req.WantReply {
+			req.Reply(ok, nil)
+		}
+	}
+	// 客户端关闭了通道, 结束还在运行的进程
+	sess.mu.Lock()
+	if sess.cmd != nil && sess.cmd.Process != nil && !sess.exited {
+		sess.cmd.Process.Signal(syscall.SIGHUP)
+	}
+	sess.mu.Unlock()
+}
+
+func (sess *session) handleRequest(req *ssh.Request) bool {
+	sess.mu.Lock()
+	defer sess.mu.Unlock()
+	switch req.Type {
+	case "env":
+		var m envMsg
+		if ssh.Unmarshal(req.Payload, &m) != nil || sess.started {
+			return false
+		}
+		sess.env = append(sess.env, m.Name+"="+m.Value)
+		return true
+	case "pty-req":
+		var m ptyRequestMsg
+		if ssh.Unmarshal(req.Payload, &m) != nil || sess.started {
+			return false
+		}
+		sess.pty = &m
+		return true
+	case "window-change":
+		var m windowChangeMsg
+		if ssh.Unmarshal(req.Payload, &m) != nil {
+			return false
+		}
+		if sess.pty != nil {
+			sess.pty.Columns, sess.pty.Rows = m.Columns, m.Rows
+		}
+		if sess.ptmx != nil {
+			pty.Setsize(sess.ptmx, &pty.Winsize{Cols: uint16(m.Columns), Rows: uint16(m.Rows)})
+		}
+		return true
+	case "signal":
+		var m signalMsg
+		if ssh.Unmarshal(req.Payload, &m) != nil {
+			return false
+		}
+		sig, ok := signals[m.Signal]
+		if !ok || sess.cmd == nil || sess.cmd.Process == nil || sess.exited {
+			return false
+		}
+		return sess.cmd.Process.Signal(sig) == nil
+	case "shell", "exec":
+		if sess.started {
+			return false
+		}
+		shell := sess.server.Shell
+		if shell == "" {
+			if shell = os.Getenv("SHELL"); shell == "" {
+				shell = "/bin/sh"
+			}
+		}
+		cmd := exec.Command(shell)
+		if req.Type == "exec" {
+			var m execMsg
+			if ssh.Unmarshal(req.Payload, &m) != nil {
+				return false
+			}
+			cmd = exec.Command(shell, "-c", m.Command)
+		}
+		if err := sess.start(cmd); err != nil {
+			sess.server.logf("sshd: %s: %v", req.Type, err)
+			return false
+		}
+		return true
+	case "subsystem":
+		var m execMsg
+		if ssh.Unmarshal(req.Payload, &m) != nil || m.Command != "sftp" || sess.server.DisableSFTP || sess.started {
+			return false
+		}
+		sess.started = true
+		go func() {
+			defer sess.ch.Close()
+			server, err := sftp.NewServer(sess.ch)
+			if err != nil {
+				return
+			}
+			server.Serve()
+			sess.exit(0, "")
+		}()
+		return true
+	}
+	return false
+}
+
+// 启动进程, 有 pty-req 时接到 PTY 上; 调用方持有 sess.mu
+func (sess *session) start(cmd *exec.Cmd) error {
+	cmd.Env = sess.environ()
+	if home, err := os.UserHomeDir(); err == nil {
+		cmd.Dir = home
+	}
+	sess.started = true
+	sess.cmd = cmd
+	if sess.pty != nil {
+		cmd.Env = append(cmd.Env, "TERM="+sess.pty.Term)
+		ptmx, err := pty.StartWithSize(cmd, &pty.Winsize{Cols: uint16(sess.pty.Columns), Rows: uint16(sess.pty.Rows)})
+		if err != nil {
+			return err
+		}
+		sess.ptmx = ptmx
+		go func() {
+			io.Copy(ptmx, sess.ch)
+		}()
+		output := make(chan struct{})
+		go func() {
+			// 进程退出后读 ptmx 返回 EIO
+			io.Copy(sess.ch, ptmx)
+			close(output)
+		}()
+		go sess.wait(cmd, func() {
+			select {
+			case <-output:
+			case <-time.After(time.Second):
+			}
+			ptmx.Close()
+		})
+		return nil
+	}
+
+	stdin, err := cmd.StdinPipe()
+	if err != nil {
+		return err
+	}
+	cmd.Stdout, cmd.Stderr = sess.ch, sess.ch.Stderr()
+	if err := cmd.Start(); err != nil {
+		return err
+	}
+	go func() {
+		io.Copy(stdin, sess.ch)
+		stdin.Close()
+	}()
+	go sess.wait(cmd, func() {})
+	return nil
+}
+
+// 与 sshd 一样设置 USER、HOME 等变量, 客户端的 env 请求最后追加
+func (sess *session) environ() []string {
+	env := []string{
+		"USER=" + sess.conn.User(),
+		"LOGNAME=" + sess.conn.User(),
+		"PATH=" + os.Getenv("PATH"),
+		"SSH_CONNECTION=" + hostPort(sess.conn.RemoteAddr()) + " " + hostPort(sess.conn.LocalAddr()),
+	}
+	if home, err := os.UserHomeDir(); err == nil {
+		env = append(env, "HOME="+home)
+	}
+	if sess.server.Shell != "" {
+		env = append(env, "SHELL="+sess.server.Shell)
+	}
+	env = append(env, sess.server.Env...)
+	return append(env, sess.env...)
+}
+
+// "ip port" 格式, 用于 SSH_CONNECTION
+func hostPort(addr net.Addr) string {
+	host, port, err := net.SplitHostPort(addr.String())
+	if err != nil {
+		return addr.String()
+	}
+	return host + " " + port
+}
+
+// 等进程结束, 发送退出状态后关闭通道
+func (sess *session) wait(cmd *exec.Cmd, drain func()) {
+	err := cmd.Wait()
+	sess.mu.Lock()
+	sess.exited = true
+	sess.mu.Unlock()
+	drain()
+	var exitErr *exec.ExitError
+	switch {
+	case err == nil:
+		sess.exit(0, "")
+	case errors.As(err, &exitErr):
+		if ws, ok := exitErr.Sys().(syscall.WaitStatus); ok && ws.Signaled() {
+			sess.ch.SendRequest("exit-signal", false, ssh.Marshal(exitSignalMsg{Signal: signalName(ws.Signal()), CoreDumped: ws.CoreDump()}))
+			sess.ch.Close()
+			return
+		}
+		sess.exit(exitErr.ExitCode(), "")
+	default:
+		sess.exit(255, err.Error())
+	}
+}
+
+func (sess *session) exit(code int, msg string) {
+	if msg != "" {
+		fmt.Fprintln(sess.ch.Stderr(), msg)
+	}
+	sess.ch.SendRequest("exit-status", false, ssh.Marshal(exitStatusMsg{Status: uint32(code)}))
+	sess.ch.Close()
+}
@@ -0,0 +1,464 @@
+package sshd
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/ed25519"
+	"crypto/rand"
+	"errors"
+	"io"
+	"net"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/pkg/sftp"
+	"golang.org/x/crypto/ssh"
+)
+
+// 启动服务端, 用户 test 可以用密码 secret 或 key 登录
+func startServer(t *testing.T, key ssh.PublicKey, configure func(s *Server)) (*Server, string) {
+	t.Helper()
+	hostKey, err := LoadOrGenerateHostKey(filepath.Join(t.TempDir(), "host_key"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := &Server{
+		HostKeys:     []ssh.Signer{hostKey},
+		Shell:        "/bin/sh",
+		PasswordAuth: Passwords(map[string]string{"test": "secret"}),
+		Logf:         t.Logf,
+	}
+	if key != nil {
+		s.PublicKeyAuth = AuthorizedKeys(map[string][]ssh.PublicKey{"test": {key}})
+	}
+	if configure != nil {
+		configure(s)
+	}
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	done := make(chan error, 1)
+	go func() { done <- s.Serve(l) }()
+	t.Cleanup(func() {
+		s.Close()
+		if err := <-done; err != ErrServerClosed {
+			t.Errorf("serve: %v", err)
+		}
+	})
+	return s, l.Addr().String()
+}
+
+func dial(t *testing.T, addr string, auth ...ssh.AuthMethod) *ssh.Client {
+	t.Helper()
+	if len(auth) == 0 {
+		auth = []ssh.AuthMethod{ssh.Password("secret")}
+	}
+	c, err := ssh.Dial("tcp", addr, &ssh.ClientConfig{
+		User:            "test",
+		Auth:            auth,
+		HostKeyCallback: ssh.InsecureIgnoreHostKey(),
+		Timeout:         5 * time.Second,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { c.Close() })
+	return c
+}
+
+func echoListener(t *testing.T, network, addr string) net.Listener {
+	t.Helper()
+	l, err := net.Listen(network, addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { l.Close() })
+	go func() {
+		for {
+			c, err := l.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer c.Close()
+				io.Copy(c, c)
+			}()
+		}
+	}()
+	return l
+}
+
+func expectEcho(t *testing.T, c net.Conn, msg string) {
+	t.Helper()
+	defer c.Close()
+	c.SetDeadline(time.Now().Add(5 * time.Second))
+	if _, err := io.WriteString(c, msg); err != nil {
+		t.Fatal(err)
+	}
+	buf := make([]byte, len(msg))
+	if _, err := io.ReadFull(c, buf); err != nil || string(buf) != msg {
+		t.Fatalf("echo: %q %v", buf, err)
+	}
+}
+
+func TestAuth(t *testing.T) {
+	_, priv, _ := ed25519.GenerateKey(rand.Reader)
+	signer, _ := ssh.NewSignerFromKey(priv)
+	_, otherPriv, _ := ed25519.GenerateKey(rand.Reader)
+	other, _ := ssh.NewSignerFromKey(otherPriv)
+	_, addr := startServer(t, signer.PublicKey(), nil)
+
+	config := func(user string, auth ssh.AuthMethod) *ssh.ClientConfig {
+		return &ssh.ClientConfig{User: user, Auth: []ssh.AuthMethod{auth}, HostKeyCallback: ssh.InsecureIgnoreHostKey(), Timeout: 5 * time.Second}
+	}
+	tests := []struct {
+		name string
+		c    *ssh.ClientConfig
+		ok   bool
+	}{
+		{"password", config("test", ssh.Password("secret")), true},
+		{"wrong password", config("test", ssh.Password("wrong")), false},
+		{"unknown user", config("root", ssh.Password("secret")), false},
+		{"public key", config("test", ssh.PublicKeys(signer)), true},
+		{"unknown key", config("test", ssh.PublicKeys(other)), false},
+		{"key of other user", config("root", ssh.PublicKeys(signer)), false},
+	}
+	for _, tt := range tests {
+		c, err := ssh.Dial("tcp", addr, tt.c)
+		if (err == nil) != tt.ok {
+			t.Errorf("%s: %v", tt.name, err)
+		}
+		if c != nil {
+			c.Close()
+		}
+	}
+
+	// 没有配置认证方式时拒绝所有登录
+	_, addr = startServer(t, nil, func(s *Server) { s.PasswordAuth = nil })
+	if c, err := ssh.Dial("tcp", addr, config("test", ssh.Password("secret"))); err == nil {
+		c.Close()
+		t.Error("login without auth methods succeeded")
+	}
+	if err := (&Server{}).Serve(nil); err == nil {
+		t.Error("serve without host keys succeeded")
+	}
+}
+
+func TestHostKeyAndAuthorizedKeys(t *testing.T) {
+	file := filepath.Join(t.TempDir(), "keys", "host_key")
+	first, err := LoadOrGenerateHostKey(file)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if st, err := os.Stat(file); err != nil || st.Mode().Perm() != 0600 {
+		t.Fatalf("host key file: %v %v", st, err)
+	}
+	// 再次加载得到同一把密钥
+	again, err := LoadOrGenerateHostKey(file)
+	if err != nil || !bytes.Equal(first.PublicKey().Marshal(), again.PublicKey().Marshal()) {
+		t.Fatalf("reloaded host key differs: %v", err)
+	}
+
+	keys := filepath.Join(t.TempDir(), "authorized_keys")
+	line := string(ssh.MarshalAuthorizedKey(first.PublicKey()))
+	os.WriteFile(keys, []byte(line+"\n"+strings.TrimSpace(line)+" comment\n"), 0600)
+	loaded, err := LoadAuthorizedKeys(keys)
+	if err != nil || len(loaded) != 2 {
+		t.Fatalf("authorized keys: %d %v", len(loaded), err)
+	}
+	os.WriteFile(keys, []byte("not a key\n"), 0600)
+	if _, err := LoadAuthorizedKeys(keys); err == nil {
+		t.Error("invalid authorized_keys accepted")
+	}
+}
+
+func TestExec(t *testing.T) {
+	_, addr := startServer(t, nil, func(s *Server) { s.Env = []string{"SERVER_VAR=server"} })
+	c := dial(t, addr)
+
+	run := func(cmd string, setup func(*ssh.Session)) (string, string, error) {
+		sess, err := c.NewSession()
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer sess.Close()
+		var stdout, stderr bytes.Buffer
+		sess.Stdout, sess.Stderr = &stdout, &stderr
+		if setup != nil {
+			setup(sess)
+		}
+		err = sess.Run(cmd)
+		return stdout.String(), stderr.String(), err
+	}
+
+	if out, errOut, err := run("echo out; echo err >&2", nil); err != nil || out != "out\n" || errOut != "err\n" {
+		t.Errorf("output: %q %q %v", out, errOut, err)
+	}
+	// 退出码
+	_, _, err := run("exit 3", nil)
+	var exitErr *ssh.ExitError
+	if !errors.As(err, &exitErr) || exitErr.ExitStatus() != 3 {
+		t.Errorf("exit status: %v", err)
+	}
+	// 环境变量: 登录用户、服务端配置和客户端的 env 请求
+	out, _, err := run("echo $USER $SERVER_VAR $CLIENT_VAR; test -n \"$SSH_CONNECTION\" && echo conn", func(s *ssh.Session) {
+		s.Setenv("CLIENT_VAR", "client")
+	})
+	if err != nil || out != "test server client\nconn\n" {
+		t.Errorf("env: %q %v", out, err)
+	}
+	// 标准输入结束后命令退出
+	out, _, err = run("cat", func(s *ssh.Session) { s.Stdin = strings.NewReader("from stdin") })
+	if err != nil || out != "from stdin" {
+		t.Errorf("stdin: %q %v", out, err)
+	}
+}
+
+func TestPTYAndSignals(t *testing.T) {
+	_, addr := startServer(t, nil, nil)
+	c := dial(t, addr)
+
+	sess, err := c.NewSession()
+	if err != nil {
+		t.Fatal(err)
+	}
+	var out bytes.Buffer
+	sess.Stdout = &out
+	if err := sess.RequestPty("xterm-test", 24, 80, ssh.TerminalModes{}); err != nil {
+		t.Fatal(err)
+	}
+	if err := sess.Run("test -t 0 && echo tty; echo $TERM; stty size"); err != nil {
+		t.Fatal(err)
+	}
+	if got := strings.ReplaceAll(out.String(), "\r", ""); got != "tty\nxterm-test\n24 80\n" {
+		t.Errorf("pty output: %q", got)
+	}
+
+	// window-change 没有回复, 重复执行 stty size 直到看到新的大小
+	sess, err = c.NewSession()
+	if err != nil {
+		t.Fatal(err)
+	}
+	stdin, _ := sess.StdinPipe()
+	stdout, _ := sess.StdoutPipe()
+	sess.RequestPty("xterm", 24, 80, ssh.TerminalModes{ssh.ECHO: 0})
+	if err := sess.Shell(); err != nil {
+		t.Fatal(err)
+	}
+	if err := sess.WindowChange(50, 132); err != nil {
+		t.Fatal(err)
+	}
+	lines := bufio.NewScanner(stdout)
+	for deadline := time.Now().Add(5 * time.Second); ; {
+		io.WriteString(stdin, "stty size\n")
+		if !lines.Scan() {
+			t.Fatalf("shell output: %v", lines.Err())
+		}
+		if strings.Contains(lines.Text(), "50 132") {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("after window-change: %q", lines.Text())
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	io.WriteString(stdin, "exit\n")
+	go io.Copy(io.Discard, stdout)
+	sess.Wait()
+
+	// signal 请求转发给进程, 被信号结束时返回 exit-signal
+	sess, err = c.NewSession()
+	if err != nil {
+		t.Fatal(err)
+	}
+	sess.Stdout = io.Discard
+	if err := sess.Start("echo started; exec sleep 30"); err != nil {
+		t.Fatal(err)
+	}
+	time.Sleep(100 * time.Millisecond)
+	if err := sess.Signal(ssh.SIGTERM); err != nil {
+		t.Fatal(err)
+	}
+	done := make(chan error, 1)
+	go func() { done <- sess.Wait() }()
+	select {
+	case err := <-done:
+		var exitErr *ssh.ExitError
+		if !errors.As(err, &exitErr) || exitErr.Signal() != "TERM" {
+			t.Errorf("exit after SIGTERM: %v", err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("process not terminated by signal")
+	}
+}
+
+func TestSFTP(t *testing.T) {
+	_, addr := startServer(t, nil, nil)
+	client, err := sftp.NewClient(dial(t, addr))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Close()
+	file := filepath.Join(t.TempDir(), "upload.txt")
+	f, err := client.Create(file)
+	if err != nil {
+		t.Fatal(err)
+	}
+	io.WriteString(f, "via sftp")
+	f.Close()
+	if data, _ := os.ReadFile(file); string(data) != "via sftp" {
+		t.Errorf("uploaded %q", data)
+	}
+
+	_, addr = startServer(t, nil, func(s *Server) { s.DisableSFTP = true })
+	if _, err := sftp.NewClient(dial(t, addr)); err == nil {
+		t.Error("sftp allowed when disabled")
+	}
+}
+
+func TestDirectForward(t *testing.T) {
+	_, addr := startServer(t, nil, nil)
+	c := dial(t, addr)
+	tcpEcho := echoListener(t, "tcp", "127.0.0.1:0")
+	unixEcho := echoListener(t, "unix", filepath.Join(t.TempDir(), "echo.sock"))
+
+	conn, err := c.Dial("tcp", tcpEcho.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	expectEcho(t, conn, "direct-tcpip")
+	conn, err = c.Dial("unix", unixEcho.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	expectEcho(t, conn, "direct-streamlocal")
+
+	// 半关闭: 客户端写完后仍然能读到目标的回复
+	conn, err = c.Dial("tcp", tcpEcho.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	io.WriteString(conn, "half")
+	conn.(interface{ CloseWrite() error }).CloseWrite()
+	if got, err := io.ReadAll(conn); err != nil || string(got) != "half" {
+		t.Errorf("half close: %q %v", got, err)
+	}
+	conn.Close()
+
+	// 连不上的目标拒绝通道
+	dead, _ := net.Listen("tcp", "127.0.0.1:0")
+	dead.Close()
+	if _, err := c.Dial("tcp", dead.Addr().String()); err == nil {
+		t.Error("dial to closed port succeeded")
+	}
+}
+
+func TestRemoteForward(t *testing.T) {
+	_, addr := startServer(t, nil, nil)
+	c := dial(t, addr)
+
+	// 端口为 0 时服务端选择端口并回复
+	l, err := c.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	port := l.Addr().(*net.TCPAddr).Port
+	if port == 0 {
+		t.Fatal("server did not report the allocated port")
+	}
+	sock := filepath.Join(t.TempDir(), "remote.sock")
+	ul, err := c.ListenUnix(sock)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, ln := range []net.Listener{l, ul} {
+		go func(ln net.Listener) {
+			for {
+				conn, err := ln.Accept()
+				if err != nil {
+					return
+				}
+				go func() {
+					defer conn.Close()
+					io.Copy(conn, conn)
+				}()
+			}
+		}(ln)
+	}
+	conn, err := net.Dial("tcp", "127.0.0.1:"+strconv.Itoa(port))
+	if err != nil {
+		t.Fatal(err)
+	}
+	expectEcho(t, conn, "tcpip-forward")
+	conn, err = net.Dial("unix", sock)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expectEcho(t, conn, "streamlocal-forward")
+
+	// cancel-tcpip-forward 关闭服务端的监听
+	l.Close()
+	waitClosed(t, "tcp", "127.0.0.1:"+strconv.Itoa(port))
+
+	// 连接断开时关闭剩下的远程转发
+	c.Close()
+	waitClosed(t, "unix", sock)
+}
+
+func waitClosed(t *testing.T, network, addr string) {
+	t.Helper()
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		conn, err := net.Dial(network, addr)
+		if err != nil {
+			return
+		}
+		conn.Close()
+		if time.Now().After(deadline) {
+			t.Fatalf("%s %s still listening", network, addr)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestDisableForwarding(t *testing.T) {
+	_, addr := startServer(t, nil, func(s *Server) { s.DisableForwarding = true })
+	c := dial(t, addr)
+	echo := echoListener(t, "tcp", "127.0.0.1:0")
+	if _, err := c.Dial("tcp", echo.Addr().String()); err == nil {
+		t.Error("direct-tcpip allowed")
+	}
+	if _, err := c.Listen("tcp", "127.0.0.1:0"); err == nil {
+		t.Error("tcpip-forward allowed")
+	}
+	if _, err := c.ListenUnix(filepath.Join(t.TempDir(), "r.sock")); err == nil {
+		t.Error("streamlocal-forward allowed")
+	}
+}
+
+// Close 关闭监听和已建立的连接
+func TestClose(t *testing.T) {
+	s, addr := startServer(t, nil, nil)
+	c := dial(t, addr)
+	s.Close()
+	done := make(chan error, 1)
+	go func() { done <- c.Wait() }()
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("connection not closed")
+	}
+	if _, err := net.DialTimeout("tcp", addr, time.Second); err == nil {
+		t.Error("still listening after close")
+	}
+	l, _ := net.Listen("tcp", "127.0.0.1:0")
+	defer l.Close()
+	if err := s.Serve(l); err != ErrServerClosed {
+		t.Errorf("serve after close: %v", err)
+	}
+}
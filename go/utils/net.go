@@ -4,8 +4,26 @@ import (
 	"fmt"
 	"math/big"
 	"net"
+	"sync"
 )
 
+var (
+	internalMu       sync.RWMutex
+	internalPrefixes []*net.IPNet // 额外视为内网的网段
+)
+
+// 添加视为内网的网段, 如分配给内网使用的 IPv6 全局前缀
+func AddInternalPrefix(cidr string) error {
+	_, ipnet, err := net.ParseCIDR(cidr)
+	if err != nil {
+		return err
+	}
+	internalMu.Lock()
+	defer internalMu.Unlock()
+	internalPrefixes = append(internalPrefixes, ipnet)
+	return nil
+}
+
 // 判断是否是内网IP
 func IsInternalIP(ip net.IP) bool {
 	if ip == nil {
@@ -14,16 +32,27 @@ func IsInternalIP(ip net.IP) bool {
 
 	// IPv4内网地址范围
 	if ip4 := ip.To4(); ip4 != nil {
-		return ip4[0] == 10 ||
+		if ip4[0] == 10 ||
 			(ip4[0] == 172 && ip4[1] >= 16 && ip4[1] <= 31) ||
-			(ip4[0] == 192 && ip4[1] == 168)
-	}
-
-	// IPv6链路本地地址
-	if ip.IsLinkLocalUnicast() || ip.IsLinkLocalMulticast() {
+			(ip4[0] == 192 && ip4[1] == 168) {
+			return true
+		}
+	} else if len(ip) == net.IPv6len && ip[0]&0xfe == 0xfc {
+		// IPv6唯一本地地址 fc00::/7
+		return true
+	} else if ip.IsLinkLocalUnicast() || ip.IsLinkLocalMulticast() {
+		// IPv6链路本地地址
 		return true
 	}
 
+	// 配置的内网网段
+	internalMu.RLock()
+	defer internalMu.RUnlock()
+	for _, ipnet := range internalPrefixes {
+		if ipnet.Contains(ip) {
+			return true
+		}
+	}
 	return false
 }
 
@@ -0,0 +1,70 @@
+package utils
+
+import (
+	"net"
+	"testing"
+)
+
+func TestIsInternalIP(t *testing.T) {
+	old := internalPrefixes
+	t.Cleanup(func() { internalPrefixes = old })
+	if err := AddInternalPrefix("2001:db8:1::/48"); err != nil {
+		t.Fatal(err)
+	}
+	if err := AddInternalPrefix("100.64.0.0/10"); err != nil {
+		t.Fatal(err)
+	}
+	if err := AddInternalPrefix("2001:db8:2::"); err == nil {
+		t.Error("prefix without mask accepted")
+	}
+	if err := AddInternalPrefix("10.0.0.0/33"); err == nil {
+		t.Error("invalid mask accepted")
+	}
+
+	tests := []struct {
+		ip   string
+		want bool
+	}{
+		{"10.1.2.3", true},
+		{"172.16.0.1", true},
+		{"172.31.255.255", true},
+		{"172.32.0.1", false},
+		{"192.168.1.1", true},
+		{"8.8.8.8", false},
+		// 回环地址与 127.0.0.1 一致, 不算内网
+		{"127.0.0.1", false},
+		{"::1", false},
+		// 唯一本地地址 fc00::/7
+		{"fc00::1", true},
+		{"fd12:3456::1", true},
+		{"fe00::1", false},
+		// 链路本地 fe80::/10
+		{"fe80::1", true},
+		{"febf::1", true},
+		{"fec0::1", false},
+		{"ff02::1", true},
+		// IPv4 映射地址按 IPv4 判断
+		{"::ffff:10.0.0.1", true},
+		{"::ffff:192.168.0.1", true},
+		{"::ffff:8.8.8.8", false},
+		// 配置的网段
+		{"2001:db8:1::1", true},
+		{"2001:db8:1:ffff::1", true},
+		{"2001:db8:2::1", false},
+		{"2606:4700::1111", false},
+		{"100.64.1.1", true},
+		{"::ffff:100.64.1.1", true},
+	}
+	for _, tt := range tests {
+		ip := net.ParseIP(tt.ip)
+		if ip == nil {
+			t.Fatalf("bad test address %q", tt.ip)
+		}
+		if got := IsInternalIP(ip); got != tt.want {
+			t.Errorf("IsInternalIP(%s) = %v, want %v", tt.ip, got, tt.want)
+		}
+	}
+	if IsInternalIP(nil) {
+		t.Error("nil ip is internal")
+	}
+}